@@ -7,12 +7,14 @@ import (
 	"time"
 
 	"gostripe/conf"
+	"gostripe/gateway"
+	"gostripe/notify"
+	"gostripe/openapi"
 	"gostripe/storage"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"github.com/sirupsen/logrus"
-	"github.com/stripe/stripe-go/v72"
 )
 
 const (
@@ -24,18 +26,76 @@ var bearerRegexp = regexp.MustCompile(`^(?:B|b)earer (\S+$)`)
 
 // API is the main REST API
 type API struct {
-	handler http.Handler
-	db      *storage.Connection
-	config  *conf.GlobalConfiguration
-	version string
+	handler  http.Handler
+	db       *storage.Connection
+	config   *conf.GlobalConfiguration
+	gateway  gateway.Stripe
+	live     gateway.Stripe // bypasses the cache, for the reads that are stored
+	notifier notify.Notifier
+	// cache is nil when the Stripe lookups are not cached
+	cache   *gateway.Cached
+	jwtKeys *keyStore
+	// rateLimits is nil when rate limiting is disabled
+	rateLimits rateLimitStore
+	spec       *openapi.Document
+	version    string
+	// defaultVersion is the version of the /v1 API used without an
+	// API-Version header
+	defaultVersion string
 }
 
 // NewAPIWithVersion creates a new REST API using the specified version
 func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfiguration, db *storage.Connection, version string) *API {
-	api := &API{config: globalConfig, db: db, version: version}
+	return NewAPIWithGateway(ctx, globalConfig, db, gateway.NewClient(globalConfig.Stripe.SecretKey, globalConfig.Stripe.APIURL), version)
+}
 
-	// Initialize Stripe
-	stripe.Key = globalConfig.Stripe.SecretKey
+// NewAPIWithGateway creates a new REST API calling Stripe through the given gateway
+func NewAPIWithGateway(ctx context.Context, globalConfig *conf.GlobalConfiguration, db *storage.Connection, gw gateway.Stripe, version string) *API {
+	api := &API{config: globalConfig, db: db, gateway: gw, live: gw, spec: newOpenAPIDocument(version), version: version}
+
+	// Resolve the version of the /v1 API used without an API-Version header
+	api.defaultVersion = apiVersions[0]
+	if v := globalConfig.API.DefaultVersion; v != "" {
+		if !supportedAPIVersion(v) {
+			logrus.Fatalf("Unsupported API_DEFAULT_VERSION %s", v)
+		}
+		api.defaultVersion = v
+	}
+
+	// Cache the Stripe lookups
+	if cache := globalConfig.Cache; cache.TTL > 0 {
+		api.cache = gateway.NewCached(gw, cache.TTL, cache.StaleWhileRevalidate, cache.MaxEntries)
+		api.gateway = api.cache
+	}
+
+	// Initialize notifications
+	notifier, err := notify.New(&globalConfig.Notify)
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to configure notifications")
+	}
+	api.notifier = notifier
+
+	// Initialize the public keys used to verify asymmetric tokens
+	if len(globalConfig.JWT.PublicKeyFiles) > 0 || globalConfig.JWT.JWKSURL != "" {
+		keys, err := newKeyStore(&globalConfig.JWT)
+		if err != nil {
+			logrus.WithError(err).Fatal("Failed to load JWT public keys")
+		}
+		keys.start(ctx, globalConfig.JWT.JWKSRefreshInterval)
+		api.jwtKeys = keys
+	}
+
+	// Initialize rate limiting
+	if globalConfig.RateLimit.Enabled {
+		api.rateLimits = newRateLimitStore(ctx, &globalConfig.RateLimit, db)
+	}
+
+	go api.sweepIdempotencyKeys(ctx)
+
+	// Compare the database with Stripe on a schedule
+	if globalConfig.Reconcile.Interval > 0 {
+		go api.reconcileEvery(ctx, globalConfig.Reconcile.Interval, globalConfig.Reconcile.Fix)
+	}
 
 	// Create router
 	r := chi.NewRouter()
@@ -44,33 +104,94 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 	r.Use(recoverer)
 	r.Use(addRequestID(globalConfig))
 
-	// CORS
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	})
-	r.Use(corsHandler.Handler)
-
-	// Health check
+	// Endpoints called by servers: no CORS
 	r.Get("/health", api.HealthCheck)
-
-	// Stripe endpoints
-	r.Post("/create-checkout-session", api.requireAuthentication(api.CreateCheckoutSession))
+	r.Get("/openapi.json", api.OpenAPI)
+	r.Get("/metrics", api.requireOperator(api.Metrics))
 	r.Post("/webhooks", api.HandleWebhook)
-	r.Get("/get-subscription-status", api.requireAuthentication(api.GetSubscriptionStatus))
-	r.Post("/cancel-subscription", api.requireAuthentication(api.CancelSubscription))
-	r.Get("/get-customer-details", api.requireAuthentication(api.GetCustomerDetails))
-	r.Post("/sync-subscription", api.requireAuthentication(api.SyncSubscription))
+
+	// The /v1 routes negotiate the API version; the unversioned routes they
+	// replace are kept as deprecated aliases
+	r.Group(func(r chi.Router) {
+		r.Use(api.rateLimitIP)
+
+		// Server-to-server endpoints, authenticated with an API key
+		api.versioned(r, http.MethodGet, "/users/{user_id}/subscription-status", "/users/{user_id}/get-subscription-status", api.requireAPIKey(ScopeSubscriptionsRead, api.rateLimit(rateLimitDefault, api.GetSubscriptionStatus)))
+		api.versioned(r, http.MethodGet, "/users/{user_id}/subscriptions", "", api.requireAPIKey(ScopeSubscriptionsRead, api.rateLimit(rateLimitDefault, api.ListSubscriptions)))
+		api.versioned(r, http.MethodGet, "/users/{user_id}/customer", "/users/{user_id}/get-customer-details", api.requireAPIKey(ScopeCustomersRead, api.rateLimit(rateLimitDefault, api.GetCustomerDetails)))
+		api.versioned(r, http.MethodGet, "/users/{user_id}/customer/tax-ids", "/users/{user_id}/customer/tax-ids", api.requireAPIKey(ScopeCustomersRead, api.rateLimit(rateLimitDefault, api.ListTaxIDs)))
+		api.versioned(r, http.MethodGet, "/users/{user_id}/invoices", "/users/{user_id}/invoices", api.requireAPIKey(ScopeInvoicesRead, api.rateLimit(rateLimitDefault, api.GetInvoices)))
+
+		// Admin endpoints
+		api.versioned(r, http.MethodGet, "/admin/api-keys", "/admin/api-keys", api.requireAdmin(api.ListAPIKeys))
+		api.versioned(r, http.MethodPost, "/admin/api-keys", "/admin/api-keys", api.requireAdmin(api.CreateAPIKey))
+		api.versioned(r, http.MethodDelete, "/admin/api-keys/{id}", "/admin/api-keys/{id}", api.requireAdmin(api.RevokeAPIKey))
+	})
+
+	// Endpoints called by browsers, with the configured CORS policy
+	r.Group(func(r chi.Router) {
+		if cors := corsMiddleware(&globalConfig.API.CORS); cors != nil {
+			r.Use(cors)
+		}
+		r.Use(api.rateLimitIP)
+
+		// Stripe endpoints
+		api.versioned(r, http.MethodPost, "/checkout-sessions", "/create-checkout-session", api.requireAuthentication(api.rateLimit(rateLimitCheckout, api.idempotent(api.CreateCheckoutSession))))
+		api.versioned(r, http.MethodGet, "/me/subscription-status", "/get-subscription-status", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.GetSubscriptionStatus)))
+		api.versioned(r, http.MethodGet, "/me/subscriptions", "", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.ListSubscriptions)))
+		api.versioned(r, http.MethodDelete, "/me/subscriptions/{id}", "", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.CancelSubscriptionByID))))
+		api.versioned(r, http.MethodPost, "/me/subscriptions/sync", "/sync-subscription", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.SyncSubscription))))
+		// Cancels the active subscription, replaced by DELETE /v1/me/subscriptions/{id}
+		r.Post("/cancel-subscription", deprecated("", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.CancelSubscription)))))
+
+		// Customer endpoints
+		api.versioned(r, http.MethodGet, "/me/customer", "/get-customer-details", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.GetCustomerDetails)))
+		api.versioned(r, http.MethodPatch, "/me/customer", "/customer", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.UpdateCustomer))))
+		api.versioned(r, http.MethodGet, "/me/customer/tax-ids", "/customer/tax-ids", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.ListTaxIDs)))
+		api.versioned(r, http.MethodPost, "/me/customer/tax-ids", "/customer/tax-ids", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.CreateTaxID))))
+		api.versioned(r, http.MethodDelete, "/me/customer/tax-ids/{id}", "/customer/tax-ids/{id}", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.idempotent(api.DeleteTaxID))))
+		api.versioned(r, http.MethodGet, "/me/invoices", "/invoices", api.requireAuthentication(api.rateLimit(rateLimitDefault, api.GetInvoices)))
+
+		// Preflight requests only reach the CORS middleware through a route
+		for _, pattern := range []string{
+			"/v1/checkout-sessions", "/v1/me/subscription-status", "/v1/me/subscriptions",
+			"/v1/me/subscriptions/{id}", "/v1/me/subscriptions/sync", "/v1/me/customer",
+			"/v1/me/customer/tax-ids", "/v1/me/customer/tax-ids/{id}", "/v1/me/invoices",
+			"/create-checkout-session", "/get-subscription-status", "/cancel-subscription",
+			"/get-customer-details", "/sync-subscription", "/customer", "/customer/tax-ids",
+			"/customer/tax-ids/{id}", "/invoices",
+		} {
+			r.Options(pattern, preflight)
+		}
+	})
 
 	api.handler = r
 
 	return api
 }
 
+// corsMiddleware returns the CORS middleware for a policy, or nil when no
+// origin is allowed. go-chi/cors allows every origin when none is given.
+func corsMiddleware(config *conf.CORSConfiguration) func(http.Handler) http.Handler {
+	if !config.Enabled() {
+		return nil
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   config.AllowedOrigins,
+		AllowedMethods:   config.AllowedMethods,
+		AllowedHeaders:   config.AllowedHeaders,
+		ExposedHeaders:   config.ExposedHeaders,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           config.MaxAge,
+	}).Handler
+}
+
+// preflight answers CORS preflight requests the middleware let through
+func preflight(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // ListenAndServe starts the API server
 func (a *API) ListenAndServe(hostAndPort string) {
 	server := &http.Server{
@@ -101,10 +222,16 @@ func (a *API) ListenAndServe(hostAndPort string) {
 	}
 }
 
+// HealthResponse is the response of the health check
+type HealthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+}
+
 // HealthCheck is the endpoint for checking the health of the API
 func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) {
-	sendJSON(w, http.StatusOK, map[string]string{
-		"status":  "ok",
-		"version": a.version,
+	sendJSON(w, http.StatusOK, &HealthResponse{
+		Status:  "ok",
+		Version: a.version,
 	})
 }
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// API key scopes
+const (
+	ScopeSubscriptionsRead = "subscriptions:read"
+	ScopeCustomersRead     = "customers:read"
+	ScopeInvoicesRead      = "invoices:read"
+)
+
+var apiKeyScopes = []string{"*", ScopeSubscriptionsRead, ScopeCustomersRead, ScopeInvoicesRead}
+
+// CreateAPIKeyRequest represents a request to create an API key
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" openapi:"min=1"`
+	Scopes    []string   `json:"scopes" openapi:"min=1,enum=*|subscriptions:read|customers:read|invoices:read"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// APIKeyListResponse lists the API keys
+type APIKeyListResponse struct {
+	APIKeys []models.APIKey `json:"api_keys"`
+}
+
+// APIKeyResponse is an API key, with its secret when it was just created
+type APIKeyResponse struct {
+	APIKey models.APIKey `json:"api_key"`
+	Key    string        `json:"key,omitempty"`
+}
+
+// ValidAPIKeyScope checks whether a scope can be granted to an API key
+func ValidAPIKeyScope(scope string) bool {
+	for _, s := range apiKeyScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAPIKey is middleware that requires an API key granted the scope. The
+// principal acts on behalf of the user given by the user_id URL parameter.
+func (a *API) requireAPIKey(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getToken(r)
+		prefix, ok := models.ParseAPIKey(token)
+		if !ok {
+			unauthorizedError(w)
+			return
+		}
+
+		key, err := models.FindAPIKeyByPrefix(a.db, prefix)
+		if err != nil {
+			internalServerError(w, r, "Failed to get API key")
+			return
+		}
+
+		if key == nil || !key.Matches(token) || !key.IsValid(time.Now()) {
+			logrus.WithField("prefix", prefix).Info("Invalid API key")
+			unauthorizedError(w)
+			return
+		}
+
+		if !key.HasScope(scope) {
+			forbiddenError(w, "Insufficient scope")
+			return
+		}
+
+		userID, err := uuid.FromString(chi.URLParam(r, "user_id"))
+		if err != nil {
+			badRequestError(w, "Invalid user ID")
+			return
+		}
+
+		if err := models.TouchAPIKey(a.db, key); err != nil {
+			logrus.WithError(err).Warn("Failed to record API key usage")
+		}
+		recordKeyUsage("api_key", key.Prefix, true)
+
+		r = r.WithContext(withPrincipal(r.Context(), &Principal{
+			UserID:     userID,
+			Scopes:     key.ScopeList(),
+			TokenID:    key.ID.String(),
+			AuthMethod: AuthMethodAPIKey,
+		}))
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireAdmin is middleware that accepts the operator token or a JWT with the
+// admin role
+func (a *API) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	operator := a.requireOperator(next)
+	admin := a.requireAuthentication(a.requireRole("admin", next))
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getToken(r)
+		if a.config.OperatorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.config.OperatorToken)) == 1 {
+			operator(w, r)
+			return
+		}
+		admin(w, r)
+	}
+}
+
+// ListAPIKeys lists the API keys
+func (a *API) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := models.FindAPIKeys(a.db)
+	if err != nil {
+		internalServerError(w, r, "Failed to get API keys")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &APIKeyListResponse{APIKeys: keys})
+}
+
+// CreateAPIKey creates an API key. The key is only returned once.
+func (a *API) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		badRequestError(w, "name is required")
+		return
+	}
+
+	key, secret, err := models.CreateAPIKey(a.db, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		internalServerError(w, r, "Failed to create API key")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"api_key_id": key.ID,
+		"name":       key.Name,
+		"scopes":     key.Scopes,
+	}).Info("Created API key")
+
+	sendJSON(w, http.StatusCreated, &APIKeyResponse{
+		APIKey: *key,
+		Key:    secret,
+	})
+}
+
+// RevokeAPIKey revokes an API key
+func (a *API) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		badRequestError(w, "Invalid API key ID")
+		return
+	}
+
+	key, err := models.FindAPIKeyByID(a.db, id)
+	if err != nil {
+		internalServerError(w, r, "Failed to get API key")
+		return
+	}
+
+	if key == nil {
+		notFoundError(w, "API key not found")
+		return
+	}
+
+	if key.RevokedAt == nil {
+		if err := models.RevokeAPIKey(a.db, key); err != nil {
+			internalServerError(w, r, "Failed to revoke API key")
+			return
+		}
+		logrus.WithField("api_key_id", key.ID).Info("Revoked API key")
+	}
+
+	sendJSON(w, http.StatusOK, &APIKeyResponse{APIKey: *key})
+}
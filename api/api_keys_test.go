@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestAdminAPIKeys(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	admin := testToken(t, uuid.Must(uuid.NewV4()), "admin@example.com", "admin")
+
+	tests := []struct {
+		name   string
+		token  string
+		body   map[string]interface{}
+		status int
+	}{
+		{"operator", testOperatorToken, map[string]interface{}{"name": "billing", "scopes": []string{ScopeSubscriptionsRead}}, http.StatusCreated},
+		{"admin role", admin, map[string]interface{}{"name": "crm", "scopes": []string{ScopeCustomersRead, ScopeInvoicesRead}}, http.StatusCreated},
+		{"no name", admin, map[string]interface{}{"scopes": []string{ScopeCustomersRead}}, http.StatusBadRequest},
+		{"no scopes", admin, map[string]interface{}{"name": "crm"}, http.StatusBadRequest},
+		{"unknown scope", admin, map[string]interface{}{"name": "crm", "scopes": []string{"subscriptions:write"}}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/admin/api-keys", tt.token, tt.body)
+			expectStatus(t, w, tt.status)
+			if tt.status == http.StatusCreated {
+				if body := decode(t, w); body["key"] == "" {
+					t.Errorf("expected the key to be returned, got %v", body)
+				}
+			}
+		})
+	}
+
+	w := a.request(t, http.MethodGet, "/admin/api-keys", admin, nil)
+	expectStatus(t, w, http.StatusOK)
+	keys := decode(t, w)["api_keys"].([]interface{})
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 API keys, got %v", keys)
+	}
+
+	id := keys[0].(map[string]interface{})["id"].(string)
+	revokes := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"invalid ID", "nope", http.StatusBadRequest},
+		{"unknown ID", uuid.Must(uuid.NewV4()).String(), http.StatusNotFound},
+		{"revoke", id, http.StatusOK},
+		{"revoke twice", id, http.StatusOK},
+	}
+
+	for _, tt := range revokes {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodDelete, "/admin/api-keys/"+tt.id, admin, nil)
+			expectStatus(t, w, tt.status)
+		})
+	}
+}
+
+func TestAPIKeyEndpoints(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	seedSubscription(t, a, seedCustomer(t, a, userID, "user@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	_, subscriptionsKey, err := models.CreateAPIKey(db, "billing", []string{ScopeSubscriptionsRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, allKey, err := models.CreateAPIKey(db, "backoffice", []string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Hour)
+	_, expiredKey, err := models.CreateAPIKey(db, "old", []string{"*"}, &expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, revokedKey, err := models.CreateAPIKey(db, "leaked", []string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := models.RevokeAPIKey(db, revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	user := "/users/" + userID.String()
+	tests := []struct {
+		name   string
+		path   string
+		key    string
+		status int
+	}{
+		{"subscription status", user + "/get-subscription-status", subscriptionsKey, http.StatusOK},
+		{"missing scope", user + "/get-customer-details", subscriptionsKey, http.StatusForbidden},
+		{"customer details", user + "/get-customer-details", allKey, http.StatusOK},
+		{"tax IDs", user + "/customer/tax-ids", allKey, http.StatusOK},
+		{"invoices", user + "/invoices", allKey, http.StatusOK},
+		{"invalid user ID", "/users/nope/invoices", allKey, http.StatusBadRequest},
+		{"expired key", user + "/invoices", expiredKey, http.StatusUnauthorized},
+		{"revoked key", user + "/invoices", revokedKey, http.StatusUnauthorized},
+		{"wrong secret", user + "/invoices", allKey + "x", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodGet, tt.path, tt.key, nil)
+			expectStatus(t, w, tt.status)
+		})
+	}
+
+	w := a.request(t, http.MethodGet, user+"/get-subscription-status", subscriptionsKey, nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decode(t, w); body["has_subscription"] != true {
+		t.Errorf("expected the subscription of the user, got %v", body)
+	}
+}
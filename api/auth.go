@@ -1,24 +1,55 @@
 package api
 
 import (
-	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
+	"strings"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/sirupsen/logrus"
 )
 
 // JWTClaims represents the claims in a JWT
 type JWTClaims struct {
-	jwt.StandardClaims
+	jwt.RegisteredClaims
 	Email    string                 `json:"email"`
 	AppData  map[string]interface{} `json:"app_metadata"`
 	UserData map[string]interface{} `json:"user_metadata"`
 }
 
+// Roles returns the roles granted in app_metadata, either as a single "role"
+// or as a list of "roles"
+func (c *JWTClaims) Roles() []string {
+	roles := []string{}
+	if role, ok := c.AppData["role"].(string); ok && role != "" {
+		roles = append(roles, role)
+	}
+	if list, ok := c.AppData["roles"].([]interface{}); ok {
+		for _, v := range list {
+			if role, ok := v.(string); ok && role != "" {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// HasRole checks whether the claims grant the given role
+func (c *JWTClaims) HasRole(role string) bool {
+	for _, r := range c.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 // requireAuthentication is middleware that requires a valid JWT token
 func (a *API) requireAuthentication(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -43,37 +74,172 @@ func (a *API) requireAuthentication(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		_, err = uuid.FromString(claims.Subject)
+		userID, err := uuid.FromString(claims.Subject)
 		if err != nil {
 			logrus.WithError(err).Info("Invalid user ID in JWT token")
 			unauthorizedError(w)
 			return
 		}
 
-		// Add user ID to context
-		ctx = context.WithValue(ctx, "user_id", claims.Subject)
-		ctx = context.WithValue(ctx, "email", claims.Email)
+		r = r.WithContext(withPrincipal(ctx, &Principal{
+			UserID:       userID,
+			Email:        claims.Email,
+			Roles:        claims.Roles(),
+			AppMetadata:  claims.AppData,
+			UserMetadata: claims.UserData,
+			TokenID:      claims.ID,
+			AuthMethod:   AuthMethodJWT,
+		}))
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireRole is middleware that requires the authenticated user to have a
+// role in app_metadata. It must be wrapped by requireAuthentication.
+func (a *API) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := getPrincipal(r.Context())
+		if principal != nil && principal.HasRole(role) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		forbiddenError(w, "Insufficient role")
+	}
+}
 
-		r = r.WithContext(ctx)
+// requireOperator is middleware that requires the operator token
+func (a *API) requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getToken(r)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.OperatorToken)) != 1 {
+			unauthorizedError(w)
+			return
+		}
+		r = r.WithContext(withPrincipal(r.Context(), &Principal{AuthMethod: AuthMethodOperator}))
 		next.ServeHTTP(w, r)
 	}
 }
 
-// parseJWT parses a JWT token
-func (a *API) parseJWT(tokenString string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// jwtKey returns the key used to verify a token, depending on its algorithm
+// and key ID
+func (a *API) jwtKey(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !a.jwtAlgorithmAllowed(alg) {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	// HMAC tokens are verified by verifyJWT, trying each active secret
+	if strings.HasPrefix(alg, "HS") {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+
+	if a.jwtKeys == nil {
+		return nil, fmt.Errorf("no public keys configured")
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, err := a.jwtKeys.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Refuse keys of another family, e.g. an RSA key for an ES256 token
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") && !strings.HasPrefix(alg, "PS") {
+			return nil, fmt.Errorf("key %s cannot verify %s tokens", kid, alg)
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return nil, fmt.Errorf("key %s cannot verify %s tokens", kid, alg)
 		}
-		return []byte(a.config.JWT.Secret), nil
-	})
+	case ed25519.PublicKey:
+		if alg != jwt.SigningMethodEdDSA.Alg() {
+			return nil, fmt.Errorf("key %s cannot verify %s tokens", kid, alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type for key %s", kid)
+	}
 
+	return key, nil
+}
+
+// verifyJWT checks the token signature and its registered claims. HMAC tokens
+// are tried against each active secret, so that secrets can be rotated without
+// downtime.
+func (a *API) verifyJWT(tokenString string) (*jwt.Token, error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(tokenString, &JWTClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	if !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+	alg := unverified.Method.Alg()
+	if !a.jwtAlgorithmAllowed(alg) {
+		return nil, fmt.Errorf("unexpected signing method: %v", alg)
+	}
+
+	parser := a.jwtParser()
+	if !strings.HasPrefix(alg, "HS") {
+		token, err := parser.ParseWithClaims(tokenString, &JWTClaims{}, a.jwtKey)
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		recordKeyUsage("jwt", kid, true)
+		return token, nil
+	}
+
+	err = fmt.Errorf("no secret configured for %s", alg)
+	for i, secret := range a.config.JWT.ActiveSecrets() {
+		key := []byte(secret.Value)
+		token, parseErr := parser.ParseWithClaims(tokenString, &JWTClaims{}, func(*jwt.Token) (interface{}, error) {
+			return key, nil
+		})
+		if parseErr == nil {
+			recordKeyUsage("jwt", secret.ID, i == 0)
+			return token, nil
+		}
+
+		// Only a bad signature means another secret may match
+		if !errors.Is(parseErr, jwt.ErrTokenSignatureInvalid) {
+			return nil, parseErr
+		}
+		err = parseErr
+	}
+
+	return nil, err
+}
+
+// jwtParser returns a parser validating exp, nbf, iat and iss with the
+// configured clock skew leeway
+func (a *API) jwtParser() *jwt.Parser {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(a.config.JWT.Algorithms),
+		jwt.WithLeeway(a.config.JWT.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	}
+	if a.config.JWT.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.config.JWT.Issuer))
+	}
+	return jwt.NewParser(options...)
+}
+
+// jwtAlgorithmAllowed checks the algorithm against the configured ones
+func (a *API) jwtAlgorithmAllowed(alg string) bool {
+	for _, allowed := range a.config.JWT.Algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJWT parses a JWT token
+func (a *API) parseJWT(tokenString string) (*JWTClaims, error) {
+	token, err := a.verifyJWT(tokenString)
+	if err != nil {
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(*JWTClaims)
@@ -81,13 +247,22 @@ func (a *API) parseJWT(tokenString string) (*JWTClaims, error) {
 		return nil, fmt.Errorf("invalid token claims")
 	}
 
-	if claims.ExpiresAt < time.Now().Unix() {
-		return nil, fmt.Errorf("token expired")
-	}
-
-	if claims.Audience != a.config.JWT.Aud {
+	// The token may be issued for several audiences, one of which must be ours
+	if !audienceAllowed(claims.Audience, a.config.JWT.Aud) {
 		return nil, fmt.Errorf("invalid token audience")
 	}
 
 	return claims, nil
 }
+
+// audienceAllowed checks that the token audience contains an accepted audience
+func audienceAllowed(audience jwt.ClaimStrings, accepted []string) bool {
+	for _, aud := range audience {
+		for _, allowed := range accepted {
+			if aud == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+
+	"github.com/gofrs/uuid"
+)
+
+// contextKey is the type of the keys stored in the request context, so that
+// they cannot collide with keys set by other packages
+type contextKey string
+
+const (
+	principalKey      = contextKey("principal")
+	requestIDKey      = contextKey("request_id")
+	idempotencyKeyKey = contextKey("idempotency_key")
+	apiVersionKey     = contextKey("api_version")
+)
+
+// AuthMethod is the way a principal authenticated
+type AuthMethod string
+
+const (
+	// AuthMethodJWT is used by end users presenting a JWT
+	AuthMethodJWT AuthMethod = "jwt"
+	// AuthMethodAPIKey is used by backend services presenting an API key
+	AuthMethodAPIKey AuthMethod = "api_key"
+	// AuthMethodOperator is used by operators presenting the operator token
+	AuthMethodOperator AuthMethod = "operator"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID       uuid.UUID              `json:"user_id"`
+	Email        string                 `json:"email"`
+	Roles        []string               `json:"roles"`
+	Scopes       []string               `json:"scopes"`
+	AppMetadata  map[string]interface{} `json:"app_metadata"`
+	UserMetadata map[string]interface{} `json:"user_metadata"`
+	TokenID      string                 `json:"token_id"`
+	AuthMethod   AuthMethod             `json:"auth_method"`
+}
+
+// HasRole checks whether the principal has been granted a role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Caller identifies who made the request, for rate limits and idempotency
+// keys. API keys act for many users, so they are identified by the key.
+func (p *Principal) Caller() string {
+	switch p.AuthMethod {
+	case AuthMethodJWT:
+		return "user:" + p.UserID.String()
+	case AuthMethodAPIKey:
+		return "api_key:" + p.TokenID
+	}
+	return string(p.AuthMethod)
+}
+
+// withPrincipal stores the authenticated principal in the context
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// getPrincipal gets the authenticated principal from the context, or nil
+func getPrincipal(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
+
+// withRequestID stores the request ID in the context
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// getRequestID gets the request ID from the context
+func getRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withIdempotencyKey stores the Idempotency-Key of the request in the context
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+// getIdempotencyKey gets the Idempotency-Key of the request from the context
+func getIdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKeyKey).(string)
+	return key
+}
+
+// withAPIVersion stores the API version negotiated for the request in the
+// context
+func withAPIVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, apiVersionKey, version)
+}
+
+// getAPIVersion gets the API version of the request from the context, the
+// oldest version when none was negotiated
+func getAPIVersion(ctx context.Context) string {
+	if version, ok := ctx.Value(apiVersionKey).(string); ok {
+		return version
+	}
+	return apiVersions[0]
+}
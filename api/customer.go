@@ -0,0 +1,318 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// AddressRequest represents a postal address in a request
+type AddressRequest struct {
+	Line1      string `json:"line1,omitempty"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	State      string `json:"state,omitempty"`
+	Country    string `json:"country,omitempty" openapi:"len=2"`
+}
+
+// TaxIDRequest represents a tax ID in a request
+type TaxIDRequest struct {
+	Type  string `json:"type" openapi:"min=1"`
+	Value string `json:"value" openapi:"min=1"`
+}
+
+// UpdateCustomerRequest represents a request to update the customer profile.
+// Omitted fields are left unchanged.
+type UpdateCustomerRequest struct {
+	Name             *string         `json:"name,omitempty"`
+	Email            *string         `json:"email,omitempty" openapi:"format=email"`
+	Phone            *string         `json:"phone,omitempty"`
+	Address          *AddressRequest `json:"address,omitempty"`
+	PreferredLocales *[]string       `json:"preferred_locales,omitempty"`
+	TaxIDs           *[]TaxIDRequest `json:"tax_ids,omitempty"`
+}
+
+// CustomerResponse is the customer profile with its tax IDs
+type CustomerResponse struct {
+	Customer models.Customer `json:"customer"`
+	TaxIDs   []models.TaxID  `json:"tax_ids"`
+}
+
+// UpdateCustomer updates the customer profile in Stripe and in the database
+func (a *API) UpdateCustomer(w http.ResponseWriter, r *http.Request) {
+	var req UpdateCustomerRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
+		return
+	}
+	userID := principal.UserID
+
+	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get customer")
+		return
+	}
+
+	if dbCustomer == nil {
+		notFoundError(w, "Customer not found")
+		return
+	}
+
+	params := &stripe.CustomerParams{
+		Name:  req.Name,
+		Email: req.Email,
+		Phone: req.Phone,
+	}
+	if req.Address != nil {
+		params.Address = &stripe.AddressParams{
+			Line1:      stripe.String(req.Address.Line1),
+			Line2:      stripe.String(req.Address.Line2),
+			City:       stripe.String(req.Address.City),
+			PostalCode: stripe.String(req.Address.PostalCode),
+			State:      stripe.String(req.Address.State),
+			Country:    stripe.String(strings.ToUpper(req.Address.Country)),
+		}
+	}
+	if req.PreferredLocales != nil {
+		params.PreferredLocales = stripe.StringSlice(*req.PreferredLocales)
+	}
+
+	setStripeIdempotencyKey(r.Context(), &params.Params, "customer.update")
+	stripeCustomer, err := a.gateway.UpdateCustomer(dbCustomer.StripeID, params)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to update Stripe customer")
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.HTTPStatusCode == http.StatusBadRequest {
+			badRequestError(w, stripeErr.Msg)
+			return
+		}
+		internalServerError(w, r, "Failed to update customer")
+		return
+	}
+
+	applyStripeCustomer(dbCustomer, stripeCustomer)
+	if err := models.UpdateCustomer(a.db, dbCustomer); err != nil {
+		logrus.WithError(err).Error("Failed to update customer in database")
+		internalServerError(w, r, "Failed to update customer")
+		return
+	}
+
+	if req.TaxIDs != nil {
+		if err := a.replaceTaxIDs(r.Context(), dbCustomer, *req.TaxIDs); err != nil {
+			logrus.WithError(err).Error("Failed to update tax IDs")
+			if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.HTTPStatusCode == http.StatusBadRequest {
+				badRequestError(w, stripeErr.Msg)
+				return
+			}
+			internalServerError(w, r, "Failed to update tax IDs")
+			return
+		}
+	}
+
+	taxIDs, err := models.FindTaxIDsByCustomerID(a.db, dbCustomer.ID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get tax IDs")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &CustomerResponse{
+		Customer: *dbCustomer,
+		TaxIDs:   taxIDs,
+	})
+}
+
+// ensureCustomer returns the customer of a user, creating it in Stripe and in
+// the database when needed. An advisory lock serializes concurrent creations
+// and the Stripe idempotency key prevents a retry from creating a second
+// Stripe customer when the database insert failed.
+func (a *API) ensureCustomer(userID uuid.UUID, email, name string) (*models.Customer, error) {
+	var dbCustomer *models.Customer
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		if err := models.LockCustomerCreation(tx, userID); err != nil {
+			return fmt.Errorf("failed to lock customer creation: %w", err)
+		}
+
+		existing, err := models.FindCustomerByUserID(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to check customer: %w", err)
+		}
+		if existing != nil {
+			dbCustomer = existing
+			return nil
+		}
+
+		params := &stripe.CustomerParams{
+			Email: stripe.String(email),
+			Name:  stripe.String(name),
+		}
+		params.AddMetadata("user_id", userID.String())
+		sum := sha256.Sum256([]byte(strings.Join([]string{"customer.create", userID.String(), email, name}, ":")))
+		params.SetIdempotencyKey(hex.EncodeToString(sum[:]))
+
+		stripeCustomer, err := a.gateway.NewCustomer(params)
+		if err != nil {
+			return fmt.Errorf("failed to create Stripe customer: %w", err)
+		}
+
+		dbCustomer, err = models.CreateCustomer(tx, userID, stripeCustomer.ID, email, name)
+		if err != nil {
+			return fmt.Errorf("failed to create customer in database: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dbCustomer, nil
+}
+
+// replaceTaxIDs makes the customer's tax IDs match the requested ones, in
+// Stripe and in the database. The new tax IDs are created first, so that a
+// value refused by Stripe leaves the existing ones in place.
+func (a *API) replaceTaxIDs(ctx context.Context, dbCustomer *models.Customer, requested []TaxIDRequest) error {
+	existing, err := models.FindTaxIDsByCustomerID(a.db, dbCustomer.ID)
+	if err != nil {
+		return err
+	}
+
+	kept := map[string]bool{}
+	for i := range existing {
+		kept[existing[i].Type+":"+existing[i].Value] = false
+	}
+
+	var added []TaxIDRequest
+	for _, t := range requested {
+		key := t.Type + ":" + t.Value
+		if _, ok := kept[key]; ok {
+			kept[key] = true
+			continue
+		}
+		kept[key] = true
+		added = append(added, t)
+	}
+
+	// Create the new tax IDs, removing the ones already created when Stripe
+	// refuses one of them
+	var created []*stripe.TaxID
+	for _, t := range added {
+		params := &stripe.TaxIDParams{
+			Customer: stripe.String(dbCustomer.StripeID),
+			Type:     stripe.String(t.Type),
+			Value:    stripe.String(t.Value),
+		}
+		setStripeIdempotencyKey(ctx, &params.Params, "tax_id.create:"+t.Type+":"+t.Value)
+		stripeTaxID, err := a.gateway.NewTaxID(params)
+		if err != nil {
+			for _, c := range created {
+				if _, err := a.gateway.DeleteTaxID(c.ID, &stripe.TaxIDParams{Customer: stripe.String(dbCustomer.StripeID)}); err != nil {
+					logrus.WithError(err).WithField("stripe_tax_id", c.ID).Warn("Failed to remove tax ID after a failed update")
+				}
+			}
+			return err
+		}
+		created = append(created, stripeTaxID)
+	}
+
+	// A failed removal still records the changes already made in Stripe
+	var removed []models.TaxID
+	var deleteErr error
+	for i := range existing {
+		if kept[existing[i].Type+":"+existing[i].Value] {
+			continue
+		}
+		if _, deleteErr = a.gateway.DeleteTaxID(existing[i].StripeID, &stripe.TaxIDParams{Customer: stripe.String(dbCustomer.StripeID)}); deleteErr != nil {
+			break
+		}
+		removed = append(removed, existing[i])
+	}
+
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		for _, stripeTaxID := range created {
+			if _, err := models.UpsertTaxID(tx, dbCustomer.ID, stripeTaxID.ID, string(stripeTaxID.Type), stripeTaxID.Value, taxIDVerificationStatus(stripeTaxID)); err != nil {
+				return err
+			}
+		}
+		for i := range removed {
+			if err := models.DeleteTaxID(tx, &removed[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+// handleCustomerUpdated keeps the local customer in sync with changes made in Stripe
+func (a *API) handleCustomerUpdated(stripeCustomer *stripe.Customer) error {
+	dbCustomer, err := models.FindCustomerByStripeID(a.db, stripeCustomer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get customer: %w", err)
+	}
+
+	if dbCustomer == nil {
+		logrus.WithField("stripe_customer_id", stripeCustomer.ID).Info("Ignoring update of unknown customer")
+		return nil
+	}
+
+	applyStripeCustomer(dbCustomer, stripeCustomer)
+	if err := models.UpdateCustomer(a.db, dbCustomer); err != nil {
+		return fmt.Errorf("failed to update customer: %w", err)
+	}
+
+	return nil
+}
+
+// applyStripeCustomer copies the profile and the default payment method of a
+// Stripe customer to the local customer
+func applyStripeCustomer(dbCustomer *models.Customer, stripeCustomer *stripe.Customer) {
+	dbCustomer.Email = stripeCustomer.Email
+	dbCustomer.Name = stripeCustomer.Name
+	dbCustomer.Phone = stripeCustomer.Phone
+	dbCustomer.AddressLine1 = stripeCustomer.Address.Line1
+	dbCustomer.AddressLine2 = stripeCustomer.Address.Line2
+	dbCustomer.AddressCity = stripeCustomer.Address.City
+	dbCustomer.AddressPostalCode = stripeCustomer.Address.PostalCode
+	dbCustomer.AddressState = stripeCustomer.Address.State
+	dbCustomer.AddressCountry = stripeCustomer.Address.Country
+	dbCustomer.SetLocales(stripeCustomer.PreferredLocales)
+
+	dbCustomer.DefaultPaymentMethod = ""
+	if stripeCustomer.InvoiceSettings != nil && stripeCustomer.InvoiceSettings.DefaultPaymentMethod != nil {
+		dbCustomer.DefaultPaymentMethod = stripeCustomer.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+	dbCustomer.DefaultSource = ""
+	if stripeCustomer.DefaultSource != nil {
+		dbCustomer.DefaultSource = stripeCustomer.DefaultSource.ID
+	}
+	if stripeCustomer.Created > 0 {
+		created := time.Unix(stripeCustomer.Created, 0)
+		dbCustomer.StripeCreatedAt = &created
+	}
+}
+
+// taxIDVerificationStatus returns the verification status of a Stripe tax ID
+func taxIDVerificationStatus(t *stripe.TaxID) string {
+	if t.Verification == nil {
+		return string(stripe.TaxIDVerificationStatusUnavailable)
+	}
+	return string(t.Verification.Status)
+}
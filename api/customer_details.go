@@ -2,24 +2,91 @@ package api
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
+	"gostripe/billing"
 	"gostripe/models"
 
+	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/price"
-	"github.com/stripe/stripe-go/v72/sub"
 )
 
-// GetCustomerDetails gets detailed information about a customer and their subscription
+// CustomerDetailsResponse describes the customer of a user and their active
+// subscription. The customer, subscription and price details are omitted when
+// there are none.
+type CustomerDetailsResponse struct {
+	HasCustomer     bool `json:"has_customer"`
+	HasSubscription bool `json:"has_subscription"`
+	*CustomerDetails
+	*SubscriptionDetails
+	*PriceDetails
+}
+
+// CustomerDetails describes a customer
+type CustomerDetails struct {
+	CustomerID           uuid.UUID `json:"customer_id"`
+	StripeCustomerID     string    `json:"stripe_customer_id"`
+	Email                string    `json:"email"`
+	Name                 string    `json:"name"`
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+	DefaultPaymentMethod string    `json:"default_payment_method,omitempty"`
+	// Refreshed tells whether the details were fetched from Stripe
+	Refreshed bool `json:"refreshed"`
+
+	// Les champs stripe_* sont conservés pour les clients existants, mais
+	// viennent désormais de la base
+	StripeCustomerEmail         string     `json:"stripe_customer_email" openapi:"deprecated"`
+	StripeCustomerName          string     `json:"stripe_customer_name" openapi:"deprecated"`
+	StripeCustomerPhone         string     `json:"stripe_customer_phone" openapi:"deprecated"`
+	StripeCustomerCreated       *time.Time `json:"stripe_customer_created" openapi:"deprecated"`
+	StripeCustomerDefaultSource string     `json:"stripe_customer_default_source,omitempty" openapi:"deprecated"`
+}
+
+// SubscriptionDetails describes the active subscription of a customer
+type SubscriptionDetails struct {
+	SubscriptionID        uuid.UUID                 `json:"subscription_id"`
+	StripeSubscriptionID  string                    `json:"stripe_subscription_id"`
+	SubscriptionStatus    models.SubscriptionStatus `json:"subscription_status"`
+	PriceID               string                    `json:"price_id"`
+	CurrentPeriodEnd      time.Time                 `json:"current_period_end"`
+	CanceledAt            *time.Time                `json:"canceled_at"`
+	SubscriptionCreatedAt time.Time                 `json:"subscription_created_at"`
+	SubscriptionUpdatedAt time.Time                 `json:"subscription_updated_at"`
+	Subscription          models.Subscription       `json:"subscription"`
+
+	StripeSubscriptionStatus models.SubscriptionStatus `json:"stripe_subscription_status" openapi:"deprecated"`
+	StripeCurrentPeriodStart *time.Time                `json:"stripe_current_period_start" openapi:"deprecated"`
+	StripeCurrentPeriodEnd   time.Time                 `json:"stripe_current_period_end" openapi:"deprecated"`
+	StripeCancelAtPeriodEnd  bool                      `json:"stripe_cancel_at_period_end" openapi:"deprecated"`
+	StripeCanceledAt         *time.Time                `json:"stripe_canceled_at,omitempty" openapi:"deprecated"`
+}
+
+// PriceDetails describes the price of a subscription, omitted when Stripe
+// could not be reached
+type PriceDetails struct {
+	PriceAmount        models.Money `json:"price_amount"`
+	PriceCurrency      string       `json:"price_currency"`
+	PriceInterval      string       `json:"price_interval,omitempty"`
+	PriceIntervalCount int64        `json:"price_interval_count,omitempty"`
+	PriceNickname      string       `json:"price_nickname"`
+	PriceProduct       string       `json:"price_product,omitempty"`
+}
+
+// GetCustomerDetails gets detailed information about a customer and their
+// subscription from the database. With ?refresh=true, the customer and the
+// subscription are fetched from Stripe first and the database is updated.
 func (a *API) GetCustomerDetails(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
+
+	refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh"))
 
 	// Get customer from database
 	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
@@ -29,24 +96,10 @@ func (a *API) GetCustomerDetails(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if dbCustomer == nil {
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"has_customer": false,
-			"has_subscription": false,
-		})
+		sendJSON(w, http.StatusOK, &CustomerDetailsResponse{})
 		return
 	}
 
-	// Prepare response with customer details
-	response := map[string]interface{}{
-		"has_customer": true,
-		"customer_id": dbCustomer.ID,
-		"stripe_customer_id": dbCustomer.StripeID,
-		"email": dbCustomer.Email,
-		"name": dbCustomer.Name,
-		"created_at": dbCustomer.CreatedAt,
-		"updated_at": dbCustomer.UpdatedAt,
-	}
-
 	// Get subscription from database
 	dbSubscription, err := models.FindActiveSubscriptionByCustomerID(a.db, dbCustomer.ID)
 	if err != nil {
@@ -54,88 +107,117 @@ func (a *API) GetCustomerDetails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	refreshed := false
+	if refresh {
+		refreshed = a.refreshCustomerDetails(dbCustomer, dbSubscription)
+		if dbSubscription, err = models.FindActiveSubscriptionByCustomerID(a.db, dbCustomer.ID); err != nil {
+			internalServerError(w, r, "Failed to get subscription")
+			return
+		}
+	}
+
+	// Prepare response with customer details
+	response := &CustomerDetailsResponse{
+		HasCustomer: true,
+		CustomerDetails: &CustomerDetails{
+			CustomerID:                  dbCustomer.ID,
+			StripeCustomerID:            dbCustomer.StripeID,
+			Email:                       dbCustomer.Email,
+			Name:                        dbCustomer.Name,
+			CreatedAt:                   dbCustomer.CreatedAt,
+			UpdatedAt:                   dbCustomer.UpdatedAt,
+			DefaultPaymentMethod:        dbCustomer.DefaultPaymentMethod,
+			Refreshed:                   refreshed,
+			StripeCustomerEmail:         dbCustomer.Email,
+			StripeCustomerName:          dbCustomer.Name,
+			StripeCustomerPhone:         dbCustomer.Phone,
+			StripeCustomerCreated:       dbCustomer.StripeCreatedAt,
+			StripeCustomerDefaultSource: dbCustomer.DefaultSource,
+		},
+	}
+
 	// Add subscription details to response
-	if dbSubscription != nil {
-		response["has_subscription"] = true
-		response["subscription_id"] = dbSubscription.ID
-		response["stripe_subscription_id"] = dbSubscription.StripeID
-		response["subscription_status"] = dbSubscription.Status
-		response["price_id"] = dbSubscription.PriceID
-		response["current_period_end"] = dbSubscription.CurrentPeriodEnd
-		response["canceled_at"] = dbSubscription.CanceledAt
-		response["subscription_created_at"] = dbSubscription.CreatedAt
-		response["subscription_updated_at"] = dbSubscription.UpdatedAt
-
-		// Récupérer les détails de l'abonnement directement depuis Stripe
-		stripeSub, err := sub.Get(dbSubscription.StripeID, nil)
+	if dbSubscription == nil {
+		sendJSON(w, http.StatusOK, response)
+		return
+	}
+
+	response.HasSubscription = true
+	response.SubscriptionDetails = &SubscriptionDetails{
+		SubscriptionID:        dbSubscription.ID,
+		StripeSubscriptionID:  dbSubscription.StripeID,
+		SubscriptionStatus:    dbSubscription.Status,
+		PriceID:               dbSubscription.PriceID,
+		CurrentPeriodEnd:      dbSubscription.CurrentPeriodEnd,
+		CanceledAt:            dbSubscription.CanceledAt,
+		SubscriptionCreatedAt: dbSubscription.CreatedAt,
+		SubscriptionUpdatedAt: dbSubscription.UpdatedAt,
+		Subscription:          *dbSubscription,
+
+		StripeSubscriptionStatus: dbSubscription.Status,
+		StripeCurrentPeriodStart: dbSubscription.CurrentPeriodStart,
+		StripeCurrentPeriodEnd:   dbSubscription.CurrentPeriodEnd,
+		StripeCancelAtPeriodEnd:  dbSubscription.CancelAtPeriodEnd,
+		StripeCanceledAt:         dbSubscription.CanceledAt,
+	}
+
+	// Les prix ne sont pas en base : ils passent par le cache des appels Stripe
+	if dbSubscription.PriceID != "" {
+		gw := a.gateway
+		if refresh {
+			gw = a.live
+		}
+		priceDetails, err := gw.GetPrice(dbSubscription.PriceID, nil)
 		if err == nil {
-			// Ajouter des informations supplémentaires sur l'abonnement
-			response["stripe_subscription_status"] = string(stripeSub.Status)
-			response["stripe_current_period_start"] = time.Unix(stripeSub.CurrentPeriodStart, 0)
-			response["stripe_current_period_end"] = time.Unix(stripeSub.CurrentPeriodEnd, 0)
-			response["stripe_cancel_at_period_end"] = stripeSub.CancelAtPeriodEnd
-
-			if stripeSub.CanceledAt > 0 {
-				canceledAt := time.Unix(stripeSub.CanceledAt, 0)
-				response["stripe_canceled_at"] = canceledAt
+			price := &PriceDetails{
+				PriceAmount:   models.NewMoney(priceDetails.UnitAmount, string(priceDetails.Currency)),
+				PriceCurrency: string(priceDetails.Currency),
+				PriceNickname: priceDetails.Nickname,
 			}
-
-			// Récupérer les informations de prix si disponibles
-			if len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Price != nil {
-				priceID := stripeSub.Items.Data[0].Price.ID
-				
-				// Récupérer les détails complets du prix
-				priceDetails, err := price.Get(priceID, nil)
-				if err == nil {
-					response["price_amount"] = float64(priceDetails.UnitAmount) / 100.0 // Convertir de centimes à euros
-					response["price_currency"] = string(priceDetails.Currency)
-					response["price_interval"] = string(priceDetails.Recurring.Interval)
-					response["price_interval_count"] = priceDetails.Recurring.IntervalCount
-					response["price_nickname"] = priceDetails.Nickname
-					response["price_product"] = priceDetails.Product.ID
-				} else {
-					logrus.WithError(err).Warn("Failed to get price details from Stripe")
-				}
+			if priceDetails.Recurring != nil {
+				price.PriceInterval = string(priceDetails.Recurring.Interval)
+				price.PriceIntervalCount = priceDetails.Recurring.IntervalCount
 			}
-		} else {
-			logrus.WithError(err).Warn("Failed to get subscription from Stripe")
-			
-			// Utiliser les données de la base de données pour les informations de base
-			response["stripe_subscription_status"] = dbSubscription.Status
-			
-			// Estimer la date de début de la période actuelle (1 mois avant la fin)
-			estimatedStart := dbSubscription.CurrentPeriodEnd.AddDate(0, -1, 0)
-			response["stripe_current_period_start"] = estimatedStart
-			response["stripe_current_period_end"] = dbSubscription.CurrentPeriodEnd
-			
-			// Déterminer si l'abonnement sera annulé à la fin de la période
-			response["stripe_cancel_at_period_end"] = dbSubscription.CanceledAt != nil
-			
-			if dbSubscription.CanceledAt != nil {
-				response["stripe_canceled_at"] = *dbSubscription.CanceledAt
+			if priceDetails.Product != nil {
+				price.PriceProduct = priceDetails.Product.ID
 			}
+			response.PriceDetails = price
+		} else {
+			logrus.WithError(err).Warn("Failed to get price details from Stripe")
 		}
-	} else {
-		response["has_subscription"] = false
 	}
 
-	// Get live customer data from Stripe API
-	stripeCustomer, err := customer.Get(dbCustomer.StripeID, nil)
-	if err == nil {
-		// Add live Stripe customer details
-		response["stripe_customer_email"] = stripeCustomer.Email
-		response["stripe_customer_name"] = stripeCustomer.Name
-		response["stripe_customer_phone"] = stripeCustomer.Phone
-		response["stripe_customer_created"] = time.Unix(stripeCustomer.Created, 0)
-		response["stripe_customer_default_source"] = stripeCustomer.DefaultSource
-
-		// Add payment method details if available
-		if stripeCustomer.InvoiceSettings.DefaultPaymentMethod != nil {
-			response["default_payment_method"] = stripeCustomer.InvoiceSettings.DefaultPaymentMethod.ID
-		}
-	} else {
+	sendJSON(w, http.StatusOK, response)
+}
+
+// refreshCustomerDetails fetches a customer and its subscription from Stripe,
+// bypassing the cache, and stores them. It returns false when Stripe could not
+// be reached, the stored details being used as they are.
+func (a *API) refreshCustomerDetails(dbCustomer *models.Customer, dbSubscription *models.Subscription) bool {
+	stripeCustomer, err := a.live.GetCustomer(dbCustomer.StripeID, nil)
+	if err != nil {
 		logrus.WithError(err).Warn("Failed to get customer from Stripe")
+		return false
+	}
+	applyStripeCustomer(dbCustomer, stripeCustomer)
+	if err := models.UpdateCustomer(a.db, dbCustomer); err != nil {
+		logrus.WithError(err).Error("Failed to update customer")
+		return false
 	}
+	a.forgetCached(stripeCustomer.ID)
 
-	sendJSON(w, http.StatusOK, response)
+	if dbSubscription == nil {
+		return true
+	}
+	stripeSub, err := a.live.GetSubscription(dbSubscription.StripeID, nil)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to get subscription from Stripe")
+		return false
+	}
+	if _, err := billing.UpsertSubscription(a.db, dbCustomer.ID, stripeSub); err != nil {
+		logrus.WithError(err).Error("Failed to update subscription")
+		return false
+	}
+	a.forgetCached(stripeSub.ID)
+	return true
 }
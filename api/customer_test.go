@@ -0,0 +1,358 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestUpdateCustomerValidation(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+	token := testToken(t, uuid.Must(uuid.NewV4()), "user@example.com")
+
+	tests := []struct {
+		name string
+		body interface{}
+	}{
+		{"invalid body", []byte("[")},
+		{"invalid email", map[string]interface{}{"email": "not an email"}},
+		{"invalid country", map[string]interface{}{"address": map[string]string{"country": "FRA"}}},
+		{"tax ID without value", map[string]interface{}{"tax_ids": []map[string]string{{"type": "eu_vat"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPatch, "/customer", token, tt.body)
+			expectStatus(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestUpdateCustomer(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	token := testToken(t, userID, "user@example.com")
+
+	w := a.request(t, http.MethodPatch, "/customer", token, map[string]interface{}{"name": "Jeanne"})
+	expectStatus(t, w, http.StatusNotFound)
+
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+
+	tests := []struct {
+		name   string
+		body   map[string]interface{}
+		check  func(t *testing.T, c *models.Customer, taxIDs []models.TaxID)
+		status int
+	}{
+		{
+			name: "profile",
+			body: map[string]interface{}{
+				"name":              "Jeanne Martin",
+				"phone":             "+33123456789",
+				"address":           map[string]string{"line1": "1 rue de la Paix", "city": "Paris", "postal_code": "75002", "country": "fr"},
+				"preferred_locales": []string{"fr", "en"},
+			},
+			check: func(t *testing.T, c *models.Customer, taxIDs []models.TaxID) {
+				if c.Name != "Jeanne Martin" || c.Phone != "+33123456789" || c.AddressCountry != "FR" || c.PreferredLocales != "fr,en" {
+					t.Errorf("unexpected customer %+v", c)
+				}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "omitted fields are kept",
+			body: map[string]interface{}{"email": "jeanne@example.com"},
+			check: func(t *testing.T, c *models.Customer, taxIDs []models.TaxID) {
+				if c.Email != "jeanne@example.com" || c.Name != "Jeanne Martin" {
+					t.Errorf("unexpected customer %+v", c)
+				}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "tax IDs",
+			body: map[string]interface{}{"tax_ids": []map[string]string{{"type": "eu_vat", "value": "FR12345678901"}}},
+			check: func(t *testing.T, c *models.Customer, taxIDs []models.TaxID) {
+				if len(taxIDs) != 1 || taxIDs[0].Value != "FR12345678901" {
+					t.Errorf("unexpected tax IDs %+v", taxIDs)
+				}
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "tax IDs are replaced",
+			body: map[string]interface{}{"tax_ids": []map[string]string{{"type": "eu_vat", "value": "DE123456789"}}},
+			check: func(t *testing.T, c *models.Customer, taxIDs []models.TaxID) {
+				if len(taxIDs) != 1 || taxIDs[0].Value != "DE123456789" {
+					t.Errorf("unexpected tax IDs %+v", taxIDs)
+				}
+			},
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPatch, "/customer", token, tt.body)
+			expectStatus(t, w, tt.status)
+
+			c, err := models.FindCustomerByUserID(db, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			taxIDs, err := models.FindTaxIDsByCustomerID(db, dbCustomer.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c, taxIDs)
+		})
+	}
+
+	t.Run("Stripe rejects the update", func(t *testing.T) {
+		a.stripe.FailNext("UpdateCustomer", &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Msg: "Invalid phone number"})
+		w := a.request(t, http.MethodPatch, "/customer", token, map[string]interface{}{"phone": "0"})
+		expectStatus(t, w, http.StatusBadRequest)
+		if body := decode(t, w); body["message"] != "Invalid phone number" {
+			t.Errorf("expected the Stripe message, got %v", body)
+		}
+	})
+
+	t.Run("Stripe rejects a tax ID", func(t *testing.T) {
+		deletions := a.stripe.Calls("DeleteTaxID")
+		a.stripe.FailNext("NewTaxID", &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Msg: "Invalid value for eu_vat"})
+		w := a.request(t, http.MethodPatch, "/customer", token, map[string]interface{}{"tax_ids": []map[string]string{{"type": "eu_vat", "value": "FR0"}}})
+		expectStatus(t, w, http.StatusBadRequest)
+
+		// The existing tax ID is kept, in Stripe and in the database
+		if a.stripe.Calls("DeleteTaxID") != deletions {
+			t.Error("expected no tax ID to be deleted in Stripe")
+		}
+		taxIDs, err := models.FindTaxIDsByCustomerID(db, dbCustomer.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(taxIDs) != 1 || taxIDs[0].Value != "DE123456789" {
+			t.Errorf("expected the tax ID to be kept, got %+v", taxIDs)
+		}
+	})
+}
+
+func TestGetCustomerDetails(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990, Nickname: "Basic"})
+
+	withoutCustomer := uuid.Must(uuid.NewV4())
+
+	withoutSubscription := uuid.Must(uuid.NewV4())
+	seedCustomer(t, a, withoutSubscription, "none@example.com")
+
+	active := uuid.Must(uuid.NewV4())
+	activeCustomer := seedCustomer(t, a, active, "active@example.com")
+	activeSub := seedSubscription(t, a, activeCustomer, "price_basic", stripe.SubscriptionStatusActive)
+
+	tests := []struct {
+		name            string
+		userID          uuid.UUID
+		hasCustomer     bool
+		hasSubscription bool
+		failStripe      bool
+	}{
+		{"no customer", withoutCustomer, false, false, false},
+		{"no subscription", withoutSubscription, true, false, false},
+		{"active", active, true, true, false},
+		{"Stripe unavailable", active, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.failStripe {
+				a.stripe.FailNext("GetPrice", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError})
+			}
+
+			w := a.request(t, http.MethodGet, "/get-customer-details", testToken(t, tt.userID, "user@example.com"), nil)
+			expectStatus(t, w, http.StatusOK)
+			body := decode(t, w)
+			if body["has_customer"] != tt.hasCustomer || body["has_subscription"] != tt.hasSubscription {
+				t.Fatalf("unexpected details %v", body)
+			}
+			if !tt.hasSubscription {
+				return
+			}
+			if body["stripe_subscription_status"] != "active" || body["stripe_current_period_start"] == nil {
+				t.Errorf("expected an active subscription, got %v", body)
+			}
+			if _, ok := body["price_nickname"]; ok == tt.failStripe {
+				t.Errorf("unexpected price details in %v", body)
+			}
+		})
+	}
+
+	t.Run("served from the database", func(t *testing.T) {
+		calls := a.stripe.Calls("GetSubscription") + a.stripe.Calls("GetCustomer")
+		w := a.request(t, http.MethodGet, "/get-customer-details", testToken(t, active, "user@example.com"), nil)
+		expectStatus(t, w, http.StatusOK)
+		if a.stripe.Calls("GetSubscription")+a.stripe.Calls("GetCustomer") != calls {
+			t.Error("expected no customer or subscription lookup in Stripe")
+		}
+	})
+
+	// Modifiés dans Stripe sans webhook
+	if _, err := a.stripe.UpdateCustomer(activeCustomer.StripeID, &stripe.CustomerParams{Name: stripe.String("Jeanne Martin")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.stripe.SetSubscriptionStatus(activeSub.StripeID, stripe.SubscriptionStatusPastDue); err != nil {
+		t.Fatal(err)
+	}
+	pm := a.stripe.AddPaymentMethod(activeCustomer.StripeID, stripe.PaymentMethodCardBrandVisa, "4242")
+
+	t.Run("refresh with Stripe unavailable", func(t *testing.T) {
+		a.stripe.FailNext("GetCustomer", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError})
+		w := a.request(t, http.MethodGet, "/get-customer-details?refresh=true", testToken(t, active, "user@example.com"), nil)
+		expectStatus(t, w, http.StatusOK)
+		if body := decode(t, w); body["refreshed"] != false || body["name"] != "" || body["has_subscription"] != true {
+			t.Errorf("expected the stored details, got %v", body)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		w := a.request(t, http.MethodGet, "/get-customer-details?refresh=true", testToken(t, active, "user@example.com"), nil)
+		expectStatus(t, w, http.StatusOK)
+		body := decode(t, w)
+		if body["refreshed"] != true || body["name"] != "Jeanne Martin" || body["has_subscription"] != false {
+			t.Errorf("expected the details from Stripe, got %v", body)
+		}
+		if body["default_payment_method"] != pm.ID || body["stripe_customer_created"] == nil {
+			t.Errorf("expected the default payment method and creation date from Stripe, got %v", body)
+		}
+
+		subscription, err := models.FindSubscriptionByStripeID(db, activeSub.StripeID)
+		if err != nil || subscription.Status != models.SubscriptionStatusPastDue {
+			t.Errorf("expected the subscription to be updated, got %+v (%v)", subscription, err)
+		}
+	})
+}
+
+func TestGetCustomerDetailsCache(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, map[string]string{"STRIPE_CACHE_TTL": "1m"}), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990, Nickname: "Basic"})
+
+	userID := uuid.Must(uuid.NewV4())
+	seedSubscription(t, a, seedCustomer(t, a, userID, "user@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	for i := 0; i < 3; i++ {
+		w := a.request(t, http.MethodGet, "/get-customer-details", testToken(t, userID, "user@example.com"), nil)
+		expectStatus(t, w, http.StatusOK)
+		if body := decode(t, w); body["price_nickname"] != "Basic" {
+			t.Errorf("expected the price details, got %v", body)
+		}
+	}
+	if calls := a.stripe.Calls("GetPrice"); calls != 1 {
+		t.Errorf("expected the price to be cached, got %d calls", calls)
+	}
+}
+
+func TestTaxIDs(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	token := testToken(t, userID, "user@example.com")
+
+	t.Run("no customer", func(t *testing.T) {
+		w := a.request(t, http.MethodGet, "/customer/tax-ids", token, nil)
+		expectStatus(t, w, http.StatusNotFound)
+	})
+
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+
+	var created map[string]interface{}
+	t.Run("create", func(t *testing.T) {
+		w := a.request(t, http.MethodPost, "/customer/tax-ids", token, map[string]string{"type": "eu_vat", "value": "FR12345678901"})
+		expectStatus(t, w, http.StatusCreated)
+		created = decode(t, w)
+		if created["verification_status"] != "verified" {
+			t.Errorf("unexpected tax ID %v", created)
+		}
+	})
+
+	t.Run("create without value", func(t *testing.T) {
+		w := a.request(t, http.MethodPost, "/customer/tax-ids", token, map[string]string{"type": "eu_vat"})
+		expectStatus(t, w, http.StatusBadRequest)
+	})
+
+	t.Run("create rejected by Stripe", func(t *testing.T) {
+		a.stripe.FailNext("NewTaxID", &stripe.Error{HTTPStatusCode: http.StatusBadRequest, Msg: "Invalid value for eu_vat"})
+		w := a.request(t, http.MethodPost, "/customer/tax-ids", token, map[string]string{"type": "eu_vat", "value": "nope"})
+		expectStatus(t, w, http.StatusBadRequest)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := a.request(t, http.MethodGet, "/customer/tax-ids", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		if taxIDs := decode(t, w)["tax_ids"].([]interface{}); len(taxIDs) != 1 {
+			t.Errorf("expected 1 tax ID, got %v", taxIDs)
+		}
+	})
+
+	t.Run("webhook for an existing tax ID", func(t *testing.T) {
+		stripeTaxID := &stripe.TaxID{ID: created["stripe_id"].(string), Type: "eu_vat", Value: "FR12345678901",
+			Verification: &stripe.TaxIDVerification{Status: stripe.TaxIDVerificationStatusUnverified}}
+		w := a.sendWebhook(t, "customer.tax_id.updated", stripeTaxID)
+		expectStatus(t, w, http.StatusOK)
+
+		taxID, err := models.FindTaxIDByStripeID(db, stripeTaxID.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taxID.VerificationStatus != "unverified" {
+			t.Errorf("expected the tax ID to be unverified, got %s", taxID.VerificationStatus)
+		}
+	})
+
+	t.Run("recorded by the API and the webhook", func(t *testing.T) {
+		first, err := models.UpsertTaxID(db, dbCustomer.ID, "txi_twice", "eu_vat", "DE123456789", "pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := models.UpsertTaxID(db, dbCustomer.ID, "txi_twice", "eu_vat", "DE123456789", "verified")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.ID != first.ID || second.VerificationStatus != "verified" {
+			t.Errorf("expected the tax ID to be updated, got %+v", second)
+		}
+		if err := models.DeleteTaxID(db, second); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"delete an invalid ID", "nope", http.StatusBadRequest},
+		{"delete an unknown ID", uuid.Must(uuid.NewV4()).String(), http.StatusNotFound},
+		{"delete", "", http.StatusOK},
+		{"delete twice", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := tt.id
+			if id == "" {
+				id = created["id"].(string)
+			}
+			w := a.request(t, http.MethodDelete, "/customer/tax-ids/"+id, token, nil)
+			expectStatus(t, w, tt.status)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gostripe/models"
+	"gostripe/notify"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// DunningNotification is the payload posted to the dunning notification URL
+type DunningNotification struct {
+	Type                 string             `json:"type"`
+	UserID               string             `json:"user_id"`
+	SubscriptionID       string             `json:"subscription_id"`
+	StripeSubscriptionID string             `json:"stripe_subscription_id"`
+	StripeInvoiceID      string             `json:"stripe_invoice_id"`
+	AttemptCount         int                `json:"attempt_count"`
+	Access               models.AccessLevel `json:"access"`
+	FixPaymentURL        string             `json:"fix_payment_url,omitempty"`
+	NextPaymentAttempt   *time.Time         `json:"next_payment_attempt,omitempty"`
+	OccurredAt           time.Time          `json:"occurred_at"`
+}
+
+// handleInvoicePaymentFailed records a failed payment and moves the subscription
+// along the dunning schedule
+func (a *API) handleInvoicePaymentFailed(invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil {
+		logrus.WithField("invoice_id", invoice.ID).Info("Ignoring failed payment for invoice without subscription")
+		return nil
+	}
+
+	subscription, err := models.FindSubscriptionByStripeID(a.db, invoice.Subscription.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	// Not synchronized yet: failing would only make Stripe retry for days
+	if subscription == nil {
+		logrus.WithFields(logrus.Fields{
+			"stripe_invoice_id":      invoice.ID,
+			"stripe_subscription_id": invoice.Subscription.ID,
+		}).Warn("Ignoring failed payment for unknown subscription")
+		return nil
+	}
+
+	// The failure and the dunning state are saved together: a retry of the
+	// webhook after a failure must not find the attempt already recorded
+	attempts := int(invoice.AttemptCount)
+	recorded := false
+	var state *models.DunningState
+	err = a.db.Transaction(func(tx *storage.Connection) error {
+		var err error
+		recorded, err = models.CreatePaymentFailure(tx, subscription.ID, invoice.ID, attempts, invoice.AmountDue, string(invoice.Currency))
+		if err != nil {
+			return fmt.Errorf("failed to record payment failure: %w", err)
+		}
+		if !recorded {
+			return nil
+		}
+
+		state, err = models.FindDunningStateBySubscriptionID(tx, subscription.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get dunning state: %w", err)
+		}
+		if state == nil {
+			state = &models.DunningState{SubscriptionID: subscription.ID}
+		}
+
+		state.StripeInvoiceID = invoice.ID
+		state.AttemptCount = attempts
+		state.Access = models.AccessLevel(a.config.Dunning.Schedule.AccessFor(attempts))
+		state.HostedInvoiceURL = invoice.HostedInvoiceURL
+		state.LastFailedAt = time.Now()
+		state.ResolvedAt = nil
+		state.NextPaymentAttempt = nil
+		if invoice.NextPaymentAttempt > 0 {
+			next := time.Unix(invoice.NextPaymentAttempt, 0)
+			state.NextPaymentAttempt = &next
+		}
+
+		if state.ID == uuid.Nil {
+			err = models.CreateDunningState(tx, state)
+		} else {
+			err = models.UpdateDunningState(tx, state)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to save dunning state: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Stripe delivers the same event again when it retries the webhook
+	if !recorded {
+		logrus.WithFields(logrus.Fields{
+			"stripe_invoice_id": invoice.ID,
+			"attempt_count":     attempts,
+		}).Info("Ignoring already recorded failed payment")
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"stripe_subscription_id": subscription.StripeID,
+		"stripe_invoice_id":      invoice.ID,
+		"attempt_count":          attempts,
+		"access":                 state.Access,
+	}).Info("Recorded failed payment")
+
+	a.notifyDunning("dunning.step", subscription, state)
+	a.notifyInvoice(invoice, notify.EventPaymentFailed, invoice.HostedInvoiceURL)
+
+	return nil
+}
+
+// handleInvoicePaid closes the dunning process of a subscription once its
+// invoice has been paid
+func (a *API) handleInvoicePaid(invoice *stripe.Invoice) error {
+	if invoice.Subscription == nil {
+		return nil
+	}
+
+	subscription, err := models.FindSubscriptionByStripeID(a.db, invoice.Subscription.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get subscription: %w", err)
+	}
+
+	if subscription == nil {
+		return nil
+	}
+
+	state, err := models.FindDunningStateBySubscriptionID(a.db, subscription.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get dunning state: %w", err)
+	}
+
+	if state == nil || !state.IsOpen() {
+		return nil
+	}
+
+	now := time.Now()
+	state.ResolvedAt = &now
+	state.Access = models.AccessFull
+	state.NextPaymentAttempt = nil
+	if err := models.UpdateDunningState(a.db, state); err != nil {
+		return fmt.Errorf("failed to update dunning state: %w", err)
+	}
+
+	a.notifyDunning("dunning.recovered", subscription, state)
+	return nil
+}
+
+// fixPaymentURL returns a link the customer can follow to fix their payment:
+// the hosted invoice page when known, a billing portal session otherwise. The
+// portal session is only created when createSession is set.
+func (a *API) fixPaymentURL(customer *models.Customer, state *models.DunningState, createSession bool) string {
+	if state.HostedInvoiceURL != "" {
+		return state.HostedInvoiceURL
+	}
+
+	if !createSession || a.config.Dunning.PortalReturnURL == "" {
+		return ""
+	}
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(customer.StripeID),
+		ReturnURL: stripe.String(a.config.Dunning.PortalReturnURL),
+	}
+	s, err := a.gateway.NewBillingPortalSession(params)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to create billing portal session")
+		return ""
+	}
+	return s.URL
+}
+
+// notifyDunning posts a dunning notification to the configured URL. Failures
+// are logged but never fail the webhook.
+func (a *API) notifyDunning(eventType string, subscription *models.Subscription, state *models.DunningState) {
+	logger := logrus.WithFields(logrus.Fields{
+		"type":                   eventType,
+		"stripe_subscription_id": subscription.StripeID,
+		"access":                 state.Access,
+	})
+
+	if a.config.Dunning.NotificationURL == "" {
+		logger.Info("Dunning notification")
+		return
+	}
+
+	notification := &DunningNotification{
+		Type:                 eventType,
+		SubscriptionID:       subscription.ID.String(),
+		StripeSubscriptionID: subscription.StripeID,
+		StripeInvoiceID:      state.StripeInvoiceID,
+		AttemptCount:         state.AttemptCount,
+		Access:               state.Access,
+		NextPaymentAttempt:   state.NextPaymentAttempt,
+		OccurredAt:           time.Now(),
+	}
+
+	customer, err := models.FindCustomerByID(a.db, subscription.CustomerID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get customer for dunning notification")
+	} else if customer != nil {
+		notification.UserID = customer.UserID.String()
+		if eventType != "dunning.recovered" {
+			notification.FixPaymentURL = a.fixPaymentURL(customer, state, true)
+		}
+	}
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode dunning notification")
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.config.Dunning.NotificationURL, bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Error("Failed to build dunning notification request")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.config.Dunning.NotificationSecret != "" {
+		mac := hmac.New(sha256.New, []byte(a.config.Dunning.NotificationSecret))
+		mac.Write(body)
+		req.Header.Set("X-Gostripe-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send dunning notification")
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logger.WithField("status", resp.StatusCode).Warn("Dunning notification rejected")
+	}
+}
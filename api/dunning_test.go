@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestWebhookInvoicePaymentFailed(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, map[string]string{
+		"DUNNING_PORTAL_RETURN_URL": "https://app.example.com/billing",
+	}), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	dbSubscription := seedSubscription(t, a, seedCustomer(t, a, userID, "user@example.com"), "price_basic", stripe.SubscriptionStatusPastDue)
+
+	invoice := &stripe.Invoice{
+		ID:           "in_failed",
+		Subscription: &stripe.Subscription{ID: dbSubscription.StripeID},
+		AttemptCount: 1,
+		AmountDue:    990,
+		Currency:     "eur",
+	}
+
+	// Stripe peut livrer plusieurs fois le même événement
+	for i := 0; i < 2; i++ {
+		w := a.sendWebhook(t, "invoice.payment_failed", invoice)
+		expectStatus(t, w, http.StatusOK)
+	}
+	count, err := db.Where("stripe_invoice_id = ?", invoice.ID).Count(&models.PaymentFailure{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected one recorded attempt, got %d", count)
+	}
+
+	t.Run("unknown subscription", func(t *testing.T) {
+		w := a.sendWebhook(t, "invoice.payment_failed", &stripe.Invoice{
+			ID:           "in_unknown",
+			Subscription: &stripe.Subscription{ID: "sub_unknown"},
+			AttemptCount: 1,
+		})
+		expectStatus(t, w, http.StatusOK)
+	})
+
+	t.Run("billing portal on demand", func(t *testing.T) {
+		token := testToken(t, userID, "user@example.com")
+		sessions := a.stripe.Calls("NewBillingPortalSession")
+
+		w := a.request(t, http.MethodGet, "/v1/me/subscription-status", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		if a.stripe.Calls("NewBillingPortalSession") != sessions {
+			t.Error("expected no billing portal session without fix_payment_url")
+		}
+
+		w = a.request(t, http.MethodGet, "/v1/me/subscription-status?fix_payment_url=true", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		dunning, _ := decode(t, w)["dunning"].(map[string]interface{})
+		if dunning["fix_payment_url"] == nil || a.stripe.Calls("NewBillingPortalSession") != sessions+1 {
+			t.Errorf("expected a billing portal session, got %v", dunning)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyKeyTTL is how long responses are replayed
+	idempotencyKeyTTL = 24 * time.Hour
+	// idempotencyProcessingTimeout is how long a request may hold its key,
+	// after which the process is considered gone and the key released
+	idempotencyProcessingTimeout = 5 * time.Minute
+	// maxIdempotentBodySize limits the size of the fingerprinted request bodies
+	maxIdempotentBodySize = 1 << 20
+)
+
+// responseRecorder copies the response written by a handler
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent is middleware that honours the Idempotency-Key header: the first
+// response is stored and replayed for retries with the same key. A retry with
+// another request body is rejected, as is a retry sent while the first request
+// is still being handled. It must be wrapped by an authentication middleware,
+// and must not wrap handlers whose responses hold secrets.
+func (a *API) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			badRequestError(w, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			badRequestError(w, "Invalid request body")
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			sendJSON(w, http.StatusRequestEntityTooLarge, &Error{
+				Code:    http.StatusRequestEntityTooLarge,
+				Message: "Request body too large",
+			})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		caller := "anonymous"
+		if principal := getPrincipal(r.Context()); principal != nil {
+			caller = principal.Caller()
+		}
+
+		record := &models.IdempotencyKey{
+			Caller:      caller,
+			Key:         key,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			Fingerprint: requestFingerprint(r.Method, r.URL.Path, body),
+		}
+
+		created, err := a.claimIdempotencyKey(record)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to store idempotency key")
+			internalServerError(w, r, "Failed to check idempotency key")
+			return
+		}
+
+		if !created {
+			existing, err := models.FindIdempotencyKey(a.db, caller, key)
+			if err != nil || existing == nil {
+				internalServerError(w, r, "Failed to check idempotency key")
+				return
+			}
+			replayIdempotentResponse(w, existing, record.Fingerprint)
+			return
+		}
+
+		// Les erreurs serveur et les paniques ne sont pas rejouées, la clé est
+		// libérée pour que le client puisse réessayer
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if err := models.DeleteIdempotencyKey(a.db, record); err != nil {
+				logrus.WithError(err).Warn("Failed to release idempotency key")
+			}
+		}()
+
+		// Only the headers set by the handler are replayed, the others being
+		// set again by the middleware for each request
+		before := w.Header().Clone()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(withIdempotencyKey(r.Context(), caller+":"+key)))
+
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			return
+		}
+
+		if err := models.CompleteIdempotencyKey(a.db, record, rec.status, handlerHeaders(before, w.Header()), rec.body.String()); err != nil {
+			logrus.WithError(err).Error("Failed to store idempotent response")
+			return
+		}
+		completed = true
+	}
+}
+
+// handlerHeaders returns the headers added or changed since before
+func handlerHeaders(before, after http.Header) http.Header {
+	headers := http.Header{}
+	for name, values := range after {
+		if strings.Join(before[name], "\n") != strings.Join(values, "\n") {
+			headers[name] = values
+		}
+	}
+	return headers
+}
+
+// claimIdempotencyKey stores the key in the processing state, replacing a key
+// used so long ago that its response is no longer replayed, or left processing
+// by a process that crashed or was killed
+func (a *API) claimIdempotencyKey(record *models.IdempotencyKey) (bool, error) {
+	created := false
+	err := a.db.Transaction(func(tx *storage.Connection) error {
+		existing, err := models.FindIdempotencyKey(tx, record.Caller, record.Key)
+		if err != nil {
+			return err
+		}
+		if existing != nil && (time.Since(existing.CreatedAt) > idempotencyKeyTTL ||
+			existing.Status == models.IdempotencyKeyProcessing && time.Since(existing.UpdatedAt) > idempotencyProcessingTimeout) {
+			if err := models.DeleteIdempotencyKey(tx, existing); err != nil {
+				return err
+			}
+		}
+
+		created, err = models.CreateIdempotencyKey(tx, record)
+		return err
+	})
+	return created, err
+}
+
+// replayIdempotentResponse answers a retry with the stored response
+func replayIdempotentResponse(w http.ResponseWriter, existing *models.IdempotencyKey, fingerprint string) {
+	if existing.Fingerprint != fingerprint {
+		sendJSON(w, http.StatusUnprocessableEntity, &Error{
+			Code:    http.StatusUnprocessableEntity,
+			Message: "Idempotency-Key was already used with another request",
+		})
+		return
+	}
+
+	if existing.Status != models.IdempotencyKeyCompleted {
+		sendJSON(w, http.StatusConflict, &Error{
+			Code:    http.StatusConflict,
+			Message: "A request with this Idempotency-Key is still being processed",
+		})
+		return
+	}
+
+	headers := http.Header{}
+	if existing.ResponseHeaders != "" {
+		if err := json.Unmarshal([]byte(existing.ResponseHeaders), &headers); err != nil {
+			logrus.WithError(err).Warn("Failed to decode stored response headers")
+		}
+	}
+	for name, values := range headers {
+		w.Header()[name] = values
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.ResponseCode)
+	w.Write([]byte(existing.ResponseBody))
+}
+
+// requestFingerprint identifies a request by its method, path and body
+func requestFingerprint(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setStripeIdempotencyKey derives the idempotency key of a Stripe call from
+// the Idempotency-Key of the request, so that a replayed request never makes
+// the same Stripe call twice. Nothing is set when the request has no key.
+func setStripeIdempotencyKey(ctx context.Context, params *stripe.Params, operation string) {
+	key := getIdempotencyKey(ctx)
+	if key == "" {
+		return
+	}
+	sum := sha256.Sum256([]byte(key + ":" + operation))
+	params.SetIdempotencyKey(hex.EncodeToString(sum[:]))
+}
+
+// sweepIdempotencyKeys deletes the expired idempotency keys every hour until
+// ctx is done
+func (a *API) sweepIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := models.DeleteIdempotencyKeysBefore(a.db, time.Now().Add(-idempotencyKeyTTL)); err != nil {
+				logrus.WithError(err).Warn("Failed to delete expired idempotency keys")
+			}
+		}
+	}
+}
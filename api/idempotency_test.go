@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+)
+
+// idempotentRequest sends a request with an Idempotency-Key to the handler
+// wrapped by the idempotent middleware
+func idempotentRequest(a *testAPI, handler http.HandlerFunc, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/things", bytes.NewReader([]byte(`{"name":"thing"}`)))
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-Id", key)
+	a.idempotent(handler)(w, r)
+	return w
+}
+
+func TestIdempotencyReplaysHeaders(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	key := uuid.Must(uuid.NewV4()).String()
+
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/things/1")
+		w.Header().Set("Content-Type", "application/vnd.thing+json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	}
+
+	first := idempotentRequest(a, handler, key)
+	expectStatus(t, first, http.StatusCreated)
+
+	retry := idempotentRequest(a, handler, key)
+	expectStatus(t, retry, http.StatusCreated)
+	if calls != 1 {
+		t.Errorf("expected the handler to be called once, got %d", calls)
+	}
+	if got := retry.Header().Get("Location"); got != "/things/1" {
+		t.Errorf("expected the Location header to be replayed, got %q", got)
+	}
+	if got := retry.Header().Get("Content-Type"); got != "application/vnd.thing+json" {
+		t.Errorf("expected the Content-Type header to be replayed, got %q", got)
+	}
+	if got := retry.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("expected the response to be replayed, got %q", got)
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the same body, got %s and %s", first.Body.String(), retry.Body.String())
+	}
+
+	// The headers set by the middleware are not stored
+	stored, err := models.FindIdempotencyKey(db, "anonymous", key)
+	if err != nil || stored == nil {
+		t.Fatalf("expected the key to be stored, got %v (%v)", stored, err)
+	}
+	if bytes.Contains([]byte(stored.ResponseHeaders), []byte("X-Request-Id")) {
+		t.Errorf("expected only the handler headers to be stored, got %s", stored.ResponseHeaders)
+	}
+}
+
+func TestIdempotencyPanicReleasesKey(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	key := uuid.Must(uuid.NewV4()).String()
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to be propagated")
+			}
+		}()
+		idempotentRequest(a, func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}, key)
+	}()
+
+	if stored, err := models.FindIdempotencyKey(db, "anonymous", key); err != nil || stored != nil {
+		t.Fatalf("expected the key to be released, got %v (%v)", stored, err)
+	}
+
+	w := idempotentRequest(a, func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}, key)
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestIdempotencyReclaimsStaleKey(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	key := uuid.Must(uuid.NewV4()).String()
+
+	// Laissée en cours de traitement par un processus arrêté
+	record := &models.IdempotencyKey{Caller: "anonymous", Key: key, Method: http.MethodPost, Path: "/things", Fingerprint: requestFingerprint(http.MethodPost, "/things", []byte(`{"name":"thing"}`))}
+	if created, err := models.CreateIdempotencyKey(db, record); err != nil || !created {
+		t.Fatalf("expected the key to be stored, got %v (%v)", created, err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+	expectStatus(t, idempotentRequest(a, ok, key), http.StatusConflict)
+
+	stale := time.Now().Add(-idempotencyProcessingTimeout - time.Minute)
+	if err := db.RawQuery("UPDATE stripe_idempotency_keys SET updated_at = ? WHERE id = ?", stale, record.ID).Exec(); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, idempotentRequest(a, ok, key), http.StatusOK)
+
+	stored, err := models.FindIdempotencyKey(db, "anonymous", key)
+	if err != nil || stored == nil || stored.Status != models.IdempotencyKeyCompleted {
+		t.Errorf("expected the key to be reclaimed and completed, got %+v (%v)", stored, err)
+	}
+}
+
+func TestCreateAPIKeyIsNotReplayed(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	body := map[string]interface{}{"name": "billing", "scopes": []string{ScopeSubscriptionsRead}}
+
+	// The secret is only returned once and must not be stored for replays
+	first := a.request(t, http.MethodPost, "/admin/api-keys", testOperatorToken, body, "Idempotency-Key", "api-key-1")
+	expectStatus(t, first, http.StatusCreated)
+	retry := a.request(t, http.MethodPost, "/admin/api-keys", testOperatorToken, body, "Idempotency-Key", "api-key-1")
+	expectStatus(t, retry, http.StatusCreated)
+
+	if retry.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("expected the API key creation not to be replayed")
+	}
+	if decode(t, first)["key"] == decode(t, retry)["key"] {
+		t.Error("expected two API keys")
+	}
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gostripe/billing"
+	"gostripe/gateway"
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// importPageSize is the number of Stripe customers fetched at once
+const importPageSize = 100
+
+// importPaymentMethodTypes are the types of payment methods imported
+var importPaymentMethodTypes = []string{"card", "sepa_debit"}
+
+// ImportOptions configures an import of Stripe customers
+type ImportOptions struct {
+	// Name identifies the checkpoint of the import
+	Name string
+	// UsersByEmail links the customers without user_id metadata to users
+	UsersByEmail map[string]uuid.UUID
+	// Restart ignores the checkpoint of an unfinished import
+	Restart bool
+}
+
+// ImportReport sums up an import run
+type ImportReport struct {
+	Name              string            `json:"name"`
+	ResumedAfter      string            `json:"resumed_after,omitempty"`
+	CustomersImported int               `json:"customers_imported"`
+	CustomersSkipped  int               `json:"customers_skipped"`
+	Subscriptions     int               `json:"subscriptions"`
+	Invoices          int               `json:"invoices"`
+	PaymentMethods    int               `json:"payment_methods"`
+	Skipped           []SkippedCustomer `json:"skipped"`
+}
+
+// SkippedCustomer is a Stripe customer that could not be linked to a user
+type SkippedCustomer struct {
+	StripeID string `json:"stripe_id"`
+	Email    string `json:"email"`
+	Reason   string `json:"reason"`
+}
+
+// Import links the Stripe customers to users and stores their subscriptions,
+// invoices and payment methods. A customer is linked through the user_id set
+// in its metadata by GoStripe, or else through its email. The progress is
+// saved after each customer, so that an interrupted import resumes where it
+// stopped.
+func Import(db *storage.Connection, gw gateway.Stripe, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{Name: opts.Name, Skipped: []SkippedCustomer{}}
+
+	checkpoint, err := models.FindImportCheckpoint(db, opts.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get import checkpoint: %w", err)
+	}
+	if checkpoint == nil || checkpoint.CompletedAt != nil || opts.Restart {
+		checkpoint = &models.ImportCheckpoint{Name: opts.Name, StartedAt: time.Now()}
+	}
+	report.ResumedAfter = checkpoint.LastStripeID
+
+	for {
+		params := &stripe.CustomerListParams{}
+		params.Limit = stripe.Int64(importPageSize)
+		if checkpoint.LastStripeID != "" {
+			params.StartingAfter = stripe.String(checkpoint.LastStripeID)
+		}
+		customers, err := gw.ListCustomers(params, importPageSize)
+		if err != nil {
+			return report, fmt.Errorf("failed to list Stripe customers: %w", err)
+		}
+
+		for _, c := range customers {
+			if err := importCustomer(db, gw, c, opts, checkpoint, report); err != nil {
+				return report, fmt.Errorf("failed to import customer %s: %w", c.ID, err)
+			}
+		}
+
+		if len(customers) < importPageSize {
+			break
+		}
+	}
+
+	now := time.Now()
+	checkpoint.CompletedAt = &now
+	if err := models.SaveImportCheckpoint(db, checkpoint); err != nil {
+		return report, fmt.Errorf("failed to save import checkpoint: %w", err)
+	}
+	return report, nil
+}
+
+// importCustomer stores a Stripe customer and what belongs to it, and moves
+// the checkpoint past it, in a single transaction
+func importCustomer(db *storage.Connection, gw gateway.Stripe, c *stripe.Customer, opts ImportOptions, checkpoint *models.ImportCheckpoint, report *ImportReport) error {
+	subscriptions, err := gw.ListSubscriptions(&stripe.SubscriptionListParams{Customer: c.ID, Status: "all"}, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	invoices, err := gw.ListInvoices(&stripe.InvoiceListParams{Customer: stripe.String(c.ID)}, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list invoices: %w", err)
+	}
+	var methods []*stripe.PaymentMethod
+	for _, t := range importPaymentMethodTypes {
+		m, err := gw.ListPaymentMethods(&stripe.PaymentMethodListParams{Customer: stripe.String(c.ID), Type: stripe.String(t)}, 0)
+		if err != nil {
+			return fmt.Errorf("failed to list payment methods: %w", err)
+		}
+		methods = append(methods, m...)
+	}
+
+	next := *checkpoint
+	next.LastStripeID = c.ID
+	counts := ImportReport{}
+	var skipped *SkippedCustomer
+
+	err = db.Transaction(func(tx *storage.Connection) error {
+		dbCustomer, reason, err := linkCustomer(tx, c, opts.UsersByEmail)
+		if err != nil {
+			return err
+		}
+		if dbCustomer == nil {
+			next.CustomersSkipped++
+			skipped = &SkippedCustomer{StripeID: c.ID, Email: c.Email, Reason: reason}
+			return models.SaveImportCheckpoint(tx, &next)
+		}
+
+		for _, s := range subscriptions {
+			if _, err := billing.UpsertSubscription(tx, dbCustomer.ID, s); err != nil {
+				return err
+			}
+			counts.Subscriptions++
+		}
+
+		for _, invoice := range invoices {
+			if err := upsertInvoice(tx, invoice); err != nil {
+				return err
+			}
+			counts.Invoices++
+		}
+
+		defaultMethod := ""
+		if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+			defaultMethod = c.InvoiceSettings.DefaultPaymentMethod.ID
+		}
+		for _, pm := range methods {
+			if err := upsertPaymentMethod(tx, dbCustomer.ID, pm, pm.ID == defaultMethod); err != nil {
+				return err
+			}
+			counts.PaymentMethods++
+		}
+
+		next.CustomersImported++
+		return models.SaveImportCheckpoint(tx, &next)
+	})
+	if err != nil {
+		return err
+	}
+
+	*checkpoint = next
+	if skipped != nil {
+		logrus.WithFields(logrus.Fields{"stripe_customer_id": c.ID, "reason": skipped.Reason}).Info("Skipped Stripe customer")
+		report.CustomersSkipped++
+		report.Skipped = append(report.Skipped, *skipped)
+		return nil
+	}
+	report.CustomersImported++
+	report.Subscriptions += counts.Subscriptions
+	report.Invoices += counts.Invoices
+	report.PaymentMethods += counts.PaymentMethods
+	return nil
+}
+
+// linkCustomer returns the local customer of a Stripe customer, creating it
+// when the user can be found. The reason is set when it cannot.
+func linkCustomer(conn *storage.Connection, c *stripe.Customer, usersByEmail map[string]uuid.UUID) (*models.Customer, string, error) {
+	dbCustomer, err := models.FindCustomerByStripeID(conn, c.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get customer: %w", err)
+	}
+
+	if dbCustomer == nil {
+		userID, err := uuid.FromString(c.Metadata["user_id"])
+		if err != nil {
+			var ok bool
+			if userID, ok = usersByEmail[strings.ToLower(c.Email)]; !ok {
+				return nil, "no user_id in the metadata and no user with this email", nil
+			}
+		}
+
+		existing, err := models.FindCustomerByUserID(conn, userID)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get customer: %w", err)
+		}
+		if existing != nil {
+			return nil, fmt.Sprintf("user %s already has the customer %s", userID, existing.StripeID), nil
+		}
+
+		if dbCustomer, err = models.CreateCustomer(conn, userID, c.ID, c.Email, c.Name); err != nil {
+			return nil, "", fmt.Errorf("failed to create customer: %w", err)
+		}
+	}
+
+	applyStripeCustomer(dbCustomer, c)
+	if err := models.UpdateCustomer(conn, dbCustomer); err != nil {
+		return nil, "", fmt.Errorf("failed to update customer: %w", err)
+	}
+	return dbCustomer, "", nil
+}
+
+// upsertPaymentMethod stores a payment method of a customer
+func upsertPaymentMethod(conn *storage.Connection, customerID uuid.UUID, pm *stripe.PaymentMethod, isDefault bool) error {
+	method, err := models.FindPaymentMethodByStripeID(conn, pm.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get payment method: %w", err)
+	}
+	if method == nil {
+		method = &models.PaymentMethod{StripeID: pm.ID}
+	}
+
+	method.CustomerID = customerID
+	method.Type = string(pm.Type)
+	method.IsDefault = isDefault
+	if pm.Card != nil {
+		method.CardBrand = string(pm.Card.Brand)
+		method.CardLast4 = pm.Card.Last4
+		method.CardExpMonth = int(pm.Card.ExpMonth)
+		method.CardExpYear = int(pm.Card.ExpYear)
+	} else if pm.SepaDebit != nil {
+		method.CardLast4 = pm.SepaDebit.Last4
+	}
+
+	if method.ID == uuid.Nil {
+		err = models.CreatePaymentMethod(conn, method)
+	} else {
+		err = models.UpdatePaymentMethod(conn, method)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save payment method: %w", err)
+	}
+	return nil
+}
+
+// ReadUserMapping reads a CSV file of emails and user IDs, with an optional
+// header line
+func ReadUserMapping(r io.Reader) (map[string]uuid.UUID, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	users := map[string]uuid.UUID{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return users, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		userID, err := uuid.FromString(strings.TrimSpace(record[1]))
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: invalid user ID %q", line, record[1])
+		}
+		users[strings.ToLower(strings.TrimSpace(record[0]))] = userID
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestReadUserMapping(t *testing.T) {
+	userID := uuid.Must(uuid.NewV4())
+
+	users, err := ReadUserMapping(strings.NewReader("email,user_id\nJeanne@Example.com, " + userID.String() + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users["jeanne@example.com"] != userID {
+		t.Errorf("unexpected users %v", users)
+	}
+
+	for _, csv := range []string{"b@example.com," + userID.String() + "\na@example.com,nope", "a@example.com," + userID.String() + ",extra"} {
+		if _, err := ReadUserMapping(strings.NewReader(csv)); err == nil {
+			t.Errorf("expected an error for %q", csv)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+
+	// Client créé par GoStripe, avec un abonnement payé et une carte
+	withMetadata := uuid.Must(uuid.NewV4())
+	linked, err := a.stripe.NewCustomer(&stripe.CustomerParams{
+		Email:  stripe.String("linked@example.com"),
+		Params: stripe.Params{Metadata: map[string]string{"user_id": withMetadata.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := paidCheckoutSession(t, a, withMetadata, linked.ID, "price_basic")
+	card := a.stripe.AddPaymentMethod(linked.ID, stripe.PaymentMethodCardBrandVisa, "4242")
+
+	// Client créé hors de GoStripe, retrouvé par son email
+	byEmail := uuid.Must(uuid.NewV4())
+	legacy, err := a.stripe.NewCustomer(&stripe.CustomerParams{Email: stripe.String("Legacy@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknown, err := a.stripe.NewCustomer(&stripe.CustomerParams{Email: stripe.String("unknown@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ImportOptions{Name: "default", UsersByEmail: map[string]uuid.UUID{"legacy@example.com": byEmail}}
+
+	t.Run("interrupted", func(t *testing.T) {
+		a.stripe.FailNext("ListInvoices", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError})
+		if _, err := Import(db, a.stripe, opts); err == nil {
+			t.Fatal("expected an error")
+		}
+		checkpoint, err := models.FindImportCheckpoint(db, "default")
+		if err != nil || checkpoint != nil {
+			t.Errorf("expected no progress, got %+v (%v)", checkpoint, err)
+		}
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		// Les clients sont listés du plus récent au plus ancien
+		err := models.SaveImportCheckpoint(db, &models.ImportCheckpoint{Name: "default", LastStripeID: unknown.ID, CustomersSkipped: 1, StartedAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Import(db, a.stripe, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ResumedAfter != unknown.ID || report.CustomersImported != 2 || report.CustomersSkipped != 0 {
+			t.Errorf("unexpected report %+v", report)
+		}
+		if report.Subscriptions != 1 || report.Invoices != 1 || report.PaymentMethods != 1 {
+			t.Errorf("unexpected report %+v", report)
+		}
+
+		checkpoint, err := models.FindImportCheckpoint(db, "default")
+		if err != nil || checkpoint == nil || checkpoint.CompletedAt == nil || checkpoint.CustomersImported != 2 || checkpoint.CustomersSkipped != 1 {
+			t.Errorf("expected a completed checkpoint, got %+v (%v)", checkpoint, err)
+		}
+	})
+
+	t.Run("imported rows", func(t *testing.T) {
+		dbCustomer, err := models.FindCustomerByUserID(db, withMetadata)
+		if err != nil || dbCustomer == nil || dbCustomer.StripeID != linked.ID {
+			t.Fatalf("expected the customer to be linked, got %+v (%v)", dbCustomer, err)
+		}
+		subscription, err := models.FindSubscriptionByStripeID(db, session.Subscription.ID)
+		if err != nil || subscription == nil || subscription.CustomerID != dbCustomer.ID || subscription.PriceID != "price_basic" {
+			t.Errorf("expected the subscription, got %+v (%v)", subscription, err)
+		}
+		invoices, err := models.FindInvoicesByCustomerID(db, dbCustomer.ID)
+		if err != nil || len(invoices) != 1 || invoices[0].Status != "paid" || !invoices[0].SubscriptionID.Valid {
+			t.Errorf("expected a paid invoice, got %+v (%v)", invoices, err)
+		}
+		methods, err := models.FindPaymentMethodsByCustomerID(db, dbCustomer.ID)
+		if err != nil || len(methods) != 1 || methods[0].StripeID != card.ID || !methods[0].IsDefault || methods[0].CardLast4 != "4242" {
+			t.Errorf("expected the default card, got %+v (%v)", methods, err)
+		}
+
+		dbCustomer, err = models.FindCustomerByUserID(db, byEmail)
+		if err != nil || dbCustomer == nil || dbCustomer.StripeID != legacy.ID {
+			t.Errorf("expected the customer to be linked by email, got %+v (%v)", dbCustomer, err)
+		}
+	})
+
+	t.Run("run again", func(t *testing.T) {
+		report, err := Import(db, a.stripe, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.ResumedAfter != "" || report.CustomersImported != 2 || len(report.Skipped) != 1 || report.Skipped[0].StripeID != unknown.ID {
+			t.Errorf("unexpected report %+v", report)
+		}
+
+		dbCustomer, err := models.FindCustomerByUserID(db, withMetadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if invoices, err := models.FindInvoicesByCustomerID(db, dbCustomer.ID); err != nil || len(invoices) != 1 {
+			t.Errorf("expected the invoice not to be duplicated, got %+v (%v)", invoices, err)
+		}
+	})
+}
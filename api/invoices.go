@@ -0,0 +1,149 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// InvoiceResponse is an invoice as returned by the API
+type InvoiceResponse struct {
+	ID               uuid.UUID    `json:"id"`
+	StripeID         string       `json:"stripe_id"`
+	Number           string       `json:"number"`
+	Status           string       `json:"status"`
+	Subtotal         models.Money `json:"subtotal"`
+	Tax              models.Money `json:"tax"`
+	Total            models.Money `json:"total"`
+	AmountDue        models.Money `json:"amount_due"`
+	AmountPaid       models.Money `json:"amount_paid"`
+	HostedInvoiceURL string       `json:"hosted_invoice_url"`
+	PeriodStart      *time.Time   `json:"period_start,omitempty"`
+	PeriodEnd        *time.Time   `json:"period_end,omitempty"`
+	CreatedAt        time.Time    `json:"created_at"`
+}
+
+// InvoiceListResponse lists the invoices of a customer, the latest first
+type InvoiceListResponse struct {
+	Invoices []*InvoiceResponse `json:"invoices"`
+}
+
+func newInvoiceResponse(invoice *models.Invoice) *InvoiceResponse {
+	return &InvoiceResponse{
+		ID:               invoice.ID,
+		StripeID:         invoice.StripeID,
+		Number:           invoice.Number,
+		Status:           invoice.Status,
+		Subtotal:         models.NewMoney(invoice.Subtotal, invoice.Currency),
+		Tax:              models.NewMoney(invoice.Tax, invoice.Currency),
+		Total:            models.NewMoney(invoice.Total, invoice.Currency),
+		AmountDue:        models.NewMoney(invoice.AmountDue, invoice.Currency),
+		AmountPaid:       models.NewMoney(invoice.AmountPaid, invoice.Currency),
+		HostedInvoiceURL: invoice.HostedInvoiceURL,
+		PeriodStart:      invoice.PeriodStart,
+		PeriodEnd:        invoice.PeriodEnd,
+		CreatedAt:        invoice.CreatedAt,
+	}
+}
+
+// GetInvoices lists the invoices of the current user
+func (a *API) GetInvoices(w http.ResponseWriter, r *http.Request) {
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
+		return
+	}
+	userID := principal.UserID
+
+	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get customer")
+		return
+	}
+
+	invoices := []*InvoiceResponse{}
+	if dbCustomer != nil {
+		dbInvoices, err := models.FindInvoicesByCustomerID(a.db, dbCustomer.ID)
+		if err != nil {
+			internalServerError(w, r, "Failed to get invoices")
+			return
+		}
+		for i := range dbInvoices {
+			invoices = append(invoices, newInvoiceResponse(&dbInvoices[i]))
+		}
+	}
+
+	sendJSON(w, http.StatusOK, &InvoiceListResponse{Invoices: invoices})
+}
+
+// upsertInvoice stores the amounts, including taxes, of a Stripe invoice
+func upsertInvoice(conn *storage.Connection, stripeInvoice *stripe.Invoice) error {
+	if stripeInvoice.Customer == nil {
+		return nil
+	}
+
+	dbCustomer, err := models.FindCustomerByStripeID(conn, stripeInvoice.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get customer: %w", err)
+	}
+
+	if dbCustomer == nil {
+		logrus.WithField("stripe_invoice_id", stripeInvoice.ID).Info("Ignoring invoice of unknown customer")
+		return nil
+	}
+
+	invoice, err := models.FindInvoiceByStripeID(conn, stripeInvoice.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get invoice: %w", err)
+	}
+
+	if invoice == nil {
+		invoice = &models.Invoice{CustomerID: dbCustomer.ID, StripeID: stripeInvoice.ID}
+	}
+
+	if stripeInvoice.Subscription != nil {
+		subscription, err := models.FindSubscriptionByStripeID(conn, stripeInvoice.Subscription.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if subscription != nil {
+			invoice.SubscriptionID = uuid.NullUUID{UUID: subscription.ID, Valid: true}
+		}
+	}
+
+	invoice.Number = stripeInvoice.Number
+	invoice.Status = string(stripeInvoice.Status)
+	invoice.Currency = string(stripeInvoice.Currency)
+	invoice.Subtotal = stripeInvoice.Subtotal
+	invoice.Tax = stripeInvoice.Tax
+	invoice.Total = stripeInvoice.Total
+	invoice.AmountDue = stripeInvoice.AmountDue
+	invoice.AmountPaid = stripeInvoice.AmountPaid
+	invoice.HostedInvoiceURL = stripeInvoice.HostedInvoiceURL
+	if stripeInvoice.PeriodStart > 0 {
+		periodStart := time.Unix(stripeInvoice.PeriodStart, 0)
+		invoice.PeriodStart = &periodStart
+	}
+	if stripeInvoice.PeriodEnd > 0 {
+		periodEnd := time.Unix(stripeInvoice.PeriodEnd, 0)
+		invoice.PeriodEnd = &periodEnd
+	}
+
+	if invoice.ID == uuid.Nil {
+		err = models.CreateInvoice(conn, invoice)
+	} else {
+		err = models.UpdateInvoice(conn, invoice)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save invoice: %w", err)
+	}
+
+	return nil
+}
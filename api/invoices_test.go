@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestInvoices(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	token := testToken(t, userID, "user@example.com")
+
+	t.Run("no customer", func(t *testing.T) {
+		w := a.request(t, http.MethodGet, "/invoices", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		if invoices := decode(t, w)["invoices"].([]interface{}); len(invoices) != 0 {
+			t.Errorf("expected no invoices, got %v", invoices)
+		}
+	})
+
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+	dbSubscription := seedSubscription(t, a, dbCustomer, "price_basic", stripe.SubscriptionStatusActive)
+
+	invoice := &stripe.Invoice{
+		ID:           "in_test",
+		Customer:     &stripe.Customer{ID: dbCustomer.StripeID},
+		Subscription: &stripe.Subscription{ID: dbSubscription.StripeID},
+		Number:       "GS-0001",
+		Currency:     "eur",
+		Subtotal:     1000,
+		Tax:          200,
+		Total:        1200,
+		AmountDue:    1200,
+	}
+
+	events := []struct {
+		name       string
+		eventType  string
+		status     stripe.InvoiceStatus
+		amountPaid int64
+	}{
+		{"finalized", "invoice.finalized", stripe.InvoiceStatusOpen, 0},
+		{"paid", "invoice.paid", stripe.InvoiceStatusPaid, 1200},
+	}
+
+	for _, e := range events {
+		t.Run(e.name, func(t *testing.T) {
+			invoice.Status = e.status
+			invoice.AmountPaid = e.amountPaid
+			w := a.sendWebhook(t, e.eventType, invoice)
+			expectStatus(t, w, http.StatusOK)
+
+			stored, err := models.FindInvoiceByStripeID(db, invoice.ID)
+			if err != nil || stored == nil {
+				t.Fatalf("expected the invoice to be stored, got %v (%v)", stored, err)
+			}
+			if stored.Status != string(e.status) || stored.AmountPaid != e.amountPaid || !stored.SubscriptionID.Valid {
+				t.Errorf("unexpected invoice %+v", stored)
+			}
+		})
+	}
+
+	t.Run("invoice of an unknown customer", func(t *testing.T) {
+		w := a.sendWebhook(t, "invoice.finalized", &stripe.Invoice{ID: "in_other", Customer: &stripe.Customer{ID: "cus_unknown"}})
+		expectStatus(t, w, http.StatusOK)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		w := a.request(t, http.MethodGet, "/invoices", token, nil)
+		expectStatus(t, w, http.StatusOK)
+		invoices := decode(t, w)["invoices"].([]interface{})
+		if len(invoices) != 1 {
+			t.Fatalf("expected 1 invoice, got %v", invoices)
+		}
+		if number := invoices[0].(map[string]interface{})["number"]; number != "GS-0001" {
+			t.Errorf("expected invoice GS-0001, got %v", number)
+		}
+	})
+}
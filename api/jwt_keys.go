@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gostripe/conf"
+
+	"github.com/sirupsen/logrus"
+)
+
+// minJWKSRefreshInterval limits how often an unknown key ID triggers a fetch
+const minJWKSRefreshInterval = 30 * time.Second
+
+// jsonWebKey is a single key of a JWKS document
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keyStore holds the public keys used to verify asymmetric tokens, loaded from
+// PEM files and from a JWKS URL
+type keyStore struct {
+	mu        sync.RWMutex
+	files     map[string]interface{}
+	jwks      map[string]interface{}
+	jwksURL   string
+	lastFetch time.Time
+	client    *http.Client
+}
+
+// newKeyStore loads the configured PEM files and fetches the JWKS document.
+// An unreachable JWKS URL is not fatal: the store starts without those keys
+// and fetches them again on the refresh interval.
+func newKeyStore(config *conf.JWTConfiguration) (*keyStore, error) {
+	s := &keyStore{
+		files:   map[string]interface{}{},
+		jwks:    map[string]interface{}{},
+		jwksURL: config.JWKSURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, file := range config.PublicKeyFiles {
+		key, err := loadPublicKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		s.files[kid] = key
+	}
+
+	if s.jwksURL != "" {
+		if err := s.refresh(); err != nil {
+			logrus.WithError(err).Warn("Failed to fetch JWKS, retrying on the refresh interval")
+		}
+	}
+
+	return s, nil
+}
+
+// start refreshes the JWKS document in the background until ctx is done
+func (s *keyStore) start(ctx context.Context, interval time.Duration) {
+	if s.jwksURL == "" || interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.refresh(); err != nil {
+					logrus.WithError(err).Warn("Failed to refresh JWKS")
+				}
+			}
+		}
+	}()
+}
+
+// lookup returns the key with the given ID. Tokens without a key ID are only
+// accepted when a single key is configured.
+func (s *keyStore) lookup(kid string) (interface{}, error) {
+	if key, ok := s.find(kid); ok {
+		return key, nil
+	}
+
+	if kid != "" && s.jwksURL != "" && s.canRefresh() {
+		if err := s.refresh(); err != nil {
+			logrus.WithError(err).Warn("Failed to refresh JWKS")
+		}
+		if key, ok := s.find(kid); ok {
+			return key, nil
+		}
+	}
+
+	if kid == "" {
+		return nil, fmt.Errorf("token has no key ID and several keys are configured")
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", kid)
+}
+
+func (s *keyStore) find(kid string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if kid == "" {
+		if len(s.files)+len(s.jwks) != 1 {
+			return nil, false
+		}
+		for _, key := range s.files {
+			return key, true
+		}
+		for _, key := range s.jwks {
+			return key, true
+		}
+	}
+
+	if key, ok := s.jwks[kid]; ok {
+		return key, true
+	}
+	key, ok := s.files[kid]
+	return key, ok
+}
+
+func (s *keyStore) canRefresh() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.lastFetch) >= minJWKSRefreshInterval
+}
+
+// refresh fetches the JWKS document and replaces the cached keys
+func (s *keyStore) refresh() error {
+	s.mu.Lock()
+	s.lastFetch = time.Now()
+	s.mu.Unlock()
+
+	resp, err := s.client.Get(s.jwksURL)
+	if err != nil {
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logrus.WithError(err).WithField("kid", jwk.Kid).Warn("Skipping invalid JWKS key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	s.mu.Lock()
+	s.jwks = keys
+	s.mu.Unlock()
+
+	logrus.WithField("keys", len(keys)).Debug("Refreshed JWKS")
+	return nil
+}
+
+// publicKey decodes an RSA, EC or OKP (Ed25519) key
+func (k *jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+// loadPublicKeyFile reads a PEM encoded public key or certificate
+func loadPublicKeyFile(file string) (interface{}, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading public key %s: %w", file, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %s: %w", file, err)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key %s: %w", file, err)
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing public key %s: %w", file, err)
+		}
+		return key, nil
+	}
+}
+
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
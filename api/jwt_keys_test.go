@@ -0,0 +1,294 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys are generated once, RSA keys being slow to generate
+var testKeys = struct {
+	once    sync.Once
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	otherEC *ecdsa.PrivateKey
+}{}
+
+func generateTestKeys(t *testing.T) {
+	t.Helper()
+	testKeys.once.Do(func() {
+		var err error
+		if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+		if testKeys.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+		if _, testKeys.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			panic(err)
+		}
+		if testKeys.otherEC, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+	})
+}
+
+// jwksServer serves a JWKS document that tests can replace
+type jwksServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	keys   []jsonWebKey
+}
+
+func newJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	t.Helper()
+
+	s := &jwksServer{status: http.StatusOK, keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+	s.keys = keys
+}
+
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kid: kid, Kty: "RSA", Use: "sig", N: base64URL(key.N.Bytes()), E: base64URL(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) jsonWebKey {
+	return jsonWebKey{Kid: kid, Kty: "EC", Crv: "P-256", X: base64URL(key.X.Bytes()), Y: base64URL(key.Y.Bytes())}
+}
+
+func edJWK(kid string, key ed25519.PublicKey) jsonWebKey {
+	return jsonWebKey{Kid: kid, Kty: "OKP", Crv: "Ed25519", X: base64URL(key)}
+}
+
+// signTestToken signs a valid token for a user with an asymmetric key
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, userID uuid.UUID) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, &JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID.String(),
+			Audience:  jwt.ClaimStrings{"obex"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// writePEM writes a PEM block to a file of dir named after the key ID
+func writePEM(t *testing.T, dir, kid, blockType string, der []byte) string {
+	t.Helper()
+
+	file := filepath.Join(dir, kid+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadPublicKeyFile(t *testing.T) {
+	generateTestKeys(t)
+	dir := t.TempDir()
+
+	spki, err := x509.MarshalPKIXPublicKey(&testKeys.ec.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "gostripe test"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, testKeys.ed.Public(), testKeys.ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want interface{}
+	}{
+		{"PKIX public key", writePEM(t, dir, "pkix", "PUBLIC KEY", spki), &testKeys.ec.PublicKey},
+		{"PKCS #1 public key", writePEM(t, dir, "pkcs1", "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&testKeys.rsa.PublicKey)), &testKeys.rsa.PublicKey},
+		{"certificate", writePEM(t, dir, "cert", "CERTIFICATE", cert), testKeys.ed.Public()},
+		{"not PEM", garbage, nil},
+		{"invalid key", writePEM(t, dir, "invalid", "PUBLIC KEY", []byte("nope")), nil},
+		{"missing file", filepath.Join(dir, "missing.pem"), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := loadPublicKeyFile(tt.file)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("expected an error, got %T", key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.(interface{ Equal(crypto.PublicKey) bool }).Equal(tt.want) {
+				t.Errorf("unexpected key %T", key)
+			}
+		})
+	}
+}
+
+func TestAsymmetricJWT(t *testing.T) {
+	generateTestKeys(t)
+	server := newJWKSServer(t,
+		rsaJWK("rsa-1", &testKeys.rsa.PublicKey),
+		ecJWK("ec-1", &testKeys.ec.PublicKey),
+		edJWK("ed-1", testKeys.ed.Public().(ed25519.PublicKey)),
+		jsonWebKey{Kid: "enc-1", Kty: "RSA", Use: "enc"},
+	)
+
+	der, err := x509.MarshalPKIXPublicKey(&testKeys.otherEC.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writePEM(t, t.TempDir(), "file-1", "PUBLIC KEY", der)
+
+	a := newTestAPI(t, testConfig(t, map[string]string{
+		"JWT_ALGORITHMS":       "HS256,RS256,ES256,EdDSA",
+		"JWT_JWKS_URL":         server.URL,
+		"JWT_PUBLIC_KEY_FILES": file,
+	}), nil)
+	userID := uuid.Must(uuid.NewV4())
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"RS256 from the JWKS", signTestToken(t, jwt.SigningMethodRS256, "rsa-1", testKeys.rsa, userID), ""},
+		{"ES256 from the JWKS", signTestToken(t, jwt.SigningMethodES256, "ec-1", testKeys.ec, userID), ""},
+		{"EdDSA from the JWKS", signTestToken(t, jwt.SigningMethodEdDSA, "ed-1", testKeys.ed, userID), ""},
+		{"ES256 from a PEM file", signTestToken(t, jwt.SigningMethodES256, "file-1", testKeys.otherEC, userID), ""},
+		{"unknown key ID", signTestToken(t, jwt.SigningMethodES256, "ec-2", testKeys.ec, userID), "unknown key ID: ec-2"},
+		{"encryption key", signTestToken(t, jwt.SigningMethodRS256, "enc-1", testKeys.rsa, userID), "unknown key ID: enc-1"},
+		{"no key ID with several keys", signTestToken(t, jwt.SigningMethodES256, "", testKeys.ec, userID), "no key ID"},
+		{"algorithm of another key family", signTestToken(t, jwt.SigningMethodES256, "rsa-1", testKeys.ec, userID), "cannot verify ES256 tokens"},
+		{"algorithm not allowed", signTestToken(t, jwt.SigningMethodPS256, "rsa-1", testKeys.rsa, userID), "unexpected signing method"},
+		{"signed by another key", signTestToken(t, jwt.SigningMethodES256, "ec-1", testKeys.otherEC, userID), "signature is invalid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := a.parseJWT(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if claims.Subject != userID.String() {
+					t.Errorf("unexpected subject %s", claims.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	t.Run("unknown key ID refreshes the JWKS", func(t *testing.T) {
+		server.set(http.StatusOK, ecJWK("ec-2", &testKeys.otherEC.PublicKey))
+		token := signTestToken(t, jwt.SigningMethodES256, "ec-2", testKeys.otherEC, userID)
+
+		// Refreshes are rate limited
+		if _, err := a.parseJWT(token); err == nil {
+			t.Fatal("expected the JWKS not to be fetched again so soon")
+		}
+
+		a.jwtKeys.mu.Lock()
+		a.jwtKeys.lastFetch = time.Time{}
+		a.jwtKeys.mu.Unlock()
+		if _, err := a.parseJWT(token); err != nil {
+			t.Fatal(err)
+		}
+		// The keys removed from the JWKS are gone
+		if _, err := a.parseJWT(signTestToken(t, jwt.SigningMethodRS256, "rsa-1", testKeys.rsa, userID)); err == nil {
+			t.Error("expected the removed key to be refused")
+		}
+	})
+}
+
+func TestJWKSUnavailableAtStartup(t *testing.T) {
+	generateTestKeys(t)
+	server := newJWKSServer(t)
+	server.set(http.StatusServiceUnavailable)
+
+	a := newTestAPI(t, testConfig(t, map[string]string{
+		"JWT_ALGORITHMS":            "HS256,ES256",
+		"JWT_JWKS_URL":              server.URL,
+		"JWT_JWKS_REFRESH_INTERVAL": "20ms",
+	}), nil)
+	token := signTestToken(t, jwt.SigningMethodES256, "ec-1", testKeys.ec, uuid.Must(uuid.NewV4()))
+
+	w := a.request(t, http.MethodGet, "/v1/me/subscription-status", token, nil)
+	expectStatus(t, w, http.StatusUnauthorized)
+
+	// The keys are fetched on the refresh interval once the JWKS is back
+	server.set(http.StatusOK, ecJWK("ec-1", &testKeys.ec.PublicKey))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := a.parseJWT(token); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the JWKS to be fetched again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// keyUsage counts the verifications per purpose and key, e.g. "jwt.2024-01"
+	keyUsage = expvar.NewMap("key_usage")
+	// keyLastUsed holds the last time each key verified a request
+	keyLastUsed = expvar.NewMap("key_last_used")
+	// oldKeyUsage counts the verifications made with a key other than the
+	// current one, per purpose
+	oldKeyUsage = expvar.NewMap("old_key_usage")
+)
+
+// recordKeyUsage tracks which key verified a request, so operators know when
+// an old key is no longer used and can be removed
+func recordKeyUsage(purpose, keyID string, current bool) {
+	name := purpose + "." + keyID
+	keyUsage.Add(name, 1)
+
+	lastUsed := new(expvar.String)
+	lastUsed.Set(time.Now().UTC().Format(time.RFC3339))
+	keyLastUsed.Set(name, lastUsed)
+
+	log := logrus.WithFields(logrus.Fields{"purpose": purpose, "key_id": keyID})
+	if !current {
+		oldKeyUsage.Add(purpose, 1)
+		log.Info("Verified with a previous key, the rotation is not over")
+		return
+	}
+	log.Debug("Verified with the current key")
+}
+
+// Metrics exposes the process metrics, including key usage, as JSON
+func (a *API) Metrics(w http.ResponseWriter, r *http.Request) {
+	expvar.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"gostripe/models"
+	"gostripe/notify"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// notifyCustomer sends a notification to a customer. Failures are logged but
+// never fail the webhook.
+func (a *API) notifyCustomer(customer *models.Customer, n *notify.Notification) {
+	n.To = customer.Email
+	n.Name = customer.Name
+	if locales := customer.Locales(); n.Locale == "" && len(locales) > 0 {
+		n.Locale = locales[0]
+	}
+	if n.Locale == "" {
+		n.Locale = a.config.Notify.DefaultLocale
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := a.notifier.Notify(ctx, n); err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"event":       n.Event,
+			"customer_id": customer.ID,
+		}).Warn("Failed to send notification")
+	}
+}
+
+// notifyStripeCustomer sends a notification to the customer with the given Stripe ID
+func (a *API) notifyStripeCustomer(stripeCustomer *stripe.Customer, n *notify.Notification) {
+	if stripeCustomer == nil {
+		return
+	}
+
+	customer, err := models.FindCustomerByStripeID(a.db, stripeCustomer.ID)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to get customer for notification")
+		return
+	}
+
+	if customer == nil {
+		logrus.WithField("stripe_customer_id", stripeCustomer.ID).Info("Skipping notification for unknown customer")
+		return
+	}
+
+	a.notifyCustomer(customer, n)
+}
+
+// handleTrialWillEnd notifies the customer that their trial is ending
+func (a *API) handleTrialWillEnd(sub *stripe.Subscription) {
+	a.notifyStripeCustomer(sub.Customer, &notify.Notification{
+		Event: notify.EventTrialWillEnd,
+		Date:  time.Unix(sub.TrialEnd, 0),
+	})
+}
+
+// handleSubscriptionDeleted notifies the customer that their subscription has been canceled
+func (a *API) handleSubscriptionDeleted(sub *stripe.Subscription) {
+	endedAt := time.Now()
+	if sub.EndedAt > 0 {
+		endedAt = time.Unix(sub.EndedAt, 0)
+	}
+
+	a.notifyStripeCustomer(sub.Customer, &notify.Notification{
+		Event: notify.EventCancellation,
+		Date:  endedAt,
+	})
+}
+
+// notifyInvoice notifies the customer about a paid or failed invoice
+func (a *API) notifyInvoice(invoice *stripe.Invoice, event notify.Event, actionURL string) {
+	// Only subscription renewals are worth an email, not the first invoice
+	if event == notify.EventRenewal && invoice.BillingReason != stripe.InvoiceBillingReasonSubscriptionCycle {
+		return
+	}
+
+	date := time.Unix(invoice.PeriodEnd, 0)
+	if invoice.Lines != nil && len(invoice.Lines.Data) > 0 && invoice.Lines.Data[0].Period != nil {
+		date = time.Unix(invoice.Lines.Data[0].Period.End, 0)
+	}
+
+	amount := invoice.AmountDue
+	if event == notify.EventRenewal {
+		amount = invoice.AmountPaid
+	}
+
+	a.notifyStripeCustomer(invoice.Customer, &notify.Notification{
+		Event:     event,
+		Date:      date,
+		Amount:    models.NewMoney(amount, string(invoice.Currency)).String(),
+		ActionURL: actionURL,
+	})
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gostripe/models"
+	"gostripe/openapi"
+
+	"github.com/gofrs/uuid"
+)
+
+// schemas derives the schemas of the requests and responses from their types.
+// Request bodies are validated against them.
+var schemas = newSchemas()
+
+func newSchemas() *openapi.Registry {
+	r := openapi.NewRegistry()
+	r.Define(reflect.TypeOf(uuid.UUID{}), "", &openapi.Schema{Type: "string", Format: "uuid"})
+	r.Define(reflect.TypeOf(models.SubscriptionStatus("")), "", &openapi.Schema{Type: "string", Enum: []string{
+		string(models.SubscriptionStatusActive), string(models.SubscriptionStatusPastDue),
+		string(models.SubscriptionStatusCanceled), string(models.SubscriptionStatusIncomplete),
+		string(models.SubscriptionStatusIncompleteExpired), string(models.SubscriptionStatusTrialing),
+		string(models.SubscriptionStatusUnpaid),
+	}})
+	r.Define(reflect.TypeOf(models.AccessLevel("")), "", &openapi.Schema{Type: "string", Enum: []string{
+		string(models.AccessFull), string(models.AccessGrace), string(models.AccessRestricted), string(models.AccessSuspended),
+	}})
+
+	// Money has its own JSON encoding
+	r.Define(reflect.TypeOf(models.Money{}), "Money", &openapi.Schema{
+		Type:        "object",
+		Description: "An amount in the smallest unit of its currency, with its decimal value",
+		Properties: map[string]*openapi.Schema{
+			"amount":   {Type: "integer", Format: "int64"},
+			"currency": {Type: "string"},
+			"decimal":  {Type: "string"},
+		},
+		Required: []string{"amount", "currency", "decimal"},
+	})
+	return r
+}
+
+// decodeRequest decodes a JSON request body into v, a pointer to a request
+// struct, once it is valid against the schema of the struct. It sends a Bad
+// Request response and returns false otherwise.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		badRequestError(w, "Failed to read request body")
+		return false
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		badRequestError(w, "Invalid request body")
+		return false
+	}
+	if err := schemas.Validate(schemas.Schema(v), raw); err != nil {
+		badRequestError(w, err.Error())
+		return false
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		badRequestError(w, "Invalid request body")
+		return false
+	}
+	return true
+}
+
+// Authentication methods of the routes
+const (
+	authJWT      = "jwt"
+	authAPIKey   = "apiKey"
+	authAdmin    = "admin"
+	authOperator = "operator"
+)
+
+// route documents a route of the API. The routes of the /v1 API also
+// document the legacy path they replace.
+type route struct {
+	method     string
+	path       string
+	legacy     string
+	deprecated bool
+	id         string
+	summary    string
+	tag        string
+	auth       string
+	idempotent bool
+	params     []*openapi.Parameter
+	request    interface{}
+	status     int
+	response   interface{}
+}
+
+var fixPaymentURLParameter = &openapi.Parameter{
+	Name:        "fix_payment_url",
+	In:          "query",
+	Description: "Create a billing portal session when the invoice page is unknown",
+	Schema:      &openapi.Schema{Type: "boolean"},
+}
+
+var refreshParameter = &openapi.Parameter{
+	Name:        "refresh",
+	In:          "query",
+	Description: "Fetch the customer and the subscription from Stripe first",
+	Schema:      &openapi.Schema{Type: "boolean"},
+}
+
+// routes lists the routes of the API, in the order of the router
+var routes = []route{
+	{method: "GET", path: "/health", id: "healthCheck", summary: "Check the health of the API", tag: "system",
+		status: http.StatusOK, response: HealthResponse{}},
+	{method: "GET", path: "/openapi.json", id: "getOpenAPI", summary: "Get this document", tag: "system",
+		status: http.StatusOK},
+	{method: "GET", path: "/metrics", id: "getMetrics", summary: "Get the process metrics", tag: "system", auth: authOperator,
+		status: http.StatusOK, response: map[string]interface{}{}},
+	{method: "POST", path: "/webhooks", id: "handleWebhook", summary: "Receive a Stripe event", tag: "webhooks",
+		params: []*openapi.Parameter{{Name: "Stripe-Signature", In: "header", Required: true, Schema: &openapi.Schema{Type: "string"}}},
+		status: http.StatusOK, response: StatusResponse{}},
+
+	{method: "GET", path: "/v1/users/{user_id}/subscription-status", legacy: "/users/{user_id}/get-subscription-status", id: "getUserSubscriptionStatus", summary: "Get the subscription status of a user", tag: "subscriptions", auth: authAPIKey,
+		params: []*openapi.Parameter{fixPaymentURLParameter}, status: http.StatusOK, response: SubscriptionStatusResponse{}},
+	{method: "GET", path: "/v1/users/{user_id}/subscriptions", id: "listUserSubscriptions", summary: "List the subscriptions of a user", tag: "subscriptions", auth: authAPIKey,
+		status: http.StatusOK, response: SubscriptionListResponse{}},
+	{method: "GET", path: "/v1/users/{user_id}/customer", legacy: "/users/{user_id}/get-customer-details", id: "getUserCustomerDetails", summary: "Get the customer details of a user", tag: "customers", auth: authAPIKey,
+		params: []*openapi.Parameter{refreshParameter}, status: http.StatusOK, response: CustomerDetailsResponse{}},
+	{method: "GET", path: "/v1/users/{user_id}/customer/tax-ids", legacy: "/users/{user_id}/customer/tax-ids", id: "listUserTaxIDs", summary: "List the tax IDs of a user", tag: "customers", auth: authAPIKey,
+		status: http.StatusOK, response: TaxIDListResponse{}},
+	{method: "GET", path: "/v1/users/{user_id}/invoices", legacy: "/users/{user_id}/invoices", id: "listUserInvoices", summary: "List the invoices of a user", tag: "invoices", auth: authAPIKey,
+		status: http.StatusOK, response: InvoiceListResponse{}},
+
+	{method: "GET", path: "/v1/admin/api-keys", legacy: "/admin/api-keys", id: "listAPIKeys", summary: "List the API keys", tag: "admin", auth: authAdmin,
+		status: http.StatusOK, response: APIKeyListResponse{}},
+	{method: "POST", path: "/v1/admin/api-keys", legacy: "/admin/api-keys", id: "createAPIKey", summary: "Create an API key", tag: "admin", auth: authAdmin,
+		request: CreateAPIKeyRequest{}, status: http.StatusCreated, response: APIKeyResponse{}},
+	{method: "DELETE", path: "/v1/admin/api-keys/{id}", legacy: "/admin/api-keys/{id}", id: "revokeAPIKey", summary: "Revoke an API key", tag: "admin", auth: authAdmin,
+		status: http.StatusOK, response: APIKeyResponse{}},
+
+	{method: "POST", path: "/v1/checkout-sessions", legacy: "/create-checkout-session", id: "createCheckoutSession", summary: "Create a Stripe checkout session", tag: "subscriptions", auth: authJWT, idempotent: true,
+		request: CreateCheckoutSessionRequest{}, status: http.StatusOK, response: CheckoutSessionResponse{}},
+	{method: "GET", path: "/v1/me/subscription-status", legacy: "/get-subscription-status", id: "getSubscriptionStatus", summary: "Get the subscription status", tag: "subscriptions", auth: authJWT,
+		params: []*openapi.Parameter{fixPaymentURLParameter}, status: http.StatusOK, response: SubscriptionStatusResponse{}},
+	{method: "GET", path: "/v1/me/subscriptions", id: "listSubscriptions", summary: "List the subscriptions", tag: "subscriptions", auth: authJWT,
+		status: http.StatusOK, response: SubscriptionListResponse{}},
+	{method: "DELETE", path: "/v1/me/subscriptions/{id}", id: "cancelSubscription", summary: "Cancel a subscription", tag: "subscriptions", auth: authJWT, idempotent: true,
+		status: http.StatusOK, response: StatusResponse{}},
+	{method: "POST", path: "/v1/me/subscriptions/sync", legacy: "/sync-subscription", id: "syncSubscription", summary: "Synchronize the subscription after a payment", tag: "subscriptions", auth: authJWT, idempotent: true,
+		request: SyncSubscriptionRequest{}, status: http.StatusOK, response: SyncSubscriptionResponse{}},
+	{method: "POST", path: "/cancel-subscription", deprecated: true, id: "cancelActiveSubscription", summary: "Cancel the active subscription", tag: "subscriptions", auth: authJWT, idempotent: true,
+		status: http.StatusOK, response: StatusResponse{}},
+
+	{method: "GET", path: "/v1/me/customer", legacy: "/get-customer-details", id: "getCustomerDetails", summary: "Get the customer details", tag: "customers", auth: authJWT,
+		params: []*openapi.Parameter{refreshParameter}, status: http.StatusOK, response: CustomerDetailsResponse{}},
+	{method: "PATCH", path: "/v1/me/customer", legacy: "/customer", id: "updateCustomer", summary: "Update the customer profile", tag: "customers", auth: authJWT, idempotent: true,
+		request: UpdateCustomerRequest{}, status: http.StatusOK, response: CustomerResponse{}},
+	{method: "GET", path: "/v1/me/customer/tax-ids", legacy: "/customer/tax-ids", id: "listTaxIDs", summary: "List the tax IDs", tag: "customers", auth: authJWT,
+		status: http.StatusOK, response: TaxIDListResponse{}},
+	{method: "POST", path: "/v1/me/customer/tax-ids", legacy: "/customer/tax-ids", id: "createTaxID", summary: "Add a tax ID", tag: "customers", auth: authJWT, idempotent: true,
+		request: TaxIDRequest{}, status: http.StatusCreated, response: models.TaxID{}},
+	{method: "DELETE", path: "/v1/me/customer/tax-ids/{id}", legacy: "/customer/tax-ids/{id}", id: "deleteTaxID", summary: "Remove a tax ID", tag: "customers", auth: authJWT, idempotent: true,
+		status: http.StatusOK, response: StatusResponse{}},
+	{method: "GET", path: "/v1/me/invoices", legacy: "/invoices", id: "listInvoices", summary: "List the invoices", tag: "invoices", auth: authJWT,
+		status: http.StatusOK, response: InvoiceListResponse{}},
+}
+
+var securitySchemes = map[string]*openapi.SecurityScheme{
+	authJWT:      {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "A user token"},
+	authAPIKey:   {Type: "http", Scheme: "bearer", Description: "A server-to-server API key, acting for the user of the path"},
+	authOperator: {Type: "http", Scheme: "bearer", Description: "The operator token"},
+}
+
+// operation describes a route in the OpenAPI document
+func (rt *route) operation() *openapi.Operation {
+	op := &openapi.Operation{
+		OperationID: rt.id,
+		Summary:     rt.summary,
+		Tags:        []string{rt.tag},
+		Deprecated:  rt.deprecated,
+		Responses: map[string]*openapi.Response{
+			"default": {Description: "Error", Content: openapi.JSONContent(schemas.Schema(Error{}))},
+		},
+	}
+
+	switch rt.auth {
+	case authJWT, authAPIKey, authOperator:
+		op.Security = []map[string][]string{{rt.auth: {}}}
+	case authAdmin:
+		// The operator token or a user token with the admin role
+		op.Security = []map[string][]string{{authOperator: {}}, {authJWT: {}}}
+	}
+
+	// Copy the shared parameters before appending the route ones
+	op.Parameters = append(op.Parameters, rt.params...)
+	if strings.HasPrefix(rt.path, "/v1/") {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name:        apiVersionHeader,
+			In:          "header",
+			Description: "The version of the API, the configured default version when absent",
+			Schema:      &openapi.Schema{Type: "string", Enum: apiVersions},
+		})
+	}
+	if rt.idempotent {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name:        idempotencyKeyHeader,
+			In:          "header",
+			Description: "Replays the response of an earlier request with the same key",
+			Schema:      &openapi.Schema{Type: "string"},
+		})
+	}
+
+	if rt.request != nil {
+		op.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSONContent(schemas.Schema(rt.request))}
+	}
+
+	response := &openapi.Response{Description: http.StatusText(rt.status)}
+	if rt.response != nil {
+		response.Content = openapi.JSONContent(schemas.Schema(rt.response))
+	}
+	op.Responses[strconv.Itoa(rt.status)] = response
+	return op
+}
+
+// newOpenAPIDocument describes the routes of the API
+func newOpenAPIDocument(version string) *openapi.Document {
+	doc := openapi.NewDocument(openapi.Info{
+		Title:       "GoStripe API",
+		Description: "Stripe subscriptions for the users of an application",
+		Version:     version,
+	})
+	for i := range routes {
+		rt := routes[i]
+		doc.Add(rt.method, rt.path, rt.operation())
+		if rt.legacy != "" {
+			// The legacy path keeps the oldest version of the route
+			legacy := rt
+			legacy.path, legacy.legacy, legacy.deprecated = rt.legacy, "", true
+			legacy.id = "legacy" + strings.ToUpper(rt.id[:1]) + rt.id[1:]
+			legacy.summary = rt.summary + ", replaced by " + rt.method + " " + rt.path
+			doc.Add(legacy.method, legacy.path, legacy.operation())
+		}
+	}
+	doc.Components = openapi.Components{
+		Schemas:         schemas.Components(),
+		SecuritySchemes: securitySchemes,
+	}
+	return doc
+}
+
+// OpenAPI serves the OpenAPI document describing the API
+func (a *API) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	sendJSON(w, http.StatusOK, a.spec)
+}
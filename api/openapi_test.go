@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+)
+
+func TestOpenAPI(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+
+	w := a.request(t, http.MethodGet, "/openapi.json", "", nil)
+	expectStatus(t, w, http.StatusOK)
+	body := decode(t, w)
+	if body["openapi"] != "3.0.3" {
+		t.Fatalf("unexpected document %v", body)
+	}
+
+	// Every route is documented
+	paths := body["paths"].(map[string]interface{})
+	documented := 0
+	for _, item := range paths {
+		documented += len(item.(map[string]interface{}))
+	}
+	served := 0
+	err := chi.Walk(a.handler.(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if method == http.MethodOptions {
+			return nil
+		}
+		served++
+		if item, ok := paths[route].(map[string]interface{}); !ok || item[strings.ToLower(method)] == nil {
+			t.Errorf("%s %s is not documented", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if served != documented {
+		t.Errorf("%d routes are served but %d are documented", served, documented)
+	}
+
+	// Every reference is defined
+	schemas := body["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	var checkRefs func(v interface{})
+	checkRefs = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok && schemas[strings.TrimPrefix(ref, "#/components/schemas/")] == nil {
+				t.Errorf("undefined schema %s", ref)
+			}
+			for _, child := range v {
+				checkRefs(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				checkRefs(child)
+			}
+		}
+	}
+	checkRefs(body)
+
+	scopes := schemas["CreateAPIKeyRequest"].(map[string]interface{})["properties"].(map[string]interface{})["scopes"].(map[string]interface{})["items"].(map[string]interface{})["enum"]
+	var want []interface{}
+	for _, scope := range apiKeyScopes {
+		want = append(want, scope)
+	}
+	if !reflect.DeepEqual(scopes, want) {
+		t.Errorf("expected the scopes %v, got %v", want, scopes)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+	token := testToken(t, uuid.Must(uuid.NewV4()), "user@example.com")
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		body    interface{}
+		message string
+	}{
+		{"invalid JSON", http.MethodPost, "/create-checkout-session", token, []byte("{"), "Invalid request body"},
+		{"wrong type", http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_basic", "automatic_tax": "yes"}, "automatic_tax must be a boolean"},
+		{"length", http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_basic", "currency": "euro"}, "currency must be 3 characters long"},
+		{"enum", http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_basic", "billing_address_collection": "never"}, "billing_address_collection must be one of auto, required"},
+		{"format", http.MethodPatch, "/customer", token, map[string]interface{}{"email": "nope"}, "email must be a valid email"},
+		{"nested", http.MethodPatch, "/customer", token, map[string]interface{}{"address": map[string]interface{}{"country": "FRA"}}, "address.country must be 2 characters long"},
+		{"array items", http.MethodPatch, "/customer", token, map[string]interface{}{"tax_ids": []interface{}{map[string]interface{}{"type": "eu_vat"}}}, "tax_ids[0].value is required"},
+		{"required", http.MethodPost, "/customer/tax-ids", token, map[string]interface{}{"value": "FR123"}, "type is required"},
+		{"items enum", http.MethodPost, "/admin/api-keys", testOperatorToken, map[string]interface{}{"name": "billing", "scopes": []string{"everything"}}, "scopes[0] must be one of " + strings.Join(apiKeyScopes, ", ")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, tt.method, tt.path, tt.token, tt.body)
+			expectStatus(t, w, http.StatusBadRequest)
+			if body := decode(t, w); body["message"] != tt.message {
+				t.Errorf("expected %q, got %v", tt.message, body["message"])
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// errPriceNotAvailable is returned when no price matches the requested currency
+type errPriceNotAvailable struct {
+	msg string
+}
+
+func (e *errPriceNotAvailable) Error() string {
+	return e.msg
+}
+
+// resolveCheckoutPrice picks the price to charge, either the given price ID or
+// the price with the given lookup key, in the requested currency. It returns
+// the price ID and the currency to set on the checkout session, which is
+// empty when the price's own currency is used.
+func (a *API) resolveCheckoutPrice(priceID, lookupKey, currency string) (string, string, error) {
+	currency = strings.ToLower(currency)
+
+	var candidates []*stripe.Price
+	if lookupKey != "" {
+		params := &stripe.PriceListParams{
+			Active:     stripe.Bool(true),
+			LookupKeys: stripe.StringSlice([]string{lookupKey}),
+		}
+		params.AddExpand("data.currency_options")
+		prices, err := a.gateway.ListPrices(params, 0)
+		if err != nil {
+			return "", "", err
+		}
+		candidates = prices
+		if len(candidates) == 0 {
+			return "", "", &errPriceNotAvailable{fmt.Sprintf("no active price with lookup key %s", lookupKey)}
+		}
+	} else {
+		if currency == "" {
+			return priceID, "", nil
+		}
+		params := &stripe.PriceParams{}
+		params.AddExpand("currency_options")
+		p, err := a.gateway.GetPrice(priceID, params)
+		if err != nil {
+			return "", "", err
+		}
+		candidates = append(candidates, p)
+	}
+
+	if currency == "" {
+		return candidates[0].ID, "", nil
+	}
+
+	for _, p := range candidates {
+		if string(p.Currency) == currency {
+			return p.ID, "", nil
+		}
+	}
+
+	for _, p := range candidates {
+		if _, ok := p.CurrencyOptions[currency]; ok {
+			return p.ID, currency, nil
+		}
+	}
+
+	return "", "", &errPriceNotAvailable{fmt.Sprintf("price is not available in %s", strings.ToUpper(currency))}
+}
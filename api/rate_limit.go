@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gostripe/conf"
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoint classes, each with its own rate limit
+const (
+	rateLimitDefault  = "default"
+	rateLimitCheckout = "checkout"
+)
+
+// rateLimitSweepInterval is how often idle buckets are deleted
+const rateLimitSweepInterval = 10 * time.Minute
+
+// rateLimitStore holds the token buckets of the callers
+type rateLimitStore interface {
+	take(key string, now time.Time, capacity, perSecond float64) (*models.RateLimitBucket, bool, error)
+	sweep(before time.Time) error
+}
+
+// memoryRateLimitStore keeps the buckets in memory, for single replica
+// deployments
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*models.RateLimitBucket
+}
+
+func (s *memoryRateLimitStore) take(key string, now time.Time, capacity, perSecond float64) (*models.RateLimitBucket, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &models.RateLimitBucket{Key: key, Tokens: capacity, UpdatedAt: now}
+		s.buckets[key] = bucket
+	}
+	allowed := bucket.Take(now, capacity, perSecond)
+	snapshot := *bucket
+	return &snapshot, allowed, nil
+}
+
+func (s *memoryRateLimitStore) sweep(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, bucket := range s.buckets {
+		if bucket.UpdatedAt.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+// postgresRateLimitStore keeps the buckets in the database, shared by all
+// replicas
+type postgresRateLimitStore struct {
+	db *storage.Connection
+}
+
+func (s *postgresRateLimitStore) take(key string, now time.Time, capacity, perSecond float64) (*models.RateLimitBucket, bool, error) {
+	return models.TakeRateLimitToken(s.db, key, now, capacity, perSecond)
+}
+
+func (s *postgresRateLimitStore) sweep(before time.Time) error {
+	return models.DeleteRateLimitBucketsBefore(s.db, before)
+}
+
+// newRateLimitStore creates the configured store and deletes idle buckets in
+// the background until ctx is done. Buckets idle for longer than the longest
+// period are full, so deleting them does not change any limit.
+func newRateLimitStore(ctx context.Context, config *conf.RateLimitConfiguration, db *storage.Connection) rateLimitStore {
+	var store rateLimitStore
+	if config.Backend == "postgres" {
+		store = &postgresRateLimitStore{db: db}
+	} else {
+		store = &memoryRateLimitStore{buckets: map[string]*models.RateLimitBucket{}}
+	}
+
+	idle := config.Default.Period
+	for _, limit := range []conf.RateLimit{config.Checkout, config.IP} {
+		if limit.Period > idle {
+			idle = limit.Period
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(rateLimitSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := store.sweep(time.Now().Add(-idle)); err != nil {
+					logrus.WithError(err).Warn("Failed to delete idle rate limit buckets")
+				}
+			}
+		}
+	}()
+
+	return store
+}
+
+// rateLimit is middleware that limits the requests of the authenticated
+// caller to an endpoint class. It must be wrapped by an authentication
+// middleware.
+func (a *API) rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	limit := a.config.RateLimit.Default
+	if class == rateLimitCheckout {
+		limit = a.config.RateLimit.Checkout
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := "ip:" + clientIP(r, a.config.RateLimitHeader, a.config.RateLimitTrustedProxies)
+		if principal := getPrincipal(r.Context()); principal != nil {
+			key = principal.Caller()
+		}
+
+		if a.allowRequest(w, r, class+":"+key, limit) {
+			next.ServeHTTP(w, r)
+		}
+	}
+}
+
+// rateLimitIP is middleware that limits the requests of each client IP,
+// authenticated or not
+func (a *API) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.allowRequest(w, r, "ip:"+clientIP(r, a.config.RateLimitHeader, a.config.RateLimitTrustedProxies), a.config.RateLimit.IP) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allowRequest takes a token for the key and sets the rate limit headers,
+// sending a 429 response when the bucket is empty. Store failures let the
+// request through. When the request already went through another limit, the
+// headers report the one with the fewest remaining requests.
+func (a *API) allowRequest(w http.ResponseWriter, r *http.Request, key string, limit conf.RateLimit) bool {
+	if a.rateLimits == nil {
+		return true
+	}
+
+	now := time.Now()
+	capacity := float64(limit.Requests)
+	perSecond := capacity / limit.Period.Seconds()
+
+	bucket, allowed, err := a.rateLimits.take(key, now, capacity, perSecond)
+	if err != nil {
+		logrus.WithError(err).WithField("key", key).Warn("Failed to check rate limit")
+		return true
+	}
+
+	remaining := int(math.Floor(bucket.Tokens))
+	if previous, err := strconv.Atoi(w.Header().Get("X-RateLimit-Remaining")); err != nil || remaining < previous {
+		reset := now.Add(time.Duration((capacity - bucket.Tokens) / perSecond * float64(time.Second)))
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	}
+
+	if !allowed {
+		retryAfter := math.Ceil((1 - bucket.Tokens) / perSecond)
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+		logrus.WithFields(logrus.Fields{
+			"key":  key,
+			"path": r.URL.Path,
+		}).Info("Rate limit exceeded")
+		tooManyRequestsError(w)
+		return false
+	}
+
+	return true
+}
+
+// clientIP returns the IP of the client, read from header when the API runs
+// behind trusted proxies. Each proxy appends the address it received the
+// request from, so the entries before the ones they added are set by the
+// client and cannot be trusted.
+func clientIP(r *http.Request, header string, trustedProxies int) string {
+	if header != "" {
+		var entries []string
+		for _, value := range r.Header.Values(header) {
+			for _, entry := range strings.Split(value, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		if len(entries) > 0 {
+			if trustedProxies < 1 {
+				trustedProxies = 1
+			}
+			i := len(entries) - trustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return entries[i]
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
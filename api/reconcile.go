@@ -0,0 +1,410 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gostripe/billing"
+	"gostripe/gateway"
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Issues found by the reconciliation
+const (
+	IssueMissingLocally  = "missing_locally"
+	IssueMissingInStripe = "missing_in_stripe"
+	IssueMismatch        = "mismatch"
+)
+
+// ErrReconcileRunning is returned when another reconciliation is fixing the
+// database
+var ErrReconcileRunning = errors.New("another reconciliation is running")
+
+// ReconcileReport lists the differences between the database and Stripe
+type ReconcileReport struct {
+	StartedAt           time.Time      `json:"started_at"`
+	FinishedAt          time.Time      `json:"finished_at"`
+	DryRun              bool           `json:"dry_run"`
+	StripeCustomers     int            `json:"stripe_customers"`
+	StripeSubscriptions int            `json:"stripe_subscriptions"`
+	LocalCustomers      int            `json:"local_customers"`
+	LocalSubscriptions  int            `json:"local_subscriptions"`
+	Discrepancies       []*Discrepancy `json:"discrepancies"`
+}
+
+// Discrepancy is a customer or subscription that differs between the
+// database and Stripe
+type Discrepancy struct {
+	Object   string               `json:"object"`
+	StripeID string               `json:"stripe_id"`
+	LocalID  *uuid.UUID           `json:"local_id,omitempty"`
+	Issue    string               `json:"issue"`
+	Fields   map[string]FieldDiff `json:"fields,omitempty"`
+	Fixed    bool                 `json:"fixed"`
+	Note     string               `json:"note,omitempty"`
+}
+
+// FieldDiff holds the local and Stripe values of a field
+type FieldDiff struct {
+	Local  string `json:"local"`
+	Stripe string `json:"stripe"`
+}
+
+// Reconcile compares every Stripe customer and subscription with the
+// database. With fix, the local rows are corrected to match Stripe, each in
+// its own short transaction, and only one reconciliation may run at a time.
+// Rows updated since the run started, e.g. by a webhook, are newer than the
+// Stripe lists and are left as is.
+func Reconcile(db *storage.Connection, gw gateway.Stripe, fix bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{StartedAt: time.Now(), DryRun: !fix, Discrepancies: []*Discrepancy{}}
+
+	if fix {
+		lock, err := models.TrySessionLock(db, "stripe_reconcile")
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock the reconciliation: %w", err)
+		}
+		if lock == nil {
+			return nil, ErrReconcileRunning
+		}
+		defer func() {
+			if err := lock.Release(); err != nil {
+				logrus.WithError(err).Warn("Failed to release the reconciliation lock")
+			}
+		}()
+	}
+
+	stripeCustomers, err := gw.ListCustomers(&stripe.CustomerListParams{}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Stripe customers: %w", err)
+	}
+	stripeSubs, err := gw.ListSubscriptions(&stripe.SubscriptionListParams{Status: "all"}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Stripe subscriptions: %w", err)
+	}
+	report.StripeCustomers = len(stripeCustomers)
+	report.StripeSubscriptions = len(stripeSubs)
+
+	if err := report.compare(db, stripeCustomers, stripeSubs, fix); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+func (r *ReconcileReport) compare(conn *storage.Connection, stripeCustomers []*stripe.Customer, stripeSubs []*stripe.Subscription, fix bool) error {
+	localCustomers, err := models.AllCustomers(conn)
+	if err != nil {
+		return fmt.Errorf("failed to list customers: %w", err)
+	}
+	localSubs, err := models.AllSubscriptions(conn)
+	if err != nil {
+		return fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	r.LocalCustomers = len(localCustomers)
+	r.LocalSubscriptions = len(localSubs)
+
+	customers := map[string]*models.Customer{}
+	for i := range localCustomers {
+		customers[localCustomers[i].StripeID] = &localCustomers[i]
+	}
+	seen := map[string]bool{}
+
+	for _, c := range stripeCustomers {
+		seen[c.ID] = true
+		d, err := reconcileCustomer(conn, customers, c, r.StartedAt, fix)
+		if err != nil {
+			return err
+		}
+		r.add(d)
+	}
+	for i := range localCustomers {
+		if !seen[localCustomers[i].StripeID] {
+			r.add(&Discrepancy{
+				Object:   "customer",
+				StripeID: localCustomers[i].StripeID,
+				LocalID:  &localCustomers[i].ID,
+				Issue:    IssueMissingInStripe,
+				Note:     "deleted in Stripe or created with another Stripe account, left as is",
+			})
+		}
+	}
+
+	subscriptions := map[string]*models.Subscription{}
+	for i := range localSubs {
+		subscriptions[localSubs[i].StripeID] = &localSubs[i]
+	}
+	seen = map[string]bool{}
+
+	for _, s := range stripeSubs {
+		seen[s.ID] = true
+		d, err := reconcileSubscription(conn, customers, subscriptions[s.ID], s, r.StartedAt, fix)
+		if err != nil {
+			return err
+		}
+		r.add(d)
+	}
+	for i := range localSubs {
+		if !seen[localSubs[i].StripeID] {
+			r.add(&Discrepancy{
+				Object:   "subscription",
+				StripeID: localSubs[i].StripeID,
+				LocalID:  &localSubs[i].ID,
+				Issue:    IssueMissingInStripe,
+				Note:     "unknown to Stripe, left as is",
+			})
+		}
+	}
+
+	return nil
+}
+
+func (r *ReconcileReport) add(d *Discrepancy) {
+	if d != nil {
+		r.Discrepancies = append(r.Discrepancies, d)
+	}
+}
+
+// reconcileCustomer compares a Stripe customer with the local one. A missing
+// customer can only be created when the Stripe customer holds the user_id set
+// by GoStripe in its metadata.
+func reconcileCustomer(conn *storage.Connection, customers map[string]*models.Customer, c *stripe.Customer, since time.Time, fix bool) (*Discrepancy, error) {
+	local := customers[c.ID]
+	if local == nil {
+		d := &Discrepancy{Object: "customer", StripeID: c.ID, Issue: IssueMissingLocally}
+
+		userID, err := uuid.FromString(c.Metadata["user_id"])
+		if err != nil {
+			d.Note = "no user_id in the metadata, the customer cannot be linked to a user"
+			return d, nil
+		}
+		existing, err := models.FindCustomerByUserID(conn, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get customer: %w", err)
+		}
+		if existing != nil {
+			d.Note = fmt.Sprintf("user %s already has the customer %s", userID, existing.StripeID)
+			return d, nil
+		}
+		if !fix {
+			return d, nil
+		}
+
+		var created *models.Customer
+		err = conn.Transaction(func(tx *storage.Connection) error {
+			if created, err = models.CreateCustomer(tx, userID, c.ID, c.Email, c.Name); err != nil {
+				return fmt.Errorf("failed to create customer: %w", err)
+			}
+			applyStripeCustomer(created, c)
+			if err := models.UpdateCustomer(tx, created); err != nil {
+				return fmt.Errorf("failed to update customer: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		customers[c.ID] = created
+		d.LocalID = &created.ID
+		d.Fixed = true
+		return d, nil
+	}
+
+	want := *local
+	applyStripeCustomer(&want, c)
+
+	fields := map[string]FieldDiff{}
+	diffField(fields, "email", local.Email, want.Email)
+	diffField(fields, "name", local.Name, want.Name)
+	diffField(fields, "phone", local.Phone, want.Phone)
+	diffField(fields, "address_line1", local.AddressLine1, want.AddressLine1)
+	diffField(fields, "address_line2", local.AddressLine2, want.AddressLine2)
+	diffField(fields, "address_city", local.AddressCity, want.AddressCity)
+	diffField(fields, "address_postal_code", local.AddressPostalCode, want.AddressPostalCode)
+	diffField(fields, "address_state", local.AddressState, want.AddressState)
+	diffField(fields, "address_country", local.AddressCountry, want.AddressCountry)
+	diffField(fields, "preferred_locales", local.PreferredLocales, want.PreferredLocales)
+	diffField(fields, "default_payment_method", local.DefaultPaymentMethod, want.DefaultPaymentMethod)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	d := &Discrepancy{Object: "customer", StripeID: c.ID, LocalID: &local.ID, Issue: IssueMismatch, Fields: fields}
+	if fix {
+		// The row stays locked until the fix is committed, so that a webhook
+		// cannot update it in between
+		err := conn.Transaction(func(tx *storage.Connection) error {
+			current, err := models.FindCustomerByStripeIDForUpdate(tx, c.ID)
+			if err != nil {
+				return fmt.Errorf("failed to get customer: %w", err)
+			}
+			if current == nil || current.UpdatedAt.After(since) {
+				d.Note = noteUpdatedDuringRun
+				return nil
+			}
+			if err := models.UpdateCustomer(tx, &want); err != nil {
+				return fmt.Errorf("failed to update customer: %w", err)
+			}
+			*local = want
+			d.Fixed = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// reconcileSubscription compares a Stripe subscription with the local one.
+// Subscriptions canceled in the database only, as done by the cancel
+// endpoints, are reported rather than reactivated.
+func reconcileSubscription(conn *storage.Connection, customers map[string]*models.Customer, local *models.Subscription, s *stripe.Subscription, since time.Time, fix bool) (*Discrepancy, error) {
+	customerID := ""
+	if s.Customer != nil {
+		customerID = s.Customer.ID
+	}
+	customer := customers[customerID]
+
+	if local == nil {
+		d := &Discrepancy{Object: "subscription", StripeID: s.ID, Issue: IssueMissingLocally}
+		if customer == nil {
+			d.Note = fmt.Sprintf("the customer %s is not stored", customerID)
+			return d, nil
+		}
+		if !fix {
+			return d, nil
+		}
+		if err := fixSubscription(conn, d, customer.ID, s, since); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	want := *local
+	billing.ApplySubscription(&want, s)
+	if customer != nil {
+		want.CustomerID = customer.ID
+	}
+
+	fields := map[string]FieldDiff{}
+	diffField(fields, "customer_id", local.CustomerID.String(), want.CustomerID.String())
+	diffField(fields, "status", string(local.Status), string(want.Status))
+	diffField(fields, "price_id", local.PriceID, want.PriceID)
+	diffField(fields, "current_period_end", formatTime(&local.CurrentPeriodEnd), formatTime(&want.CurrentPeriodEnd))
+	diffField(fields, "current_period_start", formatTime(local.CurrentPeriodStart), formatTime(want.CurrentPeriodStart))
+	diffField(fields, "trial_end", formatTime(local.TrialEnd), formatTime(want.TrialEnd))
+	diffField(fields, "cancel_at", formatTime(local.CancelAt), formatTime(want.CancelAt))
+	diffField(fields, "cancel_at_period_end", strconv.FormatBool(local.CancelAtPeriodEnd), strconv.FormatBool(want.CancelAtPeriodEnd))
+	diffField(fields, "canceled_at", formatTime(local.CanceledAt), formatTime(want.CanceledAt))
+	diffField(fields, "ended_at", formatTime(local.EndedAt), formatTime(want.EndedAt))
+	diffField(fields, "latest_invoice_id", local.LatestInvoiceID, want.LatestInvoiceID)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	d := &Discrepancy{Object: "subscription", StripeID: s.ID, LocalID: &local.ID, Issue: IssueMismatch, Fields: fields}
+	if customer == nil {
+		d.Note = fmt.Sprintf("the customer %s is not stored", customerID)
+	}
+	if local.Status == models.SubscriptionStatusCanceled && want.Status != models.SubscriptionStatusCanceled {
+		d.Note = "canceled in the database only, cancel it in Stripe or restore it by hand"
+		return d, nil
+	}
+	if local.CustomerID != want.CustomerID {
+		d.Note = "stored for another customer, subscriptions are never moved automatically"
+		return d, nil
+	}
+	if fix {
+		if err := fixSubscription(conn, d, want.CustomerID, s, since); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+const noteUpdatedDuringRun = "updated during the reconciliation, left as is"
+
+// fixSubscription stores a Stripe subscription in its own transaction. The
+// subscription is locked as webhooks do before storing it, and left as is
+// when it was stored or updated since a time.
+func fixSubscription(conn *storage.Connection, d *Discrepancy, customerID uuid.UUID, s *stripe.Subscription, since time.Time) error {
+	return conn.Transaction(func(tx *storage.Connection) error {
+		if err := models.LockSubscription(tx, s.ID); err != nil {
+			return fmt.Errorf("failed to lock subscription: %w", err)
+		}
+		current, err := models.FindSubscriptionByStripeID(tx, s.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+		if current != nil && current.UpdatedAt.After(since) {
+			d.Note = noteUpdatedDuringRun
+			return nil
+		}
+
+		stored, err := billing.UpsertSubscription(tx, customerID, s)
+		if err != nil {
+			return err
+		}
+		d.LocalID = &stored.ID
+		d.Fixed = true
+		return nil
+	})
+}
+
+func diffField(fields map[string]FieldDiff, name, local, remote string) {
+	if local != remote {
+		fields[name] = FieldDiff{Local: local, Stripe: remote}
+	}
+}
+
+// formatTime formats a time to the second, as stored by Stripe
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// reconcileEvery compares the database with Stripe at each interval until
+// ctx is done, and logs the discrepancies
+func (a *API) reconcileEvery(ctx context.Context, interval time.Duration, fix bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := Reconcile(a.db, a.live, fix)
+			if errors.Is(err, ErrReconcileRunning) {
+				logrus.Info("Skipping reconciliation, another one is running")
+				continue
+			}
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to reconcile the database with Stripe")
+				continue
+			}
+
+			entry := logrus.WithFields(logrus.Fields{
+				"discrepancies": len(report.Discrepancies),
+				"dry_run":       report.DryRun,
+			})
+			if len(report.Discrepancies) == 0 {
+				entry.Info("Database in sync with Stripe")
+				continue
+			}
+			raw, _ := json.Marshal(report.Discrepancies)
+			entry.WithField("report", string(raw)).Warn("Database out of sync with Stripe")
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// issues returns the issues of a report by object and Stripe ID
+func issues(report *ReconcileReport) map[string]*Discrepancy {
+	m := map[string]*Discrepancy{}
+	for _, d := range report.Discrepancies {
+		m[d.Object+" "+d.StripeID] = d
+	}
+	return m
+}
+
+func TestReconcile(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	// En phase
+	inSync := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "sync@example.com")
+	seedSubscription(t, a, inSync, "price_basic", stripe.SubscriptionStatusActive)
+
+	// Modifié dans Stripe
+	renamed := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "renamed@example.com")
+	if _, err := a.stripe.UpdateCustomer(renamed.StripeID, &stripe.CustomerParams{Name: stripe.String("Jeanne Martin")}); err != nil {
+		t.Fatal(err)
+	}
+	pastDue := seedSubscription(t, a, renamed, "price_basic", stripe.SubscriptionStatusActive)
+	if _, err := a.stripe.SetSubscriptionStatus(pastDue.StripeID, stripe.SubscriptionStatusPastDue); err != nil {
+		t.Fatal(err)
+	}
+
+	// Créés dans Stripe sans webhook
+	missedUserID := uuid.Must(uuid.NewV4())
+	missed, err := a.stripe.NewCustomer(&stripe.CustomerParams{
+		Email:  stripe.String("missed@example.com"),
+		Params: stripe.Params{Metadata: map[string]string{"user_id": missedUserID.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missedSub := a.stripe.AddSubscription(missed.ID, "price_basic", stripe.SubscriptionStatusTrialing)
+
+	unlinked, err := a.stripe.NewCustomer(&stripe.CustomerParams{Email: stripe.String("unlinked@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Inconnus de Stripe
+	gone, err := models.CreateCustomer(db, uuid.Must(uuid.NewV4()), "cus_gone", "gone@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goneSub, err := models.CreateSubscription(db, gone.ID, "sub_gone", "price_basic", models.SubscriptionStatusActive, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"customer " + renamed.StripeID:     IssueMismatch,
+		"subscription " + pastDue.StripeID: IssueMismatch,
+		"customer " + missed.ID:            IssueMissingLocally,
+		"subscription " + missedSub.ID:     IssueMissingLocally,
+		"customer " + unlinked.ID:          IssueMissingLocally,
+		"customer " + gone.StripeID:        IssueMissingInStripe,
+		"subscription " + goneSub.StripeID: IssueMissingInStripe,
+	}
+
+	report, err := Reconcile(db, a.stripe, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := issues(report)
+	if len(found) != len(expected) {
+		t.Errorf("expected %d discrepancies, got %d", len(expected), len(found))
+	}
+	for key, issue := range expected {
+		if d := found[key]; d == nil || d.Issue != issue || d.Fixed {
+			t.Errorf("expected %s to be reported as %s, got %+v", key, issue, d)
+		}
+	}
+	if d := found["customer "+renamed.StripeID]; d != nil && d.Fields["name"] != (FieldDiff{Local: "", Stripe: "Jeanne Martin"}) {
+		t.Errorf("expected the name to differ, got %+v", d.Fields)
+	}
+
+	t.Run("dry run changes nothing", func(t *testing.T) {
+		customer, err := models.FindCustomerByUserID(db, missedUserID)
+		if err != nil || customer != nil {
+			t.Errorf("expected no customer, got %+v (%v)", customer, err)
+		}
+	})
+
+	t.Run("fix", func(t *testing.T) {
+		report, err := Reconcile(db, a.stripe, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range report.Discrepancies {
+			fixable := d.Issue != IssueMissingInStripe && d.StripeID != unlinked.ID
+			if d.Fixed != fixable {
+				t.Errorf("expected fixed to be %v, got %+v", fixable, d)
+			}
+		}
+
+		customer, err := models.FindCustomerByUserID(db, missedUserID)
+		if err != nil || customer == nil || customer.StripeID != missed.ID {
+			t.Fatalf("expected the missed customer to be created, got %+v (%v)", customer, err)
+		}
+		subscription, err := models.FindSubscriptionByStripeID(db, missedSub.ID)
+		if err != nil || subscription == nil || subscription.CustomerID != customer.ID || subscription.Status != models.SubscriptionStatusTrialing {
+			t.Errorf("expected the missed subscription to be created, got %+v (%v)", subscription, err)
+		}
+		subscription, err = models.FindSubscriptionByStripeID(db, pastDue.StripeID)
+		if err != nil || subscription.Status != models.SubscriptionStatusPastDue {
+			t.Errorf("expected the subscription to be past due, got %+v (%v)", subscription, err)
+		}
+	})
+
+	t.Run("only what cannot be fixed remains", func(t *testing.T) {
+		report, err := Reconcile(db, a.stripe, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := issues(report)
+		for _, key := range []string{"customer " + unlinked.ID, "customer " + gone.StripeID, "subscription " + goneSub.StripeID} {
+			if found[key] == nil {
+				t.Errorf("expected %s to be reported", key)
+			}
+		}
+		if len(found) != 3 {
+			t.Errorf("expected 3 discrepancies, got %+v", report.Discrepancies)
+		}
+	})
+}
+
+func TestReconcileLeavesNewerRows(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	// Mis à jour par un webhook pendant la réconciliation
+	updated := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "updated@example.com")
+	if _, err := a.stripe.UpdateCustomer(updated.StripeID, &stripe.CustomerParams{Name: stripe.String("Ancien nom")}); err != nil {
+		t.Fatal(err)
+	}
+	updatedSub := seedSubscription(t, a, updated, "price_basic", stripe.SubscriptionStatusActive)
+	if _, err := a.stripe.SetSubscriptionStatus(updatedSub.StripeID, stripe.SubscriptionStatusPastDue); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := db.RawQuery("UPDATE stripe_customers SET updated_at = ? WHERE id = ?", future, updated.ID).Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RawQuery("UPDATE stripe_subscriptions SET updated_at = ? WHERE id = ?", future, updatedSub.ID).Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Annulé dans la base seulement
+	canceled := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "canceled@example.com")
+	canceledSub := seedSubscription(t, a, canceled, "price_basic", stripe.SubscriptionStatusActive)
+	canceledSub.Status = models.SubscriptionStatusCanceled
+	if err := models.UpdateSubscription(db, canceledSub); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Reconcile(db, a.stripe, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := issues(report)
+	for _, key := range []string{"customer " + updated.StripeID, "subscription " + updatedSub.StripeID} {
+		if d := found[key]; d == nil || d.Fixed || d.Note != noteUpdatedDuringRun {
+			t.Errorf("expected %s to be left as is, got %+v", key, d)
+		}
+	}
+	if d := found["subscription "+canceledSub.StripeID]; d == nil || d.Fixed || d.Note == "" {
+		t.Errorf("expected the locally canceled subscription to be reported, got %+v", d)
+	}
+
+	subscription, err := models.FindSubscriptionByStripeID(db, updatedSub.StripeID)
+	if err != nil || subscription.Status != models.SubscriptionStatusActive {
+		t.Errorf("expected the newer subscription to be kept, got %+v (%v)", subscription, err)
+	}
+	subscription, err = models.FindSubscriptionByStripeID(db, canceledSub.StripeID)
+	if err != nil || subscription.Status != models.SubscriptionStatusCanceled {
+		t.Errorf("expected the subscription to stay canceled, got %+v (%v)", subscription, err)
+	}
+}
+
+func TestReconcileRunsOnce(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	lock, err := models.TrySessionLock(db, "stripe_reconcile")
+	if err != nil || lock == nil {
+		t.Fatalf("expected to take the lock, got %v (%v)", lock, err)
+	}
+	if _, err := Reconcile(db, a.stripe, true); !errors.Is(err, ErrReconcileRunning) {
+		t.Errorf("expected the reconciliation to be refused, got %v", err)
+	}
+	// Une réconciliation sans correction ne prend pas le verrou
+	if _, err := Reconcile(db, a.stripe, false); err != nil {
+		t.Errorf("expected a dry run to proceed, got %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Reconcile(db, a.stripe, true); err != nil {
+		t.Fatalf("expected the reconciliation to run once the lock is released, got %v", err)
+	}
+	// Le verrou est rendu à la fin de la réconciliation
+	lock, err = models.TrySessionLock(db, "stripe_reconcile")
+	if err != nil || lock == nil {
+		t.Fatalf("expected the lock to be released, got %v (%v)", lock, err)
+	}
+	lock.Release()
+}
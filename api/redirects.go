@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// checkoutSessionIDPlaceholder is replaced by Stripe with the ID of the session
+const checkoutSessionIDPlaceholder = "{CHECKOUT_SESSION_ID}"
+
+// redirectURL returns the requested redirect URL, or the default one when the
+// client omitted it. The URL must be allowed by the redirect configuration.
+func (a *API) redirectURL(name, requested, fallback string) (*url.URL, error) {
+	raw := requested
+	if raw == "" {
+		raw = fallback
+	}
+	if raw == "" {
+		return nil, fmt.Errorf("%s is required", name)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("%s must be an absolute URL", name)
+	}
+
+	if !a.config.Redirect.Allows(u) {
+		return nil, fmt.Errorf("%s is not an allowed redirect URL", name)
+	}
+
+	return u, nil
+}
+
+// withCheckoutSessionID adds the session_id parameter to a success URL,
+// keeping its query string and fragment. The placeholder is left unescaped so
+// that Stripe can substitute it.
+func withCheckoutSessionID(u *url.URL) string {
+	if strings.Contains(u.RawQuery, checkoutSessionIDPlaceholder) {
+		return u.String()
+	}
+
+	withID := *u
+	if withID.RawQuery != "" {
+		withID.RawQuery += "&"
+	}
+	withID.RawQuery += "session_id=" + checkoutSessionIDPlaceholder
+	return withID.String()
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedirectURL(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, map[string]string{
+		"REDIRECT_ALLOWED_HOSTS": "*.example.com,http://localhost:3000",
+	}), nil)
+
+	tests := []struct {
+		name      string
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{"default URL", "", "https://app.example.com/success", false},
+		{"subdomain", "https://shop.example.com/done?x=1", "https://shop.example.com/done?x=1", false},
+		{"http host with scheme", "http://localhost:3000/done", "http://localhost:3000/done", false},
+		{"http on an https host", "http://shop.example.com/done", "", true},
+		{"unknown host", "https://evil.test/done", "", true},
+		{"suffix of an allowed host", "https://evilexample.com/done", "", true},
+		{"userinfo", "https://user@shop.example.com/done", "", true},
+		{"relative URL", "/done", "", true},
+		{"javascript", "javascript:alert(1)", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := a.redirectURL("success_url", tt.requested, a.config.Redirect.SuccessURL)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected %q to be rejected", tt.requested)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if u.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, u.String())
+			}
+		})
+	}
+}
+
+func TestWithCheckoutSessionID(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"https://app.example.com/success", "https://app.example.com/success?session_id={CHECKOUT_SESSION_ID}"},
+		{"https://app.example.com/success?plan=pro#top", "https://app.example.com/success?plan=pro&session_id={CHECKOUT_SESSION_ID}#top"},
+		{"https://app.example.com/success?id={CHECKOUT_SESSION_ID}", "https://app.example.com/success?id={CHECKOUT_SESSION_ID}"},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := withCheckoutSessionID(u); got != tt.want {
+			t.Errorf("withCheckoutSessionID(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
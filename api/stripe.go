@@ -5,111 +5,139 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
+	"gostripe/billing"
 	"gostripe/models"
+	"gostripe/notify"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/checkout/session"
-	"github.com/stripe/stripe-go/v72/customer"
 	"github.com/stripe/stripe-go/v72/webhook"
 )
 
 // CreateCheckoutSessionRequest represents a request to create a checkout session
 type CreateCheckoutSessionRequest struct {
-	PriceID      string `json:"price_id"`
-	SuccessURL   string `json:"success_url"`
-	CancelURL    string `json:"cancel_url"`
-	CustomerName string `json:"customer_name"`
+	PriceID      string `json:"price_id,omitempty"`
+	LookupKey    string `json:"lookup_key,omitempty"`
+	Currency     string `json:"currency,omitempty" openapi:"len=3"`
+	SuccessURL   string `json:"success_url,omitempty" openapi:"format=uri"`
+	CancelURL    string `json:"cancel_url,omitempty" openapi:"format=uri"`
+	CustomerName string `json:"customer_name,omitempty"`
+
+	// Tax options, defaulting to the Stripe configuration when omitted
+	AutomaticTax             *bool  `json:"automatic_tax,omitempty"`
+	BillingAddressCollection string `json:"billing_address_collection,omitempty" openapi:"enum=auto|required"`
+	TaxIDCollection          *bool  `json:"tax_id_collection,omitempty"`
+}
+
+// CheckoutSessionResponse is the response of CreateCheckoutSession
+type CheckoutSessionResponse struct {
+	SessionID string `json:"session_id"`
+	URL       string `json:"url"`
+}
+
+// SubscriptionStatusResponse reports the subscription of a user and the access
+// it grants. Only has_subscription is set when the user has no subscription.
+type SubscriptionStatusResponse struct {
+	HasSubscription    bool                      `json:"has_subscription"`
+	SubscriptionStatus models.SubscriptionStatus `json:"subscription_status,omitempty"`
+	CurrentPeriodEnd   *time.Time                `json:"current_period_end,omitempty"`
+	Access             models.AccessLevel        `json:"access,omitempty"`
+	Dunning            *DunningStatus            `json:"dunning,omitempty"`
+	Subscription       *models.Subscription      `json:"subscription,omitempty"`
+}
+
+// DunningStatus describes the failed payments of a subscription
+type DunningStatus struct {
+	AttemptCount       int        `json:"attempt_count"`
+	LastFailedAt       time.Time  `json:"last_failed_at"`
+	NextPaymentAttempt *time.Time `json:"next_payment_attempt"`
+	FixPaymentURL      string     `json:"fix_payment_url,omitempty"`
 }
 
 // CreateCheckoutSession creates a Stripe checkout session
 func (a *API) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	// Parse request
 	var req CreateCheckoutSessionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		badRequestError(w, "Invalid request body")
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	if req.PriceID == "" {
-		badRequestError(w, "price_id is required")
+	if req.PriceID == "" && req.LookupKey == "" {
+		badRequestError(w, "price_id or lookup_key is required")
 		return
 	}
 
-	if req.SuccessURL == "" {
-		badRequestError(w, "success_url is required")
+	successURL, err := a.redirectURL("success_url", req.SuccessURL, a.config.Redirect.SuccessURL)
+	if err != nil {
+		badRequestError(w, err.Error())
 		return
 	}
 
-	if req.CancelURL == "" {
-		badRequestError(w, "cancel_url is required")
+	cancelURL, err := a.redirectURL("cancel_url", req.CancelURL, a.config.Redirect.CancelURL)
+	if err != nil {
+		badRequestError(w, err.Error())
 		return
 	}
 
-	// Get user ID from context
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	if req.BillingAddressCollection == "" {
+		req.BillingAddressCollection = a.config.Stripe.BillingAddressCollection
+	}
+	if req.BillingAddressCollection != "auto" && req.BillingAddressCollection != "required" {
+		badRequestError(w, "billing_address_collection must be auto or required")
 		return
 	}
 
-	// Get email from context
-	email, ok := r.Context().Value("email").(string)
-	if !ok || email == "" {
-		internalServerError(w, r, "Failed to get email")
-		return
+	automaticTax := a.config.Stripe.AutomaticTax
+	if req.AutomaticTax != nil {
+		automaticTax = *req.AutomaticTax
 	}
 
-	// Check if customer already exists
-	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
-	if err != nil {
-		internalServerError(w, r, "Failed to check customer")
+	taxIDCollection := a.config.Stripe.TaxIDCollection
+	if req.TaxIDCollection != nil {
+		taxIDCollection = *req.TaxIDCollection
+	}
+
+	// Get user ID from context
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
 
-	var stripeCustomerID string
-	if dbCustomer == nil {
-		// Create a real customer in Stripe using the Stripe API
-		customerParams := &stripe.CustomerParams{
-			Email: stripe.String(email),
-			Name:  stripe.String(req.CustomerName),
-		}
-		// Ajouter les métadonnées
-		customerParams.AddMetadata("user_id", userID.String())
-		// Use the customer package from Stripe
-		stripeCustomer, err := customer.New(customerParams)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to create Stripe customer")
-			internalServerError(w, r, "Failed to create customer")
-			return
-		}
-		stripeCustomerID = stripeCustomer.ID
+	email := principal.Email
+	if email == "" {
+		internalServerError(w, r, "Failed to get email")
+		return
+	}
 
-		// Create customer in database
-		dbCustomer, err = models.CreateCustomer(a.db, userID, stripeCustomerID, email, req.CustomerName)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to create customer in database")
-			internalServerError(w, r, "Failed to create customer")
+	// Choisir le prix dans la devise demandée
+	priceID, sessionCurrency, err := a.resolveCheckoutPrice(req.PriceID, req.LookupKey, req.Currency)
+	if err != nil {
+		if _, ok := err.(*errPriceNotAvailable); ok {
+			badRequestError(w, err.Error())
 			return
 		}
-	} else {
-		stripeCustomerID = dbCustomer.StripeID
+		logrus.WithError(err).Error("Failed to resolve price")
+		internalServerError(w, r, "Failed to resolve price")
+		return
 	}
 
-	// Create checkout session
-	// Modifier l'URL de succès pour inclure l'ID de session
-	successURL := req.SuccessURL
-	if successURL != "" {
-		if !strings.Contains(successURL, "?") {
-			successURL += "?session_id={CHECKOUT_SESSION_ID}"
-		} else {
-			successURL += "&session_id={CHECKOUT_SESSION_ID}"
-		}
+	// Get or create the customer
+	dbCustomer, err := a.ensureCustomer(userID, email, req.CustomerName)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get or create customer")
+		internalServerError(w, r, "Failed to create customer")
+		return
 	}
+	stripeCustomerID := dbCustomer.StripeID
 
+	// Create checkout session
 	params := &stripe.CheckoutSessionParams{
 		Customer: stripe.String(stripeCustomerID),
 		PaymentMethodTypes: stripe.StringSlice([]string{
@@ -117,18 +145,38 @@ func (a *API) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 		}),
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
 			{
-				Price:    stripe.String(req.PriceID),
+				Price:    stripe.String(priceID),
 				Quantity: stripe.Int64(1),
 			},
 		},
 		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		SuccessURL: stripe.String(successURL),
-		CancelURL:  stripe.String(req.CancelURL),
+		// L'URL de succès inclut l'ID de session
+		SuccessURL: stripe.String(withCheckoutSessionID(successURL)),
+		CancelURL:  stripe.String(cancelURL.String()),
 		ClientReferenceID: stripe.String(userID.String()),
 		CustomerEmail: nil, // Using Customer ID instead
 		AllowPromotionCodes: stripe.Bool(true),
 	}
 
+	if sessionCurrency != "" {
+		params.Currency = stripe.String(sessionCurrency)
+	}
+
+	// Taxes : Stripe Tax a besoin de l'adresse de facturation du client
+	params.BillingAddressCollection = stripe.String(req.BillingAddressCollection)
+	params.AutomaticTax = &stripe.CheckoutSessionAutomaticTaxParams{
+		Enabled: stripe.Bool(automaticTax),
+	}
+	params.TaxIDCollection = &stripe.CheckoutSessionTaxIDCollectionParams{
+		Enabled: stripe.Bool(taxIDCollection),
+	}
+	if automaticTax || taxIDCollection {
+		params.CustomerUpdate = &stripe.CheckoutSessionCustomerUpdateParams{
+			Address: stripe.String("auto"),
+			Name:    stripe.String("auto"),
+		}
+	}
+
 	// Ajouter les métadonnées
 	params.AddMetadata("user_id", userID.String())
 
@@ -137,7 +185,8 @@ func (a *API) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	params.SubscriptionData.AddMetadata("user_id", userID.String())
 
 	// Create the session using the Stripe API
-	s, err := session.New(params)
+	setStripeIdempotencyKey(r.Context(), &params.Params, "checkout_session.create")
+	s, err := a.gateway.NewCheckoutSession(params)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to create checkout session")
 		internalServerError(w, r, "Failed to create checkout session")
@@ -145,9 +194,9 @@ func (a *API) CreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Return both session ID and URL for easier client integration
-	sendJSON(w, http.StatusOK, map[string]string{
-		"session_id": s.ID,
-		"url":        s.URL,
+	sendJSON(w, http.StatusOK, &CheckoutSessionResponse{
+		SessionID: s.ID,
+		URL:       s.URL,
 	})
 }
 
@@ -163,7 +212,7 @@ func (a *API) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify signature
-	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), a.config.Stripe.WebhookSecret)
+	event, err := a.constructEvent(payload, r.Header.Get("Stripe-Signature"))
 	if err != nil {
 		logrus.WithError(err).Error("Failed to verify webhook signature")
 		badRequestError(w, "Failed to verify signature")
@@ -203,21 +252,155 @@ func (a *API) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 			internalServerError(w, r, "Failed to handle subscription")
 			return
 		}
+
+		a.forgetCached(sub.ID)
+
+		if event.Type == "customer.subscription.deleted" {
+			a.handleSubscriptionDeleted(&sub)
+		}
+
+	case "customer.subscription.trial_will_end":
+		var sub stripe.Subscription
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse subscription")
+			badRequestError(w, "Failed to parse subscription")
+			return
+		}
+
+		a.handleTrialWillEnd(&sub)
+
+	case "customer.updated":
+		var stripeCustomer stripe.Customer
+		err := json.Unmarshal(event.Data.Raw, &stripeCustomer)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse customer")
+			badRequestError(w, "Failed to parse customer")
+			return
+		}
+
+		if err := a.handleCustomerUpdated(&stripeCustomer); err != nil {
+			logrus.WithError(err).Error("Failed to handle customer updated")
+			internalServerError(w, r, "Failed to handle customer")
+			return
+		}
+		a.forgetCached(stripeCustomer.ID)
+
+	case "customer.tax_id.created", "customer.tax_id.updated", "customer.tax_id.deleted":
+		var stripeTaxID stripe.TaxID
+		err := json.Unmarshal(event.Data.Raw, &stripeTaxID)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse tax ID")
+			badRequestError(w, "Failed to parse tax ID")
+			return
+		}
+
+		if err := a.handleTaxIDEvent(event.Type, &stripeTaxID); err != nil {
+			logrus.WithError(err).Error("Failed to handle tax ID")
+			internalServerError(w, r, "Failed to handle tax ID")
+			return
+		}
+
+	case "invoice.finalized", "invoice.updated", "invoice.voided":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse invoice")
+			badRequestError(w, "Failed to parse invoice")
+			return
+		}
+
+		if err := upsertInvoice(a.db, &invoice); err != nil {
+			logrus.WithError(err).Error("Failed to store invoice")
+			internalServerError(w, r, "Failed to handle invoice")
+			return
+		}
+
+	case "invoice.payment_failed":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse invoice")
+			badRequestError(w, "Failed to parse invoice")
+			return
+		}
+
+		if err := upsertInvoice(a.db, &invoice); err != nil {
+			logrus.WithError(err).Error("Failed to store invoice")
+			internalServerError(w, r, "Failed to handle invoice")
+			return
+		}
+
+		if err := a.handleInvoicePaymentFailed(&invoice); err != nil {
+			logrus.WithError(err).Error("Failed to handle invoice payment failed")
+			internalServerError(w, r, "Failed to handle invoice")
+			return
+		}
+
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			logrus.WithError(err).Error("Failed to parse invoice")
+			badRequestError(w, "Failed to parse invoice")
+			return
+		}
+
+		if err := upsertInvoice(a.db, &invoice); err != nil {
+			logrus.WithError(err).Error("Failed to store invoice")
+			internalServerError(w, r, "Failed to handle invoice")
+			return
+		}
+
+		if err := a.handleInvoicePaid(&invoice); err != nil {
+			logrus.WithError(err).Error("Failed to handle invoice paid")
+			internalServerError(w, r, "Failed to handle invoice")
+			return
+		}
+
+		a.notifyInvoice(&invoice, notify.EventRenewal, "")
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{
-		"status": "success",
-	})
+	sendJSON(w, http.StatusOK, &StatusResponse{Status: "success"})
+}
+
+// forgetCached drops a Stripe object a webhook reported as changed from the
+// cache of Stripe lookups
+func (a *API) forgetCached(id string) {
+	if a.cache != nil {
+		a.cache.Forget(id)
+	}
+}
+
+// constructEvent verifies the webhook signature against each active webhook
+// secret, so that secrets can be rotated without downtime
+func (a *API) constructEvent(payload []byte, signature string) (stripe.Event, error) {
+	err := fmt.Errorf("no webhook secret configured")
+	for i, secret := range a.config.Stripe.ActiveWebhookSecrets() {
+		event, constructErr := webhook.ConstructEvent(payload, signature, secret.Value)
+		if constructErr == nil {
+			recordKeyUsage("webhook", secret.ID, i == 0)
+			return event, nil
+		}
+
+		// Only a bad signature means another secret may match
+		if constructErr != webhook.ErrNoValidSignature {
+			return event, constructErr
+		}
+		err = constructErr
+	}
+	return stripe.Event{}, err
 }
 
 // GetSubscriptionStatus gets the subscription status for a user
 func (a *API) GetSubscriptionStatus(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
 
 	// Get customer
 	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
@@ -227,9 +410,7 @@ func (a *API) GetSubscriptionStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if dbCustomer == nil {
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"has_subscription": false,
-		})
+		sendJSON(w, http.StatusOK, &SubscriptionStatusResponse{HasSubscription: false})
 		return
 	}
 
@@ -241,27 +422,106 @@ func (a *API) GetSubscriptionStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if subscription == nil {
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"has_subscription": false,
-		})
+		a.sendDelinquentSubscriptionStatus(w, r, dbCustomer)
 		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]interface{}{
-		"has_subscription":    true,
-		"subscription_status": subscription.Status,
-		"current_period_end":  subscription.CurrentPeriodEnd,
+	sendJSON(w, http.StatusOK, &SubscriptionStatusResponse{
+		HasSubscription:    true,
+		SubscriptionStatus: subscription.Status,
+		CurrentPeriodEnd:   &subscription.CurrentPeriodEnd,
+		Access:             models.AccessFull,
+		Subscription:       subscription,
+	})
+}
+
+// sendDelinquentSubscriptionStatus reports the status of a subscription whose
+// payments are failing, along with a link to fix the payment
+func (a *API) sendDelinquentSubscriptionStatus(w http.ResponseWriter, r *http.Request, dbCustomer *models.Customer) {
+	subscription, err := models.FindDelinquentSubscriptionByCustomerID(a.db, dbCustomer.ID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get subscription")
+		return
+	}
+
+	if subscription == nil {
+		sendJSON(w, http.StatusOK, &SubscriptionStatusResponse{HasSubscription: false})
+		return
+	}
+
+	state, err := models.FindDunningStateBySubscriptionID(a.db, subscription.ID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get dunning state")
+		return
+	}
+
+	// The billing portal session is only created on demand, with
+	// ?fix_payment_url=true
+	createSession, _ := strconv.ParseBool(r.URL.Query().Get("fix_payment_url"))
+
+	// Without a recorded failure, apply the first step of the schedule
+	if state == nil || !state.IsOpen() {
+		state = &models.DunningState{
+			AttemptCount: 1,
+			Access:       models.AccessLevel(a.config.Dunning.Schedule.AccessFor(1)),
+		}
+	}
+
+	sendJSON(w, http.StatusOK, &SubscriptionStatusResponse{
+		HasSubscription:    state.Access != models.AccessSuspended,
+		SubscriptionStatus: subscription.Status,
+		CurrentPeriodEnd:   &subscription.CurrentPeriodEnd,
+		Access:             state.Access,
+		Dunning: &DunningStatus{
+			AttemptCount:       state.AttemptCount,
+			LastFailedAt:       state.LastFailedAt,
+			NextPaymentAttempt: state.NextPaymentAttempt,
+			FixPaymentURL:      a.fixPaymentURL(dbCustomer, state, createSession),
+		},
+		Subscription: subscription,
 	})
 }
 
-// CancelSubscription cancels a subscription
+// SubscriptionListResponse lists the subscriptions of a customer
+type SubscriptionListResponse struct {
+	Subscriptions []models.Subscription `json:"subscriptions"`
+}
+
+// ListSubscriptions lists the subscriptions of the current user, including
+// canceled ones
+func (a *API) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
+		return
+	}
+
+	dbCustomer, err := models.FindCustomerByUserID(a.db, principal.UserID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get customer")
+		return
+	}
+
+	subscriptions := []models.Subscription{}
+	if dbCustomer != nil {
+		if subscriptions, err = models.FindSubscriptionsByCustomerID(a.db, dbCustomer.ID); err != nil {
+			internalServerError(w, r, "Failed to get subscriptions")
+			return
+		}
+	}
+
+	sendJSON(w, http.StatusOK, &SubscriptionListResponse{Subscriptions: subscriptions})
+}
+
+// CancelSubscription cancels the active subscription
 func (a *API) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
 
 	// Get customer
 	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
@@ -287,15 +547,48 @@ func (a *API) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	a.cancelSubscription(w, r, subscription)
+}
+
+// CancelSubscriptionByID cancels a subscription of the current user. Canceling
+// a canceled subscription succeeds.
+func (a *API) CancelSubscriptionByID(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		badRequestError(w, "Invalid subscription ID")
+		return
+	}
+
+	dbCustomer, ok := a.requireCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	subscription, err := models.FindCustomerSubscription(a.db, dbCustomer.ID, id)
+	if err != nil {
+		internalServerError(w, r, "Failed to get subscription")
+		return
+	}
+
+	if subscription == nil {
+		notFoundError(w, "Subscription not found")
+		return
+	}
+
+	if subscription.Status == models.SubscriptionStatusCanceled {
+		sendJSON(w, http.StatusOK, &StatusResponse{Status: "canceled"})
+		return
+	}
+
+	a.cancelSubscription(w, r, subscription)
+}
+
+// cancelSubscription cancels a subscription and sends the response
+func (a *API) cancelSubscription(w http.ResponseWriter, r *http.Request, subscription *models.Subscription) {
 	// Cancel subscription in Stripe
 	// Note: In a real implementation, you would use the Stripe API to cancel the subscription
 	// For now, we'll just update our database
 	// _, err = subscription.Cancel(subscription.StripeID, nil)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to cancel subscription in Stripe")
-		internalServerError(w, r, "Failed to cancel subscription")
-		return
-	}
 
 	// Update subscription in database
 	now := time.Now()
@@ -307,33 +600,13 @@ func (a *API) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sendJSON(w, http.StatusOK, map[string]string{
-		"status": "canceled",
-	})
+	sendJSON(w, http.StatusOK, &StatusResponse{Status: "canceled"})
 }
 
 // handleCheckoutSessionCompleted processes a completed checkout session
 func (a *API) handleCheckoutSessionCompleted(session *stripe.CheckoutSession) error {
-	// Get subscription
-	// Note: In a real implementation, you would use the Stripe API to get the subscription
-	// For now, we'll just create a mock subscription object
-	sub := &stripe.Subscription{
-		ID:               session.Subscription.ID,
-		Status:           "active",
-		CurrentPeriodEnd: time.Now().AddDate(0, 1, 0).Unix(), // 1 month from now
-		Items: &stripe.SubscriptionItemList{
-			Data: []*stripe.SubscriptionItem{
-				{
-					Price: &stripe.Price{
-						ID: "price_123",
-					},
-				},
-			},
-		},
-	}
-	var err error
-	if err != nil {
-		return fmt.Errorf("failed to get subscription: %w", err)
+	if session.Subscription == nil {
+		return nil
 	}
 
 	// Get customer
@@ -346,81 +619,23 @@ func (a *API) handleCheckoutSessionCompleted(session *stripe.CheckoutSession) er
 		return fmt.Errorf("customer not found: %s", session.Customer.ID)
 	}
 
-	// Check if subscription already exists
-	existingSub, err := models.FindSubscriptionByStripeID(a.db, sub.ID)
+	// L'événement ne contient que l'ID de l'abonnement ; il est relu sans
+	// passer par le cache puisqu'il est enregistré
+	sub, err := a.live.GetSubscription(session.Subscription.ID, nil)
 	if err != nil {
-		return fmt.Errorf("failed to check subscription: %w", err)
+		return fmt.Errorf("failed to get subscription: %w", err)
 	}
 
-	if existingSub != nil {
-		// Update existing subscription
-		existingSub.Status = models.SubscriptionStatus(sub.Status)
-		existingSub.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0)
-		if err := models.UpdateSubscription(a.db, existingSub); err != nil {
-			return fmt.Errorf("failed to update subscription: %w", err)
-		}
-	} else {
-		// Create new subscription
-		_, err = models.CreateSubscription(
-			a.db,
-			dbCustomer.ID,
-			sub.ID,
-			sub.Items.Data[0].Price.ID,
-			models.SubscriptionStatus(sub.Status),
-			time.Unix(sub.CurrentPeriodEnd, 0),
-		)
-		if err != nil {
-			return fmt.Errorf("failed to create subscription: %w", err)
-		}
+	if _, err := billing.UpsertSubscription(a.db, dbCustomer.ID, sub); err != nil {
+		return err
 	}
-
 	return nil
 }
 
 // handleSubscriptionUpdated processes an updated subscription
 func (a *API) handleSubscriptionUpdated(sub *stripe.Subscription) error {
-	// Get subscription from database
-	subscription, err := models.FindSubscriptionByStripeID(a.db, sub.ID)
-	if err != nil {
-		return fmt.Errorf("failed to get subscription: %w", err)
-	}
-
-	if subscription == nil {
-		// This might be a new subscription created outside of our system
-		// Get customer
-		dbCustomer, err := models.FindCustomerByStripeID(a.db, sub.Customer.ID)
-		if err != nil {
-			return fmt.Errorf("failed to get customer: %w", err)
-		}
-
-		if dbCustomer == nil {
-			return fmt.Errorf("customer not found: %s", sub.Customer.ID)
-		}
-
-		// Create new subscription
-		_, err = models.CreateSubscription(
-			a.db,
-			dbCustomer.ID,
-			sub.ID,
-			sub.Items.Data[0].Price.ID,
-			models.SubscriptionStatus(sub.Status),
-			time.Unix(sub.CurrentPeriodEnd, 0),
-		)
-		if err != nil {
-			return fmt.Errorf("failed to create subscription: %w", err)
-		}
-	} else {
-		// Update existing subscription
-		subscription.Status = models.SubscriptionStatus(sub.Status)
-		subscription.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0)
-		if sub.CanceledAt > 0 {
-			canceledAt := time.Unix(sub.CanceledAt, 0)
-			subscription.CanceledAt = &canceledAt
-		}
-		if err := models.UpdateSubscription(a.db, subscription); err != nil {
-			return fmt.Errorf("failed to update subscription: %w", err)
-		}
+	if _, err := billing.UpsertStripeSubscription(a.db, sub); err != nil {
+		return err
 	}
-
 	return nil
 }
@@ -0,0 +1,632 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"testing"
+	"time"
+
+	"gostripe/billing"
+	"gostripe/fixtures"
+	"gostripe/gateway"
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// seedCustomer creates a customer in the fake Stripe and in the database
+func seedCustomer(t *testing.T, a *testAPI, userID uuid.UUID, email string) *models.Customer {
+	t.Helper()
+
+	stripeCustomer, err := a.stripe.NewCustomer(&stripe.CustomerParams{Email: stripe.String(email)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbCustomer, err := models.CreateCustomer(a.db, userID, stripeCustomer.ID, email, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbCustomer
+}
+
+// seedSubscription creates a subscription in the fake Stripe and in the database
+func seedSubscription(t *testing.T, a *testAPI, dbCustomer *models.Customer, priceID string, status stripe.SubscriptionStatus) *models.Subscription {
+	t.Helper()
+
+	stripeSub := a.stripe.AddSubscription(dbCustomer.StripeID, priceID, status)
+	dbSubscription, err := billing.UpsertSubscription(a.db, dbCustomer.ID, stripeSub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbSubscription
+}
+
+func TestCreateCheckoutSessionValidation(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+	token := testToken(t, uuid.Must(uuid.NewV4()), "user@example.com")
+
+	tests := []struct {
+		name string
+		body interface{}
+	}{
+		{"invalid body", []byte("{")},
+		{"no price", map[string]interface{}{}},
+		{"invalid currency", map[string]interface{}{"price_id": "price_basic", "currency": "euro"}},
+		{"success URL not allowed", map[string]interface{}{"price_id": "price_basic", "success_url": "https://evil.test/ok"}},
+		{"cancel URL not allowed", map[string]interface{}{"price_id": "price_basic", "cancel_url": "https://evil.test/ko"}},
+		{"invalid billing address collection", map[string]interface{}{"price_id": "price_basic", "billing_address_collection": "never"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/create-checkout-session", token, tt.body)
+			expectStatus(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+func TestCreateCheckoutSession(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990, LookupKey: "basic",
+		CurrencyOptions: map[string]*stripe.PriceCurrencyOptions{"usd": {UnitAmount: 1090}}})
+
+	tests := []struct {
+		name     string
+		body     map[string]interface{}
+		status   int
+		currency string
+	}{
+		{"price ID", map[string]interface{}{"price_id": "price_basic"}, http.StatusOK, ""},
+		{"lookup key", map[string]interface{}{"lookup_key": "basic"}, http.StatusOK, ""},
+		{"currency option", map[string]interface{}{"lookup_key": "basic", "currency": "USD"}, http.StatusOK, "usd"},
+		{"unavailable currency", map[string]interface{}{"price_id": "price_basic", "currency": "gbp"}, http.StatusBadRequest, ""},
+		{"unknown lookup key", map[string]interface{}{"lookup_key": "premium"}, http.StatusBadRequest, ""},
+	}
+
+	userID := uuid.Must(uuid.NewV4())
+	token := testToken(t, userID, "user@example.com")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/create-checkout-session", token, tt.body)
+			expectStatus(t, w, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			body := decode(t, w)
+			session, err := a.stripe.GetCheckoutSession(body["session_id"].(string), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body["url"] != session.URL {
+				t.Errorf("expected url %q, got %v", session.URL, body["url"])
+			}
+			if string(session.Currency) != tt.currency {
+				t.Errorf("expected currency %q, got %q", tt.currency, session.Currency)
+			}
+			if session.ClientReferenceID != userID.String() {
+				t.Errorf("expected client reference %s, got %s", userID, session.ClientReferenceID)
+			}
+			if session.SuccessURL != "https://app.example.com/success?session_id={CHECKOUT_SESSION_ID}" {
+				t.Errorf("unexpected success URL %s", session.SuccessURL)
+			}
+		})
+	}
+
+	// Un seul client Stripe est créé pour l'utilisateur
+	if calls := a.stripe.Calls("NewCustomer"); calls != 1 {
+		t.Errorf("expected 1 Stripe customer, got %d", calls)
+	}
+	dbCustomer, err := models.FindCustomerByUserID(db, userID)
+	if err != nil || dbCustomer == nil {
+		t.Fatalf("expected a customer, got %v (%v)", dbCustomer, err)
+	}
+}
+
+func TestCreateCheckoutSessionIdempotency(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+	token := testToken(t, uuid.Must(uuid.NewV4()), "user@example.com")
+	body := map[string]interface{}{"price_id": "price_basic"}
+
+	first := a.request(t, http.MethodPost, "/create-checkout-session", token, body, "Idempotency-Key", "checkout-1")
+	expectStatus(t, first, http.StatusOK)
+
+	retry := a.request(t, http.MethodPost, "/create-checkout-session", token, body, "Idempotency-Key", "checkout-1")
+	expectStatus(t, retry, http.StatusOK)
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected the retry to be replayed")
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("expected the same response, got %s and %s", first.Body.String(), retry.Body.String())
+	}
+	if calls := a.stripe.Calls("NewCheckoutSession"); calls != 1 {
+		t.Errorf("expected 1 checkout session, got %d", calls)
+	}
+
+	other := a.request(t, http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_other"}, "Idempotency-Key", "checkout-1")
+	expectStatus(t, other, http.StatusUnprocessableEntity)
+}
+
+func TestCreateCheckoutSessionStripeError(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+	a.stripe.FailNext("NewCheckoutSession", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError, Msg: "boom"})
+	token := testToken(t, uuid.Must(uuid.NewV4()), "user@example.com")
+
+	w := a.request(t, http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_basic"}, "Idempotency-Key", "checkout-2")
+	expectStatus(t, w, http.StatusInternalServerError)
+
+	// La clé est libérée après une erreur serveur
+	w = a.request(t, http.MethodPost, "/create-checkout-session", token, map[string]interface{}{"price_id": "price_basic"}, "Idempotency-Key", "checkout-2")
+	expectStatus(t, w, http.StatusOK)
+}
+
+func TestGetSubscriptionStatus(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	withoutCustomer := uuid.Must(uuid.NewV4())
+
+	withoutSubscription := uuid.Must(uuid.NewV4())
+	seedCustomer(t, a, withoutSubscription, "none@example.com")
+
+	active := uuid.Must(uuid.NewV4())
+	seedSubscription(t, a, seedCustomer(t, a, active, "active@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	pastDue := uuid.Must(uuid.NewV4())
+	seedSubscription(t, a, seedCustomer(t, a, pastDue, "late@example.com"), "price_basic", stripe.SubscriptionStatusPastDue)
+
+	tests := []struct {
+		name            string
+		userID          uuid.UUID
+		hasSubscription bool
+		access          interface{}
+	}{
+		{"no customer", withoutCustomer, false, nil},
+		{"no subscription", withoutSubscription, false, nil},
+		{"active", active, true, string(models.AccessFull)},
+		{"past due", pastDue, true, a.config.Dunning.Schedule.AccessFor(1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodGet, "/get-subscription-status", testToken(t, tt.userID, "user@example.com"), nil)
+			expectStatus(t, w, http.StatusOK)
+			body := decode(t, w)
+			if body["has_subscription"] != tt.hasSubscription {
+				t.Errorf("expected has_subscription %v, got %v", tt.hasSubscription, body["has_subscription"])
+			}
+			if body["access"] != tt.access {
+				t.Errorf("expected access %v, got %v", tt.access, body["access"])
+			}
+		})
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	withoutCustomer := uuid.Must(uuid.NewV4())
+
+	withoutSubscription := uuid.Must(uuid.NewV4())
+	seedCustomer(t, a, withoutSubscription, "none@example.com")
+
+	active := uuid.Must(uuid.NewV4())
+	dbSubscription := seedSubscription(t, a, seedCustomer(t, a, active, "active@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	tests := []struct {
+		name   string
+		userID uuid.UUID
+		status int
+	}{
+		{"no customer", withoutCustomer, http.StatusNotFound},
+		{"no subscription", withoutSubscription, http.StatusNotFound},
+		{"active", active, http.StatusOK},
+		{"already canceled", active, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/cancel-subscription", testToken(t, tt.userID, "user@example.com"), nil)
+			expectStatus(t, w, tt.status)
+		})
+	}
+
+	canceled, err := models.FindSubscriptionByStripeID(db, dbSubscription.StripeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != models.SubscriptionStatusCanceled || canceled.CanceledAt == nil {
+		t.Errorf("expected the subscription to be canceled, got %s", canceled.Status)
+	}
+}
+
+func TestListSubscriptions(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	withoutCustomer := uuid.Must(uuid.NewV4())
+	w := a.request(t, http.MethodGet, "/v1/me/subscriptions", testToken(t, withoutCustomer, "none@example.com"), nil)
+	expectStatus(t, w, http.StatusOK)
+	if subscriptions := decode(t, w)["subscriptions"].([]interface{}); len(subscriptions) != 0 {
+		t.Errorf("expected no subscriptions, got %v", subscriptions)
+	}
+
+	userID := uuid.Must(uuid.NewV4())
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+	seedSubscription(t, a, dbCustomer, "price_basic", stripe.SubscriptionStatusCanceled)
+	seedSubscription(t, a, dbCustomer, "price_basic", stripe.SubscriptionStatusActive)
+
+	w = a.request(t, http.MethodGet, "/v1/me/subscriptions", testToken(t, userID, "user@example.com"), nil)
+	expectStatus(t, w, http.StatusOK)
+	if subscriptions := decode(t, w)["subscriptions"].([]interface{}); len(subscriptions) != 2 {
+		t.Errorf("expected 2 subscriptions, got %v", subscriptions)
+	}
+}
+
+func TestCancelSubscriptionByID(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	dbSubscription := seedSubscription(t, a, seedCustomer(t, a, userID, "user@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	other := uuid.Must(uuid.NewV4())
+	otherSubscription := seedSubscription(t, a, seedCustomer(t, a, other, "other@example.com"), "price_basic", stripe.SubscriptionStatusActive)
+
+	token := testToken(t, userID, "user@example.com")
+	tests := []struct {
+		name   string
+		id     string
+		status int
+	}{
+		{"invalid ID", "sub_123", http.StatusBadRequest},
+		{"another customer", otherSubscription.ID.String(), http.StatusNotFound},
+		{"active", dbSubscription.ID.String(), http.StatusOK},
+		{"already canceled", dbSubscription.ID.String(), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodDelete, "/v1/me/subscriptions/"+tt.id, token, nil)
+			expectStatus(t, w, tt.status)
+		})
+	}
+
+	canceled, err := models.FindSubscriptionByStripeID(db, dbSubscription.StripeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.Status != models.SubscriptionStatusCanceled {
+		t.Errorf("expected the subscription to be canceled, got %s", canceled.Status)
+	}
+
+	untouched, err := models.FindSubscriptionByStripeID(db, otherSubscription.StripeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if untouched.Status != models.SubscriptionStatusActive {
+		t.Errorf("expected the other subscription to stay active, got %s", untouched.Status)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+
+	tests := []struct {
+		name      string
+		signature string
+	}{
+		{"no signature", ""},
+		{"malformed signature", "v1=nope"},
+		{"wrong signature", "t=1700000000,v1=0123456789abcdef"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/webhooks", "", []byte(`{"type":"invoice.paid"}`), "Stripe-Signature", tt.signature)
+			expectStatus(t, w, http.StatusBadRequest)
+		})
+	}
+}
+
+// expvarInt reads a counter of an expvar map, 0 when it is not set yet
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWebhookSecretRotation(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, map[string]string{
+		"STRIPE_WEBHOOK_SECRET":  "",
+		"STRIPE_WEBHOOK_SECRETS": "new:whsec_new,old:whsec_old:2999-01-01,expired:whsec_expired:2000-01-01",
+	}), nil)
+
+	payload, err := fixtures.Prepare([]byte(`{"id":"ch_rotation","object":"charge"}`), "charge.succeeded", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		secret  string
+		status  int
+		keyID   string
+		current bool
+	}{
+		{"current secret", "whsec_new", http.StatusOK, "new", true},
+		{"previous secret during the overlap", "whsec_old", http.StatusOK, "old", false},
+		{"expired secret", "whsec_expired", http.StatusBadRequest, "expired", false},
+		{"unknown secret", "whsec_unknown", http.StatusBadRequest, "unknown", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used := expvarInt(keyUsage, "webhook."+tt.keyID)
+			old := expvarInt(oldKeyUsage, "webhook")
+
+			signature := gateway.SignWebhook(payload, tt.secret, time.Now())
+			w := a.request(t, http.MethodPost, "/webhooks", "", payload, "Stripe-Signature", signature)
+			expectStatus(t, w, tt.status)
+
+			verified := int64(0)
+			if tt.status == http.StatusOK {
+				verified = 1
+			}
+			if got := expvarInt(keyUsage, "webhook."+tt.keyID) - used; got != verified {
+				t.Errorf("expected %d use of key %s, got %d", verified, tt.keyID, got)
+			}
+			previous := int64(0)
+			if tt.status == http.StatusOK && !tt.current {
+				previous = 1
+			}
+			if got := expvarInt(oldKeyUsage, "webhook") - old; got != previous {
+				t.Errorf("expected %d use of a previous key, got %d", previous, got)
+			}
+		})
+	}
+}
+
+func TestWebhookSubscriptionEvents(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+	stripeSub := a.stripe.AddSubscription(dbCustomer.StripeID, "price_basic", stripe.SubscriptionStatusActive)
+
+	expectSubscription := func(t *testing.T, status models.SubscriptionStatus) {
+		t.Helper()
+		dbSubscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbSubscription == nil {
+			t.Fatal("expected a subscription")
+		}
+		if dbSubscription.Status != status {
+			t.Errorf("expected status %s, got %s", status, dbSubscription.Status)
+		}
+	}
+
+	steps := []struct {
+		name      string
+		eventType string
+		status    stripe.SubscriptionStatus
+	}{
+		{"created outside of the API", "customer.subscription.updated", stripe.SubscriptionStatusActive},
+		{"payment failing", "customer.subscription.updated", stripe.SubscriptionStatusPastDue},
+		{"deleted", "customer.subscription.deleted", stripe.SubscriptionStatusCanceled},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			stripeSub.Status = step.status
+			if step.status == stripe.SubscriptionStatusCanceled {
+				stripeSub.CanceledAt = time.Now().Unix()
+			}
+			w := a.sendWebhook(t, step.eventType, stripeSub)
+			expectStatus(t, w, http.StatusOK)
+			expectSubscription(t, models.SubscriptionStatus(step.status))
+		})
+	}
+
+	t.Run("unknown customer", func(t *testing.T) {
+		other := a.stripe.AddSubscription("cus_unknown", "price_basic", stripe.SubscriptionStatusActive)
+		w := a.sendWebhook(t, "customer.subscription.updated", other)
+		expectStatus(t, w, http.StatusInternalServerError)
+	})
+}
+
+func TestWebhookCheckoutSessionCompleted(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+
+	userID := uuid.Must(uuid.NewV4())
+	w := a.request(t, http.MethodPost, "/create-checkout-session", testToken(t, userID, "user@example.com"), map[string]interface{}{"price_id": "price_basic"})
+	expectStatus(t, w, http.StatusOK)
+
+	session, err := a.stripe.CompleteCheckoutSession(decode(t, w)["session_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = a.sendWebhook(t, "checkout.session.completed", session)
+	expectStatus(t, w, http.StatusOK)
+
+	w = a.request(t, http.MethodGet, "/get-subscription-status", testToken(t, userID, "user@example.com"), nil)
+	expectStatus(t, w, http.StatusOK)
+	if body := decode(t, w); body["has_subscription"] != true {
+		t.Errorf("expected a subscription, got %v", body)
+	}
+
+	subscription, err := models.FindSubscriptionByStripeID(db, session.Subscription.ID)
+	if err != nil || subscription == nil || subscription.PriceID != "price_basic" || subscription.CurrentPeriodEnd.Unix() != session.Subscription.CurrentPeriodEnd {
+		t.Errorf("expected the subscription as stored in Stripe, got %+v (%v)", subscription, err)
+	}
+}
+
+func TestWebhookCheckoutSessionCompletedBypassesCache(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, map[string]string{"STRIPE_CACHE_TTL": "1m"}), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+
+	userID := uuid.Must(uuid.NewV4())
+	w := a.request(t, http.MethodPost, "/create-checkout-session", testToken(t, userID, "user@example.com"), map[string]interface{}{"price_id": "price_basic"})
+	expectStatus(t, w, http.StatusOK)
+	session, err := a.stripe.CompleteCheckoutSession(decode(t, w)["session_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Une lecture met l'abonnement en cache avant qu'il change dans Stripe
+	if _, err := a.gateway.GetSubscription(session.Subscription.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.stripe.SetSubscriptionStatus(session.Subscription.ID, stripe.SubscriptionStatusPastDue); err != nil {
+		t.Fatal(err)
+	}
+
+	w = a.sendWebhook(t, "checkout.session.completed", session)
+	expectStatus(t, w, http.StatusOK)
+
+	subscription, err := models.FindSubscriptionByStripeID(db, session.Subscription.ID)
+	if err != nil || subscription == nil || subscription.Status != models.SubscriptionStatusPastDue {
+		t.Errorf("expected the subscription as it is in Stripe, got %+v (%v)", subscription, err)
+	}
+}
+
+func TestWebhookCustomerUpdated(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+	pm := a.stripe.AddPaymentMethod(dbCustomer.StripeID, stripe.PaymentMethodCardBrandVisa, "4242")
+
+	stripeCustomer, err := a.stripe.UpdateCustomer(dbCustomer.StripeID, &stripe.CustomerParams{
+		Email:   stripe.String("new@example.com"),
+		Name:    stripe.String("Jeanne Martin"),
+		Address: &stripe.AddressParams{City: stripe.String("Lyon"), Country: stripe.String("FR")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := a.sendWebhook(t, "customer.updated", stripeCustomer)
+	expectStatus(t, w, http.StatusOK)
+
+	updated, err := models.FindCustomerByUserID(db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Email != "new@example.com" || updated.Name != "Jeanne Martin" || updated.AddressCity != "Lyon" {
+		t.Errorf("customer was not updated: %+v", updated)
+	}
+	if updated.DefaultPaymentMethod != pm.ID {
+		t.Errorf("expected the default payment method %s, got %q", pm.ID, updated.DefaultPaymentMethod)
+	}
+}
+
+func TestWebhookFixtures(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	userID := uuid.Must(uuid.NewV4())
+	dbCustomer := seedCustomer(t, a, userID, "user@example.com")
+	// checkout.session.completed relit l'abonnement dans Stripe
+	stripeSub := a.stripe.AddSubscription(dbCustomer.StripeID, "price_fixture", stripe.SubscriptionStatusActive)
+	replace := map[string]string{fixtures.CustomerID: dbCustomer.StripeID, fixtures.SubscriptionID: stripeSub.ID, fixtures.UserID: userID.String()}
+
+	// Tous les types d'événements gérés, dans un ordre plausible
+	steps := []struct {
+		eventType string
+		check     func(t *testing.T)
+	}{
+		{"customer.updated", func(t *testing.T) {
+			customer, err := models.FindCustomerByUserID(db, userID)
+			if err != nil || customer.Name != "Jeanne Martin" || customer.AddressCity != "Paris" {
+				t.Errorf("customer was not updated: %+v (%v)", customer, err)
+			}
+		}},
+		{"checkout.session.completed", func(t *testing.T) {
+			subscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+			if err != nil || subscription == nil || subscription.CustomerID != dbCustomer.ID || subscription.PriceID != "price_fixture" {
+				t.Errorf("expected the subscription, got %+v (%v)", subscription, err)
+			}
+		}},
+		{"customer.subscription.updated", func(t *testing.T) {
+			subscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+			if err != nil || subscription == nil {
+				t.Fatalf("expected the subscription, got %v", err)
+			}
+			if subscription.CurrentPeriodStart == nil || subscription.CurrentPeriodStart.Unix() != 1735689600 || subscription.LatestInvoiceID != fixtures.InvoiceID ||
+				subscription.DefaultPaymentMethodID != "pm_fixture" || subscription.Metadata["user_id"] != userID.String() || len(subscription.Items) != 1 {
+				t.Errorf("expected the full subscription to be stored, got %+v", subscription)
+			}
+		}},
+		{"customer.subscription.trial_will_end", nil},
+		{"customer.tax_id.created", nil},
+		{"customer.tax_id.updated", func(t *testing.T) {
+			taxID, err := models.FindTaxIDByStripeID(db, fixtures.TaxID)
+			if err != nil || taxID == nil || taxID.VerificationStatus != "verified" {
+				t.Errorf("expected a verified tax ID, got %+v (%v)", taxID, err)
+			}
+		}},
+		{"customer.tax_id.deleted", nil},
+		{"invoice.finalized", nil},
+		{"invoice.updated", nil},
+		{"invoice.payment_failed", func(t *testing.T) {
+			subscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+			if err != nil || subscription == nil {
+				t.Fatalf("expected the subscription, got %v", err)
+			}
+			state, err := models.FindDunningStateBySubscriptionID(db, subscription.ID)
+			if err != nil || state == nil || !state.IsOpen() {
+				t.Errorf("expected an open dunning state, got %+v (%v)", state, err)
+			}
+		}},
+		{"invoice.paid", func(t *testing.T) {
+			invoice, err := models.FindInvoiceByStripeID(db, fixtures.InvoiceID)
+			if err != nil || invoice == nil || invoice.Status != "paid" || !invoice.SubscriptionID.Valid {
+				t.Errorf("expected a paid invoice, got %+v (%v)", invoice, err)
+			}
+		}},
+		{"invoice.voided", nil},
+		{"customer.subscription.deleted", func(t *testing.T) {
+			subscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+			if err != nil || subscription == nil || subscription.Status != models.SubscriptionStatus(stripe.SubscriptionStatusCanceled) {
+				t.Errorf("expected a canceled subscription, got %+v (%v)", subscription, err)
+			}
+		}},
+	}
+
+	for _, step := range steps {
+		t.Run(step.eventType, func(t *testing.T) {
+			w := a.sendFixture(t, step.eventType, replace)
+			expectStatus(t, w, http.StatusOK)
+			if step.check != nil {
+				step.check(t)
+			}
+		})
+	}
+
+	t.Run("every fixture is replayed", func(t *testing.T) {
+		types, err := fixtures.Types(fixtures.Latest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(types) != len(steps) {
+			t.Errorf("expected %d fixtures, got %v", len(steps), types)
+		}
+	})
+}
@@ -1,31 +1,38 @@
 package api
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
 	"time"
 
+	"gostripe/billing"
 	"gostripe/models"
 
+	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/checkout/session"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/sub"
 )
 
 // SyncSubscriptionRequest représente la requête pour synchroniser un abonnement
 type SyncSubscriptionRequest struct {
-	SessionID string `json:"session_id"`
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// SyncSubscriptionResponse représente le résultat d'une synchronisation
+type SyncSubscriptionResponse struct {
+	Success            bool                      `json:"success"`
+	AlreadyProcessed   bool                      `json:"already_processed,omitempty"`
+	Message            string                    `json:"message"`
+	HasSubscription    bool                      `json:"has_subscription,omitempty"`
+	SubscriptionStatus models.SubscriptionStatus `json:"subscription_status,omitempty"`
+	CurrentPeriodEnd   *time.Time                `json:"current_period_end,omitempty"`
 }
 
 // SyncSubscription force la synchronisation de l'abonnement après un paiement réussi
 func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 	// Décoder la requête pour obtenir l'ID de session
 	var req SyncSubscriptionRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		logrus.WithError(err).Error("Failed to decode request body")
-		badRequestError(w, "Invalid request body")
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
@@ -37,11 +44,12 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Récupérer l'utilisateur à partir du contexte
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
 
 	// Vérifier si cette session a déjà été traitée
 	logrus.WithFields(logrus.Fields{
@@ -51,7 +59,7 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 
 	// Vérifier si la session a déjà été traitée - mais ne pas créer immédiatement un enregistrement
 	var processedSession *models.ProcessedSession
-	processedSession, err = models.FindProcessedSessionBySessionID(a.db, req.SessionID)
+	processedSession, err := models.FindProcessedSessionBySessionID(a.db, req.SessionID)
 
 	var newlyCreatedSession bool = false
 
@@ -86,9 +94,9 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 				"original_user_id": processedSession.UserID,
 			}).Warn("Attempt to use a session ID that belongs to another user")
 
-			sendJSON(w, http.StatusForbidden, map[string]interface{}{
-				"success": false,
-				"message": "Cette session de paiement a déjà été utilisée par un autre compte",
+			sendJSON(w, http.StatusForbidden, &SyncSubscriptionResponse{
+				Success: false,
+				Message: "Cette session de paiement a déjà été utilisée par un autre compte",
 			})
 			return
 		}
@@ -103,10 +111,10 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
 		if err != nil || dbCustomer == nil {
 			// Si on ne trouve pas le client, on renvoie un message générique
-			sendJSON(w, http.StatusOK, map[string]interface{}{
-				"success": true,
-				"already_processed": true,
-				"message": "Ce paiement a déjà été traité. Votre abonnement est actif.",
+			sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+				Success:          true,
+				AlreadyProcessed: true,
+				Message:          "Ce paiement a déjà été traité. Votre abonnement est actif.",
 			})
 			return
 		}
@@ -115,22 +123,22 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		subscription, err := models.FindActiveSubscriptionByCustomerID(a.db, dbCustomer.ID)
 		if err != nil || subscription == nil {
 			// Si on ne trouve pas d'abonnement actif, envoyer un message générique
-			sendJSON(w, http.StatusOK, map[string]interface{}{
-				"success": true,
-				"already_processed": true,
-				"message": "Ce paiement a déjà été traité. Votre abonnement est actif.",
+			sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+				Success:          true,
+				AlreadyProcessed: true,
+				Message:          "Ce paiement a déjà été traité. Votre abonnement est actif.",
 			})
 			return
 		}
 
 		// Renvoyer les détails de l'abonnement existant
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"success": true,
-			"already_processed": true,
-			"message": "Ce paiement a déjà été traité. Votre abonnement est actif.",
-			"has_subscription": true,
-			"subscription_status": string(subscription.Status),
-			"current_period_end": subscription.CurrentPeriodEnd,
+		sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+			Success:            true,
+			AlreadyProcessed:   true,
+			Message:            "Ce paiement a déjà été traité. Votre abonnement est actif.",
+			HasSubscription:    true,
+			SubscriptionStatus: subscription.Status,
+			CurrentPeriodEnd:   &subscription.CurrentPeriodEnd,
 		})
 		return
 	}
@@ -145,7 +153,7 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		"session_id": req.SessionID,
 	}).Info("Fetching session from Stripe")
 
-	sess, err := session.Get(req.SessionID, params)
+	sess, err := a.live.GetCheckoutSession(req.SessionID, params)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to retrieve Stripe session")
 		internalServerError(w, r, "Failed to retrieve Stripe session")
@@ -172,23 +180,32 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		"customer_id": customerID,
 	}).Info("Retrieved session from Stripe")
 
-	// Vérifier si la session contient un abonnement
-	if sess.Subscription == nil {
+	// La session doit avoir été créée pour l'utilisateur : sans cette
+	// vérification, un ID de session suffirait à s'approprier l'abonnement
+	// d'un autre compte
+	if !checkoutSessionBelongsTo(sess, userID) {
 		logrus.WithFields(logrus.Fields{
 			"session_id": req.SessionID,
-		}).Error("No subscription found in Stripe session")
+			"user_id":    userID,
+		}).Warn("Attempt to sync a checkout session created for another user")
 
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"success": false,
-			"message": "No subscription found in Stripe session",
+		sendJSON(w, http.StatusForbidden, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "Cette session de paiement appartient à un autre compte",
 		})
 		return
 	}
 
-	// Récupérer l'utilisateur à partir du contexte
-	userID, err = getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	// Vérifier si la session contient un abonnement
+	if sess.Subscription == nil || sess.Customer == nil {
+		logrus.WithFields(logrus.Fields{
+			"session_id": req.SessionID,
+		}).Error("No subscription found in Stripe session")
+
+		sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "No subscription found in Stripe session",
+		})
 		return
 	}
 
@@ -207,6 +224,21 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		"stripe_customer_id": sess.Customer.ID,
 	}).Info("Customer lookup result")
 
+	// Le client de la session doit être celui de l'utilisateur
+	if dbCustomer != nil && dbCustomer.StripeID != sess.Customer.ID {
+		logrus.WithFields(logrus.Fields{
+			"session_id":         req.SessionID,
+			"user_id":            userID,
+			"stripe_customer_id": sess.Customer.ID,
+		}).Warn("Checkout session paid by another Stripe customer")
+
+		sendJSON(w, http.StatusForbidden, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "Cette session de paiement appartient à un autre compte",
+		})
+		return
+	}
+
 	// Si le client n'existe pas, nous devons le créer avec les informations de la session Stripe
 	if dbCustomer == nil {
 		logrus.WithFields(logrus.Fields{
@@ -215,13 +247,27 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 		}).Info("Customer not found in database, creating new customer record")
 
 		// Récupérer les détails du client depuis Stripe
-		stripeCustomer, err := customer.Get(sess.Customer.ID, nil)
+		stripeCustomer, err := a.live.GetCustomer(sess.Customer.ID, nil)
 		if err != nil {
 			logrus.WithError(err).Error("Failed to get customer details from Stripe")
 			internalServerError(w, r, "Failed to get customer details from Stripe")
 			return
 		}
 
+		// Un client Stripe créé pour un autre utilisateur ne lui est pas rattaché
+		if owner := stripeCustomer.Metadata["user_id"]; owner != "" && owner != userID.String() {
+			logrus.WithFields(logrus.Fields{
+				"user_id":            userID,
+				"stripe_customer_id": stripeCustomer.ID,
+			}).Warn("Stripe customer created for another user")
+
+			sendJSON(w, http.StatusForbidden, &SyncSubscriptionResponse{
+				Success: false,
+				Message: "Cette session de paiement appartient à un autre compte",
+			})
+			return
+		}
+
 		// Log des détails du client Stripe avant création
 		logrus.WithFields(logrus.Fields{
 			"stripe_customer_id": stripeCustomer.ID,
@@ -236,6 +282,14 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 			internalServerError(w, r, "Failed to create customer")
 			return
 		}
+		if dbCustomer.StripeID == stripeCustomer.ID {
+			applyStripeCustomer(dbCustomer, stripeCustomer)
+			if err := models.UpdateCustomer(a.db, dbCustomer); err != nil {
+				logrus.WithError(err).Error("Failed to update customer in database")
+				internalServerError(w, r, "Failed to create customer")
+				return
+			}
+		}
 
 		logrus.WithFields(logrus.Fields{
 			"user_id": userID,
@@ -252,84 +306,35 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 
 	if dbCustomer == nil {
 		logrus.Error("Customer is still nil after creation attempt")
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"success": false,
-			"message": "Customer not found or could not be created",
+		sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "Customer not found or could not be created",
 		})
 		return
 	}
 
-	// Extraire les informations de l'abonnement
-	stripeSub := sess.Subscription
-	hasSubscription = true
-	stripeSubscriptionID := stripeSub.ID
-	subscriptionStatus := string(stripeSub.Status)
-	currentPeriodEnd := time.Unix(stripeSub.CurrentPeriodEnd, 0)
-
-	// Déterminer l'ID du prix
-	var priceID string
-	if len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Price != nil {
-		priceID = stripeSub.Items.Data[0].Price.ID
-	} else {
-		// Utiliser un ID de prix par défaut si non disponible
-		priceID = "price_1PSQokJKyP34gH73kOw1DhX1"
+	// Enregistrer l'abonnement tel qu'il est dans Stripe
+	subscription, err := billing.UpsertSubscription(a.db, dbCustomer.ID, sess.Subscription)
+	if errors.Is(err, billing.ErrCustomerMismatch) {
+		logrus.WithError(err).WithField("user_id", userID).Warn("Subscription stored for another customer")
+		sendJSON(w, http.StatusForbidden, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "Cet abonnement appartient à un autre compte",
+		})
+		return
 	}
-
-	// Vérifier si l'abonnement existe déjà dans la base de données
-	dbSubscription, err := models.FindSubscriptionByStripeID(a.db, stripeSubscriptionID)
 	if err != nil {
-		logrus.WithError(err).Error("Failed to check if subscription exists in database")
-		internalServerError(w, r, "Failed to check subscription")
+		logrus.WithError(err).Error("Failed to store subscription in database")
+		internalServerError(w, r, "Failed to store subscription")
 		return
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"subscription_exists": dbSubscription != nil,
-		"stripe_id": stripeSubscriptionID,
-		"status": subscriptionStatus,
-	}).Info("Checking if subscription exists in database")
-
-	if dbSubscription != nil {
-		// L'abonnement existe déjà, nous le mettons à jour
-		dbSubscription.Status = models.SubscriptionStatus(subscriptionStatus)
-		dbSubscription.CurrentPeriodEnd = currentPeriodEnd
-		dbSubscription.PriceID = priceID
-
-		err = models.UpdateSubscription(a.db, dbSubscription)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to update subscription in database")
-			internalServerError(w, r, "Failed to update subscription")
-			return
-		}
-
-		logrus.WithFields(logrus.Fields{
-			"customer_id":            dbCustomer.ID,
-			"stripe_subscription_id": stripeSubscriptionID,
-			"status":                 subscriptionStatus,
-		}).Info("Updated subscription in database")
-	} else {
-		// L'abonnement n'existe pas encore, nous le créons
-		createdSubscription, err := models.CreateSubscription(
-			a.db,
-			dbCustomer.ID,
-			stripeSubscriptionID,
-			priceID,
-			models.SubscriptionStatus(subscriptionStatus),
-			currentPeriodEnd,
-		)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to create subscription in database")
-			internalServerError(w, r, "Failed to create subscription")
-			return
-		}
-
-		logrus.WithFields(logrus.Fields{
-			"customer_id":            dbCustomer.ID,
-			"stripe_subscription_id": stripeSubscriptionID,
-			"status":                 subscriptionStatus,
-			"subscription_id":        createdSubscription.ID,
-		}).Info("Created new subscription in database")
-	}
+		"customer_id":            dbCustomer.ID,
+		"stripe_subscription_id": subscription.StripeID,
+		"status":                 subscription.Status,
+		"subscription_id":        subscription.ID,
+	}).Info("Stored subscription in database")
 
 	// Enregistrer la session comme traitée si elle ne l'a pas déjà été
 	if newlyCreatedSession && req.SessionID != "" {
@@ -351,23 +356,24 @@ func (a *API) SyncSubscription(w http.ResponseWriter, r *http.Request) {
 	}).Info("Session processing completed successfully")
 
 	// Réponse de succès
-	sendJSON(w, http.StatusOK, map[string]interface{}{
-		"success":             true,
-		"message":             "Subscription synchronized successfully",
-		"has_subscription":    hasSubscription,
-		"subscription_status": subscriptionStatus,
-		"current_period_end":  currentPeriodEnd,
+	sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+		Success:            true,
+		Message:            "Subscription synchronized successfully",
+		HasSubscription:    true,
+		SubscriptionStatus: subscription.Status,
+		CurrentPeriodEnd:   &subscription.CurrentPeriodEnd,
 	})
 }
 
 // syncSubscriptionFromCustomer synchronise l'abonnement en utilisant les informations du client
 func (a *API) syncSubscriptionFromCustomer(w http.ResponseWriter, r *http.Request) {
 	// Get user ID from context
-	userID, err := getUserID(r.Context())
-	if err != nil {
-		internalServerError(w, r, "Failed to get user ID")
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
 		return
 	}
+	userID := principal.UserID
 
 	// Get customer from database
 	dbCustomer, err := models.FindCustomerByUserID(a.db, userID)
@@ -377,27 +383,26 @@ func (a *API) syncSubscriptionFromCustomer(w http.ResponseWriter, r *http.Reques
 	}
 
 	if dbCustomer == nil {
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"success": false,
-			"message": "Customer not found",
+		sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "Customer not found",
 		})
 		return
 	}
 
-	// Vérifier que le client existe dans Stripe
-	_, err = customer.Get(dbCustomer.StripeID, nil)
+	// Vérifier que le client existe dans Stripe et enregistrer son profil
+	stripeCustomer, err := a.live.GetCustomer(dbCustomer.StripeID, nil)
 	if err != nil {
 		logrus.WithError(err).Error("Failed to get customer from Stripe")
 		internalServerError(w, r, "Failed to get customer from Stripe")
 		return
 	}
-
-	// Récupérer directement les abonnements depuis l'API Stripe
-	hasSubscription := false
-	var stripeSubscriptionID string
-	var subscriptionStatus string
-	var currentPeriodEnd time.Time
-	var priceID string
+	applyStripeCustomer(dbCustomer, stripeCustomer)
+	if err := models.UpdateCustomer(a.db, dbCustomer); err != nil {
+		logrus.WithError(err).Error("Failed to update customer in database")
+		internalServerError(w, r, "Failed to update customer")
+		return
+	}
 
 	// Paramètres pour récupérer les abonnements actifs du client
 	params := &stripe.SubscriptionListParams{}
@@ -409,94 +414,54 @@ func (a *API) syncSubscriptionFromCustomer(w http.ResponseWriter, r *http.Reques
 	params.Limit = stripe.Int64(1)
 
 	// Récupérer les abonnements depuis Stripe
-	subscriptionIterator := sub.List(params)
-
-	// Vérifier si nous avons au moins un abonnement
-	if subscriptionIterator.Next() {
-		// Récupérer le premier abonnement
-		stripeSub := subscriptionIterator.Subscription()
-
-		hasSubscription = true
-		stripeSubscriptionID = stripeSub.ID
-		subscriptionStatus = string(stripeSub.Status)
-		currentPeriodEnd = time.Unix(stripeSub.CurrentPeriodEnd, 0)
-
-		// Déterminer l'ID du prix
-		if len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Price != nil {
-			priceID = stripeSub.Items.Data[0].Price.ID
-		} else {
-			// Utiliser un ID de prix par défaut si non disponible
-			priceID = "price_1PSQokJKyP34gH73kOw1DhX1"
-		}
-
-		// Vérifier si l'abonnement existe déjà dans la base de données
-		dbSubscription, err := models.FindSubscriptionByStripeID(a.db, stripeSubscriptionID)
-		if err != nil {
-			logrus.WithError(err).Error("Failed to check if subscription exists in database")
-			internalServerError(w, r, "Failed to check subscription")
-			return
-		}
-
-		if dbSubscription != nil {
-			// L'abonnement existe déjà, nous le mettons à jour
-			dbSubscription.Status = models.SubscriptionStatus(subscriptionStatus)
-			dbSubscription.CurrentPeriodEnd = currentPeriodEnd
-			dbSubscription.PriceID = priceID
-
-			err = models.UpdateSubscription(a.db, dbSubscription)
-			if err != nil {
-				logrus.WithError(err).Error("Failed to update subscription in database")
-				internalServerError(w, r, "Failed to update subscription")
-				return
-			}
-
-			logrus.WithFields(logrus.Fields{
-				"customer_id":            dbCustomer.ID,
-				"stripe_subscription_id": stripeSubscriptionID,
-				"status":                 subscriptionStatus,
-			}).Info("Updated subscription in database")
-		} else {
-			// L'abonnement n'existe pas encore, nous le créons
-			_, err = models.CreateSubscription(
-				a.db,
-				dbCustomer.ID,
-				stripeSubscriptionID,
-				priceID,
-				models.SubscriptionStatus(subscriptionStatus),
-				currentPeriodEnd,
-			)
-			if err != nil {
-				logrus.WithError(err).Error("Failed to create subscription in database")
-				internalServerError(w, r, "Failed to create subscription")
-				return
-			}
-
-			logrus.WithFields(logrus.Fields{
-				"customer_id":            dbCustomer.ID,
-				"stripe_subscription_id": stripeSubscriptionID,
-				"status":                 subscriptionStatus,
-			}).Info("Created new subscription in database")
-		}
-	} else if subscriptionIterator.Err() != nil {
+	stripeSubs, err := a.live.ListSubscriptions(params, 1)
+	if err != nil {
 		// Une erreur s'est produite lors de la récupération des abonnements
-		logrus.WithError(subscriptionIterator.Err()).Error("Failed to list subscriptions from Stripe")
+		logrus.WithError(err).Error("Failed to list subscriptions from Stripe")
 		internalServerError(w, r, "Failed to list subscriptions from Stripe")
 		return
-	} else {
+	}
+
+	// Vérifier si nous avons au moins un abonnement
+	if len(stripeSubs) == 0 {
 		// Aucun abonnement trouvé pour ce client
-		sendJSON(w, http.StatusOK, map[string]interface{}{
-			"success": false,
-			"message": "No subscription found for this customer",
+		sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+			Success: false,
+			Message: "No subscription found for this customer",
 		})
 		return
 	}
 
+	// Enregistrer le premier abonnement tel qu'il est dans Stripe
+	subscription, err := billing.UpsertSubscription(a.db, dbCustomer.ID, stripeSubs[0])
+	if err != nil {
+		logrus.WithError(err).Error("Failed to store subscription in database")
+		internalServerError(w, r, "Failed to store subscription")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"customer_id":            dbCustomer.ID,
+		"stripe_subscription_id": subscription.StripeID,
+		"status":                 subscription.Status,
+	}).Info("Stored subscription in database")
+
 	// Réponse de succès
-	sendJSON(w, http.StatusOK, map[string]interface{}{
-		"success":             true,
-		"message":             "Subscription synchronized successfully",
-		"has_subscription":    hasSubscription,
-		"subscription_status": subscriptionStatus,
-		"current_period_end":  currentPeriodEnd,
+	sendJSON(w, http.StatusOK, &SyncSubscriptionResponse{
+		Success:            true,
+		Message:            "Subscription synchronized successfully",
+		HasSubscription:    true,
+		SubscriptionStatus: subscription.Status,
+		CurrentPeriodEnd:   &subscription.CurrentPeriodEnd,
 	})
 }
+
+// checkoutSessionBelongsTo tells whether a checkout session was created for
+// a user, as recorded by CreateCheckoutSession in client_reference_id and in
+// the metadata
+func checkoutSessionBelongsTo(sess *stripe.CheckoutSession, userID uuid.UUID) bool {
+	if sess.ClientReferenceID != "" {
+		return sess.ClientReferenceID == userID.String()
+	}
+	return sess.Metadata["user_id"] == userID.String()
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"gostripe/billing"
+	"gostripe/models"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// paidCheckoutSession creates a checkout session of a user in the fake Stripe
+// and pays it
+func paidCheckoutSession(t *testing.T, a *testAPI, userID uuid.UUID, customerID, priceID string) *stripe.CheckoutSession {
+	t.Helper()
+
+	session, err := a.stripe.NewCheckoutSession(&stripe.CheckoutSessionParams{
+		ClientReferenceID: stripe.String(userID.String()),
+		Customer:          stripe.String(customerID),
+		Mode:              stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:         []*stripe.CheckoutSessionLineItemParams{{Price: stripe.String(priceID), Quantity: stripe.Int64(1)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err = a.stripe.CompleteCheckoutSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestSyncSubscriptionWithSession(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+	a.stripe.AddPrice(&stripe.Price{ID: "price_basic", Active: true, Currency: "eur", UnitAmount: 990})
+
+	// Le client Stripe n'existe pas encore en base
+	owner := uuid.Must(uuid.NewV4())
+	stripeCustomer, err := a.stripe.NewCustomer(&stripe.CustomerParams{Email: stripe.String("owner@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	paid := paidCheckoutSession(t, a, owner, stripeCustomer.ID, "price_basic")
+	second := paidCheckoutSession(t, a, owner, stripeCustomer.ID, "price_basic")
+
+	unpaid, err := a.stripe.NewCheckoutSession(&stripe.CheckoutSessionParams{
+		ClientReferenceID: stripe.String(owner.String()),
+		Customer:          stripe.String(stripeCustomer.ID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Un autre utilisateur, avec son propre client, paie une session pour le
+	// client Stripe du premier
+	other := uuid.Must(uuid.NewV4())
+	seedCustomer(t, a, other, "other@example.com")
+	foreign := paidCheckoutSession(t, a, other, stripeCustomer.ID, "price_basic")
+
+	// Un utilisateur sans client paie une session pour un client Stripe créé
+	// pour un autre utilisateur
+	newcomer := uuid.Must(uuid.NewV4())
+	taken, err := a.stripe.NewCustomer(&stripe.CustomerParams{
+		Email:  stripe.String("taken@example.com"),
+		Params: stripe.Params{Metadata: map[string]string{"user_id": owner.String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hijack := paidCheckoutSession(t, a, newcomer, taken.ID, "price_basic")
+
+	tests := []struct {
+		name             string
+		userID           uuid.UUID
+		sessionID        string
+		status           int
+		success          interface{}
+		alreadyProcessed interface{}
+	}{
+		{"session created for another user", uuid.Must(uuid.NewV4()), second.ID, http.StatusForbidden, false, nil},
+		{"paid session", owner, paid.ID, http.StatusOK, true, nil},
+		{"same session again", owner, paid.ID, http.StatusOK, true, true},
+		{"session of another user", uuid.Must(uuid.NewV4()), paid.ID, http.StatusForbidden, false, nil},
+		{"session without subscription", owner, unpaid.ID, http.StatusOK, false, nil},
+		{"session paid by another Stripe customer", other, foreign.ID, http.StatusForbidden, false, nil},
+		{"Stripe customer of another user", newcomer, hijack.ID, http.StatusForbidden, false, nil},
+		{"unknown session", owner, "cs_unknown", http.StatusInternalServerError, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/sync-subscription", testToken(t, tt.userID, "owner@example.com"), map[string]string{"session_id": tt.sessionID})
+			expectStatus(t, w, tt.status)
+			body := decode(t, w)
+			if body["success"] != tt.success {
+				t.Errorf("expected success %v, got %v", tt.success, body)
+			}
+			if body["already_processed"] != tt.alreadyProcessed {
+				t.Errorf("expected already_processed %v, got %v", tt.alreadyProcessed, body)
+			}
+		})
+	}
+
+	dbCustomer, err := models.FindCustomerByUserID(db, owner)
+	if err != nil || dbCustomer == nil {
+		t.Fatalf("expected the customer to be created, got %v (%v)", dbCustomer, err)
+	}
+	dbSubscription, err := models.FindSubscriptionByStripeID(db, paid.Subscription.ID)
+	if err != nil || dbSubscription == nil {
+		t.Fatalf("expected the subscription to be created, got %v (%v)", dbSubscription, err)
+	}
+	if dbSubscription.CustomerID != dbCustomer.ID || dbSubscription.PriceID != "price_basic" {
+		t.Errorf("unexpected subscription %+v", dbSubscription)
+	}
+	if customer, err := models.FindCustomerByUserID(db, newcomer); err != nil || customer != nil {
+		t.Errorf("expected no customer for the newcomer, got %+v (%v)", customer, err)
+	}
+}
+
+func TestSyncSubscriptionFromCustomer(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	withoutCustomer := uuid.Must(uuid.NewV4())
+
+	withoutSubscription := uuid.Must(uuid.NewV4())
+	seedCustomer(t, a, withoutSubscription, "none@example.com")
+
+	subscribed := uuid.Must(uuid.NewV4())
+	dbCustomer := seedCustomer(t, a, subscribed, "subscribed@example.com")
+	stripeSub := a.stripe.AddSubscription(dbCustomer.StripeID, "price_basic", stripe.SubscriptionStatusTrialing)
+
+	tests := []struct {
+		name    string
+		userID  uuid.UUID
+		success bool
+	}{
+		{"no customer", withoutCustomer, false},
+		{"no subscription", withoutSubscription, false},
+		{"subscription created in Stripe", subscribed, true},
+		{"subscription already stored", subscribed, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := a.request(t, http.MethodPost, "/sync-subscription", testToken(t, tt.userID, "user@example.com"), map[string]string{})
+			expectStatus(t, w, http.StatusOK)
+			if body := decode(t, w); body["success"] != tt.success {
+				t.Errorf("expected success %v, got %v", tt.success, body)
+			}
+		})
+	}
+
+	dbSubscription, err := models.FindSubscriptionByStripeID(db, stripeSub.ID)
+	if err != nil || dbSubscription == nil {
+		t.Fatalf("expected the subscription to be stored, got %v (%v)", dbSubscription, err)
+	}
+	if dbSubscription.Status != models.SubscriptionStatus(stripe.SubscriptionStatusTrialing) {
+		t.Errorf("expected a trialing subscription, got %s", dbSubscription.Status)
+	}
+
+	t.Run("Stripe unavailable", func(t *testing.T) {
+		a.stripe.FailNext("ListSubscriptions", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError})
+		w := a.request(t, http.MethodPost, "/sync-subscription", testToken(t, subscribed, "user@example.com"), map[string]string{})
+		expectStatus(t, w, http.StatusInternalServerError)
+	})
+}
+
+func TestUpsertSubscriptionCustomerMismatch(t *testing.T) {
+	db := testDB(t)
+	a := newTestAPI(t, testConfig(t, nil), db)
+
+	owner := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "owner@example.com")
+	other := seedCustomer(t, a, uuid.Must(uuid.NewV4()), "other@example.com")
+	stored := seedSubscription(t, a, owner, "price_basic", stripe.SubscriptionStatusActive)
+
+	s, err := a.stripe.GetSubscription(stored.StripeID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := billing.UpsertSubscription(db, other.ID, s); !errors.Is(err, billing.ErrCustomerMismatch) {
+		t.Fatalf("expected a customer mismatch, got %v", err)
+	}
+
+	subscription, err := models.FindSubscriptionByStripeID(db, stored.StripeID)
+	if err != nil || subscription.CustomerID != owner.ID {
+		t.Errorf("expected the subscription to stay with its customer, got %+v (%v)", subscription, err)
+	}
+}
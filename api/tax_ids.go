@@ -0,0 +1,186 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"gostripe/models"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// TaxIDListResponse lists the tax IDs of a customer
+type TaxIDListResponse struct {
+	TaxIDs []models.TaxID `json:"tax_ids"`
+}
+
+// ListTaxIDs lists the tax IDs of the current user
+func (a *API) ListTaxIDs(w http.ResponseWriter, r *http.Request) {
+	dbCustomer, ok := a.requireCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	taxIDs, err := models.FindTaxIDsByCustomerID(a.db, dbCustomer.ID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get tax IDs")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &TaxIDListResponse{TaxIDs: taxIDs})
+}
+
+// CreateTaxID adds a tax ID to the current user
+func (a *API) CreateTaxID(w http.ResponseWriter, r *http.Request) {
+	var req TaxIDRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	dbCustomer, ok := a.requireCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	params := &stripe.TaxIDParams{
+		Customer: stripe.String(dbCustomer.StripeID),
+		Type:     stripe.String(req.Type),
+		Value:    stripe.String(req.Value),
+	}
+	setStripeIdempotencyKey(r.Context(), &params.Params, "tax_id.create")
+	stripeTaxID, err := a.gateway.NewTaxID(params)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create Stripe tax ID")
+		if stripeErr, ok := err.(*stripe.Error); ok && stripeErr.HTTPStatusCode == http.StatusBadRequest {
+			badRequestError(w, stripeErr.Msg)
+			return
+		}
+		internalServerError(w, r, "Failed to create tax ID")
+		return
+	}
+
+	// The customer.tax_id.created webhook may have been processed already
+	taxID, err := models.UpsertTaxID(a.db, dbCustomer.ID, stripeTaxID.ID, string(stripeTaxID.Type), stripeTaxID.Value, taxIDVerificationStatus(stripeTaxID))
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create tax ID in database")
+		internalServerError(w, r, "Failed to create tax ID")
+		return
+	}
+
+	sendJSON(w, http.StatusCreated, taxID)
+}
+
+// DeleteTaxID removes a tax ID from the current user
+func (a *API) DeleteTaxID(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.FromString(chi.URLParam(r, "id"))
+	if err != nil {
+		badRequestError(w, "Invalid tax ID")
+		return
+	}
+
+	dbCustomer, ok := a.requireCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	taxID, err := models.FindCustomerTaxID(a.db, dbCustomer.ID, id)
+	if err != nil {
+		internalServerError(w, r, "Failed to get tax ID")
+		return
+	}
+
+	if taxID == nil {
+		notFoundError(w, "Tax ID not found")
+		return
+	}
+
+	_, err = a.gateway.DeleteTaxID(taxID.StripeID, &stripe.TaxIDParams{Customer: stripe.String(dbCustomer.StripeID)})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to delete Stripe tax ID")
+		internalServerError(w, r, "Failed to delete tax ID")
+		return
+	}
+
+	if err := models.DeleteTaxID(a.db, taxID); err != nil {
+		logrus.WithError(err).Error("Failed to delete tax ID in database")
+		internalServerError(w, r, "Failed to delete tax ID")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &StatusResponse{Status: "deleted"})
+}
+
+// requireCustomer loads the customer of the current user, sending an error
+// response when there is none
+func (a *API) requireCustomer(w http.ResponseWriter, r *http.Request) (*models.Customer, bool) {
+	principal := getPrincipal(r.Context())
+	if principal == nil {
+		internalServerError(w, r, "Failed to get principal")
+		return nil, false
+	}
+
+	dbCustomer, err := models.FindCustomerByUserID(a.db, principal.UserID)
+	if err != nil {
+		internalServerError(w, r, "Failed to get customer")
+		return nil, false
+	}
+
+	if dbCustomer == nil {
+		notFoundError(w, "Customer not found")
+		return nil, false
+	}
+
+	return dbCustomer, true
+}
+
+// handleTaxIDEvent keeps the local tax IDs and their verification status in
+// sync with Stripe
+func (a *API) handleTaxIDEvent(eventType string, stripeTaxID *stripe.TaxID) error {
+	taxID, err := models.FindTaxIDByStripeID(a.db, stripeTaxID.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get tax ID: %w", err)
+	}
+
+	if eventType == "customer.tax_id.deleted" {
+		if taxID == nil {
+			return nil
+		}
+		if err := models.DeleteTaxID(a.db, taxID); err != nil {
+			return fmt.Errorf("failed to delete tax ID: %w", err)
+		}
+		return nil
+	}
+
+	if taxID != nil {
+		taxID.Type = string(stripeTaxID.Type)
+		taxID.Value = stripeTaxID.Value
+		taxID.VerificationStatus = taxIDVerificationStatus(stripeTaxID)
+		if err := models.UpdateTaxID(a.db, taxID); err != nil {
+			return fmt.Errorf("failed to update tax ID: %w", err)
+		}
+		return nil
+	}
+
+	if stripeTaxID.Customer == nil {
+		return nil
+	}
+
+	dbCustomer, err := models.FindCustomerByStripeID(a.db, stripeTaxID.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get customer: %w", err)
+	}
+
+	if dbCustomer == nil {
+		logrus.WithField("stripe_tax_id", stripeTaxID.ID).Info("Ignoring tax ID of unknown customer")
+		return nil
+	}
+
+	if _, err := models.UpsertTaxID(a.db, dbCustomer.ID, stripeTaxID.ID, string(stripeTaxID.Type), stripeTaxID.Value, taxIDVerificationStatus(stripeTaxID)); err != nil {
+		return fmt.Errorf("failed to create tax ID: %w", err)
+	}
+
+	return nil
+}
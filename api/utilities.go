@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -19,6 +18,11 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+// StatusResponse reports the outcome of a request without other result
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
 // sendJSON sends a JSON response with the given status code and data
 func sendJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -46,9 +50,7 @@ func addRequestID(config *conf.GlobalConfiguration) func(http.Handler) http.Hand
 				id = uid.String()
 			}
 
-			ctx := r.Context()
-			ctx = context.WithValue(ctx, "request_id", id)
-			r = r.WithContext(ctx)
+			r = r.WithContext(withRequestID(r.Context(), id))
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -112,6 +114,14 @@ func notFoundError(w http.ResponseWriter, msg string) {
 	})
 }
 
+// tooManyRequestsError sends a 429 Too Many Requests response
+func tooManyRequestsError(w http.ResponseWriter) {
+	sendJSON(w, http.StatusTooManyRequests, &Error{
+		Code:    http.StatusTooManyRequests,
+		Message: "Too many requests",
+	})
+}
+
 // internalServerError sends a 500 Internal Server Error response
 func internalServerError(w http.ResponseWriter, r *http.Request, msg string) {
 	logrus.WithFields(logrus.Fields{
@@ -124,24 +134,6 @@ func internalServerError(w http.ResponseWriter, r *http.Request, msg string) {
 	})
 }
 
-// getRequestID gets the request ID from the context
-func getRequestID(ctx context.Context) string {
-	id, ok := ctx.Value("request_id").(string)
-	if !ok {
-		return ""
-	}
-	return id
-}
-
-// getUserID gets the user ID from the context
-func getUserID(ctx context.Context) (uuid.UUID, error) {
-	id, ok := ctx.Value("user_id").(string)
-	if !ok {
-		return uuid.Nil, fmt.Errorf("user_id not found in context")
-	}
-	return uuid.FromString(id)
-}
-
 // getToken gets the JWT token from the Authorization header
 func getToken(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const apiVersionHeader = "API-Version"
+
+// apiVersions lists the versions of the /v1 API, oldest first. A breaking
+// change adds a version, and the handlers check getAPIVersion to keep the
+// older behavior for the clients that did not upgrade.
+var apiVersions = []string{"2024-04-23"}
+
+var routeParamRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+// supportedAPIVersion checks whether a version of the API exists
+func supportedAPIVersion(version string) bool {
+	for _, v := range apiVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateVersion is middleware that picks the API version of a request from
+// the API-Version header, or else the default version, and reports it in the
+// response
+func (a *API) negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := r.Header.Get(apiVersionHeader)
+		if version == "" {
+			version = a.defaultVersion
+		} else if !supportedAPIVersion(version) {
+			badRequestError(w, fmt.Sprintf("Unsupported API version %s, expected one of %s", version, strings.Join(apiVersions, ", ")))
+			return
+		}
+
+		w.Header().Set(apiVersionHeader, version)
+		next.ServeHTTP(w, r.WithContext(withAPIVersion(r.Context(), version)))
+	})
+}
+
+// versioned registers a route of the /v1 API and, when legacy is not empty,
+// the unversioned path it replaces
+func (a *API) versioned(r chi.Router, method, path, legacy string, h http.HandlerFunc) {
+	r.With(a.negotiateVersion).Method(method, "/v1"+path, h)
+	if legacy != "" {
+		r.Method(method, legacy, deprecated("/v1"+path, h))
+	}
+}
+
+// deprecated marks the responses of a legacy route, pointing to the route
+// replacing it when there is one. Legacy routes keep the oldest API version.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		if successor != "" {
+			path := routeParamRegexp.ReplaceAllStringFunc(successor, func(param string) string {
+				return chi.URLParam(r, strings.Trim(param, "{}"))
+			})
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", path))
+		}
+
+		next(w, r.WithContext(withAPIVersion(r.Context(), apiVersions[0])))
+	}
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestVersionNegotiation(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+
+	tests := []struct {
+		name    string
+		version string
+		status  int
+		want    string
+	}{
+		{"default version", "", http.StatusUnauthorized, apiVersions[0]},
+		{"supported version", apiVersions[0], http.StatusUnauthorized, apiVersions[0]},
+		{"unsupported version", "2019-01-01", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.version != "" {
+				headers = []string{apiVersionHeader, tt.version}
+			}
+			w := a.request(t, http.MethodGet, "/v1/me/subscriptions", "", nil, headers...)
+			expectStatus(t, w, tt.status)
+			if got := w.Header().Get(apiVersionHeader); got != tt.want {
+				t.Errorf("expected %s %q, got %q", apiVersionHeader, tt.want, got)
+			}
+			if w.Header().Get("Deprecation") != "" {
+				t.Error("expected the /v1 route not to be deprecated")
+			}
+		})
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	a := newTestAPI(t, testConfig(t, nil), nil)
+	userID := uuid.Must(uuid.NewV4())
+
+	tests := []struct {
+		method string
+		path   string
+		link   string
+	}{
+		{http.MethodGet, "/get-subscription-status", `</v1/me/subscription-status>; rel="successor-version"`},
+		{http.MethodPost, "/create-checkout-session", `</v1/checkout-sessions>; rel="successor-version"`},
+		{http.MethodDelete, "/customer/tax-ids/txi_123", `</v1/me/customer/tax-ids/txi_123>; rel="successor-version"`},
+		{http.MethodGet, fmt.Sprintf("/users/%s/get-customer-details", userID), fmt.Sprintf(`</v1/users/%s/customer>; rel="successor-version"`, userID)},
+		{http.MethodPost, "/cancel-subscription", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := a.request(t, tt.method, tt.path, "", nil)
+			expectStatus(t, w, http.StatusUnauthorized)
+			if w.Header().Get("Deprecation") != "true" {
+				t.Error("expected the route to be deprecated")
+			}
+			if got := w.Header().Get("Link"); got != tt.link {
+				t.Errorf("expected Link %q, got %q", tt.link, got)
+			}
+		})
+	}
+}
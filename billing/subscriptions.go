@@ -0,0 +1,180 @@
+// Package billing stores the state of Stripe billing objects in the database,
+// whichever entry point (webhook, sync endpoint, reconciliation, import)
+// received it.
+package billing
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// ErrCustomerNotFound is returned when the customer of a new subscription is
+// not stored
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// ErrCustomerMismatch is returned when a stored subscription belongs to
+// another customer than the one it is stored for. Subscriptions are never
+// moved between customers.
+var ErrCustomerMismatch = errors.New("subscription belongs to another customer")
+
+// ApplySubscription copies the state of a Stripe subscription onto a local
+// subscription. The price and items are kept when the snapshot has no items.
+func ApplySubscription(subscription *models.Subscription, s *stripe.Subscription) {
+	subscription.StripeID = s.ID
+	subscription.Status = models.SubscriptionStatus(s.Status)
+	if s.Items != nil {
+		subscription.Items = models.SubscriptionItems{}
+		for _, item := range s.Items.Data {
+			i := models.SubscriptionItem{StripeID: item.ID, Quantity: item.Quantity}
+			if item.Price != nil {
+				i.PriceID = item.Price.ID
+			}
+			subscription.Items = append(subscription.Items, i)
+		}
+	}
+	if priceID := SubscriptionPriceID(s); priceID != "" {
+		subscription.PriceID = priceID
+	}
+
+	subscription.CurrentPeriodStart = unixTime(s.CurrentPeriodStart)
+	subscription.CurrentPeriodEnd = time.Unix(s.CurrentPeriodEnd, 0)
+	subscription.TrialStart = unixTime(s.TrialStart)
+	subscription.TrialEnd = unixTime(s.TrialEnd)
+	subscription.CancelAt = unixTime(s.CancelAt)
+	subscription.CancelAtPeriodEnd = s.CancelAtPeriodEnd
+	subscription.CanceledAt = unixTime(s.CanceledAt)
+	subscription.EndedAt = unixTime(s.EndedAt)
+	subscription.CollectionMethod = string(s.CollectionMethod)
+
+	subscription.LatestInvoiceID = ""
+	if s.LatestInvoice != nil {
+		subscription.LatestInvoiceID = s.LatestInvoice.ID
+	}
+	subscription.DefaultPaymentMethodID = ""
+	if s.DefaultPaymentMethod != nil {
+		subscription.DefaultPaymentMethodID = s.DefaultPaymentMethod.ID
+	}
+
+	subscription.Metadata = models.Metadata{}
+	for k, v := range s.Metadata {
+		subscription.Metadata[k] = v
+	}
+	subscription.Discount = subscriptionDiscount(s.Discount)
+}
+
+// subscriptionDiscount returns the coupon of a Stripe discount
+func subscriptionDiscount(d *stripe.Discount) *models.SubscriptionDiscount {
+	if d == nil || d.Coupon == nil {
+		return nil
+	}
+
+	discount := &models.SubscriptionDiscount{
+		CouponID:         d.Coupon.ID,
+		Name:             d.Coupon.Name,
+		PercentOff:       d.Coupon.PercentOff,
+		Duration:         string(d.Coupon.Duration),
+		DurationInMonths: d.Coupon.DurationInMonths,
+		Start:            unixTime(d.Start),
+		End:              unixTime(d.End),
+	}
+	if d.Coupon.AmountOff > 0 {
+		amountOff := models.NewMoney(d.Coupon.AmountOff, string(d.Coupon.Currency))
+		discount.AmountOff = &amountOff
+	}
+	if d.PromotionCode != nil {
+		discount.PromotionCodeID = d.PromotionCode.ID
+	}
+	return discount
+}
+
+// unixTime converts a Stripe timestamp, nil when it is not set
+func unixTime(t int64) *time.Time {
+	if t == 0 {
+		return nil
+	}
+	u := time.Unix(t, 0)
+	return &u
+}
+
+// SubscriptionPriceID returns the price of the first item of a subscription
+func SubscriptionPriceID(s *stripe.Subscription) string {
+	if s.Items != nil && len(s.Items.Data) > 0 && s.Items.Data[0].Price != nil {
+		return s.Items.Data[0].Price.ID
+	}
+	return ""
+}
+
+// UpsertSubscription stores a Stripe subscription of a customer, creating it
+// when it is not stored yet. The lookup and the write run in a transaction
+// holding a lock on the subscription. A subscription stored for another
+// customer is left as is and ErrCustomerMismatch is returned.
+func UpsertSubscription(conn *storage.Connection, customerID uuid.UUID, s *stripe.Subscription) (*models.Subscription, error) {
+	var subscription *models.Subscription
+	err := conn.Transaction(func(tx *storage.Connection) error {
+		if err := models.LockSubscription(tx, s.ID); err != nil {
+			return fmt.Errorf("failed to lock subscription: %w", err)
+		}
+
+		existing, err := models.FindSubscriptionByStripeID(tx, s.ID)
+		if err != nil {
+			return fmt.Errorf("failed to get subscription: %w", err)
+		}
+
+		if existing == nil {
+			subscription = &models.Subscription{CustomerID: customerID}
+			ApplySubscription(subscription, s)
+			if err := models.InsertSubscription(tx, subscription); err != nil {
+				return fmt.Errorf("failed to create subscription: %w", err)
+			}
+			return nil
+		}
+
+		if existing.CustomerID != customerID {
+			return fmt.Errorf("%w: %s", ErrCustomerMismatch, s.ID)
+		}
+		subscription = existing
+		ApplySubscription(subscription, s)
+		if err := models.UpdateSubscription(tx, subscription); err != nil {
+			return fmt.Errorf("failed to update subscription: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// UpsertStripeSubscription stores a Stripe subscription for the customer it
+// belongs to in Stripe. A stored subscription whose customer is unknown keeps
+// its customer.
+func UpsertStripeSubscription(conn *storage.Connection, s *stripe.Subscription) (*models.Subscription, error) {
+	stripeCustomerID := ""
+	if s.Customer != nil {
+		stripeCustomerID = s.Customer.ID
+	}
+
+	dbCustomer, err := models.FindCustomerByStripeID(conn, stripeCustomerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get customer: %w", err)
+	}
+	if dbCustomer != nil {
+		return UpsertSubscription(conn, dbCustomer.ID, s)
+	}
+
+	existing, err := models.FindSubscriptionByStripeID(conn, s.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscription: %w", err)
+	}
+	if existing == nil {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, stripeCustomerID)
+	}
+	return UpsertSubscription(conn, existing.CustomerID, s)
+}
@@ -0,0 +1,61 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"gostripe/models"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestApplySubscription(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	s := &stripe.Subscription{
+		ID:                 "sub_123",
+		Status:             stripe.SubscriptionStatusTrialing,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		TrialStart:         now.Unix(),
+		TrialEnd:           now.AddDate(0, 0, 14).Unix(),
+		CancelAtPeriodEnd:  true,
+		CollectionMethod:   stripe.SubscriptionCollectionMethodChargeAutomatically,
+		LatestInvoice:      &stripe.Invoice{ID: "in_123"},
+		Metadata:           map[string]string{"user_id": "42"},
+		Discount: &stripe.Discount{
+			Coupon: &stripe.Coupon{ID: "BIENVENUE", AmountOff: 500, Currency: "eur", Duration: stripe.CouponDurationOnce},
+			Start:  now.Unix(),
+		},
+		Items: &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{
+			{ID: "si_1", Price: &stripe.Price{ID: "price_basic"}, Quantity: 1},
+			{ID: "si_2", Price: &stripe.Price{ID: "price_seats"}, Quantity: 3},
+		}},
+	}
+
+	// Une annulation passée ne doit pas survivre à la synchronisation
+	canceledAt := now.AddDate(0, -1, 0)
+	subscription := &models.Subscription{CanceledAt: &canceledAt, DefaultPaymentMethodID: "pm_old"}
+	ApplySubscription(subscription, s)
+
+	if subscription.Status != models.SubscriptionStatusTrialing || subscription.PriceID != "price_basic" || len(subscription.Items) != 2 || subscription.Items[1].Quantity != 3 {
+		t.Errorf("unexpected subscription %+v", subscription)
+	}
+	if subscription.CurrentPeriodStart == nil || !subscription.CurrentPeriodStart.Equal(now) || subscription.TrialEnd == nil || !subscription.TrialEnd.Equal(now.AddDate(0, 0, 14)) {
+		t.Errorf("unexpected periods %+v", subscription)
+	}
+	if !subscription.CancelAtPeriodEnd || subscription.CanceledAt != nil || subscription.CancelAt != nil || subscription.EndedAt != nil {
+		t.Errorf("unexpected cancellation %+v", subscription)
+	}
+	if subscription.LatestInvoiceID != "in_123" || subscription.DefaultPaymentMethodID != "" || subscription.CollectionMethod != "charge_automatically" || subscription.Metadata["user_id"] != "42" {
+		t.Errorf("unexpected subscription %+v", subscription)
+	}
+	if d := subscription.Discount; d == nil || d.CouponID != "BIENVENUE" || d.AmountOff == nil || *d.AmountOff != models.NewMoney(500, "eur") || d.End != nil {
+		t.Errorf("unexpected discount %+v", subscription.Discount)
+	}
+
+	// Sans items, le prix enregistré est conservé
+	ApplySubscription(subscription, &stripe.Subscription{ID: "sub_123", Status: stripe.SubscriptionStatusActive})
+	if subscription.PriceID != "price_basic" || len(subscription.Items) != 2 || subscription.Discount != nil {
+		t.Errorf("unexpected subscription %+v", subscription)
+	}
+}
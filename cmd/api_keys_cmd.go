@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gostripe/api"
+	"gostripe/conf"
+	"gostripe/models"
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	apiKeyName    string
+	apiKeyScopes  []string
+	apiKeyExpires string
+)
+
+var apiKeysCmd = cobra.Command{
+	Use:   "api-keys",
+	Short: "Manage the API keys of backend services",
+}
+
+var apiKeysCreateCmd = cobra.Command{
+	Use:   "create",
+	Short: "Create an API key",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, createAPIKey)
+	},
+}
+
+var apiKeysListCmd = cobra.Command{
+	Use:   "list",
+	Short: "List the API keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, listAPIKeys)
+	},
+}
+
+var apiKeysRevokeCmd = cobra.Command{
+	Use:   "revoke [id]",
+	Short: "Revoke an API key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.GlobalConfiguration) {
+			revokeAPIKey(config, args[0])
+		})
+	},
+}
+
+func init() {
+	apiKeysCreateCmd.Flags().StringVar(&apiKeyName, "name", "", "name of the service using the key")
+	apiKeysCreateCmd.Flags().StringSliceVar(&apiKeyScopes, "scopes", nil, "scopes granted to the key, e.g. subscriptions:read")
+	apiKeysCreateCmd.Flags().StringVar(&apiKeyExpires, "expires", "", "expiry date of the key (YYYY-MM-DD)")
+	apiKeysCmd.AddCommand(&apiKeysCreateCmd, &apiKeysListCmd, &apiKeysRevokeCmd)
+}
+
+func createAPIKey(config *conf.GlobalConfiguration) {
+	if strings.TrimSpace(apiKeyName) == "" {
+		logrus.Fatal("--name is required")
+	}
+	if len(apiKeyScopes) == 0 {
+		logrus.Fatal("--scopes is required")
+	}
+	for _, scope := range apiKeyScopes {
+		if !api.ValidAPIKeyScope(scope) {
+			logrus.Fatalf("Unknown scope: %s", scope)
+		}
+	}
+
+	var expiresAt *time.Time
+	if apiKeyExpires != "" {
+		t, err := time.Parse("2006-01-02", apiKeyExpires)
+		if err != nil {
+			logrus.Fatalf("Invalid expiry date: %v", err)
+		}
+		expiresAt = &t
+	}
+
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	key, secret, err := models.CreateAPIKey(db, apiKeyName, apiKeyScopes, expiresAt)
+	if err != nil {
+		logrus.Fatalf("Failed to create API key: %+v", err)
+	}
+
+	fmt.Printf("Created API key %s (%s)\n", key.ID, key.Name)
+	fmt.Println("Store this key now, it will not be shown again:")
+	fmt.Println(secret)
+}
+
+func listAPIKeys(config *conf.GlobalConfiguration) {
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	keys, err := models.FindAPIKeys(db)
+	if err != nil {
+		logrus.Fatalf("Failed to list API keys: %+v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tLAST USED\tEXPIRES\tREVOKED")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, key.Prefix, key.Scopes,
+			formatTime(key.LastUsedAt), formatTime(key.ExpiresAt), formatTime(key.RevokedAt))
+	}
+	w.Flush()
+}
+
+func revokeAPIKey(config *conf.GlobalConfiguration, rawID string) {
+	id, err := uuid.FromString(rawID)
+	if err != nil {
+		logrus.Fatalf("Invalid API key ID: %v", err)
+	}
+
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	key, err := models.FindAPIKeyByID(db, id)
+	if err != nil {
+		logrus.Fatalf("Failed to get API key: %+v", err)
+	}
+	if key == nil {
+		logrus.Fatalf("API key not found: %s", id)
+	}
+
+	if err := models.RevokeAPIKey(db, key); err != nil {
+		logrus.Fatalf("Failed to revoke API key: %+v", err)
+	}
+	fmt.Printf("Revoked API key %s (%s)\n", key.ID, key.Name)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
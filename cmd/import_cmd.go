@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"gostripe/api"
+	"gostripe/conf"
+	"gostripe/gateway"
+	"gostripe/storage"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importUsersFile string
+	importName      string
+	importRestart   bool
+)
+
+var importCmd = cobra.Command{
+	Use:   "import",
+	Short: "Import the customers of an existing Stripe account",
+	Long: `Link the customers of an existing Stripe account to users and import their
+subscriptions, invoices and payment methods. Customers are linked through the
+user_id of their metadata, or else through their email with --users, a CSV
+file of email,user_id lines.
+
+The import resumes after the last imported customer when it was interrupted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, importCustomers)
+	},
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importUsersFile, "users", "", "CSV file of email,user_id lines linking customers to users")
+	importCmd.Flags().StringVar(&importName, "name", "default", "name of the import, to resume it")
+	importCmd.Flags().BoolVar(&importRestart, "restart", false, "start over instead of resuming an interrupted import")
+}
+
+func importCustomers(config *conf.GlobalConfiguration) {
+	opts := api.ImportOptions{Name: importName, Restart: importRestart}
+	if importUsersFile != "" {
+		f, err := os.Open(importUsersFile)
+		if err != nil {
+			logrus.Fatalf("Failed to open the users file: %+v", err)
+		}
+		opts.UsersByEmail, err = api.ReadUserMapping(f)
+		f.Close()
+		if err != nil {
+			logrus.Fatalf("Invalid users file: %+v", err)
+		}
+	}
+
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	report, err := api.Import(db, gateway.NewClient(config.Stripe.SecretKey, config.Stripe.APIURL), opts)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if report != nil {
+		encoder.Encode(report)
+	}
+	if err != nil {
+		logrus.Fatalf("Import interrupted, run it again to resume: %+v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gostripe/conf"
+	"gostripe/gateway"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go/v72"
+)
+
+var (
+	mockStripeAddr       string
+	mockStripeWebhookURL string
+	mockStripePrices     []string
+)
+
+var mockStripeCmd = cobra.Command{
+	Use:   "mock-stripe",
+	Short: "Start an in-memory Stripe API for development and integration tests",
+	Long: `Start an in-memory Stripe API serving the endpoints used by GoStripe.
+Point GoStripe at it with STRIPE_API_URL=http://<addr>. Webhooks are signed
+with the configured webhook secret and sent to --webhook-url.
+
+The /_mock endpoints simulate what happens outside of the API:
+  POST /_mock/checkout/sessions/{id}/complete
+  POST /_mock/subscriptions/{id}/fail_payment
+  POST /_mock/subscriptions/{id}/cancel
+  POST /_mock/invoices/{id}/pay`,
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.GlobalConfiguration) {
+			mockStripe(config, cmd.Flags().Changed("webhook-url"))
+		})
+	},
+}
+
+func init() {
+	mockStripeCmd.Flags().StringVar(&mockStripeAddr, "addr", "localhost:12111", "address to listen on")
+	mockStripeCmd.Flags().StringVar(&mockStripeWebhookURL, "webhook-url", "", "URL the webhooks are sent to (http://localhost:<port>/webhooks by default, empty to disable)")
+	mockStripeCmd.Flags().StringArrayVar(&mockStripePrices, "price", nil, "price to create, as lookup_key:amount:currency[:interval], e.g. pro:990:eur:month")
+}
+
+func mockStripe(config *conf.GlobalConfiguration, customWebhookURL bool) {
+	webhookURL := mockStripeWebhookURL
+	if !customWebhookURL {
+		webhookURL = fmt.Sprintf("http://localhost:%d/webhooks", config.API.Port)
+	}
+
+	webhookSecret := ""
+	if secrets := config.Stripe.ActiveWebhookSecrets(); len(secrets) > 0 {
+		webhookSecret = secrets[0].Value
+	}
+
+	fake := gateway.NewFake()
+	for _, spec := range mockStripePrices {
+		price, err := parseMockPrice(spec)
+		if err != nil {
+			logrus.Fatalf("Invalid price %q: %v", spec, err)
+		}
+		fake.AddPrice(price)
+		logrus.Infof("Created price %s (%s)", price.ID, price.LookupKey)
+	}
+
+	server := gateway.NewServer(fake, webhookURL, webhookSecret)
+	defer server.Close()
+
+	logrus.Infof("Mock Stripe API started on: %s, sending webhooks to %q", mockStripeAddr, webhookURL)
+	if err := http.ListenAndServe(mockStripeAddr, server); err != nil {
+		logrus.Fatalf("Mock Stripe API stopped: %v", err)
+	}
+}
+
+// parseMockPrice reads a price given as lookup_key:amount:currency[:interval]
+func parseMockPrice(spec string) (*stripe.Price, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 3 || len(parts) > 4 {
+		return nil, fmt.Errorf("expected lookup_key:amount:currency[:interval]")
+	}
+
+	amount, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid amount: %v", err)
+	}
+
+	interval := stripe.PriceRecurringIntervalMonth
+	if len(parts) == 4 {
+		interval = stripe.PriceRecurringInterval(parts[3])
+	}
+
+	return &stripe.Price{
+		Active:     true,
+		LookupKey:  parts[0],
+		UnitAmount: amount,
+		Currency:   stripe.Currency(strings.ToLower(parts[2])),
+		Type:       stripe.PriceTypeRecurring,
+		Recurring:  &stripe.PriceRecurring{Interval: interval, IntervalCount: 1},
+	}, nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"gostripe/api"
+	"gostripe/conf"
+	"gostripe/gateway"
+	"gostripe/storage"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var reconcileFix bool
+
+var reconcileCmd = cobra.Command{
+	Use:   "reconcile",
+	Short: "Compare the database with Stripe and print the discrepancies as JSON",
+	Long: `Compare every Stripe customer and subscription with stripe_customers and
+stripe_subscriptions and print the discrepancies as JSON. Nothing is changed
+unless --fix is given, in which case the local rows are corrected to match
+Stripe.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, reconcile)
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().BoolVar(&reconcileFix, "fix", false, "correct the local rows instead of only reporting the discrepancies")
+}
+
+func reconcile(config *conf.GlobalConfiguration) {
+	db, err := storage.Dial(config)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	report, err := api.Reconcile(db, gateway.NewClient(config.Stripe.SecretKey, config.Stripe.APIURL), reconcileFix)
+	if err != nil {
+		logrus.Fatalf("Failed to reconcile: %+v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		logrus.Fatalf("Failed to write the report: %+v", err)
+	}
+}
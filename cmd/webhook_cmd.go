@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"gostripe/conf"
+	"gostripe/fixtures"
+	"gostripe/gateway"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	webhookType    string
+	webhookFixture string
+	webhookURL     string
+	webhookVersion string
+	webhookReplace map[string]string
+)
+
+var webhookCmd = cobra.Command{
+	Use:   "webhook",
+	Short: "Send Stripe webhook events to a running instance",
+}
+
+var webhookSendCmd = cobra.Command{
+	Use:   "send",
+	Short: "Sign a webhook event with the configured secret and send it",
+	Long: `Sign a webhook event with the configured webhook secret and send it to a
+running instance. The event is read from --fixture, which holds either a full
+event or a Stripe object, or else from the built-in fixture of --type.
+
+  gostripe webhook send --type customer.subscription.updated --replace cus_fixture=cus_123`,
+	Run: func(cmd *cobra.Command, args []string) {
+		execWithConfig(cmd, func(config *conf.GlobalConfiguration) {
+			sendWebhook(config, cmd.Flags().Changed("url"))
+		})
+	},
+}
+
+var webhookFixturesCmd = cobra.Command{
+	Use:   "fixtures",
+	Short: "List the built-in webhook fixtures",
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, version := range fixtures.Versions() {
+			types, _ := fixtures.Types(version)
+			for _, t := range types {
+				fmt.Printf("%s\t%s\n", version, t)
+			}
+		}
+	},
+}
+
+func init() {
+	webhookSendCmd.Flags().StringVar(&webhookType, "type", "", "type of the event, e.g. invoice.paid")
+	webhookSendCmd.Flags().StringVar(&webhookFixture, "fixture", "", "JSON file holding the event or its object (default: built-in fixture of --type)")
+	webhookSendCmd.Flags().StringVar(&webhookURL, "url", "", "URL of the webhook endpoint (default http://localhost:<port>/webhooks)")
+	webhookSendCmd.Flags().StringVar(&webhookVersion, "version", fixtures.Latest, "version of the built-in fixtures")
+	webhookSendCmd.Flags().StringToStringVar(&webhookReplace, "replace", nil, "IDs to replace in the event, e.g. cus_fixture=cus_123")
+
+	webhookCmd.AddCommand(&webhookSendCmd, &webhookFixturesCmd)
+}
+
+func sendWebhook(config *conf.GlobalConfiguration, customURL bool) {
+	url := webhookURL
+	if !customURL {
+		url = fmt.Sprintf("http://localhost:%d/webhooks", config.API.Port)
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case webhookFixture != "":
+		data, err = os.ReadFile(webhookFixture)
+	case webhookType != "":
+		data, err = fixtures.Load(webhookVersion, webhookType)
+	default:
+		logrus.Fatal("Either --type or --fixture is required")
+	}
+	if err != nil {
+		logrus.Fatalf("Failed to read the event: %v", err)
+	}
+
+	payload, err := fixtures.Prepare(data, webhookType, webhookReplace)
+	if err != nil {
+		logrus.Fatalf("Invalid event: %v", err)
+	}
+
+	secrets := config.Stripe.ActiveWebhookSecrets()
+	if len(secrets) == 0 {
+		logrus.Fatal("No webhook secret configured")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		logrus.Fatalf("Invalid URL: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", gateway.SignWebhook(payload, secrets[0].Value, time.Now()))
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		logrus.Fatalf("Failed to send the event: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	fmt.Printf("%s\n%s\n", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,13 @@
 package conf
 
 import (
+	"fmt"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -16,18 +22,353 @@ type DBConfiguration struct {
 	MigrationsPath string `json:"migrations_path" split_words:"true" default:"./migrations"`
 }
 
+// Secret is a named signing secret which may expire.
+type Secret struct {
+	ID        string     `json:"id"`
+	Value     string     `json:"-"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// SecretList holds the secrets accepted for one purpose, the current one first.
+// It is decoded from a comma separated list of "id:secret" or
+// "id:secret:YYYY-MM-DD" entries, the date being the day the secret expires.
+type SecretList []Secret
+
+// Decode implements envconfig.Decoder.
+func (l *SecretList) Decode(value string) error {
+	secrets := SecretList{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid secret entry for %q, expected id:secret[:expiry]", parts[0])
+		}
+
+		secret := Secret{ID: parts[0], Value: parts[1]}
+		if i := strings.LastIndex(secret.Value, ":"); i > 0 {
+			if expiresAt, err := time.Parse("2006-01-02", secret.Value[i+1:]); err == nil {
+				secret.Value = secret.Value[:i]
+				secret.ExpiresAt = &expiresAt
+			}
+		}
+		secrets = append(secrets, secret)
+	}
+	*l = secrets
+	return nil
+}
+
+// Active returns the secrets which have not expired yet.
+func (l SecretList) Active(now time.Time) SecretList {
+	active := SecretList{}
+	for _, secret := range l {
+		if secret.ExpiresAt == nil || now.Before(*secret.ExpiresAt) {
+			active = append(active, secret)
+		}
+	}
+	return active
+}
+
+// withLegacySecret returns the list with the single legacy secret appended.
+func (l SecretList) withLegacySecret(value string) SecretList {
+	if value == "" {
+		return l
+	}
+	return append(append(SecretList{}, l...), Secret{ID: "default", Value: value})
+}
+
 // StripeConfiguration holds all the Stripe related configuration.
 type StripeConfiguration struct {
 	SecretKey      string `json:"secret_key" envconfig:"STRIPE_SECRET_KEY" required:"true"`
 	PublishableKey string `json:"publishable_key" envconfig:"STRIPE_PUBLISHABLE_KEY" required:"true"`
-	WebhookSecret  string `json:"webhook_secret" envconfig:"STRIPE_WEBHOOK_SECRET" required:"true"`
+	WebhookSecret  string `json:"webhook_secret" envconfig:"STRIPE_WEBHOOK_SECRET"`
+	// Base URL of the Stripe API, to use a mock such as gostripe mock-stripe
+	APIURL string `json:"api_url" envconfig:"STRIPE_API_URL"`
+	// Webhook secrets accepted during a rotation, see SecretList
+	WebhookSecrets SecretList `json:"webhook_secrets" envconfig:"STRIPE_WEBHOOK_SECRETS"`
+
+	// Checkout defaults, which clients may override per session
+	AutomaticTax             bool   `json:"automatic_tax" envconfig:"STRIPE_AUTOMATIC_TAX"`
+	BillingAddressCollection string `json:"billing_address_collection" envconfig:"STRIPE_BILLING_ADDRESS_COLLECTION" default:"auto"`
+	TaxIDCollection          bool   `json:"tax_id_collection" envconfig:"STRIPE_TAX_ID_COLLECTION"`
+}
+
+// ActiveWebhookSecrets returns the webhook secrets to try, the current one first.
+func (c *StripeConfiguration) ActiveWebhookSecrets() SecretList {
+	return c.WebhookSecrets.withLegacySecret(c.WebhookSecret).Active(time.Now())
 }
 
 // JWTConfiguration holds the JWT related configuration.
 type JWTConfiguration struct {
-	Secret string `json:"secret" envconfig:"JWT_SECRET" required:"true"`
-	Exp    int    `json:"exp" envconfig:"JWT_EXP" default:"3600"` // 1 hour
-	Aud    string `json:"aud" envconfig:"JWT_AUD" default:"obex"`
+	Secret string `json:"secret" envconfig:"JWT_SECRET"`
+	// HMAC secrets accepted during a rotation, see SecretList
+	Secrets SecretList `json:"secrets" envconfig:"JWT_SECRETS"`
+	Exp     int        `json:"exp" envconfig:"JWT_EXP" default:"3600"` // 1 hour
+	// Accepted audiences, the token must be issued for at least one of them
+	Aud []string `json:"aud" envconfig:"JWT_AUD" default:"obex"`
+	// Required issuer, not checked when empty
+	Issuer string `json:"issuer" envconfig:"JWT_ISSUER"`
+	// Clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration `json:"leeway" envconfig:"JWT_LEEWAY" default:"30s"`
+
+	// Accepted signing algorithms (HS256, RS256, ES256, EdDSA, ...)
+	Algorithms []string `json:"algorithms" envconfig:"JWT_ALGORITHMS" default:"HS256"`
+	// PEM encoded public keys, the file name without extension is the key ID
+	PublicKeyFiles      []string      `json:"public_key_files" envconfig:"JWT_PUBLIC_KEY_FILES"`
+	JWKSURL             string        `json:"jwks_url" envconfig:"JWT_JWKS_URL"`
+	JWKSRefreshInterval time.Duration `json:"jwks_refresh_interval" envconfig:"JWT_JWKS_REFRESH_INTERVAL" default:"1h"`
+}
+
+// ActiveSecrets returns the HMAC secrets to try, the current one first.
+func (c *JWTConfiguration) ActiveSecrets() SecretList {
+	return c.Secrets.withLegacySecret(c.Secret).Active(time.Now())
+}
+
+// Validate checks that tokens can be verified with the configured keys.
+func (c *JWTConfiguration) Validate() error {
+	if len(c.Algorithms) == 0 {
+		return fmt.Errorf("at least one JWT algorithm is required")
+	}
+	if len(c.Aud) == 0 {
+		return fmt.Errorf("at least one JWT audience is required")
+	}
+	for _, alg := range c.Algorithms {
+		if strings.HasPrefix(alg, "HS") {
+			if len(c.ActiveSecrets()) == 0 {
+				return fmt.Errorf("JWT_SECRET or JWT_SECRETS is required for %s", alg)
+			}
+		} else if len(c.PublicKeyFiles) == 0 && c.JWKSURL == "" {
+			return fmt.Errorf("JWT_PUBLIC_KEY_FILES or JWT_JWKS_URL is required for %s", alg)
+		}
+	}
+	return nil
+}
+
+// DunningStep maps a number of failed payment attempts to the access level
+// granted to the customer once that many attempts have failed.
+type DunningStep struct {
+	Attempts int    `json:"attempts"`
+	Access   string `json:"access"`
+}
+
+// DunningSchedule is an ordered list of dunning steps. It is decoded from a
+// comma separated list of "attempts:access" pairs, e.g. "1:grace,3:suspended".
+type DunningSchedule []DunningStep
+
+// Decode implements envconfig.Decoder.
+func (s *DunningSchedule) Decode(value string) error {
+	schedule := DunningSchedule{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid dunning step %q, expected attempts:access", entry)
+		}
+		attempts, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || attempts < 1 {
+			return fmt.Errorf("invalid attempt count in dunning step %q", entry)
+		}
+		access := strings.TrimSpace(parts[1])
+		switch access {
+		case "full", "grace", "restricted", "suspended":
+		default:
+			return fmt.Errorf("invalid access level in dunning step %q", entry)
+		}
+		schedule = append(schedule, DunningStep{Attempts: attempts, Access: access})
+	}
+	sort.SliceStable(schedule, func(i, j int) bool {
+		return schedule[i].Attempts < schedule[j].Attempts
+	})
+	*s = schedule
+	return nil
+}
+
+// AccessFor returns the access level for the given number of failed attempts,
+// or "full" when no step has been reached yet.
+func (s DunningSchedule) AccessFor(attempts int) string {
+	access := "full"
+	for _, step := range s {
+		if attempts >= step.Attempts {
+			access = step.Access
+		}
+	}
+	return access
+}
+
+// DunningConfiguration holds the failed payment recovery configuration.
+type DunningConfiguration struct {
+	Schedule           DunningSchedule `json:"schedule" envconfig:"DUNNING_SCHEDULE" default:"1:grace,3:restricted,4:suspended"`
+	NotificationURL    string          `json:"notification_url" envconfig:"DUNNING_NOTIFICATION_URL"`
+	NotificationSecret string          `json:"notification_secret" envconfig:"DUNNING_NOTIFICATION_SECRET"`
+	PortalReturnURL    string          `json:"portal_return_url" envconfig:"DUNNING_PORTAL_RETURN_URL"`
+}
+
+// ReconcileConfiguration holds the scheduled comparison of the database with
+// Stripe. The job is disabled when Interval is zero.
+type ReconcileConfiguration struct {
+	Interval time.Duration `json:"interval" envconfig:"RECONCILE_INTERVAL"`
+	Fix      bool          `json:"fix" envconfig:"RECONCILE_FIX" default:"false"`
+}
+
+// CacheConfiguration holds the in-process cache of Stripe lookups. Objects
+// are fresh for TTL, then returned for StaleWhileRevalidate more while being
+// fetched again. The cache is disabled when TTL is zero, the default, and
+// MaxEntries is not enforced when it is not positive.
+type CacheConfiguration struct {
+	TTL                  time.Duration `json:"ttl" envconfig:"STRIPE_CACHE_TTL" default:"0"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate" envconfig:"STRIPE_CACHE_STALE_WHILE_REVALIDATE" default:"10m"`
+	MaxEntries           int           `json:"max_entries" envconfig:"STRIPE_CACHE_MAX_ENTRIES" default:"10000"`
+}
+
+// SMTPConfiguration holds the SMTP server used to send emails.
+type SMTPConfiguration struct {
+	Host string `json:"host" envconfig:"SMTP_HOST"`
+	Port int    `json:"port" envconfig:"SMTP_PORT" default:"587"`
+	User string `json:"user" envconfig:"SMTP_USER"`
+	Pass string `json:"pass" envconfig:"SMTP_PASS"`
+	From string `json:"from" envconfig:"SMTP_FROM"`
+	// Timeout bounds the whole exchange with the server, which happens
+	// while a webhook is being handled
+	Timeout time.Duration `json:"timeout" envconfig:"SMTP_TIMEOUT" default:"5s"`
+}
+
+// NotificationConfiguration holds the customer notification configuration.
+type NotificationConfiguration struct {
+	Backend       string            `json:"backend" envconfig:"NOTIFY_BACKEND" default:"log"`
+	DefaultLocale string            `json:"default_locale" envconfig:"NOTIFY_LOCALE" default:"fr"`
+	SMTP          SMTPConfiguration `json:"smtp"`
+}
+
+// CORSConfiguration holds the CORS policy of the browser facing endpoints.
+// Origins may contain one wildcard, e.g. "https://*.example.com".
+type CORSConfiguration struct {
+	AllowedOrigins   []string `json:"allowed_origins" envconfig:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods   []string `json:"allowed_methods" envconfig:"CORS_ALLOWED_METHODS" default:"GET,POST,PATCH,DELETE,OPTIONS"`
+	AllowedHeaders   []string `json:"allowed_headers" envconfig:"CORS_ALLOWED_HEADERS" default:"Accept,Authorization,Content-Type,X-CSRF-Token,Idempotency-Key,API-Version"`
+	ExposedHeaders   []string `json:"exposed_headers" envconfig:"CORS_EXPOSED_HEADERS" default:"Link,Retry-After,X-RateLimit-Limit,X-RateLimit-Remaining,X-RateLimit-Reset,Idempotent-Replayed,API-Version,Deprecation"`
+	AllowCredentials bool     `json:"allow_credentials" envconfig:"CORS_ALLOW_CREDENTIALS" default:"false"`
+	MaxAge           int      `json:"max_age" envconfig:"CORS_MAX_AGE" default:"300"`
+}
+
+// Enabled returns true when cross-origin requests are allowed at all.
+func (c *CORSConfiguration) Enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+// Validate rejects policies that browsers refuse or that expose credentials to
+// any site.
+func (c *CORSConfiguration) Validate() error {
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" && c.AllowCredentials {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS cannot be * when CORS_ALLOW_CREDENTIALS is enabled")
+		}
+		if strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("CORS origin %q may contain a single wildcard", origin)
+		}
+	}
+	return nil
+}
+
+// RateLimit is a number of requests allowed per period. It is decoded from
+// "requests/period", e.g. "10/1m".
+type RateLimit struct {
+	Requests int           `json:"requests"`
+	Period   time.Duration `json:"period"`
+}
+
+// Decode implements envconfig.Decoder.
+func (l *RateLimit) Decode(value string) error {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid rate limit %q, expected requests/period", value)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return fmt.Errorf("invalid request count in rate limit %q", value)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return fmt.Errorf("invalid period in rate limit %q", value)
+	}
+	l.Requests = requests
+	l.Period = period
+	return nil
+}
+
+// RateLimitConfiguration holds the rate limits of each endpoint class.
+type RateLimitConfiguration struct {
+	Enabled bool   `json:"enabled" envconfig:"RATE_LIMIT_ENABLED" default:"true"`
+	Backend string `json:"backend" envconfig:"RATE_LIMIT_BACKEND" default:"memory"`
+	// Per authenticated caller
+	Default  RateLimit `json:"default" envconfig:"RATE_LIMIT_DEFAULT" default:"120/1m"`
+	Checkout RateLimit `json:"checkout" envconfig:"RATE_LIMIT_CHECKOUT" default:"10/1m"`
+	// Per client IP, before authentication
+	IP RateLimit `json:"ip" envconfig:"RATE_LIMIT_IP" default:"300/1m"`
+}
+
+// RedirectConfiguration holds the URLs customers may be sent back to after
+// leaving for a Stripe hosted page. Allowed hosts are "host[:port]" entries,
+// which only allow https, or "scheme://host[:port]" entries. A leading "*."
+// matches any subdomain.
+type RedirectConfiguration struct {
+	AllowedHosts []string `json:"allowed_hosts" envconfig:"REDIRECT_ALLOWED_HOSTS"`
+	SuccessURL   string   `json:"success_url" envconfig:"CHECKOUT_SUCCESS_URL"`
+	CancelURL    string   `json:"cancel_url" envconfig:"CHECKOUT_CANCEL_URL"`
+}
+
+// Allows checks whether an absolute URL may be used as a redirect. The hosts
+// of the default URLs are always allowed.
+func (c *RedirectConfiguration) Allows(u *url.URL) bool {
+	if u.User != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+
+	patterns := append([]string{}, c.AllowedHosts...)
+	for _, raw := range []string{c.SuccessURL, c.CancelURL} {
+		if d, err := url.Parse(raw); err == nil && d.Host != "" {
+			patterns = append(patterns, d.Scheme+"://"+d.Host)
+		}
+	}
+
+	host := strings.ToLower(u.Host)
+	for _, pattern := range patterns {
+		scheme := "https"
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			scheme, pattern = pattern[:i], pattern[i+3:]
+		}
+		if scheme != u.Scheme {
+			continue
+		}
+
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the default URLs are absolute.
+func (c *RedirectConfiguration) Validate() error {
+	for name, raw := range map[string]string{"CHECKOUT_SUCCESS_URL": c.SuccessURL, "CHECKOUT_CANCEL_URL": c.CancelURL} {
+		if raw == "" {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || !u.IsAbs() || u.Host == "" {
+			return fmt.Errorf("%s must be an absolute URL", name)
+		}
+	}
+	return nil
 }
 
 // LoggingConfig holds the logging related configuration.
@@ -43,13 +384,24 @@ type GlobalConfiguration struct {
 		Port            int    `envconfig:"PORT" default:"8082"`
 		Endpoint        string
 		RequestIDHeader string `envconfig:"REQUEST_ID_HEADER"`
+		DefaultVersion  string `envconfig:"API_DEFAULT_VERSION"`
+		CORS            CORSConfiguration
 	}
 	DB              DBConfiguration
 	Stripe          StripeConfiguration
 	JWT             JWTConfiguration
+	Dunning         DunningConfiguration
+	Notify          NotificationConfiguration
+	RateLimit       RateLimitConfiguration
+	Redirect        RedirectConfiguration
+	Reconcile       ReconcileConfiguration
+	Cache           CacheConfiguration
 	Logging         LoggingConfig `envconfig:"LOG"`
 	OperatorToken   string        `envconfig:"OPERATOR_TOKEN" required:"true"`
 	RateLimitHeader string        `split_words:"true"`
+	// Proxies appending to RateLimitHeader in front of the API, the client IP
+	// being the entry they added
+	RateLimitTrustedProxies int `split_words:"true" default:"1"`
 }
 
 // LoadGlobal loads configuration from file and environment variables.
@@ -63,6 +415,35 @@ func LoadGlobal(filename string) (*GlobalConfiguration, error) {
 		return nil, err
 	}
 
+	if err := config.JWT.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.API.CORS.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := config.Redirect.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Dunning.PortalReturnURL != "" {
+		u, err := url.Parse(config.Dunning.PortalReturnURL)
+		if err != nil || !config.Redirect.Allows(u) {
+			return nil, fmt.Errorf("DUNNING_PORTAL_RETURN_URL is not an allowed redirect URL")
+		}
+	}
+
+	switch config.RateLimit.Backend {
+	case "memory", "postgres":
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", config.RateLimit.Backend)
+	}
+
+	if len(config.Stripe.ActiveWebhookSecrets()) == 0 {
+		return nil, fmt.Errorf("STRIPE_WEBHOOK_SECRET or STRIPE_WEBHOOK_SECRETS is required")
+	}
+
 	if _, err := ConfigureLogging(&config.Logging); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,106 @@
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSecretListDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []Secret
+		err   bool
+	}{
+		{"empty", "", []Secret{}, false},
+		{"single secret", "2024-01:s3cret", []Secret{{ID: "2024-01", Value: "s3cret"}}, false},
+		{"with expiry", "new:whsec_new, old:whsec_old:2024-06-30", []Secret{
+			{ID: "new", Value: "whsec_new"},
+			{ID: "old", Value: "whsec_old", ExpiresAt: date(2024, 6, 30)},
+		}, false},
+		{"colon in the secret", "k1:a:b", []Secret{{ID: "k1", Value: "a:b"}}, false},
+		{"missing secret", "k1:", nil, true},
+		{"missing ID", ":s3cret", nil, true},
+		{"no separator", "s3cret", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var l SecretList
+			err := l.Decode(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", l)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(l) != len(tt.want) {
+				t.Fatalf("expected %d secrets, got %v", len(tt.want), l)
+			}
+			for i, want := range tt.want {
+				got := l[i]
+				if got.ID != want.ID || got.Value != want.Value {
+					t.Errorf("secret %d: expected %s:%s, got %s:%s", i, want.ID, want.Value, got.ID, got.Value)
+				}
+				if (got.ExpiresAt == nil) != (want.ExpiresAt == nil) || (got.ExpiresAt != nil && !got.ExpiresAt.Equal(*want.ExpiresAt)) {
+					t.Errorf("secret %d: expected expiry %v, got %v", i, want.ExpiresAt, got.ExpiresAt)
+				}
+			}
+		})
+	}
+}
+
+func TestSecretListActive(t *testing.T) {
+	l := SecretList{
+		{ID: "new", Value: "new"},
+		{ID: "old", Value: "old", ExpiresAt: date(2024, 6, 30)},
+		{ID: "older", Value: "older", ExpiresAt: date(2024, 1, 31)},
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want []string
+	}{
+		{"during the overlap", *date(2024, 6, 29), []string{"new", "old"}},
+		{"once the previous secret expired", *date(2024, 6, 30), []string{"new"}},
+		{"before any expiry", *date(2024, 1, 1), []string{"new", "old", "older"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active := l.Active(tt.now)
+			if len(active) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, active)
+			}
+			for i, id := range tt.want {
+				if active[i].ID != id {
+					t.Errorf("expected %v, got %v", tt.want, active)
+				}
+			}
+		})
+	}
+}
+
+func TestActiveWebhookSecrets(t *testing.T) {
+	c := &StripeConfiguration{
+		WebhookSecret: "whsec_legacy",
+		WebhookSecrets: SecretList{
+			{ID: "new", Value: "whsec_new"},
+			{ID: "expired", Value: "whsec_expired", ExpiresAt: date(2000, 1, 1)},
+		},
+	}
+
+	active := c.ActiveWebhookSecrets()
+	if len(active) != 2 || active[0].ID != "new" || active[1].ID != "default" || active[1].Value != "whsec_legacy" {
+		t.Errorf("expected the new secret then the legacy one, got %v", active)
+	}
+}
+
+func date(year int, month time.Month, day int) *time.Time {
+	d := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	return &d
+}
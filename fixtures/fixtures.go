@@ -0,0 +1,120 @@
+// Package fixtures holds sample Stripe webhook events, one per event type
+// handled by GoStripe. The events are grouped by version so that the tests
+// keep covering the payloads of older Stripe API versions once a newer one is
+// added.
+package fixtures
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+//go:embed webhooks
+var files embed.FS
+
+// Latest is the version of the fixtures matching the Stripe API version used
+// by GoStripe
+const Latest = "v1"
+
+// IDs used across the fixtures, to be replaced with the IDs of real objects
+const (
+	CustomerID     = "cus_fixture"
+	SubscriptionID = "sub_fixture"
+	InvoiceID      = "in_fixture"
+	TaxID          = "txi_fixture"
+	SessionID      = "cs_test_fixture"
+	UserID         = "6f1c2a9e-3b4d-4c5e-8f70-91a2b3c4d5e6"
+)
+
+// Versions returns the available fixture versions
+func Versions() []string {
+	entries, _ := fs.ReadDir(files, "webhooks")
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		versions = append(versions, e.Name())
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Types returns the event types with a fixture in a version
+func Types(version string) ([]string, error) {
+	entries, err := fs.ReadDir(files, path.Join("webhooks", version))
+	if err != nil {
+		return nil, fmt.Errorf("unknown fixture version %s", version)
+	}
+
+	types := make([]string, 0, len(entries))
+	for _, e := range entries {
+		types = append(types, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return types, nil
+}
+
+// Load returns the fixture of an event type, as stored
+func Load(version, eventType string) ([]byte, error) {
+	data, err := files.ReadFile(path.Join("webhooks", version, eventType+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("no %s fixture for %s", version, eventType)
+	}
+	return data, nil
+}
+
+// Event returns the latest fixture of an event type, ready to be sent: the
+// event gets a new ID and creation date, and each ID of replace found in the
+// payload is replaced with its value.
+func Event(eventType string, replace map[string]string) ([]byte, error) {
+	data, err := Load(Latest, eventType)
+	if err != nil {
+		return nil, err
+	}
+	return Prepare(data, eventType, replace)
+}
+
+// Prepare turns a payload into an event ready to be sent. The payload is
+// either a full event or the object of the event, which is then wrapped in an
+// event of the given type.
+func Prepare(data []byte, eventType string, replace map[string]string) ([]byte, error) {
+	for old, id := range replace {
+		data = []byte(strings.ReplaceAll(string(data), strconv.Quote(old), strconv.Quote(id)))
+	}
+
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	var object string
+	json.Unmarshal(event["object"], &object)
+	if object != "event" {
+		apiVersion, _ := json.Marshal(stripe.APIVersion)
+		event = map[string]json.RawMessage{
+			"object":      json.RawMessage(`"event"`),
+			"api_version": apiVersion,
+			"livemode":    json.RawMessage(`false`),
+			"data":        json.RawMessage(`{"object":` + string(data) + `}`),
+		}
+	}
+
+	if eventType != "" {
+		event["type"], _ = json.Marshal(eventType)
+	}
+	if _, ok := event["type"]; !ok {
+		return nil, fmt.Errorf("the event type is missing")
+	}
+
+	now := time.Now()
+	event["id"], _ = json.Marshal(fmt.Sprintf("evt_%d", now.UnixNano()))
+	event["created"], _ = json.Marshal(now.Unix())
+
+	return json.Marshal(event)
+}
@@ -0,0 +1,98 @@
+package fixtures
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+func TestFixtures(t *testing.T) {
+	for _, version := range Versions() {
+		types, err := Types(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, eventType := range types {
+			t.Run(version+"/"+eventType, func(t *testing.T) {
+				data, err := Load(version, eventType)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var event stripe.Event
+				if err := json.Unmarshal(data, &event); err != nil {
+					t.Fatalf("invalid event: %v", err)
+				}
+				if event.Type != eventType {
+					t.Errorf("expected a %s event, got %s", eventType, event.Type)
+				}
+
+				var object interface{}
+				switch {
+				case strings.HasPrefix(eventType, "checkout.session."):
+					object = &stripe.CheckoutSession{}
+				case strings.HasPrefix(eventType, "customer.subscription."):
+					object = &stripe.Subscription{}
+				case strings.HasPrefix(eventType, "customer.tax_id."):
+					object = &stripe.TaxID{}
+				case strings.HasPrefix(eventType, "customer."):
+					object = &stripe.Customer{}
+				case strings.HasPrefix(eventType, "invoice."):
+					object = &stripe.Invoice{}
+				default:
+					t.Fatalf("unexpected event type %s", eventType)
+				}
+				if err := json.Unmarshal(event.Data.Raw, object); err != nil {
+					t.Errorf("invalid %s object: %v", eventType, err)
+				}
+			})
+		}
+	}
+}
+
+func TestPrepare(t *testing.T) {
+	t.Run("fixture", func(t *testing.T) {
+		data, err := Event("invoice.paid", map[string]string{CustomerID: "cus_real"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var event stripe.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID == "evt_fixture_invoice_paid" || event.GetObjectValue("customer") != "cus_real" {
+			t.Errorf("expected a new event for cus_real, got %s", data)
+		}
+	})
+
+	t.Run("object", func(t *testing.T) {
+		data, err := Prepare([]byte(`{"id":"cus_123","object":"customer"}`), "customer.updated", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var event stripe.Event
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != "customer.updated" || event.GetObjectValue("id") != "cus_123" {
+			t.Errorf("expected the customer to be wrapped in an event, got %s", data)
+		}
+	})
+
+	t.Run("no type", func(t *testing.T) {
+		if _, err := Prepare([]byte(`{"id":"cus_123"}`), "", nil); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		if _, err := Event("customer.deleted", nil); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Cached is a Stripe gateway keeping the customers, subscriptions and prices
+// it gets in memory. An entry is fresh for ttl; for stale more, it is still
+// returned while being fetched again in the background. Lookups with expanded
+// fields or another account are not cached, nor are lists and writes. The
+// objects returned are shared and must not be modified.
+type Cached struct {
+	Stripe
+
+	ttl        time.Duration
+	stale      time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	value      interface{}
+	fetchedAt  time.Time
+	refreshing bool
+}
+
+// NewCached wraps a gateway with a cache of at most maxEntries objects, or
+// without limit when maxEntries is not positive
+func NewCached(gw Stripe, ttl, stale time.Duration, maxEntries int) *Cached {
+	return &Cached{
+		Stripe:     gw,
+		ttl:        ttl,
+		stale:      stale,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    map[string]*cacheEntry{},
+	}
+}
+
+// GetCustomer gets a customer, from the cache when possible
+func (c *Cached) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	if params != nil && !cacheable(&params.Params) {
+		return c.Stripe.GetCustomer(id, params)
+	}
+	v, err := c.get(id, func() (interface{}, error) { return c.Stripe.GetCustomer(id, nil) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*stripe.Customer), nil
+}
+
+// UpdateCustomer updates a customer and caches the result
+func (c *Cached) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	customer, err := c.Stripe.UpdateCustomer(id, params)
+	c.Forget(id)
+	if err == nil && (params == nil || cacheable(&params.Params)) {
+		c.set(id, customer)
+	}
+	return customer, err
+}
+
+// GetSubscription gets a subscription, from the cache when possible
+func (c *Cached) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	if params != nil && !cacheable(&params.Params) {
+		return c.Stripe.GetSubscription(id, params)
+	}
+	v, err := c.get(id, func() (interface{}, error) { return c.Stripe.GetSubscription(id, nil) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*stripe.Subscription), nil
+}
+
+// GetPrice gets a price, from the cache when possible
+func (c *Cached) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	if params != nil && !cacheable(&params.Params) {
+		return c.Stripe.GetPrice(id, params)
+	}
+	v, err := c.get(id, func() (interface{}, error) { return c.Stripe.GetPrice(id, nil) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*stripe.Price), nil
+}
+
+// Forget drops an object from the cache, e.g. when a webhook reports that it
+// changed
+func (c *Cached) Forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// get returns the cached object with the given ID, fetching it when it is
+// missing or too old. Errors are not cached.
+func (c *Cached) get(id string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[id]; ok {
+		value := entry.value
+		age := c.now().Sub(entry.fetchedAt)
+		if age < c.ttl+c.stale {
+			if age >= c.ttl && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(id, entry, fetch)
+			}
+			c.mu.Unlock()
+			return value, nil
+		}
+	}
+	c.mu.Unlock()
+
+	v, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.set(id, v)
+	return v, nil
+}
+
+// refresh fetches a stale object again in the background
+func (c *Cached) refresh(id string, entry *cacheEntry, fetch func() (interface{}, error)) {
+	v, err := fetch()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refreshing = false
+	if err != nil {
+		logrus.WithError(err).WithField("stripe_id", id).Warn("Failed to refresh cached Stripe object")
+		return
+	}
+	// The entry may have been forgotten in the meantime
+	if c.entries[id] == entry {
+		entry.value = v
+		entry.fetchedAt = c.now()
+	}
+}
+
+func (c *Cached) set(id string, v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[id]; !ok && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		c.evict()
+	}
+	c.entries[id] = &cacheEntry{value: v, fetchedAt: c.now()}
+}
+
+// evict makes room for an entry, dropping the expired entries or else an
+// arbitrary one
+func (c *Cached) evict() {
+	now := c.now()
+	for id, entry := range c.entries {
+		if now.Sub(entry.fetchedAt) >= c.ttl+c.stale {
+			delete(c.entries, id)
+		}
+	}
+	for id := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			break
+		}
+		delete(c.entries, id)
+	}
+}
+
+// cacheable tells whether a lookup returns the plain object
+func cacheable(params *stripe.Params) bool {
+	return len(params.Expand) == 0 && params.StripeAccount == nil && params.Headers == nil
+}
@@ -0,0 +1,144 @@
+package gateway
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// testClock is a clock moved by the tests
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestCached(t *testing.T) {
+	fake := NewFake()
+	fake.AddPrice(&stripe.Price{ID: "price_basic", Nickname: "Basic"})
+	clock := &testClock{now: time.Now()}
+	cached := NewCached(fake, time.Minute, 10*time.Minute, 100)
+	cached.now = clock.Now
+
+	nickname := func(t *testing.T) string {
+		t.Helper()
+		p, err := cached.GetPrice("price_basic", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Nickname
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		nickname(t)
+		if nickname(t) != "Basic" || fake.Calls("GetPrice") != 1 {
+			t.Errorf("expected a single call, got %d", fake.Calls("GetPrice"))
+		}
+	})
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		fake.AddPrice(&stripe.Price{ID: "price_basic", Nickname: "Basique"})
+		clock.Add(2 * time.Minute)
+		if got := nickname(t); got != "Basic" {
+			t.Errorf("expected the stale price, got %s", got)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for nickname(t) != "Basique" {
+			if time.Now().After(deadline) {
+				t.Fatal("the price was not refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if calls := fake.Calls("GetPrice"); calls != 2 {
+			t.Errorf("expected a single refresh, got %d calls", calls)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		fake.AddPrice(&stripe.Price{ID: "price_basic", Nickname: "Pro"})
+		clock.Add(time.Hour)
+		if got := nickname(t); got != "Pro" {
+			t.Errorf("expected the new price, got %s", got)
+		}
+	})
+
+	t.Run("forget", func(t *testing.T) {
+		fake.AddPrice(&stripe.Price{ID: "price_basic", Nickname: "Premium"})
+		cached.Forget("price_basic")
+		if got := nickname(t); got != "Premium" {
+			t.Errorf("expected the new price, got %s", got)
+		}
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		fake.FailNext("GetCustomer", &stripe.Error{HTTPStatusCode: http.StatusInternalServerError})
+		customer, err := fake.NewCustomer(&stripe.CustomerParams{Email: stripe.String("user@example.com")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cached.GetCustomer(customer.ID, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		if _, err := cached.GetCustomer(customer.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("expanded lookups", func(t *testing.T) {
+		calls := fake.Calls("GetPrice")
+		params := &stripe.PriceParams{}
+		params.AddExpand("product")
+		if _, err := cached.GetPrice("price_basic", params); err != nil {
+			t.Fatal(err)
+		}
+		if fake.Calls("GetPrice") != calls+1 {
+			t.Error("expected the expanded lookup to reach Stripe")
+		}
+	})
+}
+
+func TestCachedEviction(t *testing.T) {
+	fake := NewFake()
+	cached := NewCached(fake, time.Minute, time.Minute, 2)
+	for _, id := range []string{"price_a", "price_b", "price_c"} {
+		fake.AddPrice(&stripe.Price{ID: id})
+		if _, err := cached.GetPrice(id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cached.entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(cached.entries))
+	}
+	if _, ok := cached.entries["price_c"]; !ok {
+		t.Error("expected the last price to be cached")
+	}
+}
+
+func TestCachedWithoutLimit(t *testing.T) {
+	fake := NewFake()
+	cached := NewCached(fake, time.Minute, time.Minute, 0)
+	for _, id := range []string{"price_a", "price_b", "price_c"} {
+		fake.AddPrice(&stripe.Price{ID: id})
+		if _, err := cached.GetPrice(id, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cached.entries) != 3 {
+		t.Errorf("expected 3 entries, got %d", len(cached.entries))
+	}
+}
@@ -0,0 +1,796 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// Fake is an in-memory implementation of Stripe, for tests and local
+// development. Calls made with an idempotency key return the first result.
+type Fake struct {
+	mu            sync.Mutex
+	seq           int
+	customers     map[string]*stripe.Customer
+	sessions      map[string]*stripe.CheckoutSession
+	subscriptions map[string]*stripe.Subscription
+	prices        map[string]*stripe.Price
+	taxIDs        map[string]*stripe.TaxID
+	invoices      map[string]*stripe.Invoice
+	methods       map[string]*stripe.PaymentMethod
+	idempotent    map[string]interface{}
+	failures      map[string]error
+	calls         map[string]int
+}
+
+// NewFake creates an empty fake
+func NewFake() *Fake {
+	return &Fake{
+		customers:     map[string]*stripe.Customer{},
+		sessions:      map[string]*stripe.CheckoutSession{},
+		subscriptions: map[string]*stripe.Subscription{},
+		prices:        map[string]*stripe.Price{},
+		taxIDs:        map[string]*stripe.TaxID{},
+		invoices:      map[string]*stripe.Invoice{},
+		methods:       map[string]*stripe.PaymentMethod{},
+		idempotent:    map[string]interface{}{},
+		failures:      map[string]error{},
+		calls:         map[string]int{},
+	}
+}
+
+// notFound returns the error Stripe returns for an unknown object
+func notFound(kind, id string) error {
+	return &stripe.Error{
+		Type:           stripe.ErrorTypeInvalidRequest,
+		Code:           stripe.ErrorCodeResourceMissing,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+func (f *Fake) newID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake%06d", prefix, f.seq)
+}
+
+// call records a call and returns the failure set for it, if any
+func (f *Fake) call(method string) error {
+	f.calls[method]++
+	if err, ok := f.failures[method]; ok {
+		delete(f.failures, method)
+		return err
+	}
+	return nil
+}
+
+// replay returns the result of a previous call made with the same
+// idempotency key
+func (f *Fake) replay(method string, params *stripe.Params) (interface{}, bool) {
+	if params == nil || params.IdempotencyKey == nil {
+		return nil, false
+	}
+	result, ok := f.idempotent[method+":"+*params.IdempotencyKey]
+	return result, ok
+}
+
+func (f *Fake) remember(method string, params *stripe.Params, result interface{}) {
+	if params != nil && params.IdempotencyKey != nil {
+		f.idempotent[method+":"+*params.IdempotencyKey] = result
+	}
+}
+
+// FailNext makes the next call to method return err
+func (f *Fake) FailNext(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method] = err
+}
+
+// Calls returns the number of calls made to method
+func (f *Fake) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// AddPrice stores a price, filling in an ID and a monthly recurrence when
+// they are missing
+func (f *Fake) AddPrice(p *stripe.Price) *stripe.Price {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p.ID == "" {
+		p.ID = f.newID("price")
+	}
+	if p.Recurring == nil {
+		p.Recurring = &stripe.PriceRecurring{Interval: stripe.PriceRecurringIntervalMonth, IntervalCount: 1}
+	}
+	if p.Product == nil {
+		p.Product = &stripe.Product{ID: f.newID("prod")}
+	}
+	f.prices[p.ID] = p
+	return p
+}
+
+// AddSubscription stores a subscription of a customer to a price
+func (f *Fake) AddSubscription(customerID, priceID string, status stripe.SubscriptionStatus) *stripe.Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addSubscription(customerID, priceID, status)
+}
+
+func (f *Fake) addSubscription(customerID, priceID string, status stripe.SubscriptionStatus) *stripe.Subscription {
+	now := time.Now()
+	p, ok := f.prices[priceID]
+	if !ok {
+		p = &stripe.Price{ID: priceID}
+	}
+
+	s := &stripe.Subscription{
+		ID:                 f.newID("sub"),
+		Customer:           &stripe.Customer{ID: customerID},
+		Status:             status,
+		Created:            now.Unix(),
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Currency:           p.Currency,
+		Metadata:           map[string]string{},
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{ID: f.newID("si"), Price: p, Quantity: 1}},
+		},
+	}
+	f.subscriptions[s.ID] = s
+	return s
+}
+
+// CompleteCheckoutSession simulates a customer paying a checkout session: the
+// subscription is created, with a paid first invoice, and attached to the
+// session
+func (f *Fake) CompleteCheckoutSession(id string) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+
+	priceID := ""
+	if s.LineItems != nil && len(s.LineItems.Data) > 0 && s.LineItems.Data[0].Price != nil {
+		priceID = s.LineItems.Data[0].Price.ID
+	}
+
+	subscription := f.addSubscription(s.Customer.ID, priceID, stripe.SubscriptionStatusActive)
+	for k, v := range s.Metadata {
+		subscription.Metadata[k] = v
+	}
+	invoice := f.addInvoice(subscription, stripe.InvoiceStatusPaid)
+	subscription.LatestInvoice = &stripe.Invoice{ID: invoice.ID}
+	s.Subscription = subscription
+	s.Status = stripe.CheckoutSessionStatusComplete
+	s.PaymentStatus = stripe.CheckoutSessionPaymentStatusPaid
+	return f.session(s), nil
+}
+
+// NewCustomer creates a customer
+func (f *Fake) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("NewCustomer"); err != nil {
+		return nil, err
+	}
+	if result, ok := f.replay("NewCustomer", &params.Params); ok {
+		c := *result.(*stripe.Customer)
+		return &c, nil
+	}
+
+	c := &stripe.Customer{
+		ID:              f.newID("cus"),
+		Created:         time.Now().Unix(),
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{},
+		Metadata:        map[string]string{},
+	}
+	applyCustomerParams(c, params)
+	f.customers[c.ID] = c
+	f.remember("NewCustomer", &params.Params, c)
+
+	copy := *c
+	return &copy, nil
+}
+
+// GetCustomer gets a customer
+func (f *Fake) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetCustomer"); err != nil {
+		return nil, err
+	}
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, notFound("customer", id)
+	}
+	copy := *c
+	return &copy, nil
+}
+
+// ListCustomers lists the customers, filtered by email, from the one after
+// params.StartingAfter when it is set
+func (f *Fake) ListCustomers(params *stripe.CustomerListParams, max int) ([]*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListCustomers"); err != nil {
+		return nil, err
+	}
+
+	var customers []*stripe.Customer
+	for _, c := range f.customers {
+		if params != nil && params.Email != nil && c.Email != *params.Email {
+			continue
+		}
+		copy := *c
+		customers = append(customers, &copy)
+	}
+
+	sort.Slice(customers, func(i, j int) bool {
+		return customers[i].ID > customers[j].ID
+	})
+	if params != nil && params.StartingAfter != nil {
+		for i, c := range customers {
+			if c.ID == *params.StartingAfter {
+				customers = customers[i+1:]
+				break
+			}
+		}
+	}
+	if max > 0 && len(customers) > max {
+		customers = customers[:max]
+	}
+	return customers, nil
+}
+
+// UpdateCustomer updates a customer
+func (f *Fake) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("UpdateCustomer"); err != nil {
+		return nil, err
+	}
+	c, ok := f.customers[id]
+	if !ok {
+		return nil, notFound("customer", id)
+	}
+	applyCustomerParams(c, params)
+	copy := *c
+	return &copy, nil
+}
+
+func applyCustomerParams(c *stripe.Customer, params *stripe.CustomerParams) {
+	if params == nil {
+		return
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if params.Phone != nil {
+		c.Phone = *params.Phone
+	}
+	if params.Address != nil {
+		c.Address = stripe.Address{
+			Line1:      stripe.StringValue(params.Address.Line1),
+			Line2:      stripe.StringValue(params.Address.Line2),
+			City:       stripe.StringValue(params.Address.City),
+			PostalCode: stripe.StringValue(params.Address.PostalCode),
+			State:      stripe.StringValue(params.Address.State),
+			Country:    stripe.StringValue(params.Address.Country),
+		}
+	}
+	if params.PreferredLocales != nil {
+		c.PreferredLocales = nil
+		for _, locale := range params.PreferredLocales {
+			c.PreferredLocales = append(c.PreferredLocales, stripe.StringValue(locale))
+		}
+	}
+	for k, v := range params.Metadata {
+		c.Metadata[k] = v
+	}
+}
+
+// NewCheckoutSession creates a checkout session
+func (f *Fake) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("NewCheckoutSession"); err != nil {
+		return nil, err
+	}
+	if result, ok := f.replay("NewCheckoutSession", &params.Params); ok {
+		return f.session(result.(*stripe.CheckoutSession)), nil
+	}
+
+	customerID := stripe.StringValue(params.Customer)
+	if _, ok := f.customers[customerID]; customerID != "" && !ok {
+		return nil, notFound("customer", customerID)
+	}
+
+	s := &stripe.CheckoutSession{
+		ID:                f.newID("cs"),
+		Customer:          &stripe.Customer{ID: customerID},
+		Mode:              stripe.CheckoutSessionMode(stripe.StringValue(params.Mode)),
+		Currency:          stripe.Currency(stripe.StringValue(params.Currency)),
+		ClientReferenceID: stripe.StringValue(params.ClientReferenceID),
+		SuccessURL:        stripe.StringValue(params.SuccessURL),
+		CancelURL:         stripe.StringValue(params.CancelURL),
+		Status:            stripe.CheckoutSessionStatusOpen,
+		PaymentStatus:     stripe.CheckoutSessionPaymentStatusUnpaid,
+		Metadata:          map[string]string{},
+		LineItems:         &stripe.LineItemList{},
+	}
+	s.URL = "https://checkout.stripe.test/pay/" + s.ID
+	for k, v := range params.Metadata {
+		s.Metadata[k] = v
+	}
+	if params.SubscriptionData != nil {
+		for k, v := range params.SubscriptionData.Metadata {
+			s.Metadata[k] = v
+		}
+	}
+	for _, item := range params.LineItems {
+		priceID := stripe.StringValue(item.Price)
+		p, ok := f.prices[priceID]
+		if !ok {
+			return nil, notFound("price", priceID)
+		}
+		s.LineItems.Data = append(s.LineItems.Data, &stripe.LineItem{
+			ID:       f.newID("li"),
+			Price:    p,
+			Quantity: stripe.Int64Value(item.Quantity),
+		})
+	}
+
+	f.sessions[s.ID] = s
+	f.remember("NewCheckoutSession", &params.Params, s)
+	return f.session(s), nil
+}
+
+// GetCheckoutSession gets a checkout session, with its customer and
+// subscription expanded
+func (f *Fake) GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetCheckoutSession"); err != nil {
+		return nil, err
+	}
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, notFound("checkout.session", id)
+	}
+	return f.session(s), nil
+}
+
+// session copies a session, expanding its customer
+func (f *Fake) session(s *stripe.CheckoutSession) *stripe.CheckoutSession {
+	copy := *s
+	if c, ok := f.customers[s.Customer.ID]; ok {
+		customer := *c
+		copy.Customer = &customer
+	}
+	return &copy
+}
+
+// GetSubscription gets a subscription
+func (f *Fake) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetSubscription"); err != nil {
+		return nil, err
+	}
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	copy := *s
+	return &copy, nil
+}
+
+// ListSubscriptions lists the subscriptions, filtered by customer and status.
+// Canceled subscriptions are only listed with the status "all" or "canceled".
+func (f *Fake) ListSubscriptions(params *stripe.SubscriptionListParams, max int) ([]*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListSubscriptions"); err != nil {
+		return nil, err
+	}
+
+	var subscriptions []*stripe.Subscription
+	for _, s := range f.subscriptions {
+		if params != nil && params.Customer != "" && s.Customer.ID != params.Customer {
+			continue
+		}
+		status := ""
+		if params != nil {
+			status = params.Status
+		}
+		switch status {
+		case "all":
+		case "":
+			if s.Status == stripe.SubscriptionStatusCanceled {
+				continue
+			}
+		default:
+			if string(s.Status) != status {
+				continue
+			}
+		}
+		copy := *s
+		subscriptions = append(subscriptions, &copy)
+	}
+
+	// Comme Stripe, les plus récents en premier
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].ID > subscriptions[j].ID
+	})
+	if max > 0 && len(subscriptions) > max {
+		subscriptions = subscriptions[:max]
+	}
+	return subscriptions, nil
+}
+
+// SetSubscriptionStatus changes the status of a subscription, as Stripe does
+// when a payment fails or the subscription ends
+func (f *Fake) SetSubscriptionStatus(id string, status stripe.SubscriptionStatus) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[id]
+	if !ok {
+		return nil, notFound("subscription", id)
+	}
+	f.setSubscriptionStatus(s, status)
+	copy := *s
+	return &copy, nil
+}
+
+func (f *Fake) setSubscriptionStatus(s *stripe.Subscription, status stripe.SubscriptionStatus) {
+	s.Status = status
+	if status == stripe.SubscriptionStatusCanceled && s.CanceledAt == 0 {
+		now := time.Now().Unix()
+		s.CanceledAt = now
+		s.EndedAt = now
+	}
+}
+
+// GetPrice gets a price
+func (f *Fake) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetPrice"); err != nil {
+		return nil, err
+	}
+	p, ok := f.prices[id]
+	if !ok {
+		return nil, notFound("price", id)
+	}
+	copy := *p
+	return &copy, nil
+}
+
+// ListPrices lists the prices, filtered by lookup keys and active flag
+func (f *Fake) ListPrices(params *stripe.PriceListParams, max int) ([]*stripe.Price, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListPrices"); err != nil {
+		return nil, err
+	}
+
+	var prices []*stripe.Price
+	for _, p := range f.prices {
+		if params != nil && params.Active != nil && p.Active != *params.Active {
+			continue
+		}
+		if params != nil && len(params.LookupKeys) > 0 {
+			found := false
+			for _, key := range params.LookupKeys {
+				if stripe.StringValue(key) == p.LookupKey {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		copy := *p
+		prices = append(prices, &copy)
+	}
+
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i].ID < prices[j].ID
+	})
+	if max > 0 && len(prices) > max {
+		prices = prices[:max]
+	}
+	return prices, nil
+}
+
+// NewTaxID creates a tax ID, which is immediately verified
+func (f *Fake) NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("NewTaxID"); err != nil {
+		return nil, err
+	}
+	if result, ok := f.replay("NewTaxID", &params.Params); ok {
+		t := *result.(*stripe.TaxID)
+		return &t, nil
+	}
+
+	customerID := stripe.StringValue(params.Customer)
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, notFound("customer", customerID)
+	}
+
+	t := &stripe.TaxID{
+		ID:       f.newID("txi"),
+		Customer: &stripe.Customer{ID: customerID},
+		Type:     stripe.TaxIDType(stripe.StringValue(params.Type)),
+		Value:    stripe.StringValue(params.Value),
+		Created:  time.Now().Unix(),
+		Verification: &stripe.TaxIDVerification{
+			Status: stripe.TaxIDVerificationStatusVerified,
+		},
+	}
+	f.taxIDs[t.ID] = t
+	f.remember("NewTaxID", &params.Params, t)
+
+	copy := *t
+	return &copy, nil
+}
+
+// DeleteTaxID deletes a tax ID
+func (f *Fake) DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("DeleteTaxID"); err != nil {
+		return nil, err
+	}
+	t, ok := f.taxIDs[id]
+	if !ok {
+		return nil, notFound("tax_id", id)
+	}
+	delete(f.taxIDs, id)
+	copy := *t
+	copy.Deleted = true
+	return &copy, nil
+}
+
+// NewBillingPortalSession creates a billing portal session
+func (f *Fake) NewBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("NewBillingPortalSession"); err != nil {
+		return nil, err
+	}
+	customerID := stripe.StringValue(params.Customer)
+	if _, ok := f.customers[customerID]; !ok {
+		return nil, notFound("customer", customerID)
+	}
+
+	id := f.newID("bps")
+	return &stripe.BillingPortalSession{
+		ID:        id,
+		Customer:  customerID,
+		ReturnURL: stripe.StringValue(params.ReturnURL),
+		URL:       "https://billing.stripe.test/session/" + id,
+		Created:   time.Now().Unix(),
+	}, nil
+}
+
+// FailInvoicePayment simulates a failed payment of the latest invoice of a
+// subscription: the invoice stays open, its attempt count grows and the
+// subscription becomes past due
+func (f *Fake) FailInvoicePayment(subscriptionID string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.subscriptions[subscriptionID]
+	if !ok {
+		return nil, notFound("subscription", subscriptionID)
+	}
+
+	var invoice *stripe.Invoice
+	if s.LatestInvoice != nil {
+		if latest, ok := f.invoices[s.LatestInvoice.ID]; ok && latest.Status == stripe.InvoiceStatusOpen {
+			invoice = latest
+		}
+	}
+	if invoice == nil {
+		invoice = f.addInvoice(s, stripe.InvoiceStatusOpen)
+		s.LatestInvoice = &stripe.Invoice{ID: invoice.ID}
+	}
+
+	invoice.Attempted = true
+	invoice.AttemptCount++
+	invoice.NextPaymentAttempt = time.Now().AddDate(0, 0, 3).Unix()
+	f.setSubscriptionStatus(s, stripe.SubscriptionStatusPastDue)
+
+	copy := *invoice
+	return &copy, nil
+}
+
+// PayInvoice simulates the payment of an open invoice, which reactivates its
+// subscription
+func (f *Fake) PayInvoice(id string) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	invoice, ok := f.invoices[id]
+	if !ok {
+		return nil, notFound("invoice", id)
+	}
+
+	invoice.Status = stripe.InvoiceStatusPaid
+	invoice.Paid = true
+	invoice.AmountPaid = invoice.AmountDue
+	invoice.AmountRemaining = 0
+	invoice.NextPaymentAttempt = 0
+	if invoice.Subscription != nil {
+		if s, ok := f.subscriptions[invoice.Subscription.ID]; ok && s.Status != stripe.SubscriptionStatusCanceled {
+			f.setSubscriptionStatus(s, stripe.SubscriptionStatusActive)
+		}
+	}
+
+	copy := *invoice
+	return &copy, nil
+}
+
+// addInvoice creates an invoice for the current period of a subscription
+func (f *Fake) addInvoice(s *stripe.Subscription, status stripe.InvoiceStatus) *stripe.Invoice {
+	var amount int64
+	if len(s.Items.Data) > 0 && s.Items.Data[0].Price != nil {
+		amount = s.Items.Data[0].Price.UnitAmount
+	}
+
+	id := f.newID("in")
+	invoice := &stripe.Invoice{
+		ID:               id,
+		Number:           fmt.Sprintf("FAKE-%04d", len(f.invoices)+1),
+		Customer:         &stripe.Customer{ID: s.Customer.ID},
+		Subscription:     &stripe.Subscription{ID: s.ID},
+		Status:           status,
+		Currency:         s.Currency,
+		Subtotal:         amount,
+		Total:            amount,
+		AmountDue:        amount,
+		AmountRemaining:  amount,
+		HostedInvoiceURL: "https://invoice.stripe.test/" + id,
+		PeriodStart:      s.CurrentPeriodStart,
+		PeriodEnd:        s.CurrentPeriodEnd,
+		Created:          time.Now().Unix(),
+	}
+	if status == stripe.InvoiceStatusPaid {
+		invoice.Paid = true
+		invoice.AmountPaid = amount
+		invoice.AmountRemaining = 0
+	}
+	f.invoices[id] = invoice
+	return invoice
+}
+
+// GetInvoice gets an invoice
+func (f *Fake) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("GetInvoice"); err != nil {
+		return nil, err
+	}
+	invoice, ok := f.invoices[id]
+	if !ok {
+		return nil, notFound("invoice", id)
+	}
+	copy := *invoice
+	return &copy, nil
+}
+
+// ListInvoices lists the invoices, filtered by customer, subscription and status
+func (f *Fake) ListInvoices(params *stripe.InvoiceListParams, max int) ([]*stripe.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListInvoices"); err != nil {
+		return nil, err
+	}
+
+	var invoices []*stripe.Invoice
+	for _, invoice := range f.invoices {
+		if params != nil && params.Customer != nil && invoice.Customer.ID != *params.Customer {
+			continue
+		}
+		if params != nil && params.Subscription != nil && (invoice.Subscription == nil || invoice.Subscription.ID != *params.Subscription) {
+			continue
+		}
+		if params != nil && params.Status != nil && string(invoice.Status) != *params.Status {
+			continue
+		}
+		copy := *invoice
+		invoices = append(invoices, &copy)
+	}
+
+	sort.Slice(invoices, func(i, j int) bool {
+		return invoices[i].ID > invoices[j].ID
+	})
+	if max > 0 && len(invoices) > max {
+		invoices = invoices[:max]
+	}
+	return invoices, nil
+}
+
+// AddPaymentMethod attaches a card to a customer. The first card becomes the
+// default payment method of the customer.
+func (f *Fake) AddPaymentMethod(customerID string, brand stripe.PaymentMethodCardBrand, last4 string) *stripe.PaymentMethod {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pm := &stripe.PaymentMethod{
+		ID:       f.newID("pm"),
+		Type:     stripe.PaymentMethodTypeCard,
+		Customer: &stripe.Customer{ID: customerID},
+		Card:     &stripe.PaymentMethodCard{Brand: brand, Last4: last4, ExpMonth: 12, ExpYear: uint64(time.Now().Year() + 3)},
+		Created:  time.Now().Unix(),
+	}
+	f.methods[pm.ID] = pm
+
+	if c, ok := f.customers[customerID]; ok && (c.InvoiceSettings == nil || c.InvoiceSettings.DefaultPaymentMethod == nil) {
+		c.InvoiceSettings = &stripe.CustomerInvoiceSettings{DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm.ID}}
+	}
+	return pm
+}
+
+// ListPaymentMethods lists the payment methods of a customer, filtered by type
+func (f *Fake) ListPaymentMethods(params *stripe.PaymentMethodListParams, max int) ([]*stripe.PaymentMethod, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.call("ListPaymentMethods"); err != nil {
+		return nil, err
+	}
+
+	var methods []*stripe.PaymentMethod
+	for _, pm := range f.methods {
+		if params != nil && params.Customer != nil && pm.Customer.ID != *params.Customer {
+			continue
+		}
+		if params != nil && params.Type != nil && string(pm.Type) != *params.Type {
+			continue
+		}
+		copy := *pm
+		methods = append(methods, &copy)
+	}
+
+	sort.Slice(methods, func(i, j int) bool {
+		return methods[i].ID > methods[j].ID
+	})
+	if max > 0 && len(methods) > max {
+		methods = methods[:max]
+	}
+	return methods, nil
+}
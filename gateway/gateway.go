@@ -0,0 +1,187 @@
+// Package gateway wraps the calls made to the Stripe API, so that the API can
+// be run against Stripe or against an in-memory fake.
+package gateway
+
+import (
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/client"
+)
+
+// Stripe is the subset of the Stripe API used by GoStripe. The List methods
+// follow the pages, params.Limit being the page size, until max results are
+// found or, when max is 0, until the end of the list.
+type Stripe interface {
+	NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error)
+	GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+	ListCustomers(params *stripe.CustomerListParams, max int) ([]*stripe.Customer, error)
+	UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error)
+
+	NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+	GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
+
+	GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	ListSubscriptions(params *stripe.SubscriptionListParams, max int) ([]*stripe.Subscription, error)
+
+	GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error)
+	ListPrices(params *stripe.PriceListParams, max int) ([]*stripe.Price, error)
+
+	GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error)
+	ListInvoices(params *stripe.InvoiceListParams, max int) ([]*stripe.Invoice, error)
+
+	ListPaymentMethods(params *stripe.PaymentMethodListParams, max int) ([]*stripe.PaymentMethod, error)
+
+	NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error)
+	DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error)
+
+	NewBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
+}
+
+// Client calls the Stripe API
+type Client struct {
+	api *client.API
+}
+
+// NewClient creates a client using the given secret key. The requests are
+// sent to apiURL instead of the Stripe API when it is set, e.g. to a mock.
+func NewClient(secretKey, apiURL string) *Client {
+	if apiURL == "" {
+		return &Client{api: client.New(secretKey, nil)}
+	}
+
+	return &Client{api: client.New(secretKey, &stripe.Backends{
+		API:     stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{URL: stripe.String(apiURL)}),
+		Connect: stripe.GetBackendWithConfig(stripe.ConnectBackend, &stripe.BackendConfig{URL: stripe.String(apiURL)}),
+		Uploads: stripe.GetBackendWithConfig(stripe.UploadsBackend, &stripe.BackendConfig{URL: stripe.String(apiURL)}),
+	})}
+}
+
+// NewCustomer creates a customer
+func (c *Client) NewCustomer(params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return c.api.Customers.New(params)
+}
+
+// GetCustomer gets a customer
+func (c *Client) GetCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return c.api.Customers.Get(id, params)
+}
+
+// ListCustomers lists the customers matching params, following the pages
+// until max customers are found when it is set
+func (c *Client) ListCustomers(params *stripe.CustomerListParams, max int) ([]*stripe.Customer, error) {
+	var customers []*stripe.Customer
+	it := c.api.Customers.List(params)
+	for it.Next() {
+		customers = append(customers, it.Customer())
+		if limitReached(max, len(customers)) {
+			break
+		}
+	}
+	return customers, it.Err()
+}
+
+// UpdateCustomer updates a customer
+func (c *Client) UpdateCustomer(id string, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	return c.api.Customers.Update(id, params)
+}
+
+// NewCheckoutSession creates a checkout session
+func (c *Client) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return c.api.CheckoutSessions.New(params)
+}
+
+// GetCheckoutSession gets a checkout session
+func (c *Client) GetCheckoutSession(id string, params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
+	return c.api.CheckoutSessions.Get(id, params)
+}
+
+// GetSubscription gets a subscription
+func (c *Client) GetSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	return c.api.Subscriptions.Get(id, params)
+}
+
+// ListSubscriptions lists the subscriptions matching params, following the
+// pages until max subscriptions are found when it is set
+func (c *Client) ListSubscriptions(params *stripe.SubscriptionListParams, max int) ([]*stripe.Subscription, error) {
+	var subscriptions []*stripe.Subscription
+	it := c.api.Subscriptions.List(params)
+	for it.Next() {
+		subscriptions = append(subscriptions, it.Subscription())
+		if limitReached(max, len(subscriptions)) {
+			break
+		}
+	}
+	return subscriptions, it.Err()
+}
+
+// GetPrice gets a price
+func (c *Client) GetPrice(id string, params *stripe.PriceParams) (*stripe.Price, error) {
+	return c.api.Prices.Get(id, params)
+}
+
+// ListPrices lists the prices matching params, following the pages until
+// max prices are found when it is set
+func (c *Client) ListPrices(params *stripe.PriceListParams, max int) ([]*stripe.Price, error) {
+	var prices []*stripe.Price
+	it := c.api.Prices.List(params)
+	for it.Next() {
+		prices = append(prices, it.Price())
+		if limitReached(max, len(prices)) {
+			break
+		}
+	}
+	return prices, it.Err()
+}
+
+// GetInvoice gets an invoice
+func (c *Client) GetInvoice(id string, params *stripe.InvoiceParams) (*stripe.Invoice, error) {
+	return c.api.Invoices.Get(id, params)
+}
+
+// ListInvoices lists the invoices matching params, following the pages until
+// max invoices are found when it is set
+func (c *Client) ListInvoices(params *stripe.InvoiceListParams, max int) ([]*stripe.Invoice, error) {
+	var invoices []*stripe.Invoice
+	it := c.api.Invoices.List(params)
+	for it.Next() {
+		invoices = append(invoices, it.Invoice())
+		if limitReached(max, len(invoices)) {
+			break
+		}
+	}
+	return invoices, it.Err()
+}
+
+// ListPaymentMethods lists the payment methods of a customer, following the
+// pages until max payment methods are found when it is set
+func (c *Client) ListPaymentMethods(params *stripe.PaymentMethodListParams, max int) ([]*stripe.PaymentMethod, error) {
+	var methods []*stripe.PaymentMethod
+	it := c.api.PaymentMethods.List(params)
+	for it.Next() {
+		methods = append(methods, it.PaymentMethod())
+		if limitReached(max, len(methods)) {
+			break
+		}
+	}
+	return methods, it.Err()
+}
+
+// NewTaxID creates a tax ID
+func (c *Client) NewTaxID(params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	return c.api.TaxIDs.New(params)
+}
+
+// DeleteTaxID deletes a tax ID
+func (c *Client) DeleteTaxID(id string, params *stripe.TaxIDParams) (*stripe.TaxID, error) {
+	return c.api.TaxIDs.Del(id, params)
+}
+
+// NewBillingPortalSession creates a billing portal session
+func (c *Client) NewBillingPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	return c.api.BillingPortalSessions.New(params)
+}
+
+// limitReached tells whether n results are enough for the max of a list, 0
+// listing everything
+func limitReached(max, n int) bool {
+	return max > 0 && n >= max
+}
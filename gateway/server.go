@@ -0,0 +1,640 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// Server serves the subset of the Stripe REST API used by GoStripe on top of
+// a Fake, so that the API can run end to end without network access. The
+// changes Stripe notifies with webhooks are signed and posted to WebhookURL.
+//
+// The /_mock endpoints simulate what happens outside of the API: a customer
+// paying a checkout session, a failed or recovered payment, a cancellation.
+type Server struct {
+	fake          *Fake
+	webhookURL    string
+	webhookSecret string
+	client        *http.Client
+	events        chan *stripe.Event
+	handler       http.Handler
+}
+
+// NewServer creates a server on top of fake. Webhooks are not sent when
+// webhookURL is empty.
+func NewServer(fake *Fake, webhookURL, webhookSecret string) *Server {
+	s := &Server{
+		fake:          fake,
+		webhookURL:    webhookURL,
+		webhookSecret: webhookSecret,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		events:        make(chan *stripe.Event, 100),
+	}
+
+	r := chi.NewRouter()
+	r.Route("/v1", func(r chi.Router) {
+		r.Use(requireSecretKey)
+
+		r.Post("/customers", s.newCustomer)
+		r.Get("/customers", s.listCustomers)
+		r.Get("/customers/{id}", s.getCustomer)
+		r.Post("/customers/{id}", s.updateCustomer)
+		r.Post("/customers/{id}/tax_ids", s.newTaxID)
+		r.Delete("/customers/{id}/tax_ids/{tax_id}", s.deleteTaxID)
+
+		r.Post("/checkout/sessions", s.newCheckoutSession)
+		r.Get("/checkout/sessions/{id}", s.getCheckoutSession)
+
+		r.Get("/subscriptions", s.listSubscriptions)
+		r.Get("/subscriptions/{id}", s.getSubscription)
+		r.Delete("/subscriptions/{id}", s.cancelSubscription)
+
+		r.Post("/prices", s.newPrice)
+		r.Get("/prices", s.listPrices)
+		r.Get("/prices/{id}", s.getPrice)
+
+		r.Get("/invoices", s.listInvoices)
+		r.Get("/invoices/{id}", s.getInvoice)
+
+		r.Get("/payment_methods", s.listPaymentMethods)
+
+		r.Post("/billing_portal/sessions", s.newBillingPortalSession)
+	})
+
+	r.Route("/_mock", func(r chi.Router) {
+		r.Post("/checkout/sessions/{id}/complete", s.completeCheckoutSession)
+		r.Post("/subscriptions/{id}/fail_payment", s.failPayment)
+		r.Post("/subscriptions/{id}/cancel", s.cancelSubscription)
+		r.Post("/invoices/{id}/pay", s.payInvoice)
+	})
+
+	s.handler = r
+	go s.deliverEvents()
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.WithFields(logrus.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Debug("Mock Stripe request")
+	s.handler.ServeHTTP(w, r)
+}
+
+// Close stops sending webhooks
+func (s *Server) Close() {
+	close(s.events)
+}
+
+// requireSecretKey rejects requests without an API key, like Stripe
+func requireSecretKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			sendStripeError(w, &stripe.Error{
+				Type:           stripe.ErrorTypeInvalidRequest,
+				HTTPStatusCode: http.StatusUnauthorized,
+				Msg:            "You did not provide an API key.",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) newCustomer(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+	params := customerParams(form)
+	setIdempotencyKey(r, &params.Params)
+	result, err := s.fake.NewCustomer(params)
+	s.respond(w, result, err)
+}
+
+func (s *Server) listCustomers(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query()
+	params := &stripe.CustomerListParams{Email: formString(form, "email")}
+	customers, err := s.fake.ListCustomers(params, 0)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendList(w, r, form, len(customers), func(i int) (string, interface{}) {
+		return customers[i].ID, customers[i]
+	})
+}
+
+func (s *Server) getCustomer(w http.ResponseWriter, r *http.Request) {
+	result, err := s.fake.GetCustomer(chi.URLParam(r, "id"), nil)
+	s.respond(w, result, err)
+}
+
+func (s *Server) updateCustomer(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+	customer, err := s.fake.UpdateCustomer(chi.URLParam(r, "id"), customerParams(form))
+	if err == nil {
+		s.emit("customer.updated", customer)
+	}
+	s.respond(w, customer, err)
+}
+
+func (s *Server) newTaxID(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+	params := &stripe.TaxIDParams{
+		Customer: stripe.String(chi.URLParam(r, "id")),
+		Type:     formString(form, "type"),
+		Value:    formString(form, "value"),
+	}
+	setIdempotencyKey(r, &params.Params)
+	taxID, err := s.fake.NewTaxID(params)
+	if err == nil {
+		s.emit("customer.tax_id.created", taxID)
+	}
+	s.respond(w, taxID, err)
+}
+
+func (s *Server) deleteTaxID(w http.ResponseWriter, r *http.Request) {
+	taxID, err := s.fake.DeleteTaxID(chi.URLParam(r, "tax_id"), &stripe.TaxIDParams{Customer: stripe.String(chi.URLParam(r, "id"))})
+	if err == nil {
+		s.emit("customer.tax_id.deleted", taxID)
+	}
+	s.respond(w, taxID, err)
+}
+
+func (s *Server) newCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+
+	params := &stripe.CheckoutSessionParams{
+		Customer:          formString(form, "customer"),
+		Mode:              formString(form, "mode"),
+		Currency:          formString(form, "currency"),
+		ClientReferenceID: formString(form, "client_reference_id"),
+		SuccessURL:        formString(form, "success_url"),
+		CancelURL:         formString(form, "cancel_url"),
+	}
+	for i := 0; ; i++ {
+		prefix := fmt.Sprintf("line_items[%d]", i)
+		price := formString(form, prefix+"[price]")
+		if price == nil {
+			break
+		}
+		item := &stripe.CheckoutSessionLineItemParams{Price: price, Quantity: stripe.Int64(1)}
+		if q, err := strconv.ParseInt(form.Get(prefix+"[quantity]"), 10, 64); err == nil {
+			item.Quantity = stripe.Int64(q)
+		}
+		params.LineItems = append(params.LineItems, item)
+	}
+	for k, v := range formMap(form, "metadata") {
+		params.AddMetadata(k, v)
+	}
+	if metadata := formMap(form, "subscription_data[metadata]"); len(metadata) > 0 {
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{}
+		for k, v := range metadata {
+			params.SubscriptionData.AddMetadata(k, v)
+		}
+	}
+	setIdempotencyKey(r, &params.Params)
+
+	result, err := s.fake.NewCheckoutSession(params)
+	s.respond(w, result, err)
+}
+
+func (s *Server) getCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	result, err := s.fake.GetCheckoutSession(chi.URLParam(r, "id"), nil)
+	s.respond(w, result, err)
+}
+
+func (s *Server) listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query()
+	params := &stripe.SubscriptionListParams{
+		Customer: form.Get("customer"),
+		Status:   form.Get("status"),
+	}
+	subscriptions, err := s.fake.ListSubscriptions(params, 0)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendList(w, r, form, len(subscriptions), func(i int) (string, interface{}) {
+		return subscriptions[i].ID, subscriptions[i]
+	})
+}
+
+func (s *Server) getSubscription(w http.ResponseWriter, r *http.Request) {
+	result, err := s.fake.GetSubscription(chi.URLParam(r, "id"), nil)
+	s.respond(w, result, err)
+}
+
+func (s *Server) cancelSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, err := s.fake.SetSubscriptionStatus(chi.URLParam(r, "id"), stripe.SubscriptionStatusCanceled)
+	if err == nil {
+		s.emit("customer.subscription.deleted", subscription)
+	}
+	s.respond(w, subscription, err)
+}
+
+func (s *Server) newPrice(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+
+	p := &stripe.Price{
+		Active:    form.Get("active") != "false",
+		Currency:  stripe.Currency(strings.ToLower(form.Get("currency"))),
+		LookupKey: form.Get("lookup_key"),
+		Nickname:  form.Get("nickname"),
+		Type:      stripe.PriceTypeRecurring,
+	}
+	if p.Currency == "" {
+		sendStripeError(w, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Param: "currency", Msg: "Missing required param: currency."})
+		return
+	}
+	p.UnitAmount, _ = strconv.ParseInt(form.Get("unit_amount"), 10, 64)
+	if interval := form.Get("recurring[interval]"); interval != "" {
+		p.Recurring = &stripe.PriceRecurring{Interval: stripe.PriceRecurringInterval(interval), IntervalCount: 1}
+		if n, err := strconv.ParseInt(form.Get("recurring[interval_count]"), 10, 64); err == nil {
+			p.Recurring.IntervalCount = n
+		}
+	}
+	if product := form.Get("product"); product != "" {
+		p.Product = &stripe.Product{ID: product}
+	}
+	for currency, amount := range formMap(form, "currency_options") {
+		if p.CurrencyOptions == nil {
+			p.CurrencyOptions = map[string]*stripe.PriceCurrencyOptions{}
+		}
+		unitAmount, _ := strconv.ParseInt(amount, 10, 64)
+		p.CurrencyOptions[currency] = &stripe.PriceCurrencyOptions{UnitAmount: unitAmount}
+	}
+
+	sendJSON(w, http.StatusOK, s.fake.AddPrice(p))
+}
+
+func (s *Server) listPrices(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query()
+	params := &stripe.PriceListParams{LookupKeys: stripe.StringSlice(formList(form, "lookup_keys"))}
+	if active := form.Get("active"); active != "" {
+		params.Active = stripe.Bool(active == "true")
+	}
+	prices, err := s.fake.ListPrices(params, 0)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendList(w, r, form, len(prices), func(i int) (string, interface{}) {
+		return prices[i].ID, prices[i]
+	})
+}
+
+func (s *Server) getPrice(w http.ResponseWriter, r *http.Request) {
+	result, err := s.fake.GetPrice(chi.URLParam(r, "id"), nil)
+	s.respond(w, result, err)
+}
+
+func (s *Server) listInvoices(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query()
+	params := &stripe.InvoiceListParams{
+		Customer:     formString(form, "customer"),
+		Subscription: formString(form, "subscription"),
+		Status:       formString(form, "status"),
+	}
+	invoices, err := s.fake.ListInvoices(params, 0)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendList(w, r, form, len(invoices), func(i int) (string, interface{}) {
+		return invoices[i].ID, invoices[i]
+	})
+}
+
+func (s *Server) getInvoice(w http.ResponseWriter, r *http.Request) {
+	result, err := s.fake.GetInvoice(chi.URLParam(r, "id"), nil)
+	s.respond(w, result, err)
+}
+
+func (s *Server) listPaymentMethods(w http.ResponseWriter, r *http.Request) {
+	form := r.URL.Query()
+	params := &stripe.PaymentMethodListParams{
+		Customer: formString(form, "customer"),
+		Type:     formString(form, "type"),
+	}
+	methods, err := s.fake.ListPaymentMethods(params, 0)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendList(w, r, form, len(methods), func(i int) (string, interface{}) {
+		return methods[i].ID, methods[i]
+	})
+}
+
+func (s *Server) newBillingPortalSession(w http.ResponseWriter, r *http.Request) {
+	form, ok := parseForm(w, r)
+	if !ok {
+		return
+	}
+	result, err := s.fake.NewBillingPortalSession(&stripe.BillingPortalSessionParams{
+		Customer:  formString(form, "customer"),
+		ReturnURL: formString(form, "return_url"),
+	})
+	s.respond(w, result, err)
+}
+
+// completeCheckoutSession pays a checkout session and sends the webhooks
+// Stripe sends once the subscription is created
+func (s *Server) completeCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	session, err := s.fake.CompleteCheckoutSession(chi.URLParam(r, "id"))
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+
+	subscription := session.Subscription
+	invoice, err := s.fake.GetInvoice(subscription.LatestInvoice.ID, nil)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+
+	s.emit("customer.subscription.created", subscription)
+	s.emit("checkout.session.completed", session)
+	s.emit("invoice.finalized", invoice)
+	s.emit("invoice.paid", invoice)
+	sendJSON(w, http.StatusOK, session)
+}
+
+// failPayment fails the payment of the latest invoice of a subscription
+func (s *Server) failPayment(w http.ResponseWriter, r *http.Request) {
+	invoice, err := s.fake.FailInvoicePayment(chi.URLParam(r, "id"))
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	subscription, err := s.fake.GetSubscription(invoice.Subscription.ID, nil)
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+
+	s.emit("customer.subscription.updated", subscription)
+	s.emit("invoice.payment_failed", invoice)
+	sendJSON(w, http.StatusOK, invoice)
+}
+
+// payInvoice pays an open invoice
+func (s *Server) payInvoice(w http.ResponseWriter, r *http.Request) {
+	invoice, err := s.fake.PayInvoice(chi.URLParam(r, "id"))
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+
+	if invoice.Subscription != nil {
+		if subscription, err := s.fake.GetSubscription(invoice.Subscription.ID, nil); err == nil {
+			s.emit("customer.subscription.updated", subscription)
+		}
+	}
+	s.emit("invoice.paid", invoice)
+	sendJSON(w, http.StatusOK, invoice)
+}
+
+// respond sends the result of a fake call
+func (s *Server) respond(w http.ResponseWriter, result interface{}, err error) {
+	if err != nil {
+		sendStripeError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, result)
+}
+
+// emit queues a webhook event for an object
+func (s *Server) emit(eventType string, object interface{}) {
+	if s.webhookURL == "" {
+		return
+	}
+
+	raw, err := json.Marshal(object)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode webhook object")
+		return
+	}
+
+	s.events <- &stripe.Event{
+		ID:         "evt_" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		Object:     "event",
+		APIVersion: stripe.APIVersion,
+		Created:    time.Now().Unix(),
+		Type:       eventType,
+		Data:       &stripe.EventData{Raw: raw},
+	}
+}
+
+// deliverEvents sends the queued events in order, like Stripe each one in
+// its own request
+func (s *Server) deliverEvents() {
+	for event := range s.events {
+		if err := s.deliver(event); err != nil {
+			logrus.WithError(err).WithField("type", event.Type).Warn("Failed to deliver webhook")
+		}
+	}
+}
+
+// deliver signs and posts an event to the webhook URL
+func (s *Server) deliver(event *stripe.Event) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          event.ID,
+		"object":      event.Object,
+		"api_version": event.APIVersion,
+		"created":     event.Created,
+		"livemode":    false,
+		"type":        event.Type,
+		"data":        map[string]json.RawMessage{"object": event.Data.Raw},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", SignWebhook(payload, s.webhookSecret, time.Now()))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("webhook endpoint answered %s", resp.Status)
+	}
+	logrus.WithField("type", event.Type).Info("Delivered webhook")
+	return nil
+}
+
+// SignWebhook returns the Stripe-Signature header of a webhook payload
+func SignWebhook(payload []byte, secret string, t time.Time) string {
+	signature := webhook.ComputeSignature(t, payload, secret)
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(signature))
+}
+
+// customerParams reads the customer fields sent by stripe-go
+func customerParams(form url.Values) *stripe.CustomerParams {
+	params := &stripe.CustomerParams{
+		Email: formString(form, "email"),
+		Name:  formString(form, "name"),
+		Phone: formString(form, "phone"),
+	}
+	if address := formMap(form, "address"); len(address) > 0 {
+		params.Address = &stripe.AddressParams{
+			Line1:      stripe.String(address["line1"]),
+			Line2:      stripe.String(address["line2"]),
+			City:       stripe.String(address["city"]),
+			PostalCode: stripe.String(address["postal_code"]),
+			State:      stripe.String(address["state"]),
+			Country:    stripe.String(address["country"]),
+		}
+	}
+	if locales := formList(form, "preferred_locales"); len(locales) > 0 {
+		params.PreferredLocales = stripe.StringSlice(locales)
+	}
+	for k, v := range formMap(form, "metadata") {
+		params.AddMetadata(k, v)
+	}
+	return params
+}
+
+func parseForm(w http.ResponseWriter, r *http.Request) (url.Values, bool) {
+	if err := r.ParseForm(); err != nil {
+		sendStripeError(w, &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Msg: "Invalid request body"})
+		return nil, false
+	}
+	return r.Form, true
+}
+
+func setIdempotencyKey(r *http.Request, params *stripe.Params) {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		params.SetIdempotencyKey(key)
+	}
+}
+
+// formString returns a form value, or nil when it was not sent
+func formString(form url.Values, key string) *string {
+	if _, ok := form[key]; !ok {
+		return nil
+	}
+	return stripe.String(form.Get(key))
+}
+
+// formList returns the values of an array, encoded as key[0], key[1], ...
+func formList(form url.Values, key string) []string {
+	var list []string
+	for i := 0; ; i++ {
+		value := formString(form, fmt.Sprintf("%s[%d]", key, i))
+		if value == nil {
+			return list
+		}
+		list = append(list, *value)
+	}
+}
+
+// formMap returns the values of a hash, encoded as key[name]
+func formMap(form url.Values, key string) map[string]string {
+	m := map[string]string{}
+	prefix := key + "["
+	for k := range form {
+		if strings.HasPrefix(k, prefix) && strings.HasSuffix(k, "]") {
+			name := k[len(prefix) : len(k)-1]
+			if !strings.Contains(name, "[") {
+				m[name] = form.Get(k)
+			}
+		}
+	}
+	return m
+}
+
+// sendList sends a page of a Stripe list, honouring limit and starting_after
+func sendList(w http.ResponseWriter, r *http.Request, form url.Values, n int, item func(i int) (string, interface{})) {
+	limit := 10
+	if l, err := strconv.Atoi(form.Get("limit")); err == nil && l > 0 && l <= 100 {
+		limit = l
+	}
+
+	start := 0
+	if after := form.Get("starting_after"); after != "" {
+		for i := 0; i < n; i++ {
+			if id, _ := item(i); id == after {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	data := []interface{}{}
+	for i := start; i < n && len(data) < limit; i++ {
+		_, v := item(i)
+		data = append(data, v)
+	}
+
+	sendJSON(w, http.StatusOK, map[string]interface{}{
+		"object":   "list",
+		"url":      r.URL.Path,
+		"has_more": start+len(data) < n,
+		"data":     data,
+	})
+}
+
+func sendStripeError(w http.ResponseWriter, err error) {
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok {
+		stripeErr = &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: http.StatusInternalServerError, Msg: err.Error()}
+	}
+	status := stripeErr.HTTPStatusCode
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+
+	sendJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"type":    stripeErr.Type,
+			"code":    stripeErr.Code,
+			"param":   stripeErr.Param,
+			"message": stripeErr.Msg,
+		},
+	})
+}
+
+func sendJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logrus.WithError(err).Error("Failed to encode mock Stripe response")
+	}
+}
@@ -0,0 +1,172 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// newTestServer starts a mock Stripe API and returns its URL, a client calling
+// it and the webhook events it sends
+func newTestServer(t *testing.T) (string, *Client, *Fake, <-chan stripe.Event) {
+	t.Helper()
+
+	events := make(chan stripe.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), testWebhookSecret)
+		if err != nil {
+			t.Errorf("invalid webhook: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+
+	fake := NewFake()
+	server := NewServer(fake, receiver.URL, testWebhookSecret)
+	api := httptest.NewServer(server)
+	t.Cleanup(func() {
+		api.Close()
+		server.Close()
+	})
+
+	return api.URL, NewClient("sk_test_mock", api.URL), fake, events
+}
+
+func expectEvent(t *testing.T, events <-chan stripe.Event, eventType string) stripe.Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Type != eventType {
+			t.Fatalf("expected a %s event, got %s", eventType, event.Type)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event received", eventType)
+	}
+	return stripe.Event{}
+}
+
+func TestServerCheckoutFlow(t *testing.T) {
+	url, client, fake, events := newTestServer(t)
+	fake.AddPrice(&stripe.Price{ID: "price_pro", LookupKey: "pro", Active: true, Currency: "eur", UnitAmount: 990})
+
+	customer, err := client.NewCustomer(&stripe.CustomerParams{
+		Email:   stripe.String("user@example.com"),
+		Address: &stripe.AddressParams{City: stripe.String("Paris"), Country: stripe.String("FR")},
+		Params:  stripe.Params{Metadata: map[string]string{"user_id": "42"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if customer.Address.City != "Paris" || customer.Metadata["user_id"] != "42" {
+		t.Errorf("unexpected customer %+v", customer)
+	}
+
+	customers, err := client.ListCustomers(&stripe.CustomerListParams{Email: stripe.String("user@example.com")}, 0)
+	if err != nil || len(customers) != 1 || customers[0].ID != customer.ID {
+		t.Fatalf("expected the customer to be listed, got %v (%v)", customers, err)
+	}
+
+	prices, err := client.ListPrices(&stripe.PriceListParams{Active: stripe.Bool(true), LookupKeys: stripe.StringSlice([]string{"pro"})}, 0)
+	if err != nil || len(prices) != 1 || prices[0].UnitAmount != 990 {
+		t.Fatalf("expected the pro price, got %v (%v)", prices, err)
+	}
+
+	session, err := client.NewCheckoutSession(&stripe.CheckoutSessionParams{
+		Customer:   stripe.String(customer.ID),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:  []*stripe.CheckoutSessionLineItemParams{{Price: stripe.String("price_pro"), Quantity: stripe.Int64(1)}},
+		SuccessURL: stripe.String("https://app.example.com/success"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.URL == "" {
+		t.Errorf("expected a checkout URL, got %+v", session)
+	}
+
+	resp, err := http.Post(url+"/_mock/checkout/sessions/"+session.ID+"/complete", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the session to be completed, got %s", resp.Status)
+	}
+
+	expectEvent(t, events, "customer.subscription.created")
+	event := expectEvent(t, events, "checkout.session.completed")
+	if event.GetObjectValue("id") != session.ID {
+		t.Errorf("expected the completed session, got %v", event.Data.Object)
+	}
+	expectEvent(t, events, "invoice.finalized")
+	expectEvent(t, events, "invoice.paid")
+
+	subscriptions, err := client.ListSubscriptions(&stripe.SubscriptionListParams{Customer: customer.ID, Status: "all"}, 0)
+	if err != nil || len(subscriptions) != 1 {
+		t.Fatalf("expected 1 subscription, got %v (%v)", subscriptions, err)
+	}
+	if subscriptions[0].Status != stripe.SubscriptionStatusActive || subscriptions[0].Items.Data[0].Price.ID != "price_pro" {
+		t.Errorf("unexpected subscription %+v", subscriptions[0])
+	}
+
+	invoices, err := client.ListInvoices(&stripe.InvoiceListParams{Customer: stripe.String(customer.ID)}, 0)
+	if err != nil || len(invoices) != 1 || invoices[0].Status != stripe.InvoiceStatusPaid {
+		t.Fatalf("expected a paid invoice, got %v (%v)", invoices, err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	_, client, _, _ := newTestServer(t)
+
+	_, err := client.GetCustomer("cus_unknown", nil)
+	stripeErr, ok := err.(*stripe.Error)
+	if !ok || stripeErr.HTTPStatusCode != http.StatusNotFound || stripeErr.Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("expected a resource_missing error, got %v", err)
+	}
+}
+
+func TestClientListPages(t *testing.T) {
+	_, client, _, _ := newTestServer(t)
+	for i := 0; i < 5; i++ {
+		if _, err := client.NewCustomer(&stripe.CustomerParams{Email: stripe.String("user@example.com")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		pageSize int64
+		max      int
+		want     int
+	}{
+		{"all pages", 2, 0, 5},
+		{"max inside the first page", 10, 3, 3},
+		{"max across pages", 2, 3, 3},
+		{"max above the total", 2, 10, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &stripe.CustomerListParams{}
+			params.Limit = stripe.Int64(tt.pageSize)
+			customers, err := client.ListCustomers(params, tt.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(customers) != tt.want {
+				t.Errorf("expected %d customers, got %d", tt.want, len(customers))
+			}
+		})
+	}
+}
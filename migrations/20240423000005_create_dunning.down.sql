@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS stripe_payment_failures;
+DROP TABLE IF EXISTS stripe_dunning_states;
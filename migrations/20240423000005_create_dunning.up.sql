@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS stripe_dunning_states (
+  id UUID PRIMARY KEY,
+  subscription_id UUID NOT NULL UNIQUE,
+  stripe_invoice_id VARCHAR(255) NOT NULL,
+  attempt_count INTEGER NOT NULL DEFAULT 0,
+  access VARCHAR(50) NOT NULL,
+  hosted_invoice_url TEXT NOT NULL DEFAULT '',
+  next_payment_attempt TIMESTAMP,
+  last_failed_at TIMESTAMP NOT NULL,
+  resolved_at TIMESTAMP,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  FOREIGN KEY (subscription_id) REFERENCES stripe_subscriptions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS stripe_payment_failures (
+  id UUID PRIMARY KEY,
+  subscription_id UUID NOT NULL,
+  stripe_invoice_id VARCHAR(255) NOT NULL,
+  attempt_count INTEGER NOT NULL,
+  amount_due BIGINT NOT NULL,
+  currency VARCHAR(10) NOT NULL,
+  created_at TIMESTAMP NOT NULL,
+  -- Stripe peut livrer plusieurs fois le même webhook
+  UNIQUE (stripe_invoice_id, attempt_count),
+  FOREIGN KEY (subscription_id) REFERENCES stripe_subscriptions(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_payment_failures_subscription_id ON stripe_payment_failures(subscription_id);
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS stripe_tax_ids;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS phone;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_line1;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_line2;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_city;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_postal_code;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_state;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS address_country;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS preferred_locales;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS default_payment_method;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS default_source;
+ALTER TABLE stripe_customers DROP COLUMN IF EXISTS stripe_created_at;
@@ -0,0 +1,25 @@
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS phone VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_line1 VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_line2 VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_city VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_postal_code VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_state VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS address_country VARCHAR(2) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS preferred_locales VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS default_payment_method VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS default_source VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_customers ADD COLUMN IF NOT EXISTS stripe_created_at TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS stripe_tax_ids (
+  id UUID PRIMARY KEY,
+  customer_id UUID NOT NULL,
+  stripe_id VARCHAR(255) NOT NULL UNIQUE,
+  type VARCHAR(50) NOT NULL,
+  value VARCHAR(255) NOT NULL,
+  verification_status VARCHAR(50) NOT NULL DEFAULT 'pending',
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  FOREIGN KEY (customer_id) REFERENCES stripe_customers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_tax_ids_customer_id ON stripe_tax_ids(customer_id);
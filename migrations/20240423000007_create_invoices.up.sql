@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS stripe_invoices (
+  id UUID PRIMARY KEY,
+  customer_id UUID NOT NULL,
+  subscription_id UUID,
+  stripe_id VARCHAR(255) NOT NULL UNIQUE,
+  number VARCHAR(255) NOT NULL DEFAULT '',
+  status VARCHAR(50) NOT NULL,
+  currency VARCHAR(10) NOT NULL,
+  subtotal BIGINT NOT NULL DEFAULT 0,
+  tax BIGINT NOT NULL DEFAULT 0,
+  total BIGINT NOT NULL DEFAULT 0,
+  amount_due BIGINT NOT NULL DEFAULT 0,
+  amount_paid BIGINT NOT NULL DEFAULT 0,
+  hosted_invoice_url TEXT NOT NULL DEFAULT '',
+  period_start TIMESTAMP,
+  period_end TIMESTAMP,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  FOREIGN KEY (customer_id) REFERENCES stripe_customers(id) ON DELETE CASCADE,
+  FOREIGN KEY (subscription_id) REFERENCES stripe_subscriptions(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_invoices_customer_id ON stripe_invoices(customer_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS stripe_api_keys (
+  id UUID PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  prefix VARCHAR(32) NOT NULL UNIQUE,
+  hash VARCHAR(64) NOT NULL,
+  scopes TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL,
+  last_used_at TIMESTAMP,
+  expires_at TIMESTAMP,
+  revoked_at TIMESTAMP
+);
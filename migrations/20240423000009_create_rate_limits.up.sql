@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS stripe_rate_limits (
+  key VARCHAR(255) PRIMARY KEY,
+  tokens DOUBLE PRECISION NOT NULL,
+  updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_rate_limits_updated_at ON stripe_rate_limits(updated_at);
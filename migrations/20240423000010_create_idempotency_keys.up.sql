@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS stripe_idempotency_keys (
+  id UUID PRIMARY KEY,
+  caller VARCHAR(255) NOT NULL,
+  key VARCHAR(255) NOT NULL,
+  method VARCHAR(10) NOT NULL,
+  path TEXT NOT NULL,
+  fingerprint VARCHAR(64) NOT NULL,
+  status VARCHAR(20) NOT NULL,
+  response_code INTEGER NOT NULL DEFAULT 0,
+  response_body TEXT NOT NULL DEFAULT '',
+  response_headers TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  UNIQUE (caller, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_idempotency_keys_created_at ON stripe_idempotency_keys(created_at);
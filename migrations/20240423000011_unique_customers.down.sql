@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_stripe_customers_user_id;
+DROP INDEX IF EXISTS idx_stripe_customers_stripe_id;
+CREATE INDEX IF NOT EXISTS idx_stripe_customers_user_id ON stripe_customers(user_id);
+CREATE INDEX IF NOT EXISTS idx_stripe_customers_stripe_id ON stripe_customers(stripe_id);
@@ -0,0 +1,60 @@
+-- Fusionner les lignes qui pointent vers le même client Stripe : garder la
+-- plus ancienne et y rattacher les abonnements, factures et numéros fiscaux
+CREATE TEMPORARY TABLE stripe_customer_duplicates AS
+SELECT id, winner_id FROM (
+  SELECT id, FIRST_VALUE(id) OVER (PARTITION BY stripe_id ORDER BY created_at, id) AS winner_id
+  FROM stripe_customers
+) c WHERE id <> winner_id;
+
+UPDATE stripe_subscriptions s SET customer_id = d.winner_id
+FROM stripe_customer_duplicates d WHERE s.customer_id = d.id;
+
+UPDATE stripe_invoices i SET customer_id = d.winner_id
+FROM stripe_customer_duplicates d WHERE i.customer_id = d.id;
+
+UPDATE stripe_tax_ids t SET customer_id = d.winner_id
+FROM stripe_customer_duplicates d WHERE t.customer_id = d.id;
+
+DELETE FROM stripe_customers c USING stripe_customer_duplicates d WHERE c.id = d.id;
+
+DROP TABLE stripe_customer_duplicates;
+
+-- Un utilisateur avec plusieurs clients Stripe garde celui qui porte ses
+-- abonnements ou factures. Si plusieurs en portent, aucun ne peut être
+-- supprimé sans perdre de données : la migration échoue avec la liste des
+-- utilisateurs concernés, à fusionner à la main.
+CREATE TEMPORARY TABLE stripe_customer_candidates AS
+SELECT c.id, c.user_id, c.stripe_id, c.created_at,
+  EXISTS (SELECT 1 FROM stripe_subscriptions s WHERE s.customer_id = c.id)
+    OR EXISTS (SELECT 1 FROM stripe_invoices i WHERE i.customer_id = c.id) AS owns_data
+FROM stripe_customers c
+WHERE c.user_id IN (SELECT user_id FROM stripe_customers GROUP BY user_id HAVING COUNT(*) > 1);
+
+DO $$
+DECLARE
+  report TEXT;
+BEGIN
+  SELECT string_agg(user_id || ': ' || stripe_ids, E'\n' ORDER BY user_id) INTO report FROM (
+    SELECT user_id, string_agg(stripe_id, ', ' ORDER BY stripe_id) AS stripe_ids
+    FROM stripe_customer_candidates
+    WHERE owns_data
+    GROUP BY user_id
+    HAVING COUNT(*) > 1
+  ) conflicts;
+
+  IF report IS NOT NULL THEN
+    RAISE EXCEPTION E'Several Stripe customers hold subscriptions or invoices of the same user, merge them before migrating:\n%', report;
+  END IF;
+END $$;
+
+DELETE FROM stripe_customers c USING (
+  SELECT id, FIRST_VALUE(id) OVER (PARTITION BY user_id ORDER BY owns_data DESC, created_at, id) AS winner_id
+  FROM stripe_customer_candidates
+) d WHERE c.id = d.id AND d.id <> d.winner_id;
+
+DROP TABLE stripe_customer_candidates;
+
+DROP INDEX IF EXISTS idx_stripe_customers_user_id;
+DROP INDEX IF EXISTS idx_stripe_customers_stripe_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stripe_customers_user_id ON stripe_customers(user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stripe_customers_stripe_id ON stripe_customers(stripe_id);
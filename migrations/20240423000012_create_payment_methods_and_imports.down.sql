@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS stripe_import_checkpoints;
+DROP TABLE IF EXISTS stripe_payment_methods;
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS stripe_payment_methods (
+  id UUID PRIMARY KEY,
+  customer_id UUID NOT NULL,
+  stripe_id VARCHAR(255) NOT NULL UNIQUE,
+  type VARCHAR(50) NOT NULL,
+  card_brand VARCHAR(50) NOT NULL DEFAULT '',
+  card_last4 VARCHAR(4) NOT NULL DEFAULT '',
+  card_exp_month INTEGER NOT NULL DEFAULT 0,
+  card_exp_year INTEGER NOT NULL DEFAULT 0,
+  is_default BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  FOREIGN KEY (customer_id) REFERENCES stripe_customers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_stripe_payment_methods_customer_id ON stripe_payment_methods(customer_id);
+
+-- Avancement de gostripe import, pour reprendre après une interruption
+CREATE TABLE IF NOT EXISTS stripe_import_checkpoints (
+  name VARCHAR(255) PRIMARY KEY,
+  last_stripe_id VARCHAR(255) NOT NULL DEFAULT '',
+  customers_imported INTEGER NOT NULL DEFAULT 0,
+  customers_skipped INTEGER NOT NULL DEFAULT 0,
+  started_at TIMESTAMP NOT NULL,
+  updated_at TIMESTAMP NOT NULL,
+  completed_at TIMESTAMP
+);
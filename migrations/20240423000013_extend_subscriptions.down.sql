@@ -0,0 +1,12 @@
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS current_period_start;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS trial_start;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS trial_end;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS cancel_at;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS cancel_at_period_end;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS ended_at;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS collection_method;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS latest_invoice_id;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS default_payment_method_id;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS items;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS metadata;
+ALTER TABLE stripe_subscriptions DROP COLUMN IF EXISTS discount;
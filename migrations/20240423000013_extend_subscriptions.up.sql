@@ -0,0 +1,12 @@
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS current_period_start TIMESTAMP;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS trial_start TIMESTAMP;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS trial_end TIMESTAMP;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS cancel_at TIMESTAMP;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS ended_at TIMESTAMP;
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS collection_method VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS latest_invoice_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS default_payment_method_id VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS items JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE stripe_subscriptions ADD COLUMN IF NOT EXISTS discount JSONB;
@@ -0,0 +1,169 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to tell apart from JWTs
+const APIKeyPrefix = "gsk_"
+
+// APIKey represents a key used by backend services to call the API. Only the
+// hash of the secret is stored.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Hash       string     `json:"-" db:"hash"`
+	Scopes     string     `json:"scopes" db:"scopes"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at" db:"revoked_at"`
+}
+
+// TableName returns the table name for the APIKey model
+func (APIKey) TableName() string {
+	return "stripe_api_keys"
+}
+
+// ScopeList returns the scopes granted to the key
+func (k *APIKey) ScopeList() []string {
+	if k.Scopes == "" {
+		return nil
+	}
+	return strings.Split(k.Scopes, ",")
+}
+
+// HasScope checks whether the key has been granted a scope, "*" granting all
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.ScopeList() {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValid checks that the key is neither revoked nor expired
+func (k *APIKey) IsValid(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// Matches checks a secret against the stored hash in constant time
+func (k *APIKey) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashAPIKey(secret)), []byte(k.Hash)) == 1
+}
+
+// ParseAPIKey extracts the lookup prefix of a "gsk_<prefix>_<random>" key
+func ParseAPIKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(key, APIKeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// FindAPIKeys finds all API keys
+func FindAPIKeys(conn *storage.Connection) ([]APIKey, error) {
+	keys := []APIKey{}
+	if err := conn.Order("created_at ASC").All(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// FindAPIKeyByID finds an API key by ID
+func FindAPIKeyByID(conn *storage.Connection, id uuid.UUID) (*APIKey, error) {
+	key := &APIKey{}
+	if err := conn.Find(key, id); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// FindAPIKeyByPrefix finds an API key by prefix
+func FindAPIKeyByPrefix(conn *storage.Connection, prefix string) (*APIKey, error) {
+	key := &APIKey{}
+	if err := conn.Where("prefix = ?", prefix).First(key); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// CreateAPIKey generates and stores a new API key. The returned secret is the
+// only copy of the key and must be handed to the caller.
+func CreateAPIKey(conn *storage.Connection, name string, scopes []string, expiresAt *time.Time) (*APIKey, string, error) {
+	prefix, err := randomString(6)
+	if err != nil {
+		return nil, "", err
+	}
+	random, err := randomString(24)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := fmt.Sprintf("%s%s_%s", APIKeyPrefix, prefix, random)
+
+	key := &APIKey{
+		ID:        uuid.Must(uuid.NewV4()),
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hashAPIKey(secret),
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if err := conn.Create(key); err != nil {
+		return nil, "", err
+	}
+	return key, secret, nil
+}
+
+// TouchAPIKey records that an API key has just been used
+func TouchAPIKey(conn *storage.Connection, key *APIKey) error {
+	now := time.Now()
+	key.LastUsedAt = &now
+	return conn.RawQuery("UPDATE stripe_api_keys SET last_used_at = ? WHERE id = ?", now, key.ID).Exec()
+}
+
+// RevokeAPIKey revokes an API key
+func RevokeAPIKey(conn *storage.Connection, key *APIKey) error {
+	now := time.Now()
+	key.RevokedAt = &now
+	return conn.Update(key)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
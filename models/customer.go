@@ -2,6 +2,7 @@ package models
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"gostripe/storage"
@@ -12,13 +13,24 @@ import (
 
 // Customer represents a customer in our system
 type Customer struct {
-	ID        uuid.UUID `json:"id" db:"id"`
-	UserID    uuid.UUID `json:"user_id" db:"user_id"`
-	StripeID  string    `json:"stripe_id" db:"stripe_id"`
-	Email     string    `json:"email" db:"email"`
-	Name      string    `json:"name" db:"name"`
-	CreatedAt time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	ID                   uuid.UUID  `json:"id" db:"id"`
+	UserID               uuid.UUID  `json:"user_id" db:"user_id"`
+	StripeID             string     `json:"stripe_id" db:"stripe_id"`
+	Email                string     `json:"email" db:"email"`
+	Name                 string     `json:"name" db:"name"`
+	Phone                string     `json:"phone" db:"phone"`
+	AddressLine1         string     `json:"address_line1" db:"address_line1"`
+	AddressLine2         string     `json:"address_line2" db:"address_line2"`
+	AddressCity          string     `json:"address_city" db:"address_city"`
+	AddressPostalCode    string     `json:"address_postal_code" db:"address_postal_code"`
+	AddressState         string     `json:"address_state" db:"address_state"`
+	AddressCountry       string     `json:"address_country" db:"address_country"`
+	PreferredLocales     string     `json:"preferred_locales" db:"preferred_locales"`
+	DefaultPaymentMethod string     `json:"default_payment_method" db:"default_payment_method"`
+	DefaultSource        string     `json:"default_source" db:"default_source"`
+	StripeCreatedAt      *time.Time `json:"stripe_created_at" db:"stripe_created_at"`
+	CreatedAt            time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 // TableName returns the table name for the Customer model
@@ -26,6 +38,31 @@ func (Customer) TableName() string {
 	return "stripe_customers"
 }
 
+// Locales returns the customer's preferred locales, most preferred first
+func (c *Customer) Locales() []string {
+	if c.PreferredLocales == "" {
+		return nil
+	}
+	return strings.Split(c.PreferredLocales, ",")
+}
+
+// SetLocales sets the customer's preferred locales
+func (c *Customer) SetLocales(locales []string) {
+	c.PreferredLocales = strings.Join(locales, ",")
+}
+
+// FindCustomerByID finds a customer by ID
+func FindCustomerByID(conn *storage.Connection, id uuid.UUID) (*Customer, error) {
+	customer := &Customer{}
+	if err := conn.Find(customer, id); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return customer, nil
+}
+
 // FindCustomerByUserID finds a customer by user ID
 func FindCustomerByUserID(conn *storage.Connection, userID uuid.UUID) (*Customer, error) {
 	customer := &Customer{}
@@ -50,12 +87,23 @@ func FindCustomerByStripeID(conn *storage.Connection, stripeID string) (*Custome
 	return customer, nil
 }
 
-// CreateCustomer creates a new customer
-func CreateCustomer(conn *storage.Connection, userID uuid.UUID, stripeID, email, name string) (*Customer, error) {
-	// Log au début de la fonction pour voir les paramètres
-	log.Printf("CreateCustomer: Début de la création du client - userID: %s, stripeID: %s, email: %s, name: %s",
-		userID.String(), stripeID, email, name)
+// FindCustomerByStripeIDForUpdate finds a customer by Stripe ID and locks its
+// row until the end of the transaction
+func FindCustomerByStripeIDForUpdate(conn *storage.Connection, stripeID string) (*Customer, error) {
+	customer := &Customer{}
+	if err := conn.RawQuery("SELECT * FROM stripe_customers WHERE stripe_id = ? FOR UPDATE", stripeID).First(customer); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return customer, nil
+}
 
+// CreateCustomer creates a new customer. When the user already has a
+// customer, for instance created by a concurrent request, that customer is
+// returned instead.
+func CreateCustomer(conn *storage.Connection, userID uuid.UUID, stripeID, email, name string) (*Customer, error) {
 	customer := &Customer{
 		ID:        uuid.Must(uuid.NewV4()),
 		UserID:    userID,
@@ -66,24 +114,53 @@ func CreateCustomer(conn *storage.Connection, userID uuid.UUID, stripeID, email,
 		UpdatedAt: time.Now(),
 	}
 
-	// Log des détails de l'objet avant insertion
-	log.Printf("CreateCustomer: Tentative d'insertion en DB - ID: %s, UserID: %s, StripeID: %s",
-		customer.ID.String(), customer.UserID.String(), customer.StripeID)
-
-	if err := conn.Create(customer); err != nil {
+	count, err := conn.RawQuery(
+		`INSERT INTO stripe_customers (id, user_id, stripe_id, email, name, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (user_id) DO NOTHING`,
+		customer.ID, customer.UserID, customer.StripeID, customer.Email, customer.Name, customer.CreatedAt, customer.UpdatedAt,
+	).ExecWithCount()
+	if err != nil {
 		log.Printf("CreateCustomer: ERREUR lors de la création du client: %v", err)
 		return nil, err
 	}
 
-	// Vérifier que le client a bien été créé en le recherchant
-	verifyCustomer, err := FindCustomerByUserID(conn, userID)
+	if count == 1 {
+		return customer, nil
+	}
+
+	// Un autre client existe déjà pour cet utilisateur
+	existing, err := FindCustomerByUserID(conn, userID)
 	if err != nil {
-		log.Printf("CreateCustomer: Le client a été créé mais impossible de le vérifier: %v", err)
-	} else if verifyCustomer == nil {
-		log.Printf("CreateCustomer: ATTENTION - Le client a été créé mais la vérification n'a pas pu le retrouver")
-	} else {
-		log.Printf("CreateCustomer: Client créé et vérifié avec succès - ID: %s", customer.ID.String())
+		return nil, err
+	}
+	if existing == nil {
+		return nil, errors.Errorf("customer of user %s disappeared during creation", userID)
 	}
+	if existing.StripeID != stripeID {
+		log.Printf("CreateCustomer: le client Stripe %s n'est pas utilisé, l'utilisateur %s a déjà le client %s",
+			stripeID, userID.String(), existing.StripeID)
+	}
+	return existing, nil
+}
 
-	return customer, nil
+// LockCustomerCreation takes a transaction level advisory lock on the
+// creation of the customer of a user, so that only one Stripe customer is
+// ever created per user. It must be called within a transaction.
+func LockCustomerCreation(conn *storage.Connection, userID uuid.UUID) error {
+	return conn.RawQuery("SELECT pg_advisory_xact_lock(hashtext(?))", "stripe_customers:"+userID.String()).Exec()
+}
+
+// UpdateCustomer updates a customer
+func UpdateCustomer(conn *storage.Connection, customer *Customer) error {
+	customer.UpdatedAt = time.Now()
+	return conn.Update(customer)
+}
+
+// AllCustomers returns every customer
+func AllCustomers(conn *storage.Connection) ([]Customer, error) {
+	customers := []Customer{}
+	if err := conn.Order("created_at").All(&customers); err != nil {
+		return nil, err
+	}
+	return customers, nil
 }
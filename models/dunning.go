@@ -0,0 +1,105 @@
+package models
+
+import (
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// AccessLevel represents the access granted to a customer whose payments are failing
+type AccessLevel string
+
+const (
+	// AccessFull grants full access
+	AccessFull AccessLevel = "full"
+	// AccessGrace grants full access while the payment is being recovered
+	AccessGrace AccessLevel = "grace"
+	// AccessRestricted grants limited access
+	AccessRestricted AccessLevel = "restricted"
+	// AccessSuspended revokes access
+	AccessSuspended AccessLevel = "suspended"
+)
+
+// DunningState tracks the failed payment recovery of a subscription
+type DunningState struct {
+	ID                 uuid.UUID   `json:"id" db:"id"`
+	SubscriptionID     uuid.UUID   `json:"subscription_id" db:"subscription_id"`
+	StripeInvoiceID    string      `json:"stripe_invoice_id" db:"stripe_invoice_id"`
+	AttemptCount       int         `json:"attempt_count" db:"attempt_count"`
+	Access             AccessLevel `json:"access" db:"access"`
+	HostedInvoiceURL   string      `json:"hosted_invoice_url" db:"hosted_invoice_url"`
+	NextPaymentAttempt *time.Time  `json:"next_payment_attempt,omitempty" db:"next_payment_attempt"`
+	LastFailedAt       time.Time   `json:"last_failed_at" db:"last_failed_at"`
+	ResolvedAt         *time.Time  `json:"resolved_at,omitempty" db:"resolved_at"`
+	CreatedAt          time.Time   `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time   `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the DunningState model
+func (DunningState) TableName() string {
+	return "stripe_dunning_states"
+}
+
+// IsOpen returns true while the failed payment has not been recovered
+func (d *DunningState) IsOpen() bool {
+	return d.ResolvedAt == nil
+}
+
+// PaymentFailure records a single failed payment attempt
+type PaymentFailure struct {
+	ID              uuid.UUID `json:"id" db:"id"`
+	SubscriptionID  uuid.UUID `json:"subscription_id" db:"subscription_id"`
+	StripeInvoiceID string    `json:"stripe_invoice_id" db:"stripe_invoice_id"`
+	AttemptCount    int       `json:"attempt_count" db:"attempt_count"`
+	AmountDue       int64     `json:"amount_due" db:"amount_due"`
+	Currency        string    `json:"currency" db:"currency"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+// TableName returns the table name for the PaymentFailure model
+func (PaymentFailure) TableName() string {
+	return "stripe_payment_failures"
+}
+
+// FindDunningStateBySubscriptionID finds the dunning state of a subscription
+func FindDunningStateBySubscriptionID(conn *storage.Connection, subscriptionID uuid.UUID) (*DunningState, error) {
+	state := &DunningState{}
+	if err := conn.Where("subscription_id = ?", subscriptionID).First(state); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return state, nil
+}
+
+// CreateDunningState creates a new dunning state
+func CreateDunningState(conn *storage.Connection, state *DunningState) error {
+	state.ID = uuid.Must(uuid.NewV4())
+	state.CreatedAt = time.Now()
+	state.UpdatedAt = time.Now()
+	return conn.Create(state)
+}
+
+// UpdateDunningState updates a dunning state
+func UpdateDunningState(conn *storage.Connection, state *DunningState) error {
+	state.UpdatedAt = time.Now()
+	return conn.Update(state)
+}
+
+// CreatePaymentFailure records a failed payment attempt, once per invoice and
+// attempt. It returns false when the attempt was already recorded.
+func CreatePaymentFailure(conn *storage.Connection, subscriptionID uuid.UUID, stripeInvoiceID string, attemptCount int, amountDue int64, currency string) (bool, error) {
+	count, err := conn.RawQuery(`INSERT INTO stripe_payment_failures
+		(id, subscription_id, stripe_invoice_id, attempt_count, amount_due, currency, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (stripe_invoice_id, attempt_count) DO NOTHING`,
+		uuid.Must(uuid.NewV4()), subscriptionID, stripeInvoiceID, attemptCount, amountDue, currency, time.Now(),
+	).ExecWithCount()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// IdempotencyKeyStatus represents the progress of an idempotent request
+type IdempotencyKeyStatus string
+
+const (
+	// IdempotencyKeyProcessing means the first request is still being handled
+	IdempotencyKeyProcessing IdempotencyKeyStatus = "processing"
+	// IdempotencyKeyCompleted means the response has been stored
+	IdempotencyKeyCompleted IdempotencyKeyStatus = "completed"
+)
+
+// IdempotencyKey stores the response of a request sent with an
+// Idempotency-Key header, so that retries get the same response
+type IdempotencyKey struct {
+	ID              uuid.UUID            `json:"id" db:"id"`
+	Caller          string               `json:"caller" db:"caller"`
+	Key             string               `json:"key" db:"key"`
+	Method          string               `json:"method" db:"method"`
+	Path            string               `json:"path" db:"path"`
+	Fingerprint     string               `json:"fingerprint" db:"fingerprint"`
+	Status          IdempotencyKeyStatus `json:"status" db:"status"`
+	ResponseCode    int                  `json:"response_code" db:"response_code"`
+	ResponseBody    string               `json:"response_body" db:"response_body"`
+	ResponseHeaders string               `json:"response_headers" db:"response_headers"`
+	CreatedAt       time.Time            `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time            `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the IdempotencyKey model
+func (IdempotencyKey) TableName() string {
+	return "stripe_idempotency_keys"
+}
+
+// FindIdempotencyKey finds the idempotency key of a caller
+func FindIdempotencyKey(conn *storage.Connection, caller, key string) (*IdempotencyKey, error) {
+	idempotencyKey := &IdempotencyKey{}
+	if err := conn.Where("caller = ? AND key = ?", caller, key).First(idempotencyKey); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return idempotencyKey, nil
+}
+
+// CreateIdempotencyKey stores a key in the processing state. It returns false
+// when the caller already used the key.
+func CreateIdempotencyKey(conn *storage.Connection, idempotencyKey *IdempotencyKey) (bool, error) {
+	idempotencyKey.ID = uuid.Must(uuid.NewV4())
+	idempotencyKey.Status = IdempotencyKeyProcessing
+	idempotencyKey.CreatedAt = time.Now()
+	idempotencyKey.UpdatedAt = time.Now()
+
+	count, err := conn.RawQuery(
+		`INSERT INTO stripe_idempotency_keys (id, caller, key, method, path, fingerprint, status, response_code, response_body, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 0, '', ?, ?) ON CONFLICT (caller, key) DO NOTHING`,
+		idempotencyKey.ID, idempotencyKey.Caller, idempotencyKey.Key, idempotencyKey.Method, idempotencyKey.Path,
+		idempotencyKey.Fingerprint, idempotencyKey.Status, idempotencyKey.CreatedAt, idempotencyKey.UpdatedAt,
+	).ExecWithCount()
+	if err != nil {
+		return false, err
+	}
+	return count == 1, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request
+func CompleteIdempotencyKey(conn *storage.Connection, idempotencyKey *IdempotencyKey, code int, headers http.Header, body string) error {
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	idempotencyKey.Status = IdempotencyKeyCompleted
+	idempotencyKey.ResponseCode = code
+	idempotencyKey.ResponseHeaders = string(encoded)
+	idempotencyKey.ResponseBody = body
+	idempotencyKey.UpdatedAt = time.Now()
+	return conn.Update(idempotencyKey)
+}
+
+// DeleteIdempotencyKey deletes a key, so that the request can be retried
+func DeleteIdempotencyKey(conn *storage.Connection, idempotencyKey *IdempotencyKey) error {
+	return conn.Destroy(idempotencyKey)
+}
+
+// DeleteIdempotencyKeysBefore deletes the keys created before a time
+func DeleteIdempotencyKeysBefore(conn *storage.Connection, before time.Time) error {
+	return conn.RawQuery("DELETE FROM stripe_idempotency_keys WHERE created_at < ?", before).Exec()
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/pkg/errors"
+)
+
+// ImportCheckpoint records how far an import of Stripe customers went, so
+// that an interrupted import resumes after the last imported customer
+type ImportCheckpoint struct {
+	Name              string     `json:"name" db:"name"`
+	LastStripeID      string     `json:"last_stripe_id" db:"last_stripe_id"`
+	CustomersImported int        `json:"customers_imported" db:"customers_imported"`
+	CustomersSkipped  int        `json:"customers_skipped" db:"customers_skipped"`
+	StartedAt         time.Time  `json:"started_at" db:"started_at"`
+	UpdatedAt         time.Time  `json:"updated_at" db:"updated_at"`
+	CompletedAt       *time.Time `json:"completed_at,omitempty" db:"completed_at"`
+}
+
+// TableName returns the table name for the ImportCheckpoint model
+func (ImportCheckpoint) TableName() string {
+	return "stripe_import_checkpoints"
+}
+
+// FindImportCheckpoint finds the checkpoint of an import by name
+func FindImportCheckpoint(conn *storage.Connection, name string) (*ImportCheckpoint, error) {
+	checkpoint := &ImportCheckpoint{}
+	if err := conn.RawQuery("SELECT * FROM stripe_import_checkpoints WHERE name = ?", name).First(checkpoint); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// SaveImportCheckpoint creates or updates the checkpoint of an import
+func SaveImportCheckpoint(conn *storage.Connection, checkpoint *ImportCheckpoint) error {
+	checkpoint.UpdatedAt = time.Now()
+	return conn.RawQuery(
+		`INSERT INTO stripe_import_checkpoints (name, last_stripe_id, customers_imported, customers_skipped, started_at, updated_at, completed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET last_stripe_id = EXCLUDED.last_stripe_id,
+			customers_imported = EXCLUDED.customers_imported, customers_skipped = EXCLUDED.customers_skipped,
+			started_at = EXCLUDED.started_at, updated_at = EXCLUDED.updated_at, completed_at = EXCLUDED.completed_at`,
+		checkpoint.Name, checkpoint.LastStripeID, checkpoint.CustomersImported, checkpoint.CustomersSkipped,
+		checkpoint.StartedAt, checkpoint.UpdatedAt, checkpoint.CompletedAt,
+	).Exec()
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// Invoice represents a Stripe invoice of a customer
+type Invoice struct {
+	ID               uuid.UUID     `json:"id" db:"id"`
+	CustomerID       uuid.UUID     `json:"customer_id" db:"customer_id"`
+	SubscriptionID   uuid.NullUUID `json:"subscription_id" db:"subscription_id"`
+	StripeID         string        `json:"stripe_id" db:"stripe_id"`
+	Number           string        `json:"number" db:"number"`
+	Status           string        `json:"status" db:"status"`
+	Currency         string        `json:"currency" db:"currency"`
+	Subtotal         int64         `json:"subtotal" db:"subtotal"`
+	Tax              int64         `json:"tax" db:"tax"`
+	Total            int64         `json:"total" db:"total"`
+	AmountDue        int64         `json:"amount_due" db:"amount_due"`
+	AmountPaid       int64         `json:"amount_paid" db:"amount_paid"`
+	HostedInvoiceURL string        `json:"hosted_invoice_url" db:"hosted_invoice_url"`
+	PeriodStart      *time.Time    `json:"period_start,omitempty" db:"period_start"`
+	PeriodEnd        *time.Time    `json:"period_end,omitempty" db:"period_end"`
+	CreatedAt        time.Time     `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the Invoice model
+func (Invoice) TableName() string {
+	return "stripe_invoices"
+}
+
+// FindInvoiceByStripeID finds an invoice by Stripe ID
+func FindInvoiceByStripeID(conn *storage.Connection, stripeID string) (*Invoice, error) {
+	invoice := &Invoice{}
+	if err := conn.Where("stripe_id = ?", stripeID).First(invoice); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// FindInvoicesByCustomerID finds the invoices of a customer, most recent first
+func FindInvoicesByCustomerID(conn *storage.Connection, customerID uuid.UUID) ([]Invoice, error) {
+	invoices := []Invoice{}
+	if err := conn.Where("customer_id = ?", customerID).Order("created_at DESC").All(&invoices); err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// CreateInvoice creates a new invoice
+func CreateInvoice(conn *storage.Connection, invoice *Invoice) error {
+	invoice.ID = uuid.Must(uuid.NewV4())
+	invoice.CreatedAt = time.Now()
+	invoice.UpdatedAt = time.Now()
+	return conn.Create(invoice)
+}
+
+// UpdateInvoice updates an invoice
+func UpdateInvoice(conn *storage.Connection, invoice *Invoice) error {
+	invoice.UpdatedAt = time.Now()
+	return conn.Update(invoice)
+}
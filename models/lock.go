@@ -0,0 +1,46 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"gostripe/storage"
+)
+
+// SessionLock is a session level advisory lock, held on a dedicated
+// connection until it is released
+type SessionLock struct {
+	conn *sql.Conn
+	key  string
+}
+
+// TrySessionLock takes a session level advisory lock on key when it is free,
+// and returns nil when another session holds it. Unlike a transaction level
+// lock, it is kept across transactions until it is released.
+func TrySessionLock(conn *storage.Connection, key string) (*SessionLock, error) {
+	ctx := context.Background()
+	session, err := conn.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var locked bool
+	if err := session.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", key).Scan(&locked); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if !locked {
+		session.Close()
+		return nil, nil
+	}
+	return &SessionLock{conn: session, key: key}, nil
+}
+
+// Release releases the lock and returns its connection to the pool
+func (l *SessionLock) Release() error {
+	_, err := l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", l.key)
+	if closeErr := l.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// Metadata holds the key-value pairs set on a Stripe object, stored as a JSON
+// object
+type Metadata map[string]string
+
+// Value implements driver.Valuer
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		m = Metadata{}
+	}
+	return jsonValue(m)
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(src interface{}) error {
+	return scanJSON(src, m)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func scanJSON(src interface{}, v interface{}) error {
+	switch src := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(src, v)
+	case string:
+		return json.Unmarshal([]byte(src), v)
+	default:
+		return fmt.Errorf("cannot scan %T as JSON", src)
+	}
+}
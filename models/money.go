@@ -0,0 +1,79 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// zeroDecimalCurrencies are charged in whole units, e.g. 500 JPY is ¥500
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true,
+	"krw": true, "mga": true, "pyg": true, "rwf": true, "ugx": true, "vnd": true,
+	"vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// threeDecimalCurrencies are charged in thousandths of a unit
+var threeDecimalCurrencies = map[string]bool{
+	"bhd": true, "jod": true, "kwd": true, "omr": true, "tnd": true,
+}
+
+// CurrencyExponent returns the number of decimals of a currency
+func CurrencyExponent(currency string) int {
+	currency = strings.ToLower(currency)
+	switch {
+	case zeroDecimalCurrencies[currency]:
+		return 0
+	case threeDecimalCurrencies[currency]:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// Money is an amount expressed in the smallest unit of its currency, as Stripe
+// does (cents for EUR, yen for JPY, fils for KWD)
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney creates an amount in the smallest unit of the given currency
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: strings.ToLower(currency)}
+}
+
+// Decimal returns the amount in major units, e.g. "19.99" for 1999 EUR
+func (m Money) Decimal() string {
+	exponent := CurrencyExponent(m.Currency)
+	if exponent == 0 {
+		return fmt.Sprintf("%d", m.Amount)
+	}
+
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	divisor := int64(1)
+	for i := 0; i < exponent; i++ {
+		divisor *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/divisor, exponent, amount%divisor)
+}
+
+// String formats the amount for display, e.g. "19.99 EUR"
+func (m Money) String() string {
+	return m.Decimal() + " " + strings.ToUpper(m.Currency)
+}
+
+// MarshalJSON exposes both the amount in minor units and its decimal value
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Decimal  string `json:"decimal"`
+	}{m.Amount, m.Currency, m.Decimal()})
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		name     string
+		money    Money
+		exponent int
+		decimal  string
+		str      string
+	}{
+		{"standard currency", NewMoney(1999, "EUR"), 2, "19.99", "19.99 EUR"},
+		{"leading zeros", NewMoney(5, "usd"), 2, "0.05", "0.05 USD"},
+		{"zero", NewMoney(0, "eur"), 2, "0.00", "0.00 EUR"},
+		{"negative amount", NewMoney(-1050, "eur"), 2, "-10.50", "-10.50 EUR"},
+		{"zero-decimal currency", NewMoney(500, "JPY"), 0, "500", "500 JPY"},
+		{"negative zero-decimal amount", NewMoney(-500, "jpy"), 0, "-500", "-500 JPY"},
+		{"three-decimal currency", NewMoney(1234, "KWD"), 3, "1.234", "1.234 KWD"},
+		{"three-decimal leading zeros", NewMoney(7, "bhd"), 3, "0.007", "0.007 BHD"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if exponent := CurrencyExponent(tt.money.Currency); exponent != tt.exponent {
+				t.Errorf("expected exponent %d, got %d", tt.exponent, exponent)
+			}
+			if decimal := tt.money.Decimal(); decimal != tt.decimal {
+				t.Errorf("expected decimal %q, got %q", tt.decimal, decimal)
+			}
+			if str := tt.money.String(); str != tt.str {
+				t.Errorf("expected %q, got %q", tt.str, str)
+			}
+		})
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		money Money
+		json  string
+	}{
+		{NewMoney(1999, "EUR"), `{"amount":1999,"currency":"eur","decimal":"19.99"}`},
+		{NewMoney(500, "jpy"), `{"amount":500,"currency":"jpy","decimal":"500"}`},
+		{NewMoney(1234, "kwd"), `{"amount":1234,"currency":"kwd","decimal":"1.234"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.money.Currency, func(t *testing.T) {
+			raw, err := json.Marshal(tt.money)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != tt.json {
+				t.Errorf("expected %s, got %s", tt.json, raw)
+			}
+
+			// The decimal value is derived, only the amount is read back
+			var decoded Money
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded != tt.money {
+				t.Errorf("expected %+v, got %+v", tt.money, decoded)
+			}
+		})
+	}
+
+	// Embedded in a response, pointers included
+	raw, err := json.Marshal(struct {
+		Price *Money `json:"price"`
+	}{&Money{Amount: 990, Currency: "eur"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `{"price":{"amount":990,"currency":"eur","decimal":"9.90"}}` {
+		t.Errorf("unexpected encoding %s", raw)
+	}
+}
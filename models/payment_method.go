@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// PaymentMethod represents a payment method saved on a Stripe customer
+type PaymentMethod struct {
+	ID           uuid.UUID `json:"id" db:"id"`
+	CustomerID   uuid.UUID `json:"customer_id" db:"customer_id"`
+	StripeID     string    `json:"stripe_id" db:"stripe_id"`
+	Type         string    `json:"type" db:"type"`
+	CardBrand    string    `json:"card_brand" db:"card_brand"`
+	CardLast4    string    `json:"card_last4" db:"card_last4"`
+	CardExpMonth int       `json:"card_exp_month" db:"card_exp_month"`
+	CardExpYear  int       `json:"card_exp_year" db:"card_exp_year"`
+	IsDefault    bool      `json:"is_default" db:"is_default"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the PaymentMethod model
+func (PaymentMethod) TableName() string {
+	return "stripe_payment_methods"
+}
+
+// FindPaymentMethodByStripeID finds a payment method by Stripe ID
+func FindPaymentMethodByStripeID(conn *storage.Connection, stripeID string) (*PaymentMethod, error) {
+	method := &PaymentMethod{}
+	if err := conn.Where("stripe_id = ?", stripeID).First(method); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return method, nil
+}
+
+// FindPaymentMethodsByCustomerID finds the payment methods of a customer, the
+// default one first
+func FindPaymentMethodsByCustomerID(conn *storage.Connection, customerID uuid.UUID) ([]PaymentMethod, error) {
+	methods := []PaymentMethod{}
+	if err := conn.Where("customer_id = ?", customerID).Order("is_default DESC, created_at DESC").All(&methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// CreatePaymentMethod creates a new payment method
+func CreatePaymentMethod(conn *storage.Connection, method *PaymentMethod) error {
+	method.ID = uuid.Must(uuid.NewV4())
+	method.CreatedAt = time.Now()
+	method.UpdatedAt = time.Now()
+	return conn.Create(method)
+}
+
+// UpdatePaymentMethod updates a payment method
+func UpdatePaymentMethod(conn *storage.Connection, method *PaymentMethod) error {
+	method.UpdatedAt = time.Now()
+	return conn.Update(method)
+}
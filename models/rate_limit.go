@@ -0,0 +1,72 @@
+package models
+
+import (
+	"math"
+	"time"
+
+	"gostripe/storage"
+)
+
+// RateLimitBucket is a token bucket holding the requests a caller may still
+// make. Buckets refill continuously up to their capacity.
+type RateLimitBucket struct {
+	Key       string    `json:"key" db:"key"`
+	Tokens    float64   `json:"tokens" db:"tokens"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the RateLimitBucket model
+func (RateLimitBucket) TableName() string {
+	return "stripe_rate_limits"
+}
+
+// Take refills the bucket and takes a token from it when one is available.
+// perSecond is the refill rate.
+func (b *RateLimitBucket) Take(now time.Time, capacity, perSecond float64) bool {
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(capacity, b.Tokens+elapsed*perSecond)
+	}
+	b.UpdatedAt = now
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// TakeRateLimitToken takes a token from a bucket stored in the database, so
+// that all replicas share the same limits. The row is locked while updated.
+func TakeRateLimitToken(conn *storage.Connection, key string, now time.Time, capacity, perSecond float64) (*RateLimitBucket, bool, error) {
+	bucket := &RateLimitBucket{}
+	allowed := false
+
+	err := conn.Transaction(func(tx *storage.Connection) error {
+		err := tx.RawQuery(
+			"INSERT INTO stripe_rate_limits (key, tokens, updated_at) VALUES (?, ?, ?) ON CONFLICT (key) DO NOTHING",
+			key, capacity, now,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		if err := tx.RawQuery("SELECT * FROM stripe_rate_limits WHERE key = ? FOR UPDATE", key).First(bucket); err != nil {
+			return err
+		}
+
+		allowed = bucket.Take(now, capacity, perSecond)
+		return tx.RawQuery(
+			"UPDATE stripe_rate_limits SET tokens = ?, updated_at = ? WHERE key = ?",
+			bucket.Tokens, bucket.UpdatedAt, key,
+		).Exec()
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return bucket, allowed, nil
+}
+
+// DeleteRateLimitBucketsBefore deletes the buckets unused since a time
+func DeleteRateLimitBucketsBefore(conn *storage.Connection, before time.Time) error {
+	return conn.RawQuery("DELETE FROM stripe_rate_limits WHERE updated_at < ?", before).Exec()
+}
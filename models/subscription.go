@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql/driver"
 	"log"
 	"time"
 
@@ -32,15 +33,73 @@ const (
 
 // Subscription represents a subscription in our system
 type Subscription struct {
-	ID               uuid.UUID          `json:"id" db:"id"`
-	CustomerID       uuid.UUID          `json:"customer_id" db:"customer_id"`
-	StripeID         string             `json:"stripe_id" db:"stripe_id"`
-	Status           SubscriptionStatus `json:"status" db:"status"`
-	PriceID          string             `json:"price_id" db:"price_id"`
-	CurrentPeriodEnd time.Time          `json:"current_period_end" db:"current_period_end"`
-	CanceledAt       *time.Time         `json:"canceled_at,omitempty" db:"canceled_at"`
-	CreatedAt        time.Time          `json:"created_at" db:"created_at"`
-	UpdatedAt        time.Time          `json:"updated_at" db:"updated_at"`
+	ID                     uuid.UUID             `json:"id" db:"id"`
+	CustomerID             uuid.UUID             `json:"customer_id" db:"customer_id"`
+	StripeID               string                `json:"stripe_id" db:"stripe_id"`
+	Status                 SubscriptionStatus    `json:"status" db:"status"`
+	PriceID                string                `json:"price_id" db:"price_id"`
+	Items                  SubscriptionItems     `json:"items" db:"items"`
+	CurrentPeriodStart     *time.Time            `json:"current_period_start,omitempty" db:"current_period_start"`
+	CurrentPeriodEnd       time.Time             `json:"current_period_end" db:"current_period_end"`
+	TrialStart             *time.Time            `json:"trial_start,omitempty" db:"trial_start"`
+	TrialEnd               *time.Time            `json:"trial_end,omitempty" db:"trial_end"`
+	CancelAt               *time.Time            `json:"cancel_at,omitempty" db:"cancel_at"`
+	CancelAtPeriodEnd      bool                  `json:"cancel_at_period_end" db:"cancel_at_period_end"`
+	CanceledAt             *time.Time            `json:"canceled_at,omitempty" db:"canceled_at"`
+	EndedAt                *time.Time            `json:"ended_at,omitempty" db:"ended_at"`
+	CollectionMethod       string                `json:"collection_method" db:"collection_method"`
+	LatestInvoiceID        string                `json:"latest_invoice_id" db:"latest_invoice_id"`
+	DefaultPaymentMethodID string                `json:"default_payment_method_id" db:"default_payment_method_id"`
+	Metadata               Metadata              `json:"metadata" db:"metadata"`
+	Discount               *SubscriptionDiscount `json:"discount,omitempty" db:"discount"`
+	CreatedAt              time.Time             `json:"created_at" db:"created_at"`
+	UpdatedAt              time.Time             `json:"updated_at" db:"updated_at"`
+}
+
+// SubscriptionItem is a price a subscription is billed for
+type SubscriptionItem struct {
+	StripeID string `json:"stripe_id"`
+	PriceID  string `json:"price_id"`
+	Quantity int64  `json:"quantity"`
+}
+
+// SubscriptionItems are stored as a JSON array
+type SubscriptionItems []SubscriptionItem
+
+// Value implements driver.Valuer
+func (i SubscriptionItems) Value() (driver.Value, error) {
+	if i == nil {
+		i = SubscriptionItems{}
+	}
+	return jsonValue(i)
+}
+
+// Scan implements sql.Scanner
+func (i *SubscriptionItems) Scan(src interface{}) error {
+	return scanJSON(src, i)
+}
+
+// SubscriptionDiscount is the coupon applied to a subscription
+type SubscriptionDiscount struct {
+	CouponID         string     `json:"coupon_id"`
+	Name             string     `json:"name,omitempty"`
+	PercentOff       float64    `json:"percent_off,omitempty"`
+	AmountOff        *Money     `json:"amount_off,omitempty"`
+	Duration         string     `json:"duration"`
+	DurationInMonths int64      `json:"duration_in_months,omitempty"`
+	PromotionCodeID  string     `json:"promotion_code_id,omitempty"`
+	Start            *time.Time `json:"start,omitempty"`
+	End              *time.Time `json:"end,omitempty"`
+}
+
+// Value implements driver.Valuer
+func (d SubscriptionDiscount) Value() (driver.Value, error) {
+	return jsonValue(d)
+}
+
+// Scan implements sql.Scanner
+func (d *SubscriptionDiscount) Scan(src interface{}) error {
+	return scanJSON(src, d)
 }
 
 // TableName returns the table name for the Subscription model
@@ -60,6 +119,28 @@ func FindSubscriptionByStripeID(conn *storage.Connection, stripeID string) (*Sub
 	return subscription, nil
 }
 
+// FindSubscriptionsByCustomerID finds the subscriptions of a customer, the
+// latest first
+func FindSubscriptionsByCustomerID(conn *storage.Connection, customerID uuid.UUID) ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	if err := conn.Where("customer_id = ?", customerID).Order("created_at DESC").All(&subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// FindCustomerSubscription finds a subscription of a customer by ID
+func FindCustomerSubscription(conn *storage.Connection, customerID, id uuid.UUID) (*Subscription, error) {
+	subscription := &Subscription{}
+	if err := conn.Where("id = ? AND customer_id = ?", id, customerID).First(subscription); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return subscription, nil
+}
+
 // FindActiveSubscriptionByCustomerID finds an active subscription by customer ID
 func FindActiveSubscriptionByCustomerID(conn *storage.Connection, customerID uuid.UUID) (*Subscription, error) {
 	subscription := &Subscription{}
@@ -72,26 +153,31 @@ func FindActiveSubscriptionByCustomerID(conn *storage.Connection, customerID uui
 	return subscription, nil
 }
 
+// FindDelinquentSubscriptionByCustomerID finds a past due or unpaid subscription by customer ID
+func FindDelinquentSubscriptionByCustomerID(conn *storage.Connection, customerID uuid.UUID) (*Subscription, error) {
+	subscription := &Subscription{}
+	if err := conn.Where("customer_id = ? AND status IN (?, ?)", customerID, SubscriptionStatusPastDue, SubscriptionStatusUnpaid).Order("current_period_end DESC").First(subscription); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return subscription, nil
+}
+
 // CreateSubscription creates a new subscription
 func CreateSubscription(conn *storage.Connection, customerID uuid.UUID, stripeID, priceID string, status SubscriptionStatus, currentPeriodEnd time.Time) (*Subscription, error) {
 	log.Printf("CreateSubscription: Début de la création d'un abonnement - customerID: %s, stripeID: %s, priceID: %s, status: %s", 
 		customerID.String(), stripeID, priceID, status)
 
 	subscription := &Subscription{
-		ID:               uuid.Must(uuid.NewV4()),
 		CustomerID:       customerID,
 		StripeID:         stripeID,
 		Status:           status,
 		PriceID:          priceID,
 		CurrentPeriodEnd: currentPeriodEnd,
-		CreatedAt:        time.Now(),
-		UpdatedAt:        time.Now(),
 	}
-
-	log.Printf("CreateSubscription: Tentative d'insertion en DB - ID: %s, StripeID: %s, CustomerID: %s", 
-		subscription.ID.String(), subscription.StripeID, subscription.CustomerID.String())
-
-	if err := conn.Create(subscription); err != nil {
+	if err := InsertSubscription(conn, subscription); err != nil {
 		log.Printf("CreateSubscription: ERREUR lors de la création de l'abonnement: %v", err)
 		return nil, err
 	}
@@ -100,8 +186,32 @@ func CreateSubscription(conn *storage.Connection, customerID uuid.UUID, stripeID
 	return subscription, nil
 }
 
+// InsertSubscription stores a new subscription with all its fields set
+func InsertSubscription(conn *storage.Connection, subscription *Subscription) error {
+	subscription.ID = uuid.Must(uuid.NewV4())
+	subscription.CreatedAt = time.Now()
+	subscription.UpdatedAt = time.Now()
+	return conn.Create(subscription)
+}
+
+// LockSubscription takes a transaction level advisory lock on a Stripe
+// subscription, so that concurrent syncs of the same subscription do not both
+// insert it. It must be called within a transaction.
+func LockSubscription(conn *storage.Connection, stripeID string) error {
+	return conn.RawQuery("SELECT pg_advisory_xact_lock(hashtext(?))", "stripe_subscriptions:"+stripeID).Exec()
+}
+
 // UpdateSubscription updates a subscription
 func UpdateSubscription(conn *storage.Connection, subscription *Subscription) error {
 	subscription.UpdatedAt = time.Now()
 	return conn.Update(subscription)
 }
+
+// AllSubscriptions returns every subscription
+func AllSubscriptions(conn *storage.Connection) ([]Subscription, error) {
+	subscriptions := []Subscription{}
+	if err := conn.Order("created_at").All(&subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"time"
+
+	"gostripe/storage"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+)
+
+// TaxID represents a tax ID of a customer, such as an EU VAT number
+type TaxID struct {
+	ID                 uuid.UUID `json:"id" db:"id"`
+	CustomerID         uuid.UUID `json:"customer_id" db:"customer_id"`
+	StripeID           string    `json:"stripe_id" db:"stripe_id"`
+	Type               string    `json:"type" db:"type"`
+	Value              string    `json:"value" db:"value"`
+	VerificationStatus string    `json:"verification_status" db:"verification_status"`
+	CreatedAt          time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// TableName returns the table name for the TaxID model
+func (TaxID) TableName() string {
+	return "stripe_tax_ids"
+}
+
+// FindTaxIDsByCustomerID finds the tax IDs of a customer
+func FindTaxIDsByCustomerID(conn *storage.Connection, customerID uuid.UUID) ([]TaxID, error) {
+	taxIDs := []TaxID{}
+	if err := conn.Where("customer_id = ?", customerID).Order("created_at ASC").All(&taxIDs); err != nil {
+		return nil, err
+	}
+	return taxIDs, nil
+}
+
+// FindCustomerTaxID finds a tax ID of a customer by ID
+func FindCustomerTaxID(conn *storage.Connection, customerID, id uuid.UUID) (*TaxID, error) {
+	taxID := &TaxID{}
+	if err := conn.Where("id = ? AND customer_id = ?", id, customerID).First(taxID); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return taxID, nil
+}
+
+// FindTaxIDByStripeID finds a tax ID by Stripe ID
+func FindTaxIDByStripeID(conn *storage.Connection, stripeID string) (*TaxID, error) {
+	taxID := &TaxID{}
+	if err := conn.Where("stripe_id = ?", stripeID).First(taxID); err != nil {
+		if errors.Cause(err).Error() == "sql: no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return taxID, nil
+}
+
+// UpsertTaxID creates a tax ID or updates the one with the same Stripe ID. The
+// API and the customer.tax_id.created webhook both record new tax IDs, in any
+// order.
+func UpsertTaxID(conn *storage.Connection, customerID uuid.UUID, stripeID, taxIDType, value, verificationStatus string) (*TaxID, error) {
+	now := time.Now()
+	taxID := &TaxID{}
+	err := conn.RawQuery(
+		`INSERT INTO stripe_tax_ids (id, customer_id, stripe_id, type, value, verification_status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (stripe_id) DO UPDATE SET type = EXCLUDED.type, value = EXCLUDED.value,
+			verification_status = EXCLUDED.verification_status, updated_at = EXCLUDED.updated_at
+		RETURNING *`,
+		uuid.Must(uuid.NewV4()), customerID, stripeID, taxIDType, value, verificationStatus, now, now,
+	).First(taxID)
+	if err != nil {
+		return nil, err
+	}
+	return taxID, nil
+}
+
+// UpdateTaxID updates a tax ID
+func UpdateTaxID(conn *storage.Connection, taxID *TaxID) error {
+	taxID.UpdatedAt = time.Now()
+	return conn.Update(taxID)
+}
+
+// DeleteTaxID deletes a tax ID
+func DeleteTaxID(conn *storage.Connection, taxID *TaxID) error {
+	return conn.Destroy(taxID)
+}
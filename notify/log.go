@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogNotifier only logs the notifications it is given
+type LogNotifier struct {
+	templates *Templates
+}
+
+// NewLogNotifier creates a notifier that logs instead of sending
+func NewLogNotifier(templates *Templates) *LogNotifier {
+	return &LogNotifier{templates: templates}
+}
+
+// Notify logs the rendered notification
+func (l *LogNotifier) Notify(ctx context.Context, n *Notification) error {
+	subject, _, err := l.templates.Render(n)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"event":   n.Event,
+		"to":      n.To,
+		"locale":  n.Locale,
+		"subject": subject,
+	}).Info("Notification")
+	return nil
+}
@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gostripe/conf"
+)
+
+// Event identifies the kind of notification sent to a customer
+type Event string
+
+const (
+	// EventTrialWillEnd is sent a few days before the end of a trial
+	EventTrialWillEnd Event = "trial_will_end"
+	// EventRenewal is sent when a subscription has been renewed
+	EventRenewal Event = "renewal"
+	// EventPaymentFailed is sent when a payment attempt has failed
+	EventPaymentFailed Event = "payment_failed"
+	// EventCancellation is sent when a subscription has been canceled
+	EventCancellation Event = "cancellation"
+)
+
+// Notification is a message sent to a customer
+type Notification struct {
+	Event     Event
+	Locale    string
+	To        string
+	Name      string
+	Date      time.Time
+	Amount    string
+	ActionURL string
+}
+
+// Notifier sends notifications to customers
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// New creates the notifier selected by the configuration
+func New(config *conf.NotificationConfiguration) (Notifier, error) {
+	templates, err := NewTemplates(config.DefaultLocale)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Backend {
+	case "", "log":
+		return NewLogNotifier(templates), nil
+	case "smtp":
+		return NewSMTPNotifier(&config.SMTP, templates)
+	default:
+		return nil, fmt.Errorf("unknown notification backend: %s", config.Backend)
+	}
+}
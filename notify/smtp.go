@@ -0,0 +1,119 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"gostripe/conf"
+)
+
+// SMTPNotifier sends notifications as HTML emails
+type SMTPNotifier struct {
+	config    *conf.SMTPConfiguration
+	templates *Templates
+}
+
+// NewSMTPNotifier creates a notifier sending emails through an SMTP server
+func NewSMTPNotifier(config *conf.SMTPConfiguration, templates *Templates) (*SMTPNotifier, error) {
+	if config.Host == "" {
+		return nil, fmt.Errorf("smtp host is required")
+	}
+	if config.From == "" {
+		return nil, fmt.Errorf("smtp sender address is required")
+	}
+	return &SMTPNotifier{config: config, templates: templates}, nil
+}
+
+// Notify renders the notification and sends it by email
+func (s *SMTPNotifier) Notify(ctx context.Context, n *Notification) error {
+	if n.To == "" {
+		return fmt.Errorf("notification has no recipient")
+	}
+
+	subject, body, err := s.templates.Render(n)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", n.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+
+	return s.send(ctx, n.To, msg.Bytes())
+}
+
+// send delivers a message like smtp.SendMail, but gives up once the context
+// is done or the configured timeout has elapsed, so that a slow server cannot
+// hold the webhook handler
+func (s *SMTPNotifier) send(ctx context.Context, to string, msg []byte) error {
+	if s.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.Timeout)
+		defer cancel()
+	}
+
+	addr := net.JoinHostPort(s.config.Host, strconv.Itoa(s.config.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// Unblock the SMTP exchange when the context is canceled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, s.config.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.config.Host}); err != nil {
+			return err
+		}
+	}
+	if s.config.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.config.User, s.config.Pass, s.config.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.config.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gostripe/conf"
+)
+
+// smtpServer is a local SMTP stand-in recording the messages it receives
+type smtpServer struct {
+	listener net.Listener
+	messages chan string
+}
+
+// newSMTPServer starts an SMTP stand-in. A silent server accepts connections
+// but never answers.
+func newSMTPServer(t *testing.T, silent bool) *smtpServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{listener: l, messages: make(chan string, 10)}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if silent {
+				// Hold the connection until the client gives up
+				go func() {
+					io.Copy(io.Discard, conn)
+					conn.Close()
+				}()
+				continue
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+	var envelope strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM"), strings.HasPrefix(command, "RCPT TO"):
+			envelope.WriteString(strings.TrimSpace(line) + "\n")
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.messages <- envelope.String() + data.String()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (s *smtpServer) config() *conf.SMTPConfiguration {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &conf.SMTPConfiguration{Host: host, Port: p, From: "billing@example.com", Timeout: time.Second}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	server := newSMTPServer(t, false)
+	templates, err := NewTemplates("fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier, err := NewSMTPNotifier(server.config(), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = notifier.Notify(context.Background(), &Notification{
+		Event:     EventPaymentFailed,
+		Locale:    "fr-FR",
+		To:        "jeanne@example.com",
+		Name:      "Jeanne",
+		Amount:    "19,99 €",
+		ActionURL: "https://invoice.stripe.com/i/123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg string
+	select {
+	case msg = <-server.messages:
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+	for _, want := range []string{
+		"MAIL FROM:<billing@example.com>",
+		"RCPT TO:<jeanne@example.com>",
+		"To: jeanne@example.com",
+		"Subject: =?utf-8?q?Le_paiement_de_votre_abonnement_a_=C3=A9chou=C3=A9?=",
+		"Content-Type: text/html; charset=\"utf-8\"",
+		"19,99 €",
+		`href="https://invoice.stripe.com/i/123"`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected %q in the message:\n%s", want, msg)
+		}
+	}
+}
+
+func TestSMTPNotifierTimeout(t *testing.T) {
+	server := newSMTPServer(t, true)
+	templates, err := NewTemplates("fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.config()
+	config.Timeout = 100 * time.Millisecond
+	notifier, err := NewSMTPNotifier(config, templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = notifier.Notify(context.Background(), &Notification{Event: EventRenewal, To: "jeanne@example.com", Date: time.Now()})
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the send to give up after the timeout, took %s", elapsed)
+	}
+
+	// The context can end the exchange sooner
+	config.Timeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := notifier.Notify(ctx, &Notification{Event: EventRenewal, To: "jeanne@example.com", Date: time.Now()}); err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the send to stop with the context, took %s", elapsed)
+	}
+}
@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+//go:embed templates
+var files embed.FS
+
+// subjects holds the email subjects per locale and event
+var subjects = map[string]map[Event]string{
+	"fr": {
+		EventTrialWillEnd:  "Votre période d'essai se termine bientôt",
+		EventRenewal:       "Votre abonnement a été renouvelé",
+		EventPaymentFailed: "Le paiement de votre abonnement a échoué",
+		EventCancellation:  "Votre abonnement a été annulé",
+	},
+	"en": {
+		EventTrialWillEnd:  "Your trial is ending soon",
+		EventRenewal:       "Your subscription has been renewed",
+		EventPaymentFailed: "Your subscription payment failed",
+		EventCancellation:  "Your subscription has been canceled",
+	},
+}
+
+var frenchMonths = []string{
+	"janvier", "février", "mars", "avril", "mai", "juin",
+	"juillet", "août", "septembre", "octobre", "novembre", "décembre",
+}
+
+// Templates renders notifications in the customer's language
+type Templates struct {
+	defaultLocale string
+	locales       map[string]*template.Template
+}
+
+// NewTemplates parses the embedded templates of every supported locale
+func NewTemplates(defaultLocale string) (*Templates, error) {
+	defaultLocale = normalizeLocale(defaultLocale)
+	if _, ok := subjects[defaultLocale]; !ok {
+		return nil, fmt.Errorf("unsupported notification locale: %s", defaultLocale)
+	}
+
+	t := &Templates{defaultLocale: defaultLocale, locales: map[string]*template.Template{}}
+	for locale := range subjects {
+		tmpl, err := template.New(locale).Funcs(template.FuncMap{
+			"date": dateFormatter(locale),
+		}).ParseFS(files, "templates/"+locale+"/*.html")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s templates: %w", locale, err)
+		}
+		t.locales[locale] = tmpl
+	}
+	return t, nil
+}
+
+// Render returns the subject and HTML body of a notification
+func (t *Templates) Render(n *Notification) (string, string, error) {
+	locale := normalizeLocale(n.Locale)
+	if _, ok := t.locales[locale]; !ok {
+		locale = t.defaultLocale
+	}
+
+	subject, ok := subjects[locale][n.Event]
+	if !ok {
+		return "", "", fmt.Errorf("unknown notification event: %s", n.Event)
+	}
+
+	var body bytes.Buffer
+	if err := t.locales[locale].ExecuteTemplate(&body, string(n.Event)+".html", n); err != nil {
+		return "", "", err
+	}
+	return subject, body.String(), nil
+}
+
+// normalizeLocale reduces a locale such as "fr-FR" to its language
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+	return locale
+}
+
+func dateFormatter(locale string) func(time.Time) string {
+	return func(t time.Time) string {
+		if locale == "fr" {
+			return fmt.Sprintf("%d %s %d", t.Day(), frenchMonths[t.Month()-1], t.Year())
+		}
+		return t.Format("January 2, 2006")
+	}
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplates(t *testing.T) {
+	templates, err := NewTemplates("fr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date := time.Date(2024, time.August, 15, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		n       *Notification
+		subject string
+		body    []string
+	}{
+		{"french", &Notification{Event: EventRenewal, Locale: "fr", Name: "Jeanne", Date: date, Amount: "9,90 €"}, "Votre abonnement a été renouvelé", []string{"15 août 2024", "9,90 €"}},
+		{"english", &Notification{Event: EventRenewal, Locale: "en-GB", Name: "Jane", Date: date}, "Your subscription has been renewed", []string{"August 15, 2024"}},
+		{"unsupported locale", &Notification{Event: EventCancellation, Locale: "de"}, "Votre abonnement a été annulé", nil},
+		{"action URL", &Notification{Event: EventPaymentFailed, Locale: "en", ActionURL: "https://billing.example.com/fix"}, "Your subscription payment failed", []string{`href="https://billing.example.com/fix"`}},
+		{"escaped values", &Notification{Event: EventTrialWillEnd, Locale: "en", Name: "<b>Jane</b>", Date: date}, "Your trial is ending soon", []string{"&lt;b&gt;Jane&lt;/b&gt;"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, body, err := templates.Render(tt.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.subject {
+				t.Errorf("expected subject %q, got %q", tt.subject, subject)
+			}
+			for _, want := range tt.body {
+				if !strings.Contains(body, want) {
+					t.Errorf("expected %q in the body:\n%s", want, body)
+				}
+			}
+		})
+	}
+
+	// Every event has a template in every locale
+	for locale := range subjects {
+		for event := range subjects[locale] {
+			if _, _, err := templates.Render(&Notification{Event: event, Locale: locale, Date: date}); err != nil {
+				t.Errorf("%s %s: %v", locale, event, err)
+			}
+		}
+	}
+
+	if _, _, err := templates.Render(&Notification{Event: "unknown"}); err == nil {
+		t.Error("expected an error for an unknown event")
+	}
+	if _, err := NewTemplates("de"); err == nil {
+		t.Error("expected an error for an unsupported default locale")
+	}
+}
@@ -0,0 +1,112 @@
+package openapi
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Document is an OpenAPI 3.0 document
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// Info describes the API
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem holds the operations of a path by lower case HTTP method
+type PathItem map[string]*Operation
+
+// Operation describes a route
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Deprecated  bool                 `json:"deprecated,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+	// Security is empty for a public route
+	Security []map[string][]string `json:"security"`
+}
+
+// Parameter describes a path, query or header parameter
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody describes the body of a request
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes a response
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the named schemas and the security schemes
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme describes a way to authenticate
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+var pathParamRegexp = regexp.MustCompile(`{([^}]+)}`)
+
+// NewDocument creates a document without paths
+func NewDocument(info Info) *Document {
+	return &Document{
+		OpenAPI: "3.0.3",
+		Info:    info,
+		Paths:   map[string]PathItem{},
+	}
+}
+
+// Add documents an operation. The parameters of the path are added to it.
+func (d *Document) Add(method, path string, op *Operation) {
+	var params []*Parameter
+	for _, m := range pathParamRegexp.FindAllStringSubmatch(path, -1) {
+		params = append(params, &Parameter{Name: m[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	op.Parameters = append(params, op.Parameters...)
+	if op.Security == nil {
+		op.Security = []map[string][]string{}
+	}
+
+	item, ok := d.Paths[path]
+	if !ok {
+		item = PathItem{}
+		d.Paths[path] = item
+	}
+	item[strings.ToLower(method)] = op
+}
+
+// JSONContent returns the content of a JSON body with the given schema
+func JSONContent(s *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: s}}
+}
@@ -0,0 +1,295 @@
+// Package openapi describes an API in an OpenAPI 3 document. The schemas are
+// derived from the Go types the handlers decode and encode, and requests are
+// validated against the same schemas.
+package openapi
+
+import (
+	"encoding"
+	"encoding/json"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schema is an OpenAPI 3.0 schema object, limited to what the Go types need
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Deprecated           bool               `json:"deprecated,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+
+	// allowEmpty is set on an optional string property, for which an empty
+	// string means the same as an omitted property
+	allowEmpty bool
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Registry derives schemas from Go types. Named struct types become components
+// referenced by name.
+//
+// A struct field is required unless its JSON tag has omitempty: it is always
+// present in a response, and must be present in a request. The openapi tag
+// adds constraints to a field:
+//
+//	openapi:"min=1,max=64,len=3,enum=auto|required,format=email,deprecated"
+//
+// min, max and len apply to the length of strings and min to the number of
+// items of slices; enum applies to strings and to the items of slices.
+type Registry struct {
+	mu      sync.Mutex
+	defined map[reflect.Type]*Schema
+	names   map[reflect.Type]string
+	schemas map[string]*Schema
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		defined: map[reflect.Type]*Schema{
+			timeType: {Type: "string", Format: "date-time"},
+		},
+		names:   map[reflect.Type]string{},
+		schemas: map[string]*Schema{},
+	}
+}
+
+// Define sets the schema of a type, e.g. one with a custom JSON encoding. When
+// name is not empty, the schema is a component referenced by that name.
+func (r *Registry) Define(t reflect.Type, name string, s *Schema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name == "" {
+		r.defined[t] = s
+		return
+	}
+	r.names[t] = name
+	r.schemas[name] = s
+}
+
+// Schema returns the schema of a Go value's type
+func (r *Registry) Schema(v interface{}) *Schema {
+	return r.SchemaOf(reflect.TypeOf(v))
+}
+
+// SchemaOf returns the schema of a Go type
+func (r *Registry) SchemaOf(t reflect.Type) *Schema {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.schemaOf(t)
+}
+
+// Components returns the named schemas derived so far
+func (r *Registry) Components() map[string]*Schema {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schemas := make(map[string]*Schema, len(r.schemas))
+	for name, s := range r.schemas {
+		schemas[name] = s
+	}
+	return schemas
+}
+
+// resolve follows a reference to a component
+func (r *Registry) resolve(s *Schema) *Schema {
+	if s.Ref == "" {
+		return s
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+}
+
+func (r *Registry) schemaOf(t reflect.Type) *Schema {
+	if s, ok := r.defined[t]; ok {
+		return copySchema(s)
+	}
+	if name, ok := r.names[t]; ok {
+		return ref(name)
+	}
+
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return r.schemaOf(t.Elem())
+	case t.Implements(jsonMarshalerType):
+		// Unknown encoding: any value
+		return &Schema{}
+	case t.Implements(textMarshalerType):
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: r.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: r.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return r.structSchema(t)
+		}
+		name := r.componentName(t)
+		r.names[t] = name
+		r.schemas[name] = &Schema{}
+		r.schemas[name] = r.structSchema(t)
+		return ref(name)
+	default:
+		return &Schema{}
+	}
+}
+
+// componentName names a struct type, qualified by its package when another
+// type has the same name
+func (r *Registry) componentName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := r.schemas[name]; taken {
+		pkg := path.Base(t.PkgPath())
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	return name
+}
+
+func (r *Registry) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	r.addFields(s, t, true)
+	return s
+}
+
+// addFields adds the properties of a struct, flattening embedded structs as
+// encoding/json does. The fields of an embedded pointer are optional.
+func (r *Registry) addFields(s *Schema, t reflect.Type, required bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				r.addFields(s, ft, false)
+				continue
+			}
+			if ft.Kind() == reflect.Struct {
+				r.addFields(s, ft, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		omitempty := strings.Contains(","+opts+",", ",omitempty,")
+		prop := r.fieldSchema(f, !omitempty)
+		prop.allowEmpty = omitempty && f.Type.Kind() == reflect.String
+		s.Properties[name] = prop
+		if required && !omitempty {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+// fieldSchema returns the schema of a struct field with the constraints of its
+// openapi tag. A pointer that is always encoded may be null.
+func (r *Registry) fieldSchema(f reflect.StructField, present bool) *Schema {
+	s := r.schemaOf(f.Type)
+	if f.Type.Kind() == reflect.Ptr && present {
+		if s.Ref != "" {
+			s = &Schema{AllOf: []*Schema{s}}
+		}
+		s.Nullable = true
+	}
+
+	tag := f.Tag.Get("openapi")
+	if tag == "" {
+		return s
+	}
+	if s.Ref != "" {
+		s = &Schema{AllOf: []*Schema{s}}
+	}
+	for _, opt := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "deprecated":
+			s.Deprecated = true
+		case "format":
+			s.Format = value
+		case "enum":
+			enum := strings.Split(value, "|")
+			if s.Items != nil {
+				s.Items.Enum = enum
+			} else {
+				s.Enum = enum
+			}
+		case "min":
+			n := atoi(value)
+			if s.Type == "array" {
+				s.MinItems = &n
+			} else {
+				s.MinLength = &n
+			}
+		case "max":
+			n := atoi(value)
+			s.MaxLength = &n
+		case "len":
+			min, max := atoi(value), atoi(value)
+			s.MinLength, s.MaxLength = &min, &max
+		}
+	}
+	return s
+}
+
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func copySchema(s *Schema) *Schema {
+	c := *s
+	return &c
+}
+
+func atoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic("openapi: invalid number in tag: " + s)
+	}
+	return n
+}
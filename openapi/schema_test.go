@@ -0,0 +1,102 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	Country string `json:"country" openapi:"len=2"`
+}
+
+type testDetails struct {
+	Phone string `json:"phone"`
+}
+
+type testRequest struct {
+	Name      string            `json:"name" openapi:"min=1"`
+	Email     string            `json:"email,omitempty" openapi:"format=email"`
+	Mode      string            `json:"mode,omitempty" openapi:"enum=auto|required"`
+	Scopes    []string          `json:"scopes,omitempty" openapi:"min=1"`
+	Address   *testAddress      `json:"address,omitempty"`
+	Billing   *testAddress      `json:"billing"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Internal  string            `json:"-"`
+	Legacy    string            `json:"legacy,omitempty" openapi:"deprecated"`
+	Nickname  *string           `json:"nickname,omitempty" openapi:"min=1"`
+	*testDetails
+}
+
+func TestSchema(t *testing.T) {
+	r := NewRegistry()
+	s := r.Schema(testRequest{})
+	if s.Ref != "#/components/schemas/testRequest" {
+		t.Fatalf("expected a reference, got %+v", s)
+	}
+
+	components := r.Components()
+	request := components["testRequest"]
+	if request == nil || components["testAddress"] == nil {
+		t.Fatalf("expected the components, got %v", components)
+	}
+	if !reflect.DeepEqual(request.Required, []string{"name", "billing"}) {
+		t.Errorf("unexpected required properties %v", request.Required)
+	}
+	if _, ok := request.Properties["Internal"]; ok {
+		t.Error("expected ignored fields to be skipped")
+	}
+	if p := request.Properties["phone"]; p == nil || p.Type != "string" {
+		t.Errorf("expected the embedded fields, got %+v", p)
+	}
+	if p := request.Properties["billing"]; !p.Nullable || len(p.AllOf) != 1 {
+		t.Errorf("expected a nullable reference, got %+v", p)
+	}
+	if p := request.Properties["expires_at"]; p.Type != "string" || p.Format != "date-time" || p.Nullable {
+		t.Errorf("unexpected time schema %+v", p)
+	}
+	if p := request.Properties["scopes"]; p.Type != "array" || *p.MinItems != 1 {
+		t.Errorf("unexpected array schema %+v", p)
+	}
+	if p := request.Properties["metadata"]; p.Type != "object" || p.AdditionalProperties.Type != "string" {
+		t.Errorf("unexpected map schema %+v", p)
+	}
+	if !request.Properties["legacy"].Deprecated {
+		t.Error("expected the deprecated property")
+	}
+
+	if _, err := json.Marshal(components); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDefine(t *testing.T) {
+	type status string
+	type money struct{ Amount int64 }
+
+	r := NewRegistry()
+	r.Define(reflect.TypeOf(status("")), "", &Schema{Type: "string", Enum: []string{"active"}})
+	r.Define(reflect.TypeOf(money{}), "Money", &Schema{Type: "object"})
+
+	if s := r.Schema(status("")); !reflect.DeepEqual(s.Enum, []string{"active"}) {
+		t.Errorf("expected the defined schema, got %+v", s)
+	}
+	if s := r.Schema(&money{}); s.Ref != "#/components/schemas/Money" {
+		t.Errorf("expected a reference, got %+v", s)
+	}
+}
+
+func TestDocument(t *testing.T) {
+	d := NewDocument(Info{Title: "Test", Version: "1"})
+	d.Add("DELETE", "/users/{user_id}/keys/{id}", &Operation{OperationID: "deleteKey"})
+
+	op := d.Paths["/users/{user_id}/keys/{id}"]["delete"]
+	if op == nil || len(op.Parameters) != 2 || op.Parameters[0].Name != "user_id" || op.Parameters[1].Name != "id" {
+		t.Fatalf("expected the path parameters, got %+v", op)
+	}
+	if op.Security == nil {
+		t.Error("expected a public operation")
+	}
+}
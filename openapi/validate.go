@@ -0,0 +1,170 @@
+package openapi
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError reports the first value of a request that does not match
+// its schema
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return "request body " + e.Message
+	}
+	return e.Path + " " + e.Message
+}
+
+// Validate checks a decoded JSON value against a schema. An empty string is
+// accepted for an optional string field, as Go treats it as omitted.
+func (r *Registry) Validate(s *Schema, v interface{}) error {
+	return r.validate(s, v, "")
+}
+
+func (r *Registry) validate(s *Schema, v interface{}, at string) error {
+	s = r.resolve(s)
+	if s == nil {
+		return nil
+	}
+	for _, sub := range s.AllOf {
+		if v == nil && s.Nullable {
+			break
+		}
+		if err := r.validate(sub, v, at); err != nil {
+			return err
+		}
+	}
+
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return invalid(at, "must not be null")
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid(at, "must be an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return invalid(join(at, name), "is required")
+			}
+		}
+		for name, value := range obj {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if prop == nil {
+				continue
+			}
+			if value == "" && prop.allowEmpty {
+				continue
+			}
+			if err := r.validate(prop, value, join(at, name)); err != nil {
+				return err
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return invalid(at, "must be an array")
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			if *s.MinItems == 1 {
+				return invalid(at, "must not be empty")
+			}
+			return invalid(at, fmt.Sprintf("must have at least %d items", *s.MinItems))
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				if err := r.validate(s.Items, item, at+"["+strconv.Itoa(i)+"]"); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid(at, "must be a string")
+		}
+		return validateString(s, str, at)
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return invalid(at, "must be an integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return invalid(at, "must be a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid(at, "must be a boolean")
+		}
+	}
+	return nil
+}
+
+func validateString(s *Schema, str, at string) error {
+	n := utf8.RuneCountInString(str)
+	switch {
+	case s.MinLength != nil && s.MaxLength != nil && *s.MinLength == *s.MaxLength && n != *s.MinLength:
+		return invalid(at, fmt.Sprintf("must be %d characters long", *s.MinLength))
+	case s.MinLength != nil && n < *s.MinLength:
+		if *s.MinLength == 1 {
+			return invalid(at, "must not be empty")
+		}
+		return invalid(at, fmt.Sprintf("must be at least %d characters long", *s.MinLength))
+	case s.MaxLength != nil && n > *s.MaxLength:
+		return invalid(at, fmt.Sprintf("must be at most %d characters long", *s.MaxLength))
+	}
+
+	if len(s.Enum) > 0 && !contains(s.Enum, str) {
+		return invalid(at, "must be one of "+strings.Join(s.Enum, ", "))
+	}
+
+	// Other formats only document the value
+	var err error
+	switch s.Format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, str)
+	case "email":
+		_, err = mail.ParseAddress(str)
+	}
+	if err != nil {
+		return invalid(at, "must be a valid "+s.Format)
+	}
+	return nil
+}
+
+func invalid(at, msg string) error {
+	return &ValidationError{Path: at, Message: msg}
+}
+
+func join(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
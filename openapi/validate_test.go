@@ -0,0 +1,51 @@
+package openapi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	r := NewRegistry()
+	s := r.Schema(testRequest{})
+
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"valid", `{"name": "Jeanne", "billing": null, "email": "jeanne@example.com", "mode": "auto", "scopes": ["a"]}`, ""},
+		{"empty optional values", `{"name": "Jeanne", "billing": {"country": "FR"}, "email": "", "mode": ""}`, ""},
+		{"unknown properties", `{"name": "Jeanne", "billing": null, "other": 1}`, ""},
+		{"not an object", `[]`, "request body must be an object"},
+		{"missing property", `{"name": "Jeanne"}`, "billing is required"},
+		{"empty string", `{"name": "", "billing": null}`, "name must not be empty"},
+		{"empty pointer", `{"name": "Jeanne", "billing": null, "nickname": ""}`, "nickname must not be empty"},
+		{"wrong type", `{"name": 1, "billing": null}`, "name must be a string"},
+		{"enum", `{"name": "Jeanne", "billing": null, "mode": "never"}`, "mode must be one of auto, required"},
+		{"format", `{"name": "Jeanne", "billing": null, "email": "jeanne"}`, "email must be a valid email"},
+		{"date-time", `{"name": "Jeanne", "billing": null, "expires_at": "tomorrow"}`, "expires_at must be a valid date-time"},
+		{"min items", `{"name": "Jeanne", "billing": null, "scopes": []}`, "scopes must not be empty"},
+		{"array items", `{"name": "Jeanne", "billing": null, "scopes": [1]}`, "scopes[0] must be a string"},
+		{"nested", `{"name": "Jeanne", "billing": {"country": "FRA"}}`, "billing.country must be 2 characters long"},
+		{"not nullable", `{"name": "Jeanne", "billing": null, "address": null}`, "address must not be null"},
+		{"map values", `{"name": "Jeanne", "billing": null, "metadata": {"a": true}}`, "metadata.a must be a string"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.body), &v); err != nil {
+				t.Fatal(err)
+			}
+
+			err := r.Validate(s, v)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("expected %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"net/url"
 
 	"gostripe/conf"
@@ -57,6 +59,19 @@ func (c *Connection) Transaction(fn func(*Connection) error) error {
 	return fn(c)
 }
 
+// Conn returns a dedicated connection of the pool, for statements that must
+// run in the same session such as session level advisory locks. It must be
+// closed to return to the pool, and cannot be taken within a transaction.
+func (c *Connection) Conn(ctx context.Context) (*sql.Conn, error) {
+	db, ok := c.Store.(interface {
+		Conn(context.Context) (*sql.Conn, error)
+	})
+	if !ok {
+		return nil, errors.New("no dedicated connection available from a transaction")
+	}
+	return db.Conn(ctx)
+}
+
 func getExcludedColumns(model interface{}, includeColumns ...string) ([]string, error) {
 	sm := &pop.Model{Value: model}
 